@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/difftwt"
+	"github.com/jointwt/twtxt/types/lextwt"
+	"github.com/jointwt/twtxt/types/retwt"
+)
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert [flags] <file>",
+	Short: "Rewrites a legacy Twtxt feed so lextwt parses it as retwt did",
+	Long: `Rewrites a legacy Twtxt feed so that the lextwt parser parses it the same
+way as the legacy retwt parser did. Each twt that the parsers disagree on
+(its hash, mentions, tags or subject) is rewritten from retwt's interpretation
+into canonical form with an RFC3339 timestamp separated from its text by a
+tab, which preserves its hash. Twts that still diverge once rewritten are
+reported and left as they are.
+
+By default the converted feed is written to standard output. Use --write to
+rewrite the feed in place or --check to exit with 1 if the feed needs
+converting (2 if the feed could not be read).`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		write, _ := cmd.Flags().GetBool("write")
+		check, _ := cmd.Flags().GetBool("check")
+
+		runConvert(args[0], write, check)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(convertCmd)
+
+	convertCmd.Flags().BoolP(
+		"write", "w", false,
+		"Write the converted feed back to the file",
+	)
+
+	convertCmd.Flags().BoolP(
+		"check", "c", false,
+		"Exit with a non-zero exit code if the feed needs converting",
+	)
+}
+
+func runConvert(fn string, write, check bool) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.WithError(err).Error("error reading feed")
+		os.Exit(2)
+	}
+
+	converted, err := convertFeed(data)
+	if err != nil {
+		log.WithError(err).Error("error converting feed")
+		os.Exit(2)
+	}
+
+	switch {
+	case check:
+		if !bytes.Equal(data, converted) {
+			fmt.Println(fn)
+			os.Exit(1)
+		}
+	case write:
+		if bytes.Equal(data, converted) {
+			return
+		}
+		if err := writeFeed(fn, converted); err != nil {
+			log.WithError(err).Error("error writing feed")
+			os.Exit(2)
+		}
+	default:
+		os.Stdout.Write(converted)
+	}
+}
+
+// convertFeed returns a feed with the twts lextwt and retwt disagree on
+// rewritten as retwt parses them
+func convertFeed(data []byte) ([]byte, error) {
+	twter := types.NilTwt.Twter()
+	if twtFile, err := lextwt.ParseFile(bytes.NewReader(data), twter); err == nil {
+		twter = twtFile.Twter()
+	}
+
+	out := &bytes.Buffer{}
+
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		if len(difftwt.DiffLine(n, line, twter)) == 0 {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		twt, err := retwt.ParseLine(line, twter)
+		text, ok := twt.(interface{ Text() string })
+		if err != nil || twt.IsZero() || !ok {
+			log.Warnf("%d: leaving line retwt cannot parse as is: %q", n, line)
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		convertedLine := fmt.Sprintf("%s\t%s", twt.Created().Format(time.RFC3339), text.Text())
+		if divergences := difftwt.DiffLine(n, convertedLine, twter); len(divergences) > 0 {
+			for _, d := range divergences {
+				log.Warnf("leaving line as is: %s", d)
+			}
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		log.Infof("%d: converted %q", n, line)
+		out.WriteString(convertedLine + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertFeed(t *testing.T) {
+	testCases := []struct {
+		name     string
+		feed     string
+		expected string
+	}{
+		{
+			name:     "canonical feed",
+			feed:     "# nick = example\n\n2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n",
+			expected: "# nick = example\n\n2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n",
+		},
+		{
+			name:     "text separated by spaces",
+			feed:     "# nick = example\n2020-12-25T18:55:57Z    separated by spaces\n",
+			expected: "# nick = example\n2020-12-25T18:55:57Z\tseparated by spaces\n",
+		},
+		{
+			name:     "unparseable line",
+			feed:     "not a twt\n2020-12-25T16:55:57Z\tHello\n",
+			expected: "not a twt\n2020-12-25T16:55:57Z\tHello\n",
+		},
+		{
+			name:     "missing trailing new line",
+			feed:     "2020-12-25T16:55:57Z\tHello",
+			expected: "2020-12-25T16:55:57Z\tHello\n",
+		},
+		{
+			name:     "empty feed",
+			feed:     "",
+			expected: "",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := convertFeed([]byte(testCase.feed))
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, string(actual))
+		})
+	}
+}
+
+func TestWriteFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twt-convert-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "twtxt.txt")
+	require.NoError(t, ioutil.WriteFile(fn, []byte("old\n"), 0600))
+
+	require.NoError(t, writeFeed(fn, []byte("new\n")))
+
+	data, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	assert.Equal("new\n", string(data))
+
+	fileInfo, err := os.Stat(fn)
+	require.NoError(t, err)
+	assert.Equal(os.FileMode(0600), fileInfo.Mode().Perm())
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(files, 1)
+
+	assert.Error(writeFeed(filepath.Join(dir, "missing.txt"), []byte("new\n")))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+// fmtCmd represents the fmt command
+var fmtCmd = &cobra.Command{
+	Use:   "fmt [flags] <file>",
+	Short: "Rewrites a local Twtxt feed into canonical form",
+	Long: `Rewrites a local Twtxt feed into canonical form. Timestamps are normalized
+to RFC3339 and mentions of feeds followed with '# follow = <nick> <url>' are
+expanded to @<nick url>. Comments and lines that cannot be parsed are left
+as they are.
+
+Note that expanding mentions changes the hashes of the twts affected.
+
+By default the formatted feed is written to standard output. Use --write to
+rewrite the feed in place or --check to exit with 1 if the feed is not in
+canonical form (2 if the feed could not be read), suitable for use in CI.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		write, _ := cmd.Flags().GetBool("write")
+		check, _ := cmd.Flags().GetBool("check")
+
+		runFmt(args[0], write, check)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fmtCmd)
+
+	fmtCmd.Flags().BoolP(
+		"write", "w", false,
+		"Write the formatted feed back to the file",
+	)
+
+	fmtCmd.Flags().BoolP(
+		"check", "c", false,
+		"Exit with a non-zero exit code if the feed is not formatted",
+	)
+}
+
+func runFmt(fn string, write, check bool) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.WithError(err).Error("error reading feed")
+		os.Exit(2)
+	}
+
+	formatted, err := formatFeed(data)
+	if err != nil {
+		log.WithError(err).Error("error formatting feed")
+		os.Exit(2)
+	}
+
+	switch {
+	case check:
+		if !bytes.Equal(data, formatted) {
+			fmt.Println(fn)
+			os.Exit(1)
+		}
+	case write:
+		if bytes.Equal(data, formatted) {
+			return
+		}
+		if err := writeFeed(fn, formatted); err != nil {
+			log.WithError(err).Error("error writing feed")
+			os.Exit(2)
+		}
+	default:
+		os.Stdout.Write(formatted)
+	}
+}
+
+// formatFeed returns a feed in canonical form
+func formatFeed(data []byte) ([]byte, error) {
+	twter := types.NilTwt.Twter()
+
+	// Mentions are expanded using the feeds the feed follows
+	follows := make(map[string]string)
+	if twtFile, err := lextwt.ParseFile(bytes.NewReader(data), twter); err == nil {
+		twter = twtFile.Twter()
+		for _, follow := range twtFile.Info().Followers() {
+			follows[follow.Nick] = follow.URL
+		}
+	}
+
+	out := &bytes.Buffer{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		parser := lextwt.NewParser(lextwt.NewLexer(strings.NewReader(line + "\n")))
+		parser.SetTwter(&twter)
+		twt, ok := parser.ParseLine().(*lextwt.Twt)
+		if !ok || twt.IsZero() || len(parser.Errs()) > 0 {
+			log.Warnf("leaving malformed line as is: %q", line)
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		for _, m := range twt.Mentions() {
+			if mention, ok := m.(*lextwt.Mention); ok && mention.Target() == "" {
+				if uri, ok := follows[mention.Name()]; ok {
+					mention.SetTarget(uri)
+				}
+			}
+		}
+
+		fmt.Fprintf(out, "%s\t%l\n", twt.Created().Format(time.RFC3339), twt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
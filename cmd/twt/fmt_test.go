@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatFeed(t *testing.T) {
+	testCases := []struct {
+		name     string
+		feed     string
+		expected string
+	}{
+		{
+			name:     "canonical feed",
+			feed:     "# nick = example\n\n2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n",
+			expected: "# nick = example\n\n2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n",
+		},
+		{
+			name:     "timestamps",
+			feed:     "2020-12-25T16:55:57+10:00\tHello\n2020-12-25T16:55Z\tWorld\n",
+			expected: "2020-12-25T16:55:57+10:00\tHello\n2020-12-25T16:55:00Z\tWorld\n",
+		},
+		{
+			name:     "trailing whitespace",
+			feed:     "2020-12-25T16:55:57Z\tHello \t\r\n# comment  \n",
+			expected: "2020-12-25T16:55:57Z\tHello\n# comment\n",
+		},
+		{
+			name:     "followed mentions",
+			feed:     "# follow = bob https://bob.com/twtxt.txt\n2020-12-25T16:55:57Z\tHi @bob and @alice\n",
+			expected: "# follow = bob https://bob.com/twtxt.txt\n2020-12-25T16:55:57Z\tHi @<bob https://bob.com/twtxt.txt> and @alice\n",
+		},
+		{
+			name:     "malformed line",
+			feed:     "not a twt\n",
+			expected: "not a twt\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := formatFeed([]byte(testCase.feed))
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, string(actual))
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+const (
+	// defaultMaxTwtLength matches the default maximum twt length of a pod
+	defaultMaxTwtLength = 288
+
+	// maxClockSkew is how far into the future a twt's timestamp may be
+	// before it is considered to be in the future
+	maxClockSkew = 5 * time.Minute
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint [flags] <url|file>",
+	Short: "Checks a Twtxt feed given a URL or local file for errors and common problems",
+	Long: `Checks a Twtxt feed for malformed lines, invalid, non-monotonic or future
+timestamps, duplicate twts, invalid mentions and links and twts exceeding the
+maximum twt length.
+
+Each problem is reported as <file>:<line>:<column>: <problem>. The exit code
+is 0 if no problems were found, 1 if there were problems and 2 if the feed
+could not be read, suitable for use in CI.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		maxLength, _ := cmd.Flags().GetInt("max-length")
+
+		if problems := runLint(args[0], maxLength); len(problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().IntP(
+		"max-length", "m", defaultMaxTwtLength,
+		"Maximum length of a twt (0 to disable)",
+	)
+}
+
+// lintProblem is a problem found in a feed at a given line and column
+type lintProblem struct {
+	line int
+	col  int
+	msg  string
+}
+
+func (p lintProblem) String() string {
+	return fmt.Sprintf("%d:%d: %s", p.line, p.col, p.msg)
+}
+
+func runLint(uri string, maxLength int) []lintProblem {
+	f, err := openFeed(uri)
+	if err != nil {
+		log.WithError(err).Error("error reading feed")
+		os.Exit(2)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.WithError(err).Error("error reading feed")
+		os.Exit(2)
+	}
+
+	problems := lintFeed(data, defaultTwter(uri), maxLength)
+	for _, problem := range problems {
+		fmt.Printf("%s:%s\n", uri, problem)
+	}
+
+	return problems
+}
+
+// defaultTwter returns the Twter used to parse a feed given by a URL or
+// local file before its `# nick` and `# url` metadata are applied
+func defaultTwter(uri string) types.Twter {
+	twter := types.Twter{URL: uri}
+	if u, err := url.Parse(uri); err == nil {
+		twter.Nick = strings.TrimSuffix(u.Path[strings.LastIndex(u.Path, "/")+1:], ".txt")
+	}
+	return twter
+}
+
+// lintFeed checks every line of a feed and returns the problems found
+func lintFeed(data []byte, twter types.Twter, maxLength int) []lintProblem {
+	var problems []lintProblem
+	report := func(line, col int, format string, args ...interface{}) {
+		problems = append(problems, lintProblem{line, col, fmt.Sprintf(format, args...)})
+	}
+
+	// Parse the whole feed first so that twts are hashed with the feed's
+	// advertised `# url` just like pods do.
+	if twtFile, err := lextwt.ParseFile(bytes.NewReader(data), twter); err == nil {
+		twter = twtFile.Twter()
+	}
+
+	var (
+		prev   time.Time
+		prevN  int
+		order  int // 1 for ascending, -1 for descending, 0 if not known yet
+		hashes = make(map[string]int)
+		now    = time.Now()
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			lintComment(n, line, report)
+			continue
+		case line[0] < '0' || line[0] > '9':
+			report(n, 1, "unexpected line, expected a comment or a twt")
+			continue
+		}
+
+		tab := strings.IndexRune(line, '\t')
+		if tab == -1 {
+			report(n, 1, "missing tab between timestamp and text")
+			continue
+		}
+
+		ts := line[:tab]
+		dt := lextwt.NewParser(lextwt.NewLexer(strings.NewReader(ts))).ParseDateTime()
+		if dt == nil {
+			report(n, 1, "invalid timestamp %q", ts)
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, ts); err != nil {
+			report(n, 1, "timestamp %q is not in RFC3339 format", ts)
+		}
+
+		textCol := utf8.RuneCountInString(line[:tab]) + 2
+		if strings.TrimSpace(line[tab+1:]) == "" {
+			report(n, textCol, "empty twt")
+			continue
+		}
+
+		parser := lextwt.NewParser(lextwt.NewLexer(strings.NewReader(line + "\n")))
+		parser.SetTwter(&twter)
+		twt, ok := parser.ParseLine().(*lextwt.Twt)
+		for _, err := range parser.Errs() {
+			report(n, textCol, "%s", err)
+		}
+		if !ok || twt.IsNil() {
+			report(n, 1, "malformed twt")
+			continue
+		}
+
+		created := twt.Created()
+		if created.After(now.Add(maxClockSkew)) {
+			report(n, 1, "timestamp %s is in the future", created.Format(time.RFC3339))
+		}
+		// Twts may be in either order, the feed's is that of its first two
+		// twts (with different timestamps), only twts out of it are reported
+		if !prev.IsZero() {
+			switch {
+			case order == 0 && created.After(prev):
+				order = 1
+			case order == 0 && created.Before(prev):
+				order = -1
+			case order > 0 && created.Before(prev):
+				report(n, 1, "timestamp %s is earlier than the twt on line %d", created.Format(time.RFC3339), prevN)
+			case order < 0 && created.After(prev):
+				report(n, 1, "timestamp %s is later than the twt on line %d", created.Format(time.RFC3339), prevN)
+			}
+		}
+		prev, prevN = created, n
+
+		if first, ok := hashes[twt.Hash()]; ok {
+			report(n, 1, "duplicate twt #%s (first seen on line %d)", twt.Hash(), first)
+		} else {
+			hashes[twt.Hash()] = n
+		}
+
+		for _, m := range twt.Mentions() {
+			mention, ok := m.(*lextwt.Mention)
+			if !ok {
+				continue
+			}
+			col := columnOf(line, mention.Literal())
+			if mention.Target() == "" {
+				report(n, col, "mention %s is not expanded to @<nick url>", mention.Literal())
+			} else if !isValidFeedURL(mention.Target()) {
+				report(n, col, "invalid mention %s", mention.Literal())
+			}
+		}
+
+		for _, l := range twt.Links() {
+			link, ok := l.(*lextwt.Link)
+			if !ok {
+				continue
+			}
+			if !isValidLink(link.Target()) {
+				report(n, columnOf(line, link.Literal()), "invalid link %s", link.Target())
+			}
+		}
+
+		if length := utf8.RuneCountInString(twt.Text()); maxLength > 0 && length > maxLength {
+			report(n, textCol, "twt is %d characters long, exceeds maximum of %d", length, maxLength)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		report(n+1, 1, "error reading feed: %s", err)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].line != problems[j].line {
+			return problems[i].line < problems[j].line
+		}
+		return problems[i].col < problems[j].col
+	})
+
+	return problems
+}
+
+// lintComment checks the well-known `# key = value` metadata that refers to
+// other feeds or resources contains valid URLs
+func lintComment(n int, line string, report func(int, int, string, ...interface{})) {
+	c, ok := lextwt.NewParser(lextwt.NewLexer(strings.NewReader(line + "\n"))).ParseLine().(*lextwt.Comment)
+	if !ok {
+		return
+	}
+
+	var uri string
+	switch c.Key() {
+	case "url", "twturl", "avatar":
+		uri = c.Value()
+	case "follow", "link":
+		if sp := strings.Fields(c.Value()); len(sp) > 0 {
+			uri = sp[len(sp)-1]
+		}
+	case "prev":
+		// Archived feeds may be linked to relative to the feed
+		sp := strings.Fields(c.Value())
+		if len(sp) != 2 {
+			report(n, 1, "invalid prev, expected `# prev = <hash> <url>`")
+		} else if _, err := url.Parse(sp[1]); err != nil {
+			report(n, columnOf(line, sp[1]), "invalid prev url %q", sp[1])
+		}
+		return
+	default:
+		return
+	}
+
+	if !isValidFeedURL(uri) {
+		report(n, columnOf(line, uri), "invalid %s url %q", c.Key(), uri)
+	}
+}
+
+// isValidFeedURL returns true if uri is an absolute URL that can be fetched
+func isValidFeedURL(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https", "gopher":
+		return u.Host != ""
+	default:
+		return false
+	}
+}
+
+// isValidLink returns true if uri is an absolute URL of any scheme
+func isValidLink(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return u.Scheme != "" && (u.Host != "" || u.Opaque != "")
+}
+
+// columnOf returns the (1-based) column of s in line or 1 if not found
+func columnOf(line, s string) int {
+	if i := strings.Index(line, s); s != "" && i >= 0 {
+		return utf8.RuneCountInString(line[:i]) + 1
+	}
+	return 1
+}
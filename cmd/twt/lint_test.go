@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+func TestLintFeed(t *testing.T) {
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+
+	testCases := []struct {
+		name      string
+		feed      string
+		maxLength int
+		expected  []string
+	}{
+		{
+			name: "valid feed",
+			feed: "# nick = example\n# follow = bob https://bob.com/twtxt.txt\n\n" +
+				"2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n" +
+				"2020-12-25T17:55:57Z\tA [link](https://example.com)\n",
+			maxLength: defaultMaxTwtLength,
+		},
+		{
+			name:      "unexpected line",
+			feed:      "not a twt\n",
+			maxLength: defaultMaxTwtLength,
+			expected:  []string{"1:1: unexpected line, expected a comment or a twt"},
+		},
+		{
+			name:      "missing tab",
+			feed:      "2020-12-25T16:55:57Z Hello\n",
+			maxLength: defaultMaxTwtLength,
+			expected:  []string{"1:1: missing tab between timestamp and text"},
+		},
+		{
+			name:      "empty twt",
+			feed:      "2020-12-25T16:55:57Z\t \n",
+			maxLength: defaultMaxTwtLength,
+			expected:  []string{"1:22: empty twt"},
+		},
+		{
+			name:      "timestamps",
+			feed:      "2020-12-24T16:55:57Z\tHello\n2020-12-25T16:55:57Z\tWorld\n2020-12-23T16:55:57Z\tAgain\n2999-01-01T00:00:00Z\tFuture\n",
+			maxLength: defaultMaxTwtLength,
+			expected: []string{
+				"3:1: timestamp 2020-12-23T16:55:57Z is earlier than the twt on line 2",
+				"4:1: timestamp 2999-01-01T00:00:00Z is in the future",
+			},
+		},
+		{
+			name:      "descending timestamps",
+			feed:      "2020-12-25T16:55:57Z\tHello\n2020-12-24T16:55:57Z\tWorld\n2020-12-26T16:55:57Z\tAgain\n2020-12-23T16:55:57Z\tBye\n",
+			maxLength: defaultMaxTwtLength,
+			expected:  []string{"3:1: timestamp 2020-12-26T16:55:57Z is later than the twt on line 2"},
+		},
+		{
+			name:      "duplicate twt",
+			feed:      "2020-12-25T16:55:57Z\tHello\n2020-12-25T16:55:57Z\tHello\n",
+			maxLength: defaultMaxTwtLength,
+			expected:  []string{"2:1: duplicate twt #ijvxrsa (first seen on line 1)"},
+		},
+		{
+			name:      "mentions and links",
+			feed:      "2020-12-25T16:55:57Z\tHi @bob and @<alice ftp://alice.com/twtxt.txt> see [this](/relative)\n",
+			maxLength: defaultMaxTwtLength,
+			expected: []string{
+				"1:25: mention @bob is not expanded to @<nick url>",
+				"1:34: invalid mention @<alice ftp://alice.com/twtxt.txt>",
+				"1:73: invalid link /relative",
+			},
+		},
+		{
+			name:      "comments",
+			feed:      "# url = example.com\n# prev = abcdefg\n",
+			maxLength: defaultMaxTwtLength,
+			expected: []string{
+				`1:9: invalid url url "example.com"`,
+				"2:1: invalid prev, expected `# prev = <hash> <url>`",
+			},
+		},
+		{
+			name:      "twt too long",
+			feed:      "2020-12-25T16:55:57Z\tHello World\n",
+			maxLength: 5,
+			expected:  []string{"1:22: twt is 11 characters long, exceeds maximum of 5"},
+		},
+		{
+			name:      "maximum length disabled",
+			feed:      "2020-12-25T16:55:57Z\tHello World\n",
+			maxLength: 0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var actual []string
+			for _, problem := range lintFeed([]byte(testCase.feed), twter, testCase.maxLength) {
+				actual = append(actual, problem.String())
+			}
+			assert.Equal(t, testCase.expected, actual)
+		})
+	}
+}
@@ -17,7 +17,11 @@ var postCmd = &cobra.Command{
 	Use:     "post [flags]",
 	Aliases: []string{"tweet", "twt", "new"},
 	Short:   "Post a Twt to a Twtxt Pod",
-	Long:    `...`,
+	Long: `Post a Twt to a Twtxt Pod. The text of the twt is taken from the
+arguments or if none are given read from standard input.
+
+Twts may span multiple lines, new lines are encoded as the Unicode line
+separator (U+2028) by the pod and a blank line separates paragraphs.`,
 	//Args:    cobra.NArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		uri := viper.GetString("uri")
@@ -48,7 +52,7 @@ func post(cli *client.Client, args []string) {
 			log.WithError(err).Error("error reading text from stdin")
 			os.Exit(1)
 		}
-		text = string(data)
+		text = strings.TrimSpace(string(data))
 	}
 
 	if text == "" {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/jointwt/twtxt"
 	"github.com/jointwt/twtxt/client"
+	"github.com/jointwt/twtxt/types/difftwt"
 	"github.com/jointwt/twtxt/types/lextwt"
 	"github.com/jointwt/twtxt/types/retwt"
 )
@@ -59,7 +60,7 @@ func init() {
 
 	parser := RootCmd.PersistentFlags().StringP(
 		"parser", "P", "lextwt",
-		"Set active parse engine [lextwt, retwt]",
+		"Set active parse engine [lextwt, retwt, diff]",
 	)
 
 	RootCmd.PersistentFlags().StringP(
@@ -88,6 +89,8 @@ func init() {
 		lextwt.DefaultTwtManager()
 	case "retwt":
 		retwt.DefaultTwtManager()
+	case "diff":
+		difftwt.DefaultTwtManager()
 	default:
 		log.Errorf("unknown parse engine: %s", *parser)
 		os.Exit(1)
@@ -3,13 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"sort"
 	"strings"
 
-	"github.com/prologic/go-gopher"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
@@ -34,55 +31,62 @@ func init() {
 }
 
 func runStats(args []string) {
-	url, err := url.Parse(args[0])
+	f, err := openFeed(args[0])
 	if err != nil {
-		log.WithError(err).Error("error parsing url")
+		log.WithError(err).Error("error reading feed")
 		os.Exit(2)
 	}
+	defer f.Close()
 
-	log.Debugf("Reading: %s", url)
+	doStats(f)
+}
 
-	switch url.Scheme {
-	case "", "file":
-		f, err := os.Open(url.Path)
-		if err != nil {
-			log.WithError(err).Error("error reading file feed")
-			os.Exit(2)
-		}
-		defer f.Close()
+func doStats(r io.Reader) {
+	log.Debug("Parsing file...")
 
-		doStats(f)
-	case "http", "https":
-		f, err := http.Get(url.String())
-		if err != nil {
-			log.WithError(err).Error("error reading HTTP feed")
-			os.Exit(2)
+	// Twts are read one at a time and only their aggregates kept so that
+	// very large feeds can be analysed with bounded memory.
+	var (
+		nTwts, nTags, nMentions, nLinks int
+
+		days     = make(map[string]int)
+		tags     = make(map[string]int)
+		mentions = make(map[string]int)
+		subjects = make(map[string]int)
+		links    = make(map[string]int)
+	)
+
+	scanner := lextwt.NewScanner(r, types.NilTwt.Twter())
+	for {
+		twt, err := scanner.Next()
+		if err == io.EOF {
+			break
 		}
-		defer f.Body.Close()
-
-		doStats(f.Body)
-	case "gopher":
-		res, err := gopher.Get(url.String())
 		if err != nil {
-			log.WithError(err).Error("error reading Gopher feed")
+			log.WithError(err).Error("error parsing feed")
 			os.Exit(2)
 		}
-		defer res.Body.Close()
 
-		doStats(res.Body)
-	}
-}
+		nTwts++
+		countDaysOfWeek(days, twt)
 
-func doStats(r io.Reader) {
-	log.Debug("Parsing file...")
+		nTags += len(twt.Tags())
+		countTags(tags, twt.Tags())
 
-	twt, err := lextwt.ParseFile(r, types.NilTwt.Twter())
-	if err != nil {
-		log.WithError(err).Error("error parsing feed")
-		os.Exit(2)
+		nMentions += len(twt.Mentions())
+		countMentions(mentions, twt.Mentions())
+
+		subjects[twt.Subject().String()]++
+
+		nLinks += len(twt.Links())
+		for _, link := range twt.Links() {
+			links[link.Target()]++
+		}
 	}
 	log.Debug("Complete!")
 
+	twt := scanner.File()
+
 	fmt.Println(twt.Info())
 
 	twter := twt.Twter()
@@ -99,74 +103,48 @@ func doStats(r io.Reader) {
 		fmt.Printf("  % -30s = %s\n", c.Nick, c.URL)
 	}
 
-	fmt.Println("twts: ", len(twt.Twts()))
+	fmt.Println("twts: ", nTwts)
 
-	fmt.Printf("days of week:\n%v\n", daysOfWeek(twt.Twts()))
+	fmt.Printf("days of week:\n%v\n", newStats(days))
 
-	fmt.Println("tags: ", len(twt.Twts().Tags()))
-	fmt.Println(getTags(twt.Twts().Tags()))
+	fmt.Println("tags: ", nTags)
+	fmt.Println(newStats(tags))
 
-	fmt.Println("mentions: ", len(twt.Twts().Mentions()))
-	fmt.Println(getMentions(twt.Twts(), twt.Info().Followers()))
+	fmt.Println("mentions: ", nMentions)
+	fmt.Println(newStats(mentions))
 
-	fmt.Println("subjects: ", len(twt.Twts().Subjects()))
-	var subjects stats
-	for subject, count := range twt.Twts().SubjectCount() {
-		subjects = append(subjects, stat{count, subject})
-	}
-	fmt.Println(subjects)
+	fmt.Println("subjects: ", nTwts)
+	fmt.Println(newStats(subjects))
 
-	fmt.Println("links: ", len(twt.Twts().Links()))
-	var links stats
-	for link, count := range twt.Twts().LinkCount() {
-		links = append(links, stat{count, link})
-	}
-	fmt.Println(links)
+	fmt.Println("links: ", nLinks)
+	fmt.Println(newStats(links))
 }
 
-func daysOfWeek(twts types.Twts) stats {
-	s := make(map[string]int)
-
-	for _, twt := range twts {
-		s[fmt.Sprint(twt.Created().Format("tz-Z0700"))]++
-		s[fmt.Sprint(twt.Created().Format("dow-Mon"))]++
-		s[fmt.Sprint(twt.Created().Format("year-2006"))]++
-		s[fmt.Sprint(twt.Created().Format("day-2006-01-02"))]++
-	}
-
-	var lis stats
-	for k, v := range s {
-		lis = append(lis, stat{v, k})
-	}
-	return lis
+func countDaysOfWeek(s map[string]int, twt types.Twt) {
+	s[fmt.Sprint(twt.Created().Format("tz-Z0700"))]++
+	s[fmt.Sprint(twt.Created().Format("dow-Mon"))]++
+	s[fmt.Sprint(twt.Created().Format("year-2006"))]++
+	s[fmt.Sprint(twt.Created().Format("day-2006-01-02"))]++
 }
 
-func getMentions(twts types.Twts, follows []types.Twter) stats {
-	counts := make(map[string]int)
-	for _, m := range twts.Mentions() {
+func countMentions(counts map[string]int, mentions types.MentionList) {
+	for _, m := range mentions {
 		t := m.Twter()
 		counts[fmt.Sprint(t.Nick, "\t", t.URL)]++
 	}
-
-	lis := make(stats, 0, len(counts))
-	for name, count := range counts {
-		lis = append(lis, stat{count, name})
-	}
-
-	return lis
 }
 
-func getTags(twts types.TagList) stats {
-	counts := make(map[string]int)
-	for _, m := range twts {
+func countTags(counts map[string]int, tags types.TagList) {
+	for _, m := range tags {
 		counts[fmt.Sprint(m.Text(), "\t", m.Target())]++
 	}
+}
 
+func newStats(counts map[string]int) stats {
 	lis := make(stats, 0, len(counts))
 	for name, count := range counts {
 		lis = append(lis, stat{count, name})
 	}
-
 	return lis
 }
 
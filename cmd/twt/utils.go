@@ -2,10 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/goware/urlx"
+	"github.com/prologic/go-gopher"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -50,3 +57,67 @@ func NormalizeURL(url string) string {
 	}
 	return norm
 }
+
+// openFeed opens a Twtxt feed given a URL (http, https or gopher) or local
+// file for reading
+func openFeed(uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing url: %w", err)
+	}
+
+	log.Debugf("Reading: %s", u)
+
+	switch u.Scheme {
+	case "", "file":
+		return os.Open(u.Path)
+	case "http", "https":
+		res, err := http.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("non-success HTTP %s response for %s", res.Status, u)
+		}
+		return res.Body, nil
+	case "gopher":
+		res, err := gopher.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		return res.Body, nil
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+}
+
+// writeFeed replaces the local feed fn with data, keeping its permissions.
+// The feed is written to a temporary file which is renamed over fn so the
+// feed is never left partially written.
+func writeFeed(fn string, data []byte) error {
+	fileInfo, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.Write(data); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Chmod(fileInfo.Mode()); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), fn)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/jointwt/twtxt"
 	"github.com/jointwt/twtxt/internal"
+	"github.com/jointwt/twtxt/types/difftwt"
 	"github.com/jointwt/twtxt/types/lextwt"
 	"github.com/jointwt/twtxt/types/retwt"
 )
@@ -30,6 +31,7 @@ var (
 	description string
 	data        string
 	store       string
+	mediaStore  string
 	theme       string
 	lang        string
 	baseURL     string
@@ -48,11 +50,19 @@ var (
 	twtsPerPage   int
 	maxTwtLength  int
 	maxUploadSize int64
+	mediaQuota    int64
 	maxFetchLimit int64
 	maxCacheTTL   time.Duration
 	fetchInterval string
 	maxCacheItems int
 
+	orphanedMediaGracePeriod time.Duration
+	deleteOrphanedMedia      bool
+
+	taskRetention time.Duration
+
+	twtHashVersion int
+
 	// Pod Secrets
 	apiSigningKey   string
 	cookieSecret    string
@@ -69,6 +79,9 @@ var (
 	smtpBind string
 	pop3Bind string
 
+	// Finger Settings
+	fingerBind string
+
 	// Timeouts
 	sessionExpiry     time.Duration
 	sessionCacheTTL   time.Duration
@@ -91,6 +104,7 @@ func init() {
 	flag.StringVarP(&description, "description", "m", internal.DefaultMetaDescription, "set the pod's description")
 	flag.StringVarP(&data, "data", "d", internal.DefaultData, "data directory")
 	flag.StringVarP(&store, "store", "s", internal.DefaultStore, "store to use")
+	flag.StringVar(&mediaStore, "media-store", internal.DefaultMediaStore, "store to use for uploaded media (file:// or s3://)")
 	flag.StringVarP(&theme, "theme", "t", internal.DefaultTheme, "set the default theme")
 	flag.StringVarP(&lang, "lang", "l", internal.DefaultLang, "set the default language")
 	flag.StringVarP(&baseURL, "base-url", "u", internal.DefaultBaseURL, "base url to use")
@@ -123,6 +137,10 @@ func init() {
 		&maxUploadSize, "max-upload-size", "U", internal.DefaultMaxUploadSize,
 		"maximum upload size of media",
 	)
+	flag.Int64Var(
+		&mediaQuota, "media-quota", internal.DefaultMediaQuota,
+		"storage quota for each user's uploaded media in bytes (0 for unlimited)",
+	)
 	flag.Int64VarP(
 		&maxFetchLimit, "max-fetch-limit", "F", internal.DefaultMaxFetchLimit,
 		"maximum feed fetch limit in bytes",
@@ -140,6 +158,28 @@ func init() {
 		"maximum cache items (per feed source) of cached twts in memory",
 	)
 
+	// Orphaned Media
+	flag.DurationVar(
+		&orphanedMediaGracePeriod, "orphaned-media-grace-period", internal.DefaultOrphanedMediaGracePeriod,
+		"how long uploaded media must be unreferenced by any twt, blog post or message to be orphaned",
+	)
+	flag.BoolVar(
+		&deleteOrphanedMedia, "delete-orphaned-media", internal.DefaultDeleteOrphanedMedia,
+		"whether or not to delete orphaned media (otherwise orphaned media is only reported)",
+	)
+
+	// Tasks
+	flag.DurationVar(
+		&taskRetention, "task-retention", internal.DefaultTaskRetention,
+		"how long the records of finished tasks (media processing, etc) are kept",
+	)
+
+	// Twt Hashing
+	flag.IntVar(
+		&twtHashVersion, "twt-hash-version", internal.DefaultTwtHashVersion,
+		"version of the hash local twts are hashed with (changing it migrates bookmarks and the archive)",
+	)
+
 	// Pod Secrets
 	flag.StringVar(
 		&apiSigningKey, "api-signing-key", internal.DefaultAPISigningKey,
@@ -165,6 +205,9 @@ func init() {
 	flag.StringVar(&smtpBind, "smtp-bind", internal.DefaultSMTPBind, "SMTP interface and port to bind to")
 	flag.StringVar(&pop3Bind, "pop3-bind", internal.DefaultPOP3Bind, "POP3 interface and port to bind to")
 
+	// Finger Settings
+	flag.StringVar(&fingerBind, "finger-bind", internal.DefaultFingerBind, "Finger interface and port to bind to (disabled if empty)")
+
 	// Timeouts
 	flag.DurationVar(
 		&sessionExpiry, "session-expiry", internal.DefaultSessionExpiry,
@@ -247,6 +290,8 @@ func main() {
 		lextwt.DefaultTwtManager()
 	case "retwt":
 		retwt.DefaultTwtManager()
+	case "diff":
+		difftwt.DefaultTwtManager()
 	default:
 		log.Errorf("unknown parsing engine: %s", parser)
 		os.Exit(2)
@@ -261,6 +306,7 @@ func main() {
 		internal.WithDescription(description),
 		internal.WithData(data),
 		internal.WithStore(store),
+		internal.WithMediaStore(mediaStore),
 		internal.WithTheme(theme),
 		internal.WithBaseURL(baseURL),
 		internal.WithParser(parser),
@@ -278,11 +324,22 @@ func main() {
 		internal.WithTwtsPerPage(twtsPerPage),
 		internal.WithMaxTwtLength(maxTwtLength),
 		internal.WithMaxUploadSize(maxUploadSize),
+		internal.WithMediaQuota(mediaQuota),
 		internal.WithMaxFetchLimit(maxFetchLimit),
 		internal.WithMaxCacheTTL(maxCacheTTL),
 		internal.WithFetchInterval(fetchInterval),
 		internal.WithMaxCacheItems(maxCacheItems),
 
+		// Orphaned Media
+		internal.WithOrphanedMediaGracePeriod(orphanedMediaGracePeriod),
+		internal.WithDeleteOrphanedMedia(deleteOrphanedMedia),
+
+		// Tasks
+		internal.WithTaskRetention(taskRetention),
+
+		// Twt Hashing
+		internal.WithTwtHashVersion(twtHashVersion),
+
 		// Pod Secrets
 		internal.WithAPISigningKey(apiSigningKey),
 		internal.WithCookieSecret(cookieSecret),
@@ -299,6 +356,9 @@ func main() {
 		internal.WithSMTPBind(smtpBind),
 		internal.WithPOP3Bind(pop3Bind),
 
+		// Finger Settings
+		internal.WithFingerBind(fingerBind),
+
 		// Timeouts
 		internal.WithSessionExpiry(sessionExpiry),
 		internal.WithSessionCacheTTL(sessionCacheTTL),
@@ -70,6 +70,7 @@ func (a *API) initRoutes() {
 
 	router.POST("/post", a.isAuthorized(a.PostEndpoint()))
 	router.POST("/upload", a.isAuthorized(a.UploadMediaEndpoint()))
+	router.GET("/metadata/:name", a.isAuthorized(a.MediaMetadataEndpoint()))
 
 	router.GET("/settings", a.isAuthorized(a.SettingsEndpoint()))
 	router.POST("/settings", a.isAuthorized(a.SettingsEndpoint()))
@@ -94,12 +95,25 @@ func (a *API) initRoutes() {
 	// Support / Report endpoints
 	router.POST("/support", a.isAuthorized(a.SupportEndpoint()))
 	router.POST("/report", a.isAuthorized(a.ReportEndpoint()))
+
+	// Task endpoints (Pod Owner only)
+	router.GET("/tasks", a.isAuthorized(a.TasksEndpoint()))
+	router.POST("/tasks/cancel", a.isAuthorized(a.CancelTaskEndpoint()))
 }
 
 // CreateToken ...
 func (a *API) CreateToken(user *User, r *http.Request) (*Token, error) {
+	return a.CreateScopedToken(user, "", r)
+}
+
+// CreateScopedToken creates a token limited to the space separated scopes
+// granted to a client, an empty scope creates an unrestricted API token.
+func (a *API) CreateScopedToken(user *User, scope string, r *http.Request) (*Token, error) {
 	claims := jwt.MapClaims{}
 	claims["username"] = user.Username
+	if scope != "" {
+		claims["scope"] = scope
+	}
 	createdAt := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(a.config.APISigningKey))
@@ -118,6 +132,7 @@ func (a *API) CreateToken(user *User, r *http.Request) (*Token, error) {
 		Signature: signedToken.Signature,
 		Value:     tokenString,
 		UserAgent: r.UserAgent(),
+		Scope:     scope,
 		CreatedAt: createdAt,
 	}
 
@@ -143,6 +158,12 @@ func (a *API) getLoggedInUser(r *http.Request) *User {
 
 	claims := token.Claims.(jwt.MapClaims)
 
+	// Tokens limited to a scope are only valid for Micropub and the
+	// Mastodon API
+	if _, ok := claims["scope"]; ok {
+		return nil
+	}
+
 	username := claims["username"].(string)
 
 	user, err := a.db.GetUser(username)
@@ -180,6 +201,13 @@ func (a *API) isAuthorized(endpoint httprouter.Handle) httprouter.Handle {
 		if token.Valid {
 			claims := token.Claims.(jwt.MapClaims)
 
+			// Tokens limited to a scope are only valid for Micropub and
+			// the Mastodon API
+			if _, ok := claims["scope"]; ok {
+				http.Error(w, "Invalid Token", http.StatusUnauthorized)
+				return
+			}
+
 			username := claims["username"].(string)
 
 			user, err := a.db.GetUser(username)
@@ -386,6 +414,14 @@ func (a *API) PostEndpoint() httprouter.Handle {
 			return
 		}
 
+		text = WithContentWarning(text, req.ContentWarning)
+
+		if err := ValidateTwtLength(a.config, text); err != nil {
+			log.Warnf("twt too long (%d > %d)", TwtLength(text), a.config.MaxTwtLength)
+			http.Error(w, "Twt Too Long", http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		switch req.PostAs {
 		case "", me:
 			_, err = AppendTwt(a.config, a.db, user, text)
@@ -843,7 +879,7 @@ func (a *API) OldUploadMediaEndpoint() httprouter.Handle {
 		r.Body = http.MaxBytesReader(w, r.Body, a.config.MaxUploadSize)
 		defer r.Body.Close()
 
-		mediaFile, _, err := r.FormFile("media_file")
+		mediaFile, headers, err := r.FormFile("media_file")
 		if err != nil && err != http.ErrMissingFile {
 			log.WithError(err).Error("error parsing form file")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -853,7 +889,15 @@ func (a *API) OldUploadMediaEndpoint() httprouter.Handle {
 		var mediaURI string
 
 		if mediaFile != nil {
-			opts := &ImageOptions{Resize: true, Width: MediaResolution, Height: 0}
+			user := r.Context().Value(UserContextKey).(*User)
+
+			if err := CheckMediaQuotaLeft(a.config, user.Username); err != nil {
+				log.Warnf("media quota exceeded for %s", user.Username)
+				http.Error(w, "Media Quota Exceeded", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			opts := &ImageOptions{Resize: true, Width: MediaResolution, Height: 0, Variants: true}
 			mediaURI, err = StoreUploadedImage(
 				a.config, mediaFile,
 				mediaDir, "",
@@ -865,6 +909,13 @@ func (a *API) OldUploadMediaEndpoint() httprouter.Handle {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+
+			upload := NewUploadMetadata(user.Username, headers.Filename, "")
+			if err := recordMediaUpload(a.config, mediaURI, upload); err == ErrMediaQuotaExceeded {
+				log.Warnf("media quota exceeded for %s", user.Username)
+				http.Error(w, "Media Quota Exceeded", http.StatusRequestEntityTooLarge)
+				return
+			}
 		}
 
 		uri := URI{"mediaURI", mediaURI}
@@ -911,6 +962,15 @@ func (a *API) UploadMediaEndpoint() httprouter.Handle {
 			return
 		}
 
+		user := r.Context().Value(UserContextKey).(*User)
+		upload := NewUploadMetadata(user.Username, headers.Filename, "")
+
+		if err := CheckMediaQuotaLeft(a.config, user.Username); err != nil {
+			log.Warnf("media quota exceeded for %s", user.Username)
+			http.Error(w, "Media Quota Exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		ctype := headers.Header.Get("Content-Type")
 
 		var uri URI
@@ -923,14 +983,19 @@ func (a *API) UploadMediaEndpoint() httprouter.Handle {
 				return
 			}
 
-			uuid, err := a.tasks.Dispatch(NewImageTask(a.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching image processing task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(a.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := a.tasks.Dispatch(NewImageTask(a.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching image processing task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(a.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(a.config.BaseURL, uuid)
 		}
 
 		if strings.HasPrefix(ctype, "audio/") {
@@ -941,14 +1006,19 @@ func (a *API) UploadMediaEndpoint() httprouter.Handle {
 				return
 			}
 
-			uuid, err := a.tasks.Dispatch(NewAudioTask(a.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching audio transcoding task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(a.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := a.tasks.Dispatch(NewAudioTask(a.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching audio transcoding task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(a.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(a.config.BaseURL, uuid)
 		}
 
 		if strings.HasPrefix(ctype, "video/") {
@@ -959,14 +1029,19 @@ func (a *API) UploadMediaEndpoint() httprouter.Handle {
 				return
 			}
 
-			uuid, err := a.tasks.Dispatch(NewVideoTask(a.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching vodeo transcode task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(a.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := a.tasks.Dispatch(NewVideoTask(a.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching vodeo transcode task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(a.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(a.config.BaseURL, uuid)
 		}
 
 		if uri.IsZero() {
@@ -1043,23 +1118,16 @@ func (a *API) ProfileEndpoint() httprouter.Handle {
 			Rel:  "webmention",
 		}}
 
-		profileResponse.Alternatives = types.Alternatives{
-			types.Alternative{
-				Type:  "application/atom+xml",
-				Title: fmt.Sprintf("%s local feed", a.config.Name),
-				URL:   fmt.Sprintf("%s/atom.xml", a.config.BaseURL),
-			},
-			types.Alternative{
-				Type:  "text/plain",
-				Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
-				URL:   profile.URL,
-			},
-			types.Alternative{
-				Type:  "application/atom+xml",
-				Title: fmt.Sprintf("%s's Atom Feed", profile.Username),
-				URL:   fmt.Sprintf("%s/atom.xml", UserURL(profile.URL)),
-			},
-		}
+		profileResponse.Alternatives = syndicationAlternatives(fmt.Sprintf("%s local", a.config.Name), a.config.BaseURL, nil)
+		profileResponse.Alternatives = append(profileResponse.Alternatives, types.Alternative{
+			Type:  "text/plain",
+			Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
+			URL:   profile.URL,
+		})
+		profileResponse.Alternatives = append(
+			profileResponse.Alternatives,
+			syndicationAlternatives(fmt.Sprintf("%s's", profile.Username), UserURL(profile.URL), nil)...,
+		)
 
 		profileResponse.Twter = types.Twter{
 			Nick:   profile.Username,
@@ -1452,3 +1520,126 @@ func (a *API) PodConfigEndpoint() httprouter.Handle {
 		_, _ = w.Write(data)
 	}
 }
+
+// TasksEndpoint lists the queued, running and recorded tasks
+func (a *API) TasksEndpoint() httprouter.Handle {
+	isAdminUser := IsAdminUserFactory(a.config)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		if !isAdminUser(user) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		records, err := a.tasks.Tasks()
+		if err != nil {
+			log.WithError(err).Error("error loading tasks")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		res := types.TasksResponse{Tasks: []types.Task{}}
+		for _, record := range records {
+			res.Tasks = append(res.Tasks, types.Task{
+				ID:       record.ID,
+				Kind:     record.Kind,
+				Priority: record.Priority.String(),
+				Attempts: record.Attempts,
+				State:    record.State.String(),
+				Error:    record.Error,
+				Data:     record.Data,
+				Created:  record.Created,
+				Updated:  record.Updated,
+			})
+		}
+
+		body, err := res.Bytes()
+		if err != nil {
+			log.WithError(err).Error("error serializing response")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}
+}
+
+// MediaMetadataEndpoint returns the metadata of media uploaded by the user
+func (a *API) MediaMetadataEndpoint() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		name := MediaName(p.ByName("name"))
+
+		meta := GetMediaMetadata(a.config, name)
+		if meta == nil || meta.Owner != user.Username {
+			http.Error(w, "Media Not Found", http.StatusNotFound)
+			return
+		}
+
+		res := types.MediaMetadataResponse{
+			Name:        name,
+			Owner:       meta.Owner,
+			Filename:    meta.Filename,
+			ContentType: meta.ContentType,
+			Description: meta.Description,
+			Width:       meta.Width,
+			Height:      meta.Height,
+			Duration:    meta.Duration,
+			Blurhash:    meta.Blurhash,
+			Created:     meta.Created,
+		}
+
+		body, err := res.Bytes()
+		if err != nil {
+			log.WithError(err).Error("error serializing response")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}
+}
+
+// CancelTaskEndpoint cancels a queued or running task
+func (a *API) CancelTaskEndpoint() httprouter.Handle {
+	isAdminUser := IsAdminUserFactory(a.config)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		if !isAdminUser(user) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		req, err := types.NewTaskRequest(r.Body)
+		if err != nil {
+			log.WithError(err).Error("error parsing task request")
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		switch err := a.tasks.Cancel(req.ID); err {
+		case nil:
+		case ErrTaskNotFound:
+			http.Error(w, "Task Not Found", http.StatusNotFound)
+			return
+		case ErrTaskFinished, ErrTaskNotCancellable:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.WithError(err).Errorf("error cancelling task %s", req.ID)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// No real response
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
@@ -10,23 +10,36 @@ import (
 type AudioTask struct {
 	*BaseTask
 
-	conf *Config
-	fn   string
+	conf   *Config
+	fn     string
+	upload *MediaMetadata
 }
 
-func NewAudioTask(conf *Config, fn string) *AudioTask {
-	return &AudioTask{
+func NewAudioTask(conf *Config, fn string, upload *MediaMetadata) *AudioTask {
+	task := &AudioTask{
 		BaseTask: NewBaseTask(),
 
-		conf: conf,
-		fn:   fn,
+		conf:   conf,
+		fn:     spoolUpload(conf, fn),
+		upload: upload,
 	}
+
+	// Transcoding takes a while, so image uploads (which are quick) are
+	// processed first whilst the uploader waits
+	task.SetPriority(TaskPriorityNormal)
+
+	return task
 }
 
-func (t *AudioTask) String() string { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *AudioTask) String() string           { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *AudioTask) Kind() string             { return audioTaskKind }
+func (t *AudioTask) Args() TaskData           { return mediaTaskArgs(t.fn, t.upload) }
+func (t *AudioTask) RetryPolicy() RetryPolicy { return mediaTaskRetryPolicy }
+func (t *AudioTask) Cleanup()                 { removeUpload(t.fn) }
 func (t *AudioTask) Run() error {
 	defer t.Done()
 	t.SetState(TaskStateRunning)
+	t.SetProgress(0)
 
 	log.Infof("starting audio transcode task for %s", t.fn)
 
@@ -35,6 +48,9 @@ func (t *AudioTask) Run() error {
 		Channels:   1,
 		Samplerate: 16000,
 		Bitrate:    96,
+
+		Context:  t.Context(),
+		Progress: t.setTranscodeProgress,
 	}
 	mediaURI, err := TranscodeAudio(t.conf, t.fn, mediaDir, "", opts)
 	if err != nil {
@@ -47,7 +63,12 @@ func (t *AudioTask) Run() error {
 		log.WithError(err).Warn("error removing temporary audio file")
 	}
 
+	if err := recordMediaUpload(t.conf, mediaURI, t.upload); err != nil {
+		return t.Fail(err)
+	}
+
 	t.SetData("mediaURI", mediaURI)
+	t.SetProgress(100)
 
 	return nil
 }
@@ -1,38 +1,132 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"sync"
 
 	"github.com/renstrom/shortuuid"
 )
 
 type BaseTask struct {
-	state TaskState
-	data  TaskData
-	err   error
-	id    string
+	sync.RWMutex
+
+	state    TaskState
+	priority TaskPriority
+	data     TaskData
+	err      error
+	id       string
+	attempts int
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewBaseTask() *BaseTask {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &BaseTask{
-		data: make(TaskData),
-		id:   shortuuid.New(),
+		priority: TaskPriorityNormal,
+		data:     make(TaskData),
+		id:       shortuuid.New(),
+
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
+// restore restores the id and attempts of a task recreated to be resumed
+func (t *BaseTask) restore(record *TaskRecord) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.id = record.ID
+	t.attempts = record.Attempts
+}
+
+// attempt counts an attempt at running the task and returns the attempt
+func (t *BaseTask) attempt() int {
+	t.Lock()
+	defer t.Unlock()
+
+	t.attempts++
+	return t.attempts
+}
+
+// reset resets the task so it is run again after failing
+func (t *BaseTask) reset() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.state = TaskStatePending
+	t.err = nil
+	delete(t.data, "progress")
+}
+
 func (t *BaseTask) SetState(state TaskState) {
+	t.Lock()
+	defer t.Unlock()
+
 	t.state = state
 }
 
+func (t *BaseTask) SetPriority(priority TaskPriority) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.priority = priority
+}
+
 func (t *BaseTask) SetData(key, val string) {
+	t.Lock()
+	defer t.Unlock()
+
 	if t.data == nil {
 		t.data = make(TaskData)
 	}
 	t.data[key] = val
 }
 
+// SetProgress reports the progress of the task as a percentage
+func (t *BaseTask) SetProgress(progress int) {
+	t.SetData("progress", strconv.Itoa(progress))
+}
+
+// setTranscodeProgress reports the progress of transcoding media, which
+// accounts for most of the work of processing it with the remainder being
+// storing the media once transcoded
+func (t *BaseTask) setTranscodeProgress(progress int) {
+	t.SetProgress(progress * 90 / 100)
+}
+
+// Context returns a context that is cancelled when the task is cancelled,
+// long running tasks should stop what they are doing when it is done
+func (t *BaseTask) Context() context.Context { return t.ctx }
+
+// Cancel cancels the task, a pending task is cancelled immediately whereas a
+// running task is cancelled once it stops (See: Context)
+func (t *BaseTask) Cancel() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.cancel()
+	if t.state == TaskStatePending {
+		t.state = TaskStateCancelled
+		t.err = ErrTaskCancelled
+	}
+}
+
+func (t *BaseTask) Cancelled() bool { return t.ctx.Err() != nil }
+
 func (t *BaseTask) Done() {
-	if t.err != nil {
+	t.Lock()
+	defer t.Unlock()
+
+	// A task cancelled while running that finished anyway is complete
+	if t.err != nil && t.ctx.Err() != nil {
+		t.state = TaskStateCancelled
+	} else if t.err != nil {
 		t.state = TaskStateFailed
 	} else {
 		t.state = TaskStateComplete
@@ -40,25 +134,68 @@ func (t *BaseTask) Done() {
 }
 
 func (t *BaseTask) Fail(err error) error {
+	t.Lock()
+	defer t.Unlock()
+
 	t.err = err
 	return err
 }
 
 func (t *BaseTask) Result() TaskResult {
+	t.RLock()
+	defer t.RUnlock()
+
 	stateStr := t.state.String()
 	errStr := ""
 	if t.err != nil {
 		errStr = t.err.Error()
 	}
 
+	data := make(TaskData, len(t.data))
+	for k, v := range t.data {
+		data[k] = v
+	}
+
 	return TaskResult{
 		State: stateStr,
 		Error: errStr,
-		Data:  t.data,
+		Data:  data,
 	}
 }
 
-func (t *BaseTask) String() string   { return fmt.Sprintf("%T: %s", t, t.ID()) }
-func (t *BaseTask) ID() string       { return t.id }
-func (t *BaseTask) State() TaskState { return t.state }
-func (t *BaseTask) Error() error     { return t.err }
+func (t *BaseTask) String() string { return fmt.Sprintf("%T: %s", t, t.ID()) }
+
+func (t *BaseTask) ID() string {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.id
+}
+
+func (t *BaseTask) State() TaskState {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.state
+}
+
+func (t *BaseTask) Priority() TaskPriority {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.priority
+}
+
+func (t *BaseTask) Attempts() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.attempts
+}
+
+func (t *BaseTask) Error() error {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.err
+}
@@ -15,6 +15,8 @@ const (
 	sessionsKeyPrefix = "/sessions"
 	usersKeyPrefix    = "/users"
 	tokensKeyPrefix   = "/tokens"
+	appsKeyPrefix     = "/apps"
+	tasksKeyPrefix    = "/tasks"
 )
 
 // BitcaskStore ...
@@ -374,3 +376,89 @@ func (bs *BitcaskStore) LenTokens() int64 {
 
 	return count
 }
+
+func (bs *BitcaskStore) HasApp(clientID string) bool {
+	key := []byte(fmt.Sprintf("%s/%s", appsKeyPrefix, clientID))
+	return bs.db.Has(key)
+}
+
+func (bs *BitcaskStore) GetApp(clientID string) (*App, error) {
+	key := []byte(fmt.Sprintf("%s/%s", appsKeyPrefix, clientID))
+	data, err := bs.db.Get(key)
+	if err == bitcask.ErrKeyNotFound {
+		return nil, ErrAppNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return LoadApp(data)
+}
+
+func (bs *BitcaskStore) SetApp(clientID string, app *App) error {
+	data, err := app.Bytes()
+	if err != nil {
+		return err
+	}
+
+	key := []byte(fmt.Sprintf("%s/%s", appsKeyPrefix, clientID))
+	if err := bs.db.Put(key, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (bs *BitcaskStore) DelApp(clientID string) error {
+	key := []byte(fmt.Sprintf("%s/%s", appsKeyPrefix, clientID))
+	return bs.db.Delete(key)
+}
+
+func (bs *BitcaskStore) GetTask(id string) (*TaskRecord, error) {
+	key := []byte(fmt.Sprintf("%s/%s", tasksKeyPrefix, id))
+	data, err := bs.db.Get(key)
+	if err == bitcask.ErrKeyNotFound {
+		return nil, ErrTaskNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return LoadTaskRecord(data)
+}
+
+func (bs *BitcaskStore) SetTask(id string, record *TaskRecord) error {
+	data, err := record.Bytes()
+	if err != nil {
+		return err
+	}
+
+	key := []byte(fmt.Sprintf("%s/%s", tasksKeyPrefix, id))
+	if err := bs.db.Put(key, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (bs *BitcaskStore) DelTask(id string) error {
+	key := []byte(fmt.Sprintf("%s/%s", tasksKeyPrefix, id))
+	return bs.db.Delete(key)
+}
+
+func (bs *BitcaskStore) GetAllTasks() ([]*TaskRecord, error) {
+	var records []*TaskRecord
+
+	err := bs.db.Scan([]byte(tasksKeyPrefix), func(key []byte) error {
+		data, err := bs.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		record, err := LoadTaskRecord(data)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
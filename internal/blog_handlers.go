@@ -137,6 +137,10 @@ func (s *Server) ViewBlogHandler() httprouter.Handle {
 				URL:   fmt.Sprintf("%s/atom.xml", UserURL(URLForUser(s.config.BaseURL, blogPost.Author))),
 			},
 		}...)
+		ctx.Alternatives = append(
+			ctx.Alternatives,
+			syndicationAlternatives(fmt.Sprintf("%s's Blog", blogPost.Author), URLForBlogs(s.config.BaseURL, blogPost.Author), nil)...,
+		)
 
 		var pagedTwts types.Twts
 
@@ -287,6 +291,11 @@ func (s *Server) ListBlogsHandler() httprouter.Handle {
 
 		author = NormalizeUsername(author)
 
+		if format := preferredSyndicationFormat(r); format != "" {
+			s.syndicateBlogs(w, r, author, format)
+			return
+		}
+
 		var profile types.Profile
 
 		if s.db.HasUser(author) {
@@ -322,18 +331,15 @@ func (s *Server) ListBlogsHandler() httprouter.Handle {
 			Href: fmt.Sprintf("%s/webmention", UserURL(profile.URL)),
 			Rel:  "webmention",
 		})
-		ctx.Alternatives = append(ctx.Alternatives, types.Alternatives{
-			types.Alternative{
-				Type:  "text/plain",
-				Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
-				URL:   profile.URL,
-			},
-			types.Alternative{
-				Type:  "application/atom+xml",
-				Title: fmt.Sprintf("%s's Atom Feed", profile.Username),
-				URL:   fmt.Sprintf("%s/atom.xml", UserURL(profile.URL)),
-			},
-		}...)
+		ctx.Alternatives = append(ctx.Alternatives, types.Alternative{
+			Type:  "text/plain",
+			Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
+			URL:   profile.URL,
+		})
+		ctx.Alternatives = append(
+			ctx.Alternatives,
+			syndicationAlternatives(fmt.Sprintf("%s's Blog", profile.Username), URLForBlogs(s.config.BaseURL, author), nil)...,
+		)
 
 		blogPosts, err := GetBlogPostsByAuthor(s.config, author)
 		if err != nil {
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	blurhashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+	// blurhashSize is the size images are scaled down to before encoding
+	blurhashSize = 32
+)
+
+// Blurhash encodes img as a https://blurha.sh placeholder with x by y
+// components (each between 1 and 9)
+func Blurhash(img image.Image, x, y int) string {
+	g := gift.New(gift.Resize(blurhashSize, blurhashSize, gift.BoxResampling))
+	small := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(small, img)
+
+	bounds := small.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+
+			var r, g, b float64
+			for py := 0; py < height; py++ {
+				for px := 0; px < width; px++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(px)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(py)/float64(height))
+					c := small.RGBAAt(bounds.Min.X+px, bounds.Min.Y+py)
+					r += basis * srgbToLinear(c.R)
+					g += basis * srgbToLinear(c.G)
+					b += basis * srgbToLinear(c.B)
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var hash strings.Builder
+
+	hash.WriteString(base83((x-1)+(y-1)*9, 1))
+
+	maximum := 0.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		hash.WriteString(base83(quantisedMaximum, 1))
+	} else {
+		maximum = 1
+		hash.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(base83(
+		linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4,
+	))
+
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+
+	return hash.String()
+}
+
+// BlurhashColor returns the average color of the blurhash hash as a CSS hex
+// color (e.g: #1a2b3c), or an empty string if hash is invalid
+func BlurhashColor(hash string) string {
+	if len(hash) < 6 {
+		return ""
+	}
+
+	value := 0
+	for _, c := range hash[2:6] {
+		i := strings.IndexRune(blurhashChars, c)
+		if i < 0 {
+			return ""
+		}
+		value = value*83 + i
+	}
+
+	return fmt.Sprintf("#%06x", value&0xffffff)
+}
+
+func base83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = blurhashChars[digit]
+	}
+	return string(result)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
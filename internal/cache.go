@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -23,6 +24,18 @@ import (
 const (
 	feedCacheFile    = "cache"
 	feedCacheVersion = 1 // increase this if breaking changes occur to cache file.
+
+	// maxPrevFeeds is the maximum number of archived feeds followed via
+	// `# prev` links when paging through an external feed's history
+	maxPrevFeeds = 10
+
+	// olderTwtsTTL is how long twts fetched by walking a feed's `# prev`
+	// links are kept around in memory
+	olderTwtsTTL = time.Minute * 15
+
+	// maxFeedEdits is the maximum number of a feed's most recent `# edit`
+	// markers that are kept
+	maxFeedEdits = 1000
 )
 
 // Cached ...
@@ -31,6 +44,14 @@ type Cached struct {
 	cache        types.TwtMap
 	Twts         types.Twts
 	Lastmodified string
+
+	// Edits maps the hash of an edited twt to the hash of the twt it
+	// replaced as announced by the feed's `# edit` markers
+	Edits map[string]string
+
+	// Avatar is the avatar the feed advertised (via `# avatar`) when it was
+	// last fetched, the pod's copy of it is only updated when it changes
+	Avatar string
 }
 
 // Lookup ...
@@ -65,6 +86,9 @@ type Cache struct {
 	mu      sync.RWMutex
 	Version int
 	Twts    map[string]*Cached
+
+	olderOnce sync.Once
+	older     *TTLCache
 }
 
 // Store ...
@@ -230,11 +254,17 @@ func (cache *Cache) FetchTwts(conf *Config, archive Archiver, feeds types.Feeds,
 				}
 			}
 
+			var (
+				seenBefore bool
+				lastAvatar string
+			)
+
 			cache.mu.RLock()
 			if cached, ok := cache.Twts[feed.URL]; ok {
 				if cached.Lastmodified != "" {
 					headers.Set("If-Modified-Since", cached.Lastmodified)
 				}
+				seenBefore, lastAvatar = true, cached.Avatar
 			}
 			cache.mu.RUnlock()
 
@@ -269,25 +299,105 @@ func (cache *Cache) FetchTwts(conf *Config, archive Archiver, feeds types.Feeds,
 			case http.StatusOK: // 200
 				limitedReader := &io.LimitedReader{R: res.Body, N: conf.MaxFetchLimit}
 
+				isLocal := strings.HasPrefix(feed.URL, conf.BaseURL)
+
 				twter := types.Twter{Nick: feed.Nick}
-				if strings.HasPrefix(feed.URL, conf.BaseURL) {
+				if isLocal {
 					twter.URL = URLForUser(conf.BaseURL, feed.Nick)
 					twter.Avatar = URLForAvatar(conf.BaseURL, feed.Nick)
 				} else {
 					twter.URL = feed.URL
-					avatar := GetExternalAvatar(conf, feed.Nick, feed.URL)
-					if avatar != "" {
+					if HasExternalAvatar(conf, feed.URL) {
 						twter.Avatar = URLForExternalAvatar(conf, feed.URL)
 					}
 				}
+
+				// Archive twts (opportunistically)
+				archiveTwt := func(twt types.Twt) {
+					if !archive.Has(twt.Hash()) {
+						if err := archive.Archive(twt); err != nil {
+							log.WithError(err).Errorf("error archiving twt %s aborting", twt.Hash())
+							metrics.Counter("archive", "error").Inc()
+						} else {
+							metrics.Counter("archive", "size").Inc()
+						}
+					}
+				}
+
 				log.Debugf("cache: parsing %s for %s", feed.URL, twter)
-				twtFile, err := types.ParseFile(limitedReader, twter)
+				scanner := types.ScanFile(limitedReader, twter)
+
+				// The feed's metadata (nick, url, description, ...) is applied
+				// to its Twter as it is read, and precedes its twts. Once it's
+				// read download the avatar the feed advertises (in the
+				// background) if it has changed or there is no copy of it yet,
+				// or guess one for new feeds that don't advertise one.
+				ready := func() {
+					if isLocal {
+						return
+					}
+
+					source := scanner.File().Avatar()
+					missing := !HasExternalAvatar(conf, feed.URL)
+					if source == lastAvatar && !(missing && (source != "" || !seenBefore)) {
+						return
+					}
+
+					go func() {
+						if source != "" && DownloadExternalAvatar(conf, feed.URL, source) != "" {
+							return
+						}
+						GetExternalAvatar(conf, feed.Nick, feed.URL)
+					}()
+				}
+
+				// Twts the feed has deleted (as far as it's been read, markers
+				// precede its twts) are not archived. The feed's own twts are
+				// hashed with its Twter as it is when they're archived, which
+				// metadata further down the feed may still change, so their
+				// hashes are recorded by the Twter they were hashed with.
+				var (
+					deleted  map[string]bool
+					nDeleted = -1
+					archived = make(map[twtHashing][]string)
+				)
+				archiveOldTwt := func(twt types.Twt) {
+					if hashes := scanner.File().Deleted(); len(hashes) != nDeleted {
+						nDeleted = len(hashes)
+						deleted = make(map[string]bool, nDeleted)
+						for _, hash := range hashes {
+							deleted[hash] = true
+						}
+					}
+					if !deleted[twt.Hash()] {
+						archiveTwt(twt)
+						if twter := scanner.Twter(); twt.Twter().URL == twter.URL {
+							hashing := newTwtHashing(*twter)
+							archived[hashing] = append(archived[hashing], twt.Hash())
+						}
+					}
+				}
+
+				// Only the most recent twts are kept in memory, all others are
+				// archived as they are read.
+				twts, err = types.ScanTwts(
+					&feedScanner{TwtScanner: scanner, ready: ready},
+					conf.MaxCacheTTL, conf.MaxCacheItems, archiveOldTwt,
+				)
 				if err != nil {
 					log.WithError(err).Errorf("error parsing feed %s", feed)
 					twtsch <- nil
 					return
 				}
-				twts, old := types.SplitTwts(twtFile.Twts(), conf.MaxCacheTTL, conf.MaxCacheItems)
+				twtFile := scanner.File()
+
+				// Twts archived before the feed's metadata changed its Twter
+				// are re-archived under the hash of its final Twter
+				for hashing, hashes := range archived {
+					if hashing != newTwtHashing(*scanner.Twter()) {
+						rehashArchivedTwts(archive, *scanner.Twter(), hashes)
+					}
+				}
 
 				// If N == 0 we possibly exceeded conf.MaxFetchLimit when
 				// reading this feed. Log it and bump a cache_limited counter
@@ -300,21 +410,49 @@ func (cache *Cache) FetchTwts(conf *Config, archive Archiver, feeds types.Feeds,
 					metrics.Counter("cache", "limited").Inc()
 				}
 
-				// Archive twts (opportunistically)
-				archiveTwts := func(twts []types.Twt) {
-					for _, twt := range twts {
-						if !archive.Has(twt.Hash()) {
-							if err := archive.Archive(twt); err != nil {
-								log.WithError(err).Errorf("error archiving twt %s aborting", twt.Hash())
-								metrics.Counter("archive", "error").Inc()
-							} else {
-								metrics.Counter("archive", "size").Inc()
+				// Honour the feed's `# delete` and `# edit` markers. Deleted
+				// twts (and any earlier versions of them) are removed from
+				// the archive, replaced twts are kept as edit history. Only
+				// markers for the feed's own twts are honoured.
+				owned := feedTwtOwner(archive, feed.URL, twts)
+
+				edits := twtFile.Edits()
+				if len(edits) > maxFeedEdits {
+					edits = edits[len(edits)-maxFeedEdits:]
+				}
+				replaced := make(map[string]string)
+				hidden := make(map[string]bool)
+				for _, edit := range edits {
+					if !owned(edit.Hash) || !owned(edit.Replacement) {
+						continue
+					}
+					replaced[edit.Replacement] = edit.Hash
+					hidden[edit.Hash] = true
+				}
+				for _, hash := range twtFile.Deleted() {
+					for h := hash; h != ""; {
+						next := replaced[h]
+						delete(replaced, h)
+
+						if !owned(h) {
+							break
+						}
+
+						hidden[h] = true
+						if archive.Has(h) {
+							if err := archive.Del(h); err != nil {
+								log.WithError(err).Errorf("error removing deleted twt %s from archive", h)
 							}
 						}
+
+						h = next
 					}
 				}
-				archiveTwts(old)
-				archiveTwts(twts)
+
+				twts = hideTwts(twts, hidden)
+				for _, twt := range twts {
+					archiveTwt(twt)
+				}
 
 				lastmodified := res.Header.Get("Last-Modified")
 				cache.mu.Lock()
@@ -322,6 +460,8 @@ func (cache *Cache) FetchTwts(conf *Config, archive Archiver, feeds types.Feeds,
 					cache:        make(map[string]types.Twt),
 					Twts:         twts,
 					Lastmodified: lastmodified,
+					Edits:        replaced,
+					Avatar:       twtFile.Avatar(),
 				}
 				cache.mu.Unlock()
 			case http.StatusNotModified: // 304
@@ -463,6 +603,100 @@ func (cache *Cache) GetByURL(url string) types.Twts {
 	return types.Twts{}
 }
 
+// GetOlderByURL returns the twts of an external feed beyond what is cached,
+// up to at least n twts where the feed has that many. The feed is fetched in
+// full and its `# prev` links to archived feeds are followed as needed. All
+// twts fetched are archived.
+func (cache *Cache) GetOlderByURL(conf *Config, archive Archiver, feed types.Feed, n int) types.Twts {
+	cache.olderOnce.Do(func() {
+		cache.older = NewTTLCache(olderTwtsTTL)
+	})
+
+	if older, ok := cache.older.get(feed.URL).(olderTwts); ok && (older.complete || len(older.twts) >= n) {
+		return older.twts
+	}
+
+	twter := types.Twter{Nick: feed.Nick, URL: feed.URL}
+	if HasExternalAvatar(conf, feed.URL) {
+		twter.Avatar = URLForExternalAvatar(conf, feed.URL)
+	}
+
+	var twts types.Twts
+
+	seen := make(map[string]bool)
+	walked := map[string]bool{feed.URL: true}
+	uri := feed.URL
+	i := 0
+	for ; uri != "" && i < maxPrevFeeds && len(twts) < n; i++ {
+		twtFile, err := fetchTwtFile(conf, uri, twter)
+		if err != nil {
+			log.WithError(err).Warnf("error fetching feed %s", uri)
+			uri = ""
+			break
+		}
+
+		for _, twt := range twtFile.Twts() {
+			if seen[twt.Hash()] {
+				continue
+			}
+			seen[twt.Hash()] = true
+			twts = append(twts, twt)
+
+			if !archive.Has(twt.Hash()) {
+				if err := archive.Archive(twt); err != nil {
+					log.WithError(err).Errorf("error archiving twt %s", twt.Hash())
+				}
+			}
+		}
+
+		_, prev := twtFile.Prev()
+		uri = resolvePrevURL(uri, prev)
+		if walked[uri] {
+			uri = ""
+			break
+		}
+		walked[uri] = true
+	}
+
+	sort.Sort(twts)
+
+	// The feed's history is exhausted (or we gave up walking it) so there is
+	// no point refetching it until the twts expire
+	complete := uri == "" || i >= maxPrevFeeds
+	cache.older.set(feed.URL, olderTwts{twts: twts, complete: complete})
+
+	return twts
+}
+
+// olderTwts are the twts of an external feed beyond what is cached
+type olderTwts struct {
+	twts     types.Twts
+	complete bool
+}
+
+// GetEditHistory returns the previous versions of an edited twt, most
+// recent first, by following the `# edit` markers of its feed
+func (cache *Cache) GetEditHistory(archive Archiver, hash string) types.Twts {
+	var history types.Twts
+
+	seen := map[string]bool{hash: true}
+	for {
+		hash = cache.editOf(hash)
+		if hash == "" || seen[hash] {
+			break
+		}
+		seen[hash] = true
+
+		if twt, ok := cache.Lookup(hash); ok {
+			history = append(history, twt)
+		} else if twt, err := archive.Get(hash); err == nil {
+			history = append(history, twt)
+		}
+	}
+
+	return history
+}
+
 // Delete ...
 func (cache *Cache) Delete(feeds types.Feeds) {
 	cache.mu.Lock()
@@ -472,3 +706,145 @@ func (cache *Cache) Delete(feeds types.Feeds) {
 		delete(cache.Twts, feed.URL)
 	}
 }
+
+// feedScanner calls ready once before the first twt of a feed is returned,
+// by which time the metadata in the feed's preamble has been read
+type feedScanner struct {
+	types.TwtScanner
+	ready func()
+}
+
+// Next ...
+func (s *feedScanner) Next() (types.Twt, error) {
+	twt, err := s.TwtScanner.Next()
+	if s.ready != nil {
+		s.ready()
+		s.ready = nil
+	}
+	return twt, err
+}
+
+// editOf returns the hash of the twt the edited twt with the given hash
+// replaced, or an empty string if it isn't an edit
+func (cache *Cache) editOf(hash string) string {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	for _, cached := range cache.Twts {
+		if h, ok := cached.Edits[hash]; ok {
+			return h
+		}
+	}
+	return ""
+}
+
+// twtHashing is what a twt's hash depends on besides its content
+type twtHashing struct {
+	URL         string
+	HashVersion int
+}
+
+func newTwtHashing(twter types.Twter) twtHashing {
+	return twtHashing{URL: twter.URL, HashVersion: twter.HashVersion}
+}
+
+// rehashArchivedTwts moves the archived twts with the given hashes to the
+// hashes they have when posted by twter
+func rehashArchivedTwts(archive Archiver, twter types.Twter, hashes []string) {
+	for _, hash := range hashes {
+		old, err := archive.Get(hash)
+		if err != nil {
+			continue
+		}
+
+		twt := types.MakeTwt(twter, old.Created(), fmt.Sprintf("%t", old))
+		if twt.IsZero() || twt.Hash() == hash {
+			continue
+		}
+
+		if err := archive.Del(hash); err != nil {
+			log.WithError(err).Errorf("error removing twt %s from archive", hash)
+			continue
+		}
+		if archive.Has(twt.Hash()) {
+			continue
+		}
+		if err := archive.Archive(twt); err != nil {
+			log.WithError(err).Errorf("error archiving twt %s", twt.Hash())
+			metrics.Counter("archive", "error").Inc()
+		}
+	}
+}
+
+// feedTwtOwner returns a func reporting whether the twt with a given hash
+// was posted by the feed feedURL, looking it up in the feed's fetched twts
+// and the archive. Unknown twts aren't owned by anyone.
+func feedTwtOwner(archive Archiver, feedURL string, twts types.Twts) func(hash string) bool {
+	fetched := make(map[string]bool, len(twts))
+	for _, twt := range twts {
+		fetched[twt.Hash()] = true
+	}
+
+	feedURL = NormalizeURL(feedURL)
+	return func(hash string) bool {
+		if fetched[hash] {
+			return true
+		}
+		twt, err := archive.Get(hash)
+		if err != nil {
+			return false
+		}
+		return NormalizeURL(twt.Twter().URL) == feedURL
+	}
+}
+
+// hideTwts returns twts without those whose hash is hidden
+func hideTwts(twts types.Twts, hidden map[string]bool) types.Twts {
+	if len(hidden) == 0 {
+		return twts
+	}
+
+	var visible types.Twts
+	for _, twt := range twts {
+		if !hidden[twt.Hash()] {
+			visible = append(visible, twt)
+		}
+	}
+	return visible
+}
+
+// fetchTwtFile fetches and parses a (possibly archived) feed in full
+func fetchTwtFile(conf *Config, uri string, twter types.Twter) (types.TwtFile, error) {
+	res, err := Request(conf, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-success HTTP %s response for %s", res.Status, uri)
+	}
+
+	limitedReader := &io.LimitedReader{R: res.Body, N: conf.MaxFetchLimit}
+	return types.ParseFile(limitedReader, twter)
+}
+
+// resolvePrevURL resolves a `# prev` link (which may be relative) against
+// the URL of the feed it was found in
+func resolvePrevURL(uri, prev string) string {
+	if prev == "" {
+		return ""
+	}
+
+	base, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	ref, err := url.Parse(prev)
+	if err != nil {
+		return ""
+	}
+
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+var registerCacheMetricsOnce sync.Once
+
+// registerTestCacheMetrics registers the metrics updated by fetching feeds
+func registerTestCacheMetrics() {
+	registerCacheMetricsOnce.Do(func() {
+		metrics.NewGauge("cache", "sources", "Number of feed sources being fetched")
+		metrics.NewGauge("cache", "feeds", "Number of unique feeds in the global feed cache")
+		metrics.NewGauge("cache", "twts", "Number of active twts in the global feed cache")
+		metrics.NewGauge("cache", "last_processed_seconds", "Last processed timestamp")
+		metrics.NewCounter("cache", "limited", "Number of feed exceeding MaxFetchLimit")
+		metrics.NewCounter("archive", "size", "Number of archived twts")
+		metrics.NewCounter("archive", "error", "Number of errors archiving twts")
+	})
+}
+
+func TestFetchTwtsMarkers(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	registerTestCacheMetrics()
+
+	dir, err := ioutil.TempDir("", "twtxt-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive, err := NewDiskArchiver(filepath.Join(dir, "archive"))
+	require.NoError(t, err)
+
+	var feed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, feed)
+	}))
+	defer srv.Close()
+
+	alice := types.Twter{Nick: "alice", URL: srv.URL + "/twtxt.txt"}
+	bob := types.Twter{Nick: "bob", URL: "https://bob.example.com/twtxt.txt"}
+
+	ts := func(d int) time.Time { return time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	aliceOld := types.MakeTwt(alice, ts(1), "Hello")
+	aliceEdited := types.MakeTwt(alice, ts(2), "Helo World")
+	bobTwt := types.MakeTwt(bob, ts(3), "Hi from bob")
+	bobEdited := types.MakeTwt(bob, ts(4), "Bob's twt")
+	for _, twt := range []types.Twt{aliceOld, aliceEdited, bobTwt, bobEdited} {
+		require.NoError(t, archive.Archive(twt))
+	}
+
+	aliceNew := types.MakeTwt(alice, ts(5), "Hello World")
+	aliceOther := types.MakeTwt(alice, ts(6), "Something else")
+
+	feed = strings.Join([]string{
+		"# nick = alice",
+		lextwt.NewDeleteComment(aliceOld.Hash()).Literal() +
+			lextwt.NewDeleteComment(bobTwt.Hash()).Literal() +
+			lextwt.NewEditComment(aliceEdited.Hash(), aliceNew.Hash()).Literal() +
+			lextwt.NewEditComment(bobEdited.Hash(), aliceOther.Hash()).Literal(),
+		"2021-01-05T00:00:00Z\tHello World",
+		"2021-01-06T00:00:00Z\tSomething else",
+		"",
+	}, "\n")
+
+	cache := &Cache{Twts: make(map[string]*Cached)}
+	conf := &Config{BaseURL: "https://example.com", MaxFetchLimit: 1 << 20, MaxCacheTTL: time.Hour * 24 * 365 * 10, MaxCacheItems: 100}
+	cache.FetchTwts(conf, archive, types.Feeds{types.Feed{Nick: "alice", URL: alice.URL}: true}, nil)
+
+	// Markers are only honoured for the feed's own twts
+	assert.False(archive.Has(aliceOld.Hash()))
+	assert.True(archive.Has(bobTwt.Hash()))
+
+	history := cache.GetEditHistory(archive, aliceNew.Hash())
+	require.Len(t, history, 1)
+	assert.Equal(aliceEdited.Hash(), history[0].Hash())
+	assert.Empty(cache.GetEditHistory(archive, aliceOther.Hash()))
+}
+
+func TestFetchTwtsLateMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	registerTestCacheMetrics()
+
+	dir, err := ioutil.TempDir("", "twtxt-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive, err := NewDiskArchiver(filepath.Join(dir, "archive"))
+	require.NoError(t, err)
+
+	// The feed advertises its url only after its first twts, all of which
+	// are old enough to be archived as they are read
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join([]string{
+			"2021-01-01T00:00:00Z\tHello @<bob https://bob.example.com/twtxt.txt>",
+			"2021-01-02T00:00:00Z\tHello World",
+			"# url = https://alice.example.com/twtxt.txt",
+			"2021-01-03T00:00:00Z\tHello again",
+			"",
+		}, "\n"))
+	}))
+	defer srv.Close()
+
+	cache := &Cache{Twts: make(map[string]*Cached)}
+	conf := &Config{BaseURL: "https://example.com", MaxFetchLimit: 1 << 20, MaxCacheTTL: time.Hour, MaxCacheItems: 100}
+	cache.FetchTwts(conf, archive, types.Feeds{types.Feed{Nick: "alice", URL: srv.URL + "/twtxt.txt"}: true}, nil)
+
+	ts := func(d int) time.Time { return time.Date(2021, 1, d, 0, 0, 0, 0, time.UTC) }
+	alice := types.Twter{Nick: "alice", URL: "https://alice.example.com/twtxt.txt"}
+	stale := types.Twter{Nick: "alice", URL: srv.URL + "/twtxt.txt"}
+
+	for d, text := range map[int]string{
+		1: "Hello @<bob https://bob.example.com/twtxt.txt>",
+		2: "Hello World",
+		3: "Hello again",
+	} {
+		twt := types.MakeTwt(alice, ts(d), text)
+		require.True(t, archive.Has(twt.Hash()), text)
+		assert.False(archive.Has(types.MakeTwt(stale, ts(d), text).Hash()), text)
+
+		archived, err := archive.Get(twt.Hash())
+		require.NoError(t, err)
+		assert.Equal(alice.URL, archived.Twter().URL)
+		assert.Equal(text, fmt.Sprintf("%t", archived))
+	}
+
+	count, err := archive.Count()
+	require.NoError(t, err)
+	assert.Equal(3, count)
+}
+
+func TestFetchTwtsExternalAvatar(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	registerTestCacheMetrics()
+
+	dir, err := ioutil.TempDir("", "twtxt-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive, err := NewDiskArchiver(filepath.Join(dir, "archive"))
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		avatar  = "/avatar.png"
+		fetches = make(map[string]int)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/twtxt.txt" {
+			fmt.Fprintf(w, "# nick = alice\n# avatar = %s\n2021-01-01T00:00:00Z\tHello\n", avatar)
+			return
+		}
+
+		fetches[r.URL.Path]++
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, image.NewRGBA(image.Rect(0, 0, 64, 64)))
+	}))
+	defer srv.Close()
+
+	uri := srv.URL + "/twtxt.txt"
+	conf := &Config{Data: dir, BaseURL: "https://example.com", MaxFetchLimit: 1 << 20, MaxCacheTTL: time.Hour * 24 * 365 * 10, MaxCacheItems: 100}
+	downloaded := func(path string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return fetches[path] > 0 && HasExternalAvatar(conf, uri)
+		}
+	}
+
+	cache := &Cache{Twts: make(map[string]*Cached)}
+	fetch := func() types.Twts {
+		cache.FetchTwts(conf, archive, types.Feeds{types.Feed{Nick: "alice", URL: uri}: true}, nil)
+		return cache.Twts[uri].Twts
+	}
+
+	// The advertised avatar is downloaded in the background and not
+	// referred to directly
+	twts := fetch()
+	require.Len(t, twts, 1)
+	assert.Empty(twts[0].Twter().Avatar)
+	assert.Eventually(downloaded("/avatar.png"), 5*time.Second, 10*time.Millisecond)
+
+	// ... and once downloaded the pod's copy is used
+	twts = fetch()
+	require.Len(t, twts, 1)
+	assert.Equal(URLForExternalAvatar(conf, uri), twts[0].Twter().Avatar)
+
+	// The avatar is only downloaded again when it changes
+	mu.Lock()
+	assert.Equal(1, fetches["/avatar.png"])
+	avatar = "/avatar2.png"
+	mu.Unlock()
+
+	fetch()
+	assert.Eventually(downloaded("/avatar2.png"), 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(1, fetches["/avatar.png"])
+	mu.Unlock()
+}
+
+func TestAppendTwtMarkerPrunes(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-markers-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir}
+	for i := 0; i < maxTwtMarkers+10; i++ {
+		require.NoError(t, RecordTwtDelete(conf, "alice", fmt.Sprintf("hash%d", i)))
+	}
+
+	markers := strings.Split(strings.TrimSpace(GetTwtMarkers(conf, "alice")), "\n")
+	assert.Len(markers, maxTwtMarkers)
+	assert.Equal("# delete = hash10", markers[0])
+	assert.Equal(fmt.Sprintf("# delete = hash%d", maxTwtMarkers+9), markers[len(markers)-1])
+}
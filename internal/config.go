@@ -9,6 +9,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gabstv/merger"
@@ -43,6 +44,7 @@ type Config struct {
 	Logo              string
 	Description       string
 	Store             string
+	MediaStore        string
 	Theme             string
 	Lang              string
 	BaseURL           string
@@ -56,6 +58,7 @@ type Config struct {
 	TwtsPerPage       int
 	MaxUploadSize     int64
 	MaxTwtLength      int
+	MediaQuota        int64
 	MaxCacheTTL       time.Duration
 	FetchInterval     string
 	MaxCacheItems     int
@@ -66,11 +69,18 @@ type Config struct {
 	SessionCacheTTL   time.Duration
 	TranscoderTimeout time.Duration
 
+	OrphanedMediaGracePeriod time.Duration
+	DeleteOrphanedMedia      bool
+
+	TaskRetention time.Duration
+
 	MagicLinkSecret string
 
 	SMTPBind string
 	POP3Bind string
 
+	FingerBind string
+
 	SMTPHost string
 	SMTPPort int
 	SMTPUser string
@@ -82,8 +92,16 @@ type Config struct {
 	APISessionTime time.Duration
 	APISigningKey  string
 
+	// TwtHashVersion is the version of the hash local twts are hashed with
+	// and advertised by local feeds with `# hash_version`. Only versions
+	// every pod knows are supported, so others compute the same hashes.
+	TwtHashVersion int
+
 	baseURL *url.URL
 
+	media     MediaStore
+	mediaOnce sync.Once
+
 	whitelistedDomains []*regexp.Regexp
 	WhitelistedDomains []string
 
@@ -143,6 +161,10 @@ func (c *Config) RandomTwtPrompt() string {
 // Validate validates the configuration is valid which for the most part
 // just ensures that default secrets are actually configured correctly
 func (c *Config) Validate() error {
+	if _, ok := types.LookupTwtHashVersion(c.TwtHashVersion); !ok {
+		return fmt.Errorf("error: unknown twt hash version %d", c.TwtHashVersion)
+	}
+
 	if c.Debug {
 		return nil
 	}
@@ -27,6 +27,21 @@ type Meta struct {
 	Keywords    string
 }
 
+// IndieAuthRequest is an IndieAuth (or Mastodon API OAuth) authorization
+// request made by a client that the user is asked to approve
+type IndieAuthRequest struct {
+	Me                  string
+	ClientID            string
+	ClientName          string
+	RedirectURI         string
+	State               string
+	ResponseType        string
+	Scope               string
+	Scopes              []string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
 type Context struct {
 	Config string
 
@@ -72,6 +87,15 @@ type Context struct {
 	Messages    Messages
 	NewMessages int
 
+	// Uploaded media storage used and the quota (empty if unlimited)
+	MediaUsage string
+	MediaQuota string
+
+	// Queued, running and failed tasks (See: ManageTasksHandler)
+	RunningTasks []*TaskRecord
+	QueuedTasks  []*TaskRecord
+	FailedTasks  []*TaskRecord
+
 	Twter       types.Twter
 	Twts        types.Twts
 	BlogPost    *BlogPost
@@ -87,6 +111,9 @@ type Context struct {
 	// Reset Password Token
 	PasswordResetToken string
 
+	// IndieAuth authorization request
+	IndieAuth IndieAuthRequest
+
 	// CSRF Token
 	CSRFToken string
 }
@@ -122,13 +149,7 @@ func NewContext(conf *Config, db Store, req *http.Request) *Context {
 			Description: conf.Description,
 		},
 
-		Alternatives: types.Alternatives{
-			types.Alternative{
-				Type:  "application/atom+xml",
-				Title: fmt.Sprintf("%s local feed", conf.Name),
-				URL:   fmt.Sprintf("%s/atom.xml", conf.BaseURL),
-			},
-		},
+		Alternatives: syndicationAlternatives(fmt.Sprintf("%s local", conf.Name), conf.BaseURL, nil),
 	}
 
 	ctx.CSRFToken = nosurf.Token(req)
@@ -47,6 +47,12 @@ func (s *Server) ConversationHandler() httprouter.Handle {
 		}
 
 		if twt.IsZero() {
+			// Redirect to the twt's new hash if it has been re-keyed
+			if newHash, ok := LookupMigratedTwtHash(s.config, hash); ok {
+				http.Redirect(w, r, fmt.Sprintf("%s/conv/%s", strings.TrimSuffix(s.config.BaseURL, "/"), newHash), http.StatusMovedPermanently)
+				return
+			}
+
 			ctx.Error = true
 			ctx.Message = "No matching twt found!"
 			s.render("404", w, ctx)
@@ -68,7 +74,7 @@ func (s *Server) ConversationHandler() httprouter.Handle {
 		}
 
 		when := twt.Created().Format(time.RFC3339)
-		what := twt.FormatText(types.TextFmt, s.config)
+		what := FormatTwtTextFactory(s.config)(twt)
 
 		var ks []string
 		if ks, err = keywords.Extract(what); err != nil {
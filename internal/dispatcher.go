@@ -2,6 +2,18 @@ package internal
 
 import (
 	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTaskInterrupted    = errors.New("error: task interrupted by restart")
+	ErrTaskCancelled      = errors.New("error: task cancelled")
+	ErrTaskFinished       = errors.New("error: task already finished")
+	ErrTaskNotCancellable = errors.New("error: task cannot be cancelled")
 )
 
 // Dispatcher maintains a pool for available workers
@@ -11,29 +23,47 @@ type Dispatcher struct {
 	maxQueue   int
 	workers    []*Worker
 	workerPool chan chan Task
-	taskQueue  chan Task
+	taskQueues [TaskPriorityHigh + 1]chan Task
 	taskMap    map[string]Task
+	taskMu     sync.RWMutex
 	quit       chan bool
 	active     bool
+
+	// store records tasks if set (See: NewPersistentDispatcher)
+	store     Store
+	factories map[string]TaskFactory
 }
 
 // NewDispatcher creates a new dispatcher with the given
-// number of workers and buffers the task queue based on maxQueue.
-// It also initializes the channels for the worker pool and task queue
+// number of workers and buffers the task queue of each priority based on
+// maxQueue. It also initializes the channels for the worker pool and task
+// queues
 func NewDispatcher(maxWorkers int, maxQueue int) *Dispatcher {
 	return &Dispatcher{
 		maxWorkers: maxWorkers,
 		maxQueue:   maxQueue,
+		factories:  make(map[string]TaskFactory),
 	}
 }
 
+// NewPersistentDispatcher creates a new dispatcher like NewDispatcher that
+// records the state of tasks in store, so tasks can be looked up after a
+// restart and unfinished resumable tasks resumed (See: Resume)
+func NewPersistentDispatcher(store Store, maxWorkers int, maxQueue int) *Dispatcher {
+	d := NewDispatcher(maxWorkers, maxQueue)
+	d.store = store
+	return d
+}
+
 // Start creates and starts workers, adding them to the worker pool.
-// Then, it starts a select loop to wait for tasks to be dispatched
-// to available workers
+// Then, it starts a select loop to wait for available workers and dispatch
+// the queued task with the highest priority to them
 func (d *Dispatcher) Start() {
 	d.workers = []*Worker{}
 	d.workerPool = make(chan chan Task, d.maxWorkers)
-	d.taskQueue = make(chan Task, d.maxQueue)
+	for priority := range d.taskQueues {
+		d.taskQueues[priority] = make(chan Task, d.maxQueue)
+	}
 	d.taskMap = make(map[string]Task)
 	d.quit = make(chan bool)
 
@@ -48,10 +78,15 @@ func (d *Dispatcher) Start() {
 	go func() {
 		for {
 			select {
-			case task := <-d.taskQueue:
+			case taskChannel := <-d.workerPool:
+				task, ok := d.next()
+				if !ok {
+					return
+				}
+				// The worker may have been stopped, so don't block the loop
+				// (and Stop) handing it the task
 				go func(task Task) {
-					taskChannel := <-d.workerPool
-					taskChannel <- task
+					taskChannel <- d.track(task)
 				}(task)
 			case <-d.quit:
 				return
@@ -60,6 +95,34 @@ func (d *Dispatcher) Start() {
 	}()
 }
 
+// next waits for the queued task with the highest priority, it returns false
+// if the dispatcher was stopped while waiting
+func (d *Dispatcher) next() (Task, bool) {
+	for priority := TaskPriorityHigh; priority >= TaskPriorityLow; priority-- {
+		select {
+		case task := <-d.taskQueues[priority]:
+			return task, true
+		default:
+		}
+	}
+
+	select {
+	case task := <-d.taskQueues[TaskPriorityHigh]:
+		return task, true
+	case task := <-d.taskQueues[TaskPriorityNormal]:
+		return task, true
+	case task := <-d.taskQueues[TaskPriorityLow]:
+		return task, true
+	case <-d.quit:
+		return nil, false
+	}
+}
+
+// enqueue pushes the given task into the task queue for its priority
+func (d *Dispatcher) enqueue(task Task) {
+	d.taskQueues[taskPriority(task)] <- task
+}
+
 // Stop ends execution for all workers and closes all channels, then removes
 // all workers
 func (d *Dispatcher) Stop() {
@@ -77,21 +140,45 @@ func (d *Dispatcher) Stop() {
 	d.quit <- true
 }
 
-// Lookup returns the matching `Task` given its id
+// Lookup returns the matching `Task` given its id, tasks that have finished
+// are looked up from their record if the dispatcher records tasks
 func (d *Dispatcher) Lookup(id string) (Task, bool) {
+	d.taskMu.RLock()
 	task, ok := d.taskMap[id]
-	return task, ok
+	d.taskMu.RUnlock()
+
+	if ok || d.store == nil {
+		return task, ok
+	}
+
+	record, err := d.store.GetTask(id)
+	if err != nil {
+		if err != ErrTaskNotFound {
+			log.WithError(err).Errorf("error loading task %s", id)
+		}
+		return nil, false
+	}
+
+	return &recordedTask{record: record}, true
 }
 
-// Dispatch pushes the given task into the task queue.
-// The first available worker will perform the task
+// Dispatch pushes the given task into the task queue for its priority.
+// The first available worker will perform the task once no tasks with a
+// higher priority are queued
 func (d *Dispatcher) Dispatch(task Task) (string, error) {
 	if !d.active {
 		return "", errors.New("dispatcher is not active")
 	}
 
-	d.taskQueue <- task
+	if err := d.record(task, TaskStatePending); err != nil {
+		log.WithError(err).Errorf("error recording task %s", task)
+	}
+
+	d.taskMu.Lock()
 	d.taskMap[task.ID()] = task
+	d.taskMu.Unlock()
+
+	d.enqueue(task)
 	return task.ID(), nil
 }
 
@@ -100,3 +187,357 @@ func (d *Dispatcher) Dispatch(task Task) (string, error) {
 func (d *Dispatcher) DispatchFunc(f func() error) (string, error) {
 	return d.Dispatch(NewFuncTask(f))
 }
+
+// Cancel cancels the task given its id, see CancellableTask
+func (d *Dispatcher) Cancel(id string) error {
+	d.taskMu.RLock()
+	task, ok := d.taskMap[id]
+	d.taskMu.RUnlock()
+
+	if !ok {
+		if _, ok := d.Lookup(id); ok {
+			return ErrTaskFinished
+		}
+		return ErrTaskNotFound
+	}
+
+	cancellable, ok := task.(CancellableTask)
+	if !ok {
+		return ErrTaskNotCancellable
+	}
+
+	switch task.State() {
+	case TaskStateComplete, TaskStateFailed, TaskStateCancelled:
+		return ErrTaskFinished
+	}
+
+	cancellable.Cancel()
+
+	// Pending tasks are cancelled immediately and skipped once dequeued
+	if task.State() == TaskStateCancelled {
+		d.finish(task)
+	}
+
+	return nil
+}
+
+// Tasks returns the records of all queued, running and recorded tasks with
+// running tasks first, then queued tasks and then finished tasks each most
+// recent first
+func (d *Dispatcher) Tasks() ([]*TaskRecord, error) {
+	records := make(map[string]*TaskRecord)
+
+	if d.store != nil {
+		recorded, err := d.store.GetAllTasks()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range recorded {
+			records[record.ID] = record
+		}
+	}
+
+	d.taskMu.RLock()
+	tasks := make([]Task, 0, len(d.taskMap))
+	for _, task := range d.taskMap {
+		tasks = append(tasks, task)
+	}
+	d.taskMu.RUnlock()
+
+	for _, task := range tasks {
+		record, ok := records[task.ID()]
+		if !ok {
+			record = newTaskRecord(task)
+			records[task.ID()] = record
+		}
+		updateTaskRecord(record, task, task.State())
+	}
+
+	var all []*TaskRecord
+	for _, record := range records {
+		all = append(all, record)
+	}
+
+	order := map[TaskState]int{
+		TaskStateRunning:   0,
+		TaskStatePending:   1,
+		TaskStateFailed:    2,
+		TaskStateCancelled: 2,
+		TaskStateComplete:  2,
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if order[all[i].State] != order[all[j].State] {
+			return order[all[i].State] < order[all[j].State]
+		}
+		return all[i].Updated.After(all[j].Updated)
+	})
+
+	return all, nil
+}
+
+// RegisterTask registers the factory recreating resumable tasks of the given
+// kind when they are resumed
+func (d *Dispatcher) RegisterTask(kind string, factory TaskFactory) {
+	d.factories[kind] = factory
+}
+
+// Resume dispatches the recorded tasks that had not finished when the pod
+// last stopped in the order they were first dispatched with a low priority,
+// tasks that cannot be resumed are recorded as failed
+func (d *Dispatcher) Resume() error {
+	if d.store == nil {
+		return nil
+	}
+
+	records, err := d.store.GetAllTasks()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created.Before(records[j].Created)
+	})
+
+	for _, record := range records {
+		if record.Finished() {
+			continue
+		}
+
+		d.taskMu.RLock()
+		_, ok := d.taskMap[record.ID]
+		d.taskMu.RUnlock()
+		if ok {
+			continue
+		}
+
+		task, err := d.recreate(record)
+		if err != nil {
+			log.WithError(err).Warnf("error resuming task %s", record.ID)
+
+			record.State = TaskStateFailed
+			record.Error = err.Error()
+			record.Updated = time.Now()
+			if err := d.store.SetTask(record.ID, record); err != nil {
+				log.WithError(err).Errorf("error recording task %s", record.ID)
+			}
+			continue
+		}
+
+		// Nobody is waiting for tasks resumed after a restart
+		if prioritized, ok := task.(interface{ SetPriority(TaskPriority) }); ok {
+			prioritized.SetPriority(TaskPriorityLow)
+		}
+
+		log.Infof("resuming task %s", task)
+		if _, err := d.Dispatch(task); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recreate recreates the resumable task recorded by record
+func (d *Dispatcher) recreate(record *TaskRecord) (Task, error) {
+	factory, ok := d.factories[record.Kind]
+	if !ok {
+		return nil, ErrTaskInterrupted
+	}
+
+	task, err := factory(record.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := task.(interface{ restore(record *TaskRecord) })
+	if !ok {
+		return nil, ErrTaskInterrupted
+	}
+	t.restore(record)
+
+	return task, nil
+}
+
+// record records the task as being in the given state
+func (d *Dispatcher) record(task Task, state TaskState) error {
+	if d.store == nil {
+		return nil
+	}
+
+	record, err := d.store.GetTask(task.ID())
+	if err == ErrTaskNotFound {
+		record = newTaskRecord(task)
+	} else if err != nil {
+		return err
+	}
+
+	updateTaskRecord(record, task, state)
+	record.Updated = time.Now()
+
+	return d.store.SetTask(task.ID(), record)
+}
+
+// finish records the final state of a task that has finished running or was
+// cancelled and cleans up after it if it did not complete
+func (d *Dispatcher) finish(task Task) {
+	state := task.State()
+
+	if state != TaskStateComplete {
+		if cleanup, ok := task.(CleanupTask); ok {
+			cleanup.Cleanup()
+		}
+	}
+
+	// Finished tasks are looked up from their record from now on
+	if err := d.record(task, state); err != nil {
+		log.WithError(err).Errorf("error recording task %s", task)
+	} else if d.store != nil {
+		d.taskMu.Lock()
+		delete(d.taskMap, task.ID())
+		d.taskMu.Unlock()
+	}
+}
+
+// retry queues the task to be run again if it failed and its retry policy
+// permits another attempt, it returns false otherwise
+func (d *Dispatcher) retry(task Task, attempt int) bool {
+	retryable, ok := task.(RetryableTask)
+	if !ok || task.State() != TaskStateFailed {
+		return false
+	}
+
+	policy := retryable.RetryPolicy()
+	if attempt >= policy.MaxAttempts {
+		return false
+	}
+	if policy.Retryable != nil && !policy.Retryable(task.Error()) {
+		return false
+	}
+
+	resettable, ok := task.(interface{ reset() })
+	if !ok {
+		return false
+	}
+
+	delay := policy.Delay(attempt)
+	log.WithError(task.Error()).Warnf(
+		"task %s failed on attempt %d of %d, retrying in %s",
+		task, attempt, policy.MaxAttempts, delay,
+	)
+
+	// The error the task failed with is recorded until it is retried
+	if err := d.record(task, TaskStatePending); err != nil {
+		log.WithError(err).Errorf("error recording task %s", task)
+	}
+	resettable.reset()
+
+	time.AfterFunc(delay, func() {
+		if d.active {
+			d.enqueue(task)
+		}
+	})
+
+	return true
+}
+
+// track returns task wrapped so its state is recorded as it runs and it is
+// retried or cleaned up after if it fails
+func (d *Dispatcher) track(task Task) Task {
+	return &trackedTask{Task: task, d: d}
+}
+
+// trackedTask is a task whose state is recorded as it runs
+type trackedTask struct {
+	Task
+
+	d *Dispatcher
+}
+
+func (t *trackedTask) Run() error {
+	// Cancelled whilst queued
+	if t.Task.State() == TaskStateCancelled {
+		return nil
+	}
+
+	attempt := 1
+	if a, ok := t.Task.(interface{ attempt() int }); ok {
+		attempt = a.attempt()
+	}
+
+	if err := t.d.record(t.Task, TaskStateRunning); err != nil {
+		log.WithError(err).Errorf("error recording task %s", t.Task)
+	}
+
+	err := t.Task.Run()
+
+	if !t.d.retry(t.Task, attempt) {
+		t.d.finish(t.Task)
+	}
+
+	return err
+}
+
+// newTaskRecord returns a new record of task
+func newTaskRecord(task Task) *TaskRecord {
+	now := time.Now()
+	record := &TaskRecord{ID: task.ID(), Created: now, Updated: now}
+	if resumable, ok := task.(ResumableTask); ok {
+		record.Kind = resumable.Kind()
+		record.Args = resumable.Args()
+	}
+	return record
+}
+
+// updateTaskRecord updates the record of task as being in the given state
+func updateTaskRecord(record *TaskRecord, task Task, state TaskState) {
+	result := task.Result()
+
+	record.Priority = taskPriority(task)
+	if t, ok := task.(interface{ Attempts() int }); ok {
+		record.Attempts = t.Attempts()
+	}
+
+	record.State = state
+	record.Error = result.Error
+	record.Data = result.Data
+}
+
+// taskPriority returns the priority of task
+func taskPriority(task Task) TaskPriority {
+	prioritized, ok := task.(PrioritizedTask)
+	if !ok {
+		return TaskPriorityNormal
+	}
+
+	priority := prioritized.Priority()
+	if priority < TaskPriorityLow {
+		return TaskPriorityLow
+	}
+	if priority > TaskPriorityHigh {
+		return TaskPriorityHigh
+	}
+	return priority
+}
+
+// ExpireTasks deletes the records of tasks that finished longer than
+// retention ago and returns how many were deleted
+func ExpireTasks(store Store, retention time.Duration) (int, error) {
+	records, err := store.GetAllTasks()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, record := range records {
+		if !record.Finished() || time.Since(record.Updated) < retention {
+			continue
+		}
+		if err := store.DelTask(record.ID); err != nil {
+			log.WithError(err).Errorf("error deleting task %s", record.ID)
+			continue
+		}
+		expired++
+	}
+
+	return expired, nil
+}
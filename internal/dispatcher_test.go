@@ -1,11 +1,16 @@
 package internal
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDispatcher_Dispatch(t *testing.T) {
@@ -108,3 +113,270 @@ func TestDispatcher_Stop(t *testing.T) {
 	})
 	assert.NotNil(t, err)
 }
+
+func TestDispatcher_StopStoppedWorker(t *testing.T) {
+	d := NewDispatcher(1, 3)
+	d.Start()
+
+	// Hand a task to a worker that has been stopped
+	d.workers[0].Stop()
+	time.Sleep(time.Millisecond * 100)
+	_, err := d.DispatchFunc(func() error { return nil })
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("dispatcher did not stop")
+	}
+}
+
+type echoTask struct {
+	*BaseTask
+
+	msg string
+}
+
+func (t *echoTask) Kind() string   { return "echo" }
+func (t *echoTask) Args() TaskData { return TaskData{"msg": t.msg} }
+func (t *echoTask) Run() error {
+	defer t.Done()
+	t.SetState(TaskStateRunning)
+
+	t.SetData("msg", t.msg)
+	return nil
+}
+
+func TestDispatcher_Persistent(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-tasks-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewStore("bitcask://" + dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	d := NewPersistentDispatcher(db, 1, 3)
+	d.Start()
+	defer d.Stop()
+
+	id, err := d.Dispatch(&echoTask{BaseTask: NewBaseTask(), msg: "hello"})
+	require.NoError(t, err)
+	failed, err := d.DispatchFunc(func() error { return errors.New("error: boom") })
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+
+	// Finished tasks are looked up from their record
+	task, ok := d.Lookup(id)
+	require.True(t, ok)
+	assert.Equal(TaskStateComplete, task.State())
+	assert.Equal("hello", task.Result().Data["msg"])
+
+	record, err := db.GetTask(id)
+	require.NoError(t, err)
+	assert.Equal("echo", record.Kind)
+	assert.Equal("hello", record.Args["msg"])
+
+	task, ok = d.Lookup(failed)
+	require.True(t, ok)
+	assert.Equal(TaskStateFailed, task.State())
+	assert.Equal("error: boom", task.Result().Error)
+
+	// Unfinished tasks are resumed if they can be recreated, otherwise failed
+	pending := &TaskRecord{
+		ID: "pending", Kind: "echo", Args: TaskData{"msg": "resumed"},
+		State: TaskStatePending, Created: time.Now(), Updated: time.Now(),
+	}
+	require.NoError(t, db.SetTask(pending.ID, pending))
+	running := &TaskRecord{
+		ID: "running", State: TaskStateRunning, Created: time.Now(), Updated: time.Now(),
+	}
+	require.NoError(t, db.SetTask(running.ID, running))
+
+	d.RegisterTask("echo", func(args TaskData) (Task, error) {
+		return &echoTask{BaseTask: NewBaseTask(), msg: args["msg"]}, nil
+	})
+	require.NoError(t, d.Resume())
+
+	time.Sleep(time.Millisecond * 100)
+
+	task, ok = d.Lookup("pending")
+	require.True(t, ok)
+	assert.Equal(TaskStateComplete, task.State())
+	assert.Equal("resumed", task.Result().Data["msg"])
+
+	// Nobody is waiting for resumed tasks
+	record, err = db.GetTask("pending")
+	require.NoError(t, err)
+	assert.Equal(TaskPriorityLow, record.Priority)
+
+	task, ok = d.Lookup("running")
+	require.True(t, ok)
+	assert.Equal(TaskStateFailed, task.State())
+	assert.Equal(ErrTaskInterrupted.Error(), task.Result().Error)
+
+	// Only tasks finished longer than the retention period ago are expired
+	expired, err := ExpireTasks(db, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(0, expired)
+
+	expired, err = ExpireTasks(db, 0)
+	require.NoError(t, err)
+	assert.Equal(4, expired)
+
+	_, ok = d.Lookup(id)
+	assert.False(ok)
+}
+
+type flakyTask struct {
+	*BaseTask
+
+	failures  int
+	cleanups  int32
+	retryable func(err error) bool
+}
+
+func (t *flakyTask) RetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond * 10, Retryable: t.retryable}
+}
+func (t *flakyTask) Cleanup() { atomic.AddInt32(&t.cleanups, 1) }
+func (t *flakyTask) Run() error {
+	defer t.Done()
+	t.SetState(TaskStateRunning)
+
+	if t.Attempts() <= t.failures {
+		return t.Fail(errors.New("error: flaky"))
+	}
+	return nil
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	assert := assert.New(t)
+
+	d := NewDispatcher(1, 3)
+	d.Start()
+	defer d.Stop()
+
+	recovers := &flakyTask{BaseTask: NewBaseTask(), failures: 2}
+	_, err := d.Dispatch(recovers)
+	require.NoError(t, err)
+
+	fails := &flakyTask{BaseTask: NewBaseTask(), failures: 3}
+	_, err = d.Dispatch(fails)
+	require.NoError(t, err)
+
+	permanent := &flakyTask{BaseTask: NewBaseTask(), failures: 3, retryable: func(error) bool { return false }}
+	_, err = d.Dispatch(permanent)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 200)
+
+	assert.Equal(TaskStateComplete, recovers.State())
+	assert.Equal(3, recovers.Attempts())
+	assert.Equal(int32(0), atomic.LoadInt32(&recovers.cleanups))
+
+	assert.Equal(TaskStateFailed, fails.State())
+	assert.Equal(3, fails.Attempts())
+	assert.Equal(int32(1), atomic.LoadInt32(&fails.cleanups))
+
+	// Only transient failures are retried
+	assert.Equal(TaskStateFailed, permanent.State())
+	assert.Equal(1, permanent.Attempts())
+	assert.Equal(int32(1), atomic.LoadInt32(&permanent.cleanups))
+
+	assert.True(mediaTaskRetryPolicy.Retryable(&ErrTranscodeTimeout{Err: errors.New("error: killed")}))
+	assert.False(mediaTaskRetryPolicy.Retryable(&ErrTranscodeFailed{Err: errors.New("error: invalid data")}))
+	assert.False(mediaTaskRetryPolicy.Retryable(ErrInvalidVideo))
+
+	policy := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(time.Second, policy.Delay(1))
+	assert.Equal(4*time.Second, policy.Delay(3))
+	assert.Equal(5*time.Second, policy.Delay(4))
+}
+
+func TestDispatcher_Priority(t *testing.T) {
+	assert := assert.New(t)
+
+	d := NewDispatcher(1, 3)
+	d.Start()
+	defer d.Stop()
+
+	block := make(chan struct{})
+	_, _ = d.DispatchFunc(func() error {
+		<-block
+		return nil
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	var (
+		mu    sync.Mutex
+		order []TaskPriority
+	)
+
+	for _, priority := range []TaskPriority{TaskPriorityLow, TaskPriorityNormal, TaskPriorityHigh} {
+		priority := priority
+		task := NewFuncTask(func() error {
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+			return nil
+		})
+		task.SetPriority(priority)
+		_, err := d.Dispatch(task)
+		require.NoError(t, err)
+	}
+
+	close(block)
+	time.Sleep(time.Millisecond * 100)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal([]TaskPriority{TaskPriorityHigh, TaskPriorityNormal, TaskPriorityLow}, order)
+}
+
+func TestDispatcher_Cancel(t *testing.T) {
+	assert := assert.New(t)
+
+	d := NewDispatcher(1, 3)
+	d.Start()
+	defer d.Stop()
+
+	var running *FuncTask
+	running = NewFuncTask(func() error {
+		<-running.Context().Done()
+		return running.Context().Err()
+	})
+	runningID, err := d.Dispatch(running)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 10)
+
+	pending := &flakyTask{BaseTask: NewBaseTask()}
+	pendingID, err := d.Dispatch(pending)
+	require.NoError(t, err)
+
+	// Pending tasks are cancelled immediately and never run
+	require.NoError(t, d.Cancel(pendingID))
+	assert.Equal(TaskStateCancelled, pending.State())
+	assert.Equal(ErrTaskCancelled, pending.Error())
+	assert.Equal(int32(1), atomic.LoadInt32(&pending.cleanups))
+
+	// Running tasks are cancelled via their context
+	require.NoError(t, d.Cancel(runningID))
+
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Equal(TaskStateCancelled, running.State())
+	assert.Equal(0, pending.Attempts())
+	assert.Equal(ErrTaskFinished, d.Cancel(runningID))
+	assert.Equal(ErrTaskNotFound, d.Cancel("unknown"))
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	// fingerTimeout is the maximum time allowed to read a query and write a response
+	fingerTimeout = 30 * time.Second
+
+	// fingerMaxQuery is the maximum length of a finger query (RFC 1288 doesn't
+	// specify one so we pick something sane to avoid abuse)
+	fingerMaxQuery = 512
+
+	// fingerVerboseTwts is the number of latest twts shown for verbose (/W) queries
+	fingerVerboseTwts = 5
+)
+
+// FingerService is a Finger (RFC 1288) responder that returns public
+// information about users of the pod.
+type FingerService struct {
+	sync.Mutex
+
+	config *Config
+	db     Store
+
+	listener net.Listener
+}
+
+// NewFingerService ...
+func NewFingerService(config *Config, db Store) *FingerService {
+	svc := &FingerService{config: config, db: db}
+
+	return svc
+}
+
+func (s *FingerService) Start() {
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			log.WithError(err).Error("error running Finger service")
+		}
+	}()
+}
+
+func (s *FingerService) Stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			log.WithError(err).Error("error closing Finger listener")
+		}
+		s.listener = nil
+	}
+}
+
+func (s *FingerService) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.config.FingerBind)
+	if err != nil {
+		log.WithError(err).Error("error creating listener")
+		return fmt.Errorf("error creating listener: %w", err)
+	}
+
+	s.Lock()
+	s.listener = listener
+	s.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.WithError(err).Warn("temporary error accepting finger connection")
+				continue
+			}
+
+			s.Lock()
+			closed := s.listener == nil
+			s.Unlock()
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *FingerService) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	log.Debugf("Incoming finger connection from %q", conn.RemoteAddr())
+
+	_ = conn.SetDeadline(time.Now().Add(fingerTimeout))
+
+	r := bufio.NewReader(io.LimitReader(conn, fingerMaxQuery))
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.WithError(err).Warn("error reading finger query")
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	s.respond(w, line)
+}
+
+// parseFingerQuery parses a RFC 1288 query line into the username being
+// queried, the (optional) host to forward to and whether verbose output was
+// requested with the /W token.
+func parseFingerQuery(line string) (username, host string, verbose bool) {
+	query := strings.TrimSpace(line)
+
+	if strings.HasPrefix(strings.ToUpper(query), "/W") {
+		verbose = true
+		query = strings.TrimSpace(query[2:])
+	}
+
+	if i := strings.Index(query, "@"); i >= 0 {
+		username, host = query[:i], query[i+1:]
+	} else {
+		username = query
+	}
+
+	return NormalizeUsername(username), strings.ToLower(host), verbose
+}
+
+func (s *FingerService) respond(w io.Writer, line string) {
+	username, host, verbose := parseFingerQuery(line)
+
+	if host != "" && host != HostnameFromURL(s.config.BaseURL) {
+		fmt.Fprint(w, "Finger forwarding service denied\r\n")
+		return
+	}
+
+	if username == "" {
+		fmt.Fprintf(w, "%s: %s\r\n", s.config.Name, s.config.Description)
+		fmt.Fprint(w, "Finger online user list denied\r\n")
+		return
+	}
+
+	user, err := s.db.GetUser(username)
+	if err != nil {
+		fmt.Fprintf(w, "%s: no such user\r\n", username)
+		return
+	}
+
+	profile := user.Profile(s.config.BaseURL, nil)
+
+	fmt.Fprintf(w, "Login: %s\r\n", user.Username)
+	if profile.Tagline != "" {
+		fmt.Fprintf(w, "Tagline: %s\r\n", fingerSafe(profile.Tagline))
+	}
+	fmt.Fprintf(w, "Profile: %s\r\n", profile.URL)
+	fmt.Fprintf(w, "Feed: %s\r\n", user.URL)
+
+	if user.IsFollowersPubliclyVisible {
+		fmt.Fprintf(w, "Followers: %d\r\n", len(user.Followers))
+	}
+	if user.IsFollowingPubliclyVisible {
+		fmt.Fprintf(w, "Following: %d\r\n", len(user.Following))
+	}
+
+	var twts types.Twts
+
+	if verbose {
+		twts, err = GetAllTwts(s.config, user.Username)
+		if err != nil {
+			log.WithError(err).Warnf("error loading twts for %s", user.Username)
+		}
+		sort.Sort(twts)
+		if len(twts) > fingerVerboseTwts {
+			twts = twts[:fingerVerboseTwts]
+		}
+	} else {
+		twt, _, err := GetLastTwt(s.config, user)
+		if err != nil {
+			log.WithError(err).Warnf("error loading last twt for %s", user.Username)
+		} else if !twt.IsZero() {
+			twts = append(twts, twt)
+		}
+	}
+
+	if len(twts) == 0 {
+		fmt.Fprint(w, "\r\nNo twts.\r\n")
+		return
+	}
+
+	fmt.Fprint(w, "\r\nLatest twts:\r\n")
+	for _, twt := range twts {
+		text := twt.FormatText(types.TextFmt, s.config)
+		fmt.Fprintf(
+			w, "%s  %s\r\n",
+			twt.Created().Format(time.RFC3339), fingerSafe(text),
+		)
+	}
+}
+
+// fingerSafe strips control characters from user supplied text so it cannot
+// mess with the finger client's terminal and flattens multi-line text.
+func fingerSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\u2028':
+			return ' '
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFingerQuery(t *testing.T) {
+	testCases := []struct {
+		line     string
+		username string
+		host     string
+		verbose  bool
+	}{
+		{"\r\n", "", "", false},
+		{"alice\r\n", "alice", "", false},
+		{"Alice\r\n", "alice", "", false},
+		{"  alice  \n", "alice", "", false},
+		{"alice", "alice", "", false},
+		{"/W alice\r\n", "alice", "", true},
+		{"/w alice\r\n", "alice", "", true},
+		{"/Walice\r\n", "alice", "", true},
+		{"/W\r\n", "", "", true},
+		{"alice@Example.com\r\n", "alice", "example.com", false},
+		{"/W alice@example.com\r\n", "alice", "example.com", true},
+		{"@example.com\r\n", "", "example.com", false},
+		{"alice@example.com@elsewhere.com\r\n", "alice", "example.com@elsewhere.com", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.line, func(t *testing.T) {
+			username, host, verbose := parseFingerQuery(testCase.line)
+			assert.Equal(t, testCase.username, username)
+			assert.Equal(t, testCase.host, host)
+			assert.Equal(t, testCase.verbose, verbose)
+		})
+	}
+}
+
+func TestFingerServiceRespond(t *testing.T) {
+	svc := NewFingerService(&Config{
+		Name:        "example",
+		Description: "An example pod",
+		BaseURL:     "https://example.com",
+	}, nil)
+
+	testCases := []struct {
+		line     string
+		expected string
+	}{
+		{"\r\n", "example: An example pod\r\nFinger online user list denied\r\n"},
+		{"/W\r\n", "example: An example pod\r\nFinger online user list denied\r\n"},
+		{"@example.com\r\n", "example: An example pod\r\nFinger online user list denied\r\n"},
+		{"alice@elsewhere.com\r\n", "Finger forwarding service denied\r\n"},
+		{"alice@example.com@elsewhere.com\r\n", "Finger forwarding service denied\r\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.line, func(t *testing.T) {
+			var buf bytes.Buffer
+			svc.respond(&buf, testCase.line)
+			assert.Equal(t, testCase.expected, buf.String())
+		})
+	}
+}
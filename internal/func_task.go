@@ -21,5 +21,9 @@ func (t *FuncTask) Run() error {
 	defer t.Done()
 	t.SetState(TaskStateRunning)
 
-	return t.f()
+	if err := t.f(); err != nil {
+		return t.Fail(err)
+	}
+
+	return nil
 }
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -19,10 +20,10 @@ import (
 
 	"github.com/chai2010/webp"
 	"github.com/dgrijalva/jwt-go"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
-	"github.com/gorilla/feeds"
 	"github.com/james4k/fmatter"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rickb777/accept"
@@ -218,6 +219,11 @@ func (s *Server) ProfileHandler() httprouter.Handle {
 			return
 		}
 
+		if format := preferredSyndicationFormat(r); format != "" {
+			s.syndicateTwts(w, r, nick, format)
+			return
+		}
+
 		log.Debugf("nick: %s", nick)
 
 		var profile types.Profile
@@ -255,19 +261,37 @@ func (s *Server) ProfileHandler() httprouter.Handle {
 			Href: fmt.Sprintf("%s/webmention", UserURL(profile.URL)),
 			Rel:  "webmention",
 		})
+		ctx.Links = append(ctx.Links, types.Link{
+			Href: URLForMicropub(s.config.BaseURL),
+			Rel:  "micropub",
+		})
+
+		if profile.Type == "User" {
+			ctx.Links = append(ctx.Links, types.Links{
+				types.Link{
+					Href: URLForIndieAuth(s.config.BaseURL, "auth"),
+					Rel:  "authorization_endpoint",
+				},
+				types.Link{
+					Href: URLForIndieAuth(s.config.BaseURL, "token"),
+					Rel:  "token_endpoint",
+				},
+				types.Link{
+					Href: fmt.Sprintf("%s/.well-known/oauth-authorization-server", strings.TrimSuffix(s.config.BaseURL, "/")),
+					Rel:  "indieauth-metadata",
+				},
+			}...)
+		}
 
-		ctx.Alternatives = append(ctx.Alternatives, types.Alternatives{
-			types.Alternative{
-				Type:  "text/plain",
-				Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
-				URL:   profile.URL,
-			},
-			types.Alternative{
-				Type:  "application/atom+xml",
-				Title: fmt.Sprintf("%s's Atom Feed", profile.Username),
-				URL:   fmt.Sprintf("%s/atom.xml", UserURL(profile.URL)),
-			},
-		}...)
+		ctx.Alternatives = append(ctx.Alternatives, types.Alternative{
+			Type:  "text/plain",
+			Title: fmt.Sprintf("%s's Twtxt Feed", profile.Username),
+			URL:   profile.URL,
+		})
+		ctx.Alternatives = append(
+			ctx.Alternatives,
+			syndicationAlternatives(fmt.Sprintf("%s's", profile.Username), UserURL(profile.URL), nil)...,
+		)
 
 		twts := s.cache.GetByURL(profile.URL)
 
@@ -582,12 +606,32 @@ func (s *Server) PostHandler() httprouter.Handle {
 
 		postas := strings.ToLower(strings.TrimSpace(r.FormValue("postas")))
 
+		// The twt being replaced (if any) so we can record an edit marker
+		var edited types.Twt = types.NilTwt
+
 		// TODO: Support deleting/patching last feed (`postas`) twt too.
 		if r.Method == http.MethodDelete || r.Method == http.MethodPatch {
+			lastTwt, _, err := GetLastTwt(s.config, ctx.User)
+			if err != nil {
+				ctx.Error = true
+				ctx.Message = s.tr(ctx, "ErrorDeleteLastTwt")
+				s.render("error", w, ctx)
+				return
+			}
+
 			if err := DeleteLastTwt(s.config, ctx.User); err != nil {
 				ctx.Error = true
 				ctx.Message = s.tr(ctx, "ErrorDeleteLastTwt")
 				s.render("error", w, ctx)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				if err := RecordTwtDelete(s.config, ctx.User.Username, lastTwt.Hash()); err != nil {
+					log.WithError(err).Warnf("error recording delete of twt %s", lastTwt.Hash())
+				}
+			} else {
+				edited = lastTwt
 			}
 
 			// Update user's own timeline with their own new post.
@@ -616,7 +660,9 @@ func (s *Server) PostHandler() httprouter.Handle {
 				ctx.Error = true
 				ctx.Message = s.tr(ctx, "ErrorDeleteLastTwt")
 				s.render("error", w, ctx)
+				return
 			}
+			edited = lastTwt
 		} else {
 			log.Warnf("hash mismatch %s != %s", lastTwt.Hash(), hash)
 		}
@@ -630,6 +676,17 @@ func (s *Server) PostHandler() httprouter.Handle {
 			return
 		}
 
+		cw := r.FormValue("cw")
+
+		if err := ValidateTwtLength(s.config, WithContentWarning(text, cw)); err != nil {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorTwtTooLong", map[string]interface{}{
+				"MaxTwtLength": s.config.MaxTwtLength,
+			})
+			s.render("error", w, ctx)
+			return
+		}
+
 		reply := strings.TrimSpace(r.FormValue("reply"))
 		if reply != "" {
 			re := regexp.MustCompile(`^(@<.*>[, ]*)*(\(.*?\))(.*)`)
@@ -639,6 +696,8 @@ func (s *Server) PostHandler() httprouter.Handle {
 			}
 		}
 
+		text = WithContentWarning(text, cw)
+
 		user, err := s.db.GetUser(ctx.Username)
 		if err != nil {
 			log.WithError(err).Errorf("error loading user object for %s", ctx.Username)
@@ -660,7 +719,7 @@ func (s *Server) PostHandler() httprouter.Handle {
 		default:
 			if user.OwnsFeed(postas) {
 				if hash != "" && lastTwt.Hash() == hash {
-					twt, err = AppendSpecial(s.config, s.db, postas, text, lastTwt.Created)
+					twt, err = AppendSpecial(s.config, s.db, postas, text, lastTwt.Created())
 				} else {
 					twt, err = AppendSpecial(s.config, s.db, postas, text)
 				}
@@ -677,6 +736,19 @@ func (s *Server) PostHandler() httprouter.Handle {
 			return
 		}
 
+		// Let other pods know the twt was edited (or, if it was re-posted
+		// as another feed, that it was deleted from the user's feed)
+		if !edited.IsZero() {
+			if postas == "" || postas == user.Username {
+				err = RecordTwtEdit(s.config, user.Username, edited.Hash(), twt.Hash())
+			} else {
+				err = RecordTwtDelete(s.config, user.Username, edited.Hash())
+			}
+			if err != nil {
+				log.WithError(err).Warnf("error recording edit of twt %s", edited.Hash())
+			}
+		}
+
 		// Update user's own timeline with their own new post.
 		s.cache.FetchTwts(s.config, s.archive, user.Source(), nil)
 
@@ -700,6 +772,11 @@ func (s *Server) PostHandler() httprouter.Handle {
 // TimelineHandler ...
 func (s *Server) TimelineHandler() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if format := preferredSyndicationFormat(r); format != "" {
+			s.syndicateTwts(w, r, "", format)
+			return
+		}
+
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if r.Method == http.MethodHead {
 			defer r.Body.Close()
@@ -805,6 +882,12 @@ func (s *Server) PermalinkHandler() httprouter.Handle {
 		}
 
 		if twt.IsZero() {
+			// Redirect to the twt's new hash if it has been re-keyed
+			if newHash, ok := LookupMigratedTwtHash(s.config, hash); ok {
+				http.Redirect(w, r, URLForTwt(s.config.BaseURL, newHash), http.StatusMovedPermanently)
+				return
+			}
+
 			ctx.Error = true
 			ctx.Message = s.tr(ctx, "ErrorNoMatchingTwt")
 			s.render("404", w, ctx)
@@ -825,7 +908,7 @@ func (s *Server) PermalinkHandler() httprouter.Handle {
 		}
 
 		when := twt.Created().Format(time.RFC3339)
-		what := twt.FormatText(types.TextFmt, s.config)
+		what := FormatTwtTextFactory(s.config)(twt)
 
 		var ks []string
 		if ks, err = keywords.Extract(what); err != nil {
@@ -977,8 +1060,19 @@ func (s *Server) SearchHandler() httprouter.Handle {
 			ctx.Error = true
 			ctx.Message = s.tr(ctx, "ErrorNoTag")
 			s.render("error", w, ctx)
+			return
 		}
 
+		if format := preferredSyndicationFormat(r); format != "" {
+			s.syndicateTag(w, r, tag, format)
+			return
+		}
+
+		ctx.Alternatives = append(
+			ctx.Alternatives,
+			syndicationAlternatives(fmt.Sprintf("#%s", tag), fmt.Sprintf("%s/search", strings.TrimSuffix(s.config.BaseURL, "/")), url.Values{"tag": []string{tag}})...,
+		)
+
 		getTweetsByTag := func() types.Twts {
 			var result types.Twts
 			seen := make(map[string]bool)
@@ -1174,6 +1268,13 @@ func (s *Server) LoginHandler() httprouter.Handle {
 			_ = sess.(*session.Session).Set("persist", "1")
 		}
 
+		// Resume an IndieAuth authorization request that required a login
+		if redirect, ok := sess.(*session.Session).Get("redirect"); ok && strings.HasPrefix(redirect, "/") {
+			_ = sess.(*session.Session).Del("redirect")
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+
 		http.Redirect(w, r, RedirectRefererURL(r, s.config, "/"), http.StatusFound)
 	}
 }
@@ -1268,6 +1369,14 @@ func (s *Server) RegisterHandler() httprouter.Handle {
 		user.URL = URLForUser(s.config.BaseURL, username)
 		user.CreatedAt = time.Now()
 
+		// Link the personal URL verified via IndieAuth prior to registering
+		if sess := r.Context().Value(session.SessionKey); sess != nil {
+			if me, ok := sess.(*session.Session).Get("indieauth_verified"); ok {
+				user.IndieAuthMe = me
+				_ = sess.(*session.Session).Del("indieauth_verified")
+			}
+		}
+
 		if err := s.db.SetUser(username, user); err != nil {
 			log.WithError(err).Error("error saving user object for new user")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1327,6 +1436,10 @@ func (s *Server) SettingsHandler() httprouter.Handle {
 
 		if r.Method == "GET" {
 			ctx.Title = s.tr(ctx, "PageSettingsTitle")
+			ctx.MediaUsage = humanize.Bytes(uint64(MediaUsage(s.config, ctx.Username)))
+			if s.config.MediaQuota > 0 {
+				ctx.MediaQuota = humanize.Bytes(uint64(s.config.MediaQuota))
+			}
 			s.render("settings", w, ctx)
 			return
 		}
@@ -1575,6 +1688,17 @@ func (s *Server) ExternalHandler() httprouter.Handle {
 		var pagedTwts types.Twts
 
 		page := SafeParseInt(r.FormValue("p"), 1)
+
+		// Paging past what is cached, fetch older twts from the feed itself
+		// and any archived feeds it links to. One more twt than needed is
+		// requested so the pager knows whether there is a next page.
+		if want := page*s.config.TwtsPerPage + 1; want > len(twts) {
+			older := s.cache.GetOlderByURL(s.config, s.archive, types.Feed{Nick: nick, URL: uri}, want)
+			if len(older) > len(twts) {
+				twts = older
+			}
+		}
+
 		pager := paginator.New(adapter.NewSliceAdapter(twts), s.config.TwtsPerPage)
 		pager.SetPage(page)
 
@@ -1601,6 +1725,7 @@ func (s *Server) ExternalHandler() httprouter.Handle {
 
 		ctx.Profile = types.Profile{
 			Username: nick,
+			Tagline:  ctx.Twter.Tagline,
 			TwtURL:   uri,
 			URL:      URLForExternalProfile(s.config, nick, uri),
 
@@ -1919,110 +2044,6 @@ func (s *Server) TaskHandler() httprouter.Handle {
 	}
 }
 
-// SyndicationHandler ...
-func (s *Server) SyndicationHandler() httprouter.Handle {
-	formatTwt := FormatTwtFactory(s.config)
-
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		var (
-			twts    types.Twts
-			profile types.Profile
-			err     error
-		)
-
-		nick := NormalizeUsername(p.ByName("nick"))
-		if nick != "" {
-			if s.db.HasUser(nick) {
-				if user, err := s.db.GetUser(nick); err == nil {
-					profile = user.Profile(s.config.BaseURL, nil)
-					twts = s.cache.GetByURL(profile.URL)
-				} else {
-					log.WithError(err).Error("error loading user object")
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return
-				}
-			} else if s.db.HasFeed(nick) {
-				if feed, err := s.db.GetFeed(nick); err == nil {
-					profile = feed.Profile(s.config.BaseURL, nil)
-					twts = s.cache.GetByURL(profile.URL)
-				} else {
-					log.WithError(err).Error("error loading user object")
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return
-				}
-			} else {
-				http.Error(w, "Feed Not Found", http.StatusNotFound)
-				return
-			}
-		} else {
-			twts = s.cache.GetByPrefix(s.config.BaseURL, false)
-
-			profile = types.Profile{
-				Type:     "Local",
-				Username: s.config.Name,
-				Tagline:  "", // TODO: Maybe Twtxt Pods should have a configurable description?
-				URL:      s.config.BaseURL,
-			}
-		}
-
-		if err != nil {
-			log.WithError(err).Errorf("errorloading feeds for %s", nick)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		if r.Method == http.MethodHead {
-			defer r.Body.Close()
-			w.Header().Set(
-				"Last-Modified",
-				twts[len(twts)].Created().Format(http.TimeFormat),
-			)
-			return
-		}
-
-		now := time.Now()
-		// feed author.email
-		email := ""
-		if nick == "" {
-			email = s.config.AdminEmail
-		}
-		// main feed
-		feed := &feeds.Feed{
-			Title:       fmt.Sprintf("%s Twtxt Atom Feed", profile.Username),
-			Link:        &feeds.Link{Href: profile.URL},
-			Description: profile.Tagline,
-			Author:      &feeds.Author{Name: profile.Username, Email: email},
-			Created:     now,
-		}
-		// feed items
-		var items []*feeds.Item
-
-		for _, twt := range twts {
-			url := URLForTwt(s.config.BaseURL, twt.Hash())
-			items = append(items, &feeds.Item{
-				Id:          url,
-				Title:       string(formatTwt(twt)),
-				Link:        &feeds.Link{Href: url},
-				Author:      &feeds.Author{Name: twt.Twter().Nick},
-				Description: string(formatTwt(twt)),
-				Created:     twt.Created(),
-			},
-			)
-		}
-		feed.Items = items
-
-		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
-		data, err := feed.ToAtom()
-		if err != nil {
-			log.WithError(err).Error("error serializing feed")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		_, _ = w.Write([]byte(data))
-	}
-}
-
 // PodConfigHandler ...
 func (s *Server) PodConfigHandler() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -2157,26 +2178,11 @@ func (s *Server) DeleteAllHandler() httprouter.Handle {
 
 							// Remove all uploaded media in a twt
 							for _, mediaPath := range mediaPaths {
-								// Delete .png
-								fn := filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.png", mediaPath))
-								if FileExists(fn) {
-									if err := os.Remove(fn); err != nil {
-										ctx.Error = true
-										ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
-										s.render("error", w, ctx)
-										return
-									}
-								}
-
-								// Delete .webp
-								fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.webp", mediaPath))
-								if FileExists(fn) {
-									if err := os.Remove(fn); err != nil {
-										ctx.Error = true
-										ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
-										s.render("error", w, ctx)
-										return
-									}
+								if err := ReleaseMedia(s.config, mediaPath, ctx.Username); err != nil {
+									ctx.Error = true
+									ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
+									s.render("error", w, ctx)
+									return
 								}
 							}
 						}
@@ -2202,6 +2208,14 @@ func (s *Server) DeleteAllHandler() httprouter.Handle {
 					}
 				}
 
+				// Delete feed's rotated (archived) twtxt files
+				if err := DeleteRotatedFeeds(s.config, nick); err != nil {
+					log.WithError(err).Error("error removing feed's rotated feeds")
+				}
+				if err := DeleteTwtMarkers(s.config, nick); err != nil {
+					log.WithError(err).Error("error removing feed's twt markers")
+				}
+
 				// Delete feed from cache
 				s.cache.Delete(feed.Source())
 			}
@@ -2230,26 +2244,11 @@ func (s *Server) DeleteAllHandler() httprouter.Handle {
 
 			// Remove all uploaded media in a twt
 			for _, mediaPath := range mediaPaths {
-				// Delete .png
-				fn := filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.png", mediaPath))
-				if FileExists(fn) {
-					if err := os.Remove(fn); err != nil {
-						log.WithError(err).Error("error removing media")
-						ctx.Error = true
-						ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
-						s.render("error", w, ctx)
-					}
-				}
-
-				// Delete .webp
-				fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.webp", mediaPath))
-				if FileExists(fn) {
-					if err := os.Remove(fn); err != nil {
-						log.WithError(err).Error("error removing media")
-						ctx.Error = true
-						ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
-						s.render("error", w, ctx)
-					}
+				if err := ReleaseMedia(s.config, mediaPath, ctx.Username); err != nil {
+					log.WithError(err).Error("error removing media")
+					ctx.Error = true
+					ctx.Message = s.tr(ctx, "ErrorDeletingAccount")
+					s.render("error", w, ctx)
 				}
 			}
 		}
@@ -2273,6 +2272,14 @@ func (s *Server) DeleteAllHandler() httprouter.Handle {
 			}
 		}
 
+		// Delete user's rotated (archived) twtxt files
+		if err := DeleteRotatedFeeds(s.config, ctx.User.Username); err != nil {
+			log.WithError(err).Error("error removing user's rotated feeds")
+		}
+		if err := DeleteTwtMarkers(s.config, ctx.User.Username); err != nil {
+			log.WithError(err).Error("error removing user's twt markers")
+		}
+
 		// Delete user
 		if err := s.db.DelUser(ctx.Username); err != nil {
 			ctx.Error = true
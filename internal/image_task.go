@@ -10,31 +10,62 @@ import (
 type ImageTask struct {
 	*BaseTask
 
-	conf *Config
-	fn   string
+	conf   *Config
+	fn     string
+	upload *MediaMetadata
 }
 
-func NewImageTask(conf *Config, fn string) *ImageTask {
-	return &ImageTask{
+func NewImageTask(conf *Config, fn string, upload *MediaMetadata) *ImageTask {
+	task := &ImageTask{
 		BaseTask: NewBaseTask(),
 
-		conf: conf,
-		fn:   fn,
+		conf:   conf,
+		fn:     spoolUpload(conf, fn),
+		upload: upload,
 	}
+
+	// Image uploads are quick to process and the uploader is waiting for
+	// them, unlike transcoding audio and video
+	task.SetPriority(TaskPriorityHigh)
+
+	return task
 }
 
-func (t *ImageTask) String() string { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *ImageTask) String() string           { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *ImageTask) Kind() string             { return imageTaskKind }
+func (t *ImageTask) Args() TaskData           { return mediaTaskArgs(t.fn, t.upload) }
+func (t *ImageTask) RetryPolicy() RetryPolicy { return mediaTaskRetryPolicy }
+func (t *ImageTask) Cleanup()                 { removeUpload(t.fn) }
 func (t *ImageTask) Run() error {
 	defer t.Done()
 	t.SetState(TaskStateRunning)
+	t.SetProgress(0)
 
 	log.Infof("starting image processing task for %s", t.fn)
 
-	opts := &ImageOptions{Resize: true, Width: MediaResolution, Height: 0}
-	mediaURI, err := ProcessImage(t.conf, t.fn, mediaDir, "", opts)
-	if err != nil {
-		log.WithError(err).Errorf("error processing image %s", t.fn)
-		return t.Fail(err)
+	var mediaURI string
+
+	// Animated images lose their animation when processed so are transcoded
+	// into a looping video instead, unless the transcoder can't decode them
+	if IsAnimatedImage(t.fn) {
+		uri, err := TranscodeVideo(t.conf, t.fn, mediaDir, "", &VideoOptions{Animated: true, Context: t.Context(), Progress: t.setTranscodeProgress})
+		if err != nil && t.Cancelled() {
+			return t.Fail(err)
+		} else if err != nil {
+			log.WithError(err).Warnf("error transcoding animated image %s, processing it as a still image", t.fn)
+		} else {
+			mediaURI = uri
+		}
+	}
+
+	if mediaURI == "" {
+		opts := &ImageOptions{Resize: true, Width: MediaResolution, Height: 0, Variants: true}
+		uri, err := ProcessImage(t.conf, t.fn, mediaDir, "", opts)
+		if err != nil {
+			log.WithError(err).Errorf("error processing image %s", t.fn)
+			return t.Fail(err)
+		}
+		mediaURI = uri
 	}
 	log.Infof("image processing complete for %s with uri %s", t.fn, mediaURI)
 
@@ -42,7 +73,12 @@ func (t *ImageTask) Run() error {
 		log.WithError(err).Warn("error removing temporary image file")
 	}
 
+	if err := recordMediaUpload(t.conf, mediaURI, t.upload); err != nil {
+		return t.Fail(err)
+	}
+
 	t.SetData("mediaURI", mediaURI)
+	t.SetProgress(100)
 
 	return nil
 }
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andyleap/microformats"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt"
+	"github.com/jointwt/twtxt/internal/webmention"
+)
+
+var (
+	// ErrIndieAuthNoEndpoint is returned when no authorization endpoint could
+	// be discovered for a user's personal URL
+	ErrIndieAuthNoEndpoint = errors.New("error: no indieauth authorization endpoint found")
+
+	// ErrIndieAuthInvalidURL is returned for invalid profile, client or
+	// redirect urls
+	ErrIndieAuthInvalidURL = errors.New("error: invalid indieauth url")
+
+	// ErrIndieAuthInvalidCode is returned for unknown, expired or mismatched
+	// authorization codes
+	ErrIndieAuthInvalidCode = errors.New("error: invalid indieauth authorization code")
+)
+
+// IndieAuthCode is an authorization code issued by the pod's IndieAuth
+// authorization endpoint to a client on behalf of a local user.
+type IndieAuthCode struct {
+	Username            string `json:"username"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Verify checks a code presented by a client matches how it was issued
+func (c *IndieAuthCode) Verify(clientID, redirectURI, codeVerifier string) error {
+	if c.ClientID != clientID || c.RedirectURI != redirectURI {
+		return ErrIndieAuthInvalidCode
+	}
+
+	if c.CodeChallenge == "" {
+		return nil
+	}
+
+	// Only S256 challenges are supported as IndieAuth requires
+	if c.CodeChallengeMethod != "S256" {
+		return ErrIndieAuthInvalidCode
+	}
+
+	challenge := pkceChallenge(codeVerifier)
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) != 1 {
+		return ErrIndieAuthInvalidCode
+	}
+
+	return nil
+}
+
+// pkceChallenge returns the S256 PKCE code challenge for a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// indieAuthHasScope returns true if the space separated scopes granted
+// include any of the scopes required. The legacy "post" scope is treated as
+// "create".
+func indieAuthHasScope(granted string, required ...string) bool {
+	for _, g := range strings.Fields(granted) {
+		if g == "post" {
+			g = "create"
+		}
+		for _, r := range required {
+			if g == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NormalizeIndieAuthURL canonicalizes a user entered profile URL (me) as per
+// the IndieAuth spec, defaulting to https and a path of /
+func NormalizeIndieAuthURL(me string) (string, error) {
+	me = strings.TrimSpace(me)
+	if me == "" {
+		return "", ErrIndieAuthInvalidURL
+	}
+
+	if !strings.Contains(me, "://") {
+		me = fmt.Sprintf("https://%s", me)
+	}
+
+	u, err := url.Parse(me)
+	if err != nil {
+		return "", ErrIndieAuthInvalidURL
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return "", ErrIndieAuthInvalidURL
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String(), nil
+}
+
+// sameHost returns true if both urls share the same host
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
+
+// verifyIndieAuthMe returns true if the profile URL (verified) returned by
+// the authorization endpoint a sign-in for me was started with can be
+// trusted. A profile URL other than me must be on the same host and advertise
+// the same authorization endpoint, otherwise anyone on a shared host could
+// sign in as any other user of that host.
+func verifyIndieAuthMe(conf *Config, endpoint, me, verified string) bool {
+	if verified == me {
+		return true
+	}
+
+	if !sameHost(verified, me) {
+		return false
+	}
+
+	authEndpoint, _, err := DiscoverIndieAuthEndpoints(conf, verified)
+	if err != nil {
+		log.WithError(err).Warnf("error discovering indieauth endpoints for %s", verified)
+		return false
+	}
+
+	return authEndpoint == endpoint
+}
+
+// DiscoverIndieAuthEndpoints discovers the authorization and token endpoints
+// advertised by a user's profile URL either via HTTP Link headers or <link>
+// elements in the page.
+func DiscoverIndieAuthEndpoints(conf *Config, me string) (authEndpoint, tokenEndpoint string, err error) {
+	base, err := url.Parse(me)
+	if err != nil {
+		return "", "", ErrIndieAuthInvalidURL
+	}
+
+	res, err := Request(conf, http.MethodGet, me, nil)
+	if err != nil {
+		log.WithError(err).Errorf("error fetching indieauth profile %s", me)
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return "", "", fmt.Errorf("error fetching indieauth profile %s: %s", me, res.Status)
+	}
+
+	for _, link := range webmention.GetHeaderLinks(res.Header["Link"]) {
+		if link.URL == nil {
+			continue
+		}
+		for _, rel := range link.Params["rel"] {
+			switch rel {
+			case "authorization_endpoint":
+				if authEndpoint == "" {
+					authEndpoint = base.ResolveReference(link.URL).String()
+				}
+			case "token_endpoint":
+				if tokenEndpoint == "" {
+					tokenEndpoint = base.ResolveReference(link.URL).String()
+				}
+			}
+		}
+	}
+
+	if authEndpoint == "" || tokenEndpoint == "" {
+		mf2data := microformats.New().Parse(res.Body, base)
+		if links := mf2data.Rels["authorization_endpoint"]; authEndpoint == "" && len(links) > 0 {
+			authEndpoint = links[0]
+		}
+		if links := mf2data.Rels["token_endpoint"]; tokenEndpoint == "" && len(links) > 0 {
+			tokenEndpoint = links[0]
+		}
+	}
+
+	if authEndpoint == "" {
+		return "", "", ErrIndieAuthNoEndpoint
+	}
+
+	return authEndpoint, tokenEndpoint, nil
+}
+
+// VerifyIndieAuthCode redeems an authorization code with a remote
+// authorization endpoint returning the verified profile URL (me)
+func VerifyIndieAuthCode(conf *Config, endpoint, code, clientID, redirectURI, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("client_id", clientID)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(
+		"User-Agent",
+		fmt.Sprintf(
+			"twtxt/%s (Pod: %s Support: %s)",
+			twtxt.FullVersion(), conf.Name, URLForPage(conf.BaseURL, "support"),
+		),
+	)
+
+	client := http.Client{
+		Timeout: requestTimeout,
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		log.WithError(err).Errorf("error verifying indieauth code with %s", endpoint)
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("error verifying indieauth code with %s: %s", endpoint, res.Status)
+	}
+
+	var payload struct {
+		Me string `json:"me"`
+	}
+
+	if strings.Contains(res.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(res.Body).Decode(&payload); err != nil {
+			return "", err
+		}
+	} else {
+		// Older authorization endpoints respond form-encoded
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", err
+		}
+		payload.Me = values.Get("me")
+	}
+
+	if payload.Me == "" {
+		return "", ErrIndieAuthInvalidCode
+	}
+
+	return NormalizeIndieAuthURL(payload.Me)
+}
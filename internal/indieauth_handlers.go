@@ -0,0 +1,484 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/internal/session"
+)
+
+const (
+	// indieAuthCodeTTL is how long an authorization code issued by the pod
+	// remains valid for before the client must redeem it
+	indieAuthCodeTTL = 10 * time.Minute
+)
+
+func indieAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// lookupIndieAuthUser returns the user that has linked the given profile URL
+func (s *Server) lookupIndieAuthUser(me string) (*User, bool) {
+	users, err := s.db.GetAllUsers()
+	if err != nil {
+		log.WithError(err).Error("error loading users")
+		return nil, false
+	}
+
+	for _, user := range users {
+		if user.IndieAuthMe != "" && user.IndieAuthMe == me {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+// IndieAuthLoginHandler starts an IndieAuth sign-in by discovering the
+// authorization endpoint of the personal URL provided by the user and
+// redirecting them there.
+func (s *Server) IndieAuthLoginHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		me, err := NormalizeIndieAuthURL(r.FormValue("me"))
+		if err != nil {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidURL")
+			s.render("error", w, ctx)
+			return
+		}
+
+		authEndpoint, _, err := DiscoverIndieAuthEndpoints(s.config, me)
+		if err != nil {
+			log.WithError(err).Warnf("error discovering indieauth endpoints for %s", me)
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthNoEndpoint", map[string]interface{}{"URL": me})
+			s.render("error", w, ctx)
+			return
+		}
+
+		sess := r.Context().Value(session.SessionKey)
+		if sess == nil {
+			log.Warn("no session found")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		state := GenerateRandomToken()
+		verifier := fmt.Sprintf("%s%s", GenerateRandomToken(), GenerateRandomToken())
+
+		_ = sess.(*session.Session).Set("indieauth_me", me)
+		_ = sess.(*session.Session).Set("indieauth_state", state)
+		_ = sess.(*session.Session).Set("indieauth_verifier", verifier)
+		_ = sess.(*session.Session).Set("indieauth_endpoint", authEndpoint)
+
+		u, err := url.Parse(authEndpoint)
+		if err != nil {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthNoEndpoint", map[string]interface{}{"URL": me})
+			s.render("error", w, ctx)
+			return
+		}
+
+		q := u.Query()
+		q.Set("response_type", "code")
+		q.Set("me", me)
+		q.Set("client_id", fmt.Sprintf("%s/", strings.TrimSuffix(s.config.BaseURL, "/")))
+		q.Set("redirect_uri", URLForIndieAuth(s.config.BaseURL, "callback"))
+		q.Set("state", state)
+		q.Set("code_challenge", pkceChallenge(verifier))
+		q.Set("code_challenge_method", "S256")
+		u.RawQuery = q.Encode()
+
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+}
+
+// IndieAuthCallbackHandler completes an IndieAuth sign-in. A verified
+// personal URL is linked to the logged in user, logs in the user that
+// previously linked it, or is carried over to registration so external
+// twtxt users can claim a pod account.
+func (s *Server) IndieAuthCallbackHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		v := r.Context().Value(session.SessionKey)
+		if v == nil {
+			log.Warn("no session found")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		sess := v.(*session.Session)
+
+		me, _ := sess.Get("indieauth_me")
+		state, _ := sess.Get("indieauth_state")
+		verifier, _ := sess.Get("indieauth_verifier")
+		endpoint, _ := sess.Get("indieauth_endpoint")
+
+		_ = sess.Del("indieauth_state")
+		_ = sess.Del("indieauth_verifier")
+		_ = sess.Del("indieauth_endpoint")
+
+		if state == "" || r.FormValue("state") != state || r.FormValue("code") == "" {
+			log.Warn("indieauth callback with invalid state or missing code")
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthFailed")
+			s.render("error", w, ctx)
+			return
+		}
+
+		verified, err := VerifyIndieAuthCode(
+			s.config, endpoint, r.FormValue("code"),
+			fmt.Sprintf("%s/", strings.TrimSuffix(s.config.BaseURL, "/")),
+			URLForIndieAuth(s.config.BaseURL, "callback"),
+			verifier,
+		)
+		if err != nil || !verifyIndieAuthMe(s.config, endpoint, me, verified) {
+			log.WithError(err).Warnf("error verifying indieauth code for %s", me)
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthFailed")
+			s.render("error", w, ctx)
+			return
+		}
+
+		_ = sess.Del("indieauth_me")
+
+		// Logged in users are linking their personal URL
+		if ctx.Authenticated {
+			if other, ok := s.lookupIndieAuthUser(verified); ok && other.Username != ctx.User.Username {
+				ctx.Error = true
+				ctx.Message = s.tr(ctx, "ErrorIndieAuthAlreadyLinked", map[string]interface{}{"URL": verified})
+				s.render("error", w, ctx)
+				return
+			}
+
+			ctx.User.IndieAuthMe = verified
+			if err := s.db.SetUser(ctx.Username, ctx.User); err != nil {
+				log.WithError(err).Warnf("error updating user object %s", ctx.Username)
+				ctx.Error = true
+				ctx.Message = s.tr(ctx, "ErrorUpdatingUser")
+				s.render("error", w, ctx)
+				return
+			}
+
+			ctx.Error = false
+			ctx.Message = s.tr(ctx, "MsgIndieAuthLinked", map[string]interface{}{"URL": verified})
+			s.render("error", w, ctx)
+			return
+		}
+
+		if user, ok := s.lookupIndieAuthUser(verified); ok {
+			log.Infof("indieauth login successful: %s (%s)", user.Username, verified)
+			_ = sess.Set("username", user.Username)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !s.config.OpenRegistrations {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthNoAccount", map[string]interface{}{"URL": verified})
+			s.render("error", w, ctx)
+			return
+		}
+
+		// Remember the verified URL so it is linked to the account on registration
+		_ = sess.Set("indieauth_verified", verified)
+		http.Redirect(w, r, "/register", http.StatusFound)
+	}
+}
+
+// IndieAuthAuthorizeHandler is the pod's IndieAuth authorization endpoint
+// which asks the logged in user to approve a client's sign-in request.
+func (s *Server) IndieAuthAuthorizeHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		if !ctx.Authenticated {
+			if sess := r.Context().Value(session.SessionKey); sess != nil {
+				_ = sess.(*session.Session).Set("redirect", r.URL.RequestURI())
+			}
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		responseType := r.FormValue("response_type")
+		if responseType == "" {
+			responseType = "id"
+		}
+
+		clientID := r.FormValue("client_id")
+		redirectURI := r.FormValue("redirect_uri")
+
+		if responseType != "id" && responseType != "code" {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		if _, err := NormalizeIndieAuthURL(clientID); err != nil || !strings.Contains(clientID, "://") {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		// We only allow redirecting back to the client's own host
+		if u, err := url.Parse(redirectURI); err != nil || !u.IsAbs() || !sameHost(clientID, redirectURI) {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		if r.FormValue("code_challenge") != "" && r.FormValue("code_challenge_method") != "S256" {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		if me := r.FormValue("me"); me != "" {
+			if normalized, _ := NormalizeIndieAuthURL(me); normalized != URLForIndieAuthMe(s.config.BaseURL, ctx.Username) {
+				log.Warnf("indieauth request for %s by %s", me, ctx.Username)
+			}
+		}
+
+		ctx.Title = s.tr(ctx, "IndieAuthTitle")
+		ctx.IndieAuth = IndieAuthRequest{
+			Me:                  URLForIndieAuthMe(s.config.BaseURL, ctx.Username),
+			ClientID:            clientID,
+			RedirectURI:         redirectURI,
+			State:               r.FormValue("state"),
+			ResponseType:        responseType,
+			Scope:               r.FormValue("scope"),
+			Scopes:              strings.Fields(r.FormValue("scope")),
+			CodeChallenge:       r.FormValue("code_challenge"),
+			CodeChallengeMethod: r.FormValue("code_challenge_method"),
+		}
+
+		s.render("indieauth", w, ctx)
+	}
+}
+
+// IndieAuthApproveHandler issues an authorization code once the user has
+// approved a client's request and redirects back to the client.
+func (s *Server) IndieAuthApproveHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		redirectURI := r.FormValue("redirect_uri")
+		clientID := r.FormValue("client_id")
+
+		u, err := url.Parse(redirectURI)
+		if err != nil || !u.IsAbs() || !sameHost(clientID, redirectURI) {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		q := u.Query()
+		q.Set("state", r.FormValue("state"))
+
+		if r.FormValue("approve") != "true" {
+			q.Set("error", "access_denied")
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+
+		scope := ""
+		if r.FormValue("response_type") == "code" {
+			scope = strings.Join(r.Form["scope"], " ")
+		}
+
+		code := &IndieAuthCode{
+			Username:            ctx.Username,
+			ClientID:            clientID,
+			RedirectURI:         redirectURI,
+			Scope:               scope,
+			CodeChallenge:       r.FormValue("code_challenge"),
+			CodeChallengeMethod: r.FormValue("code_challenge_method"),
+		}
+
+		data, err := json.Marshal(code)
+		if err != nil {
+			log.WithError(err).Error("error serializing indieauth code")
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorIndieAuthFailed")
+			s.render("error", w, ctx)
+			return
+		}
+
+		token := GenerateRandomToken()
+		s.indieAuthCodes.SetString(token, string(data))
+
+		q.Set("code", token)
+		q.Set("me", URLForIndieAuthMe(s.config.BaseURL, ctx.Username))
+		q.Set("iss", fmt.Sprintf("%s/", strings.TrimSuffix(s.config.BaseURL, "/")))
+		u.RawQuery = q.Encode()
+
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+}
+
+// redeemAuthCode validates and consumes an authorization code presented by
+// a client to the authorization or token endpoint that issued it in codes.
+func (s *Server) redeemAuthCode(codes *TTLCache, r *http.Request) (*IndieAuthCode, error) {
+	token := r.FormValue("code")
+	if token == "" {
+		return nil, ErrIndieAuthInvalidCode
+	}
+
+	data := codes.GetString(token)
+	if data == "" {
+		return nil, ErrIndieAuthInvalidCode
+	}
+
+	// Codes can only be used once
+	codes.SetString(token, "")
+
+	code := &IndieAuthCode{}
+	if err := json.Unmarshal([]byte(data), code); err != nil {
+		return nil, err
+	}
+
+	if err := code.Verify(r.FormValue("client_id"), r.FormValue("redirect_uri"), r.FormValue("code_verifier")); err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// IndieAuthVerifyHandler lets clients redeem an authorization code for the
+// user's profile URL (authentication only)
+func (s *Server) IndieAuthVerifyHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		code, err := s.redeemAuthCode(s.indieAuthCodes, r)
+		if err != nil {
+			indieAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+			return
+		}
+
+		res := map[string]interface{}{
+			"me": URLForIndieAuthMe(s.config.BaseURL, code.Username),
+		}
+
+		if strings.Contains(code.Scope, "profile") {
+			if user, err := s.db.GetUser(code.Username); err == nil {
+				res["profile"] = map[string]string{
+					"name":  user.Username,
+					"url":   URLForIndieAuthMe(s.config.BaseURL, user.Username),
+					"photo": URLForAvatar(s.config.BaseURL, user.Username),
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// IndieAuthTokenHandler is the pod's IndieAuth token endpoint. Codes issued
+// with a scope are exchanged for an API token that can be used with the API
+// and Micropub endpoints. A GET request verifies an access token.
+func (s *Server) IndieAuthTokenHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.Method == http.MethodGet {
+			user, scope, err := s.bearerUser(r)
+			if err != nil {
+				indieAuthError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"me":    URLForIndieAuthMe(s.config.BaseURL, user.Username),
+				"scope": scope,
+			})
+			return
+		}
+
+		if grantType := r.FormValue("grant_type"); grantType != "" && grantType != "authorization_code" {
+			indieAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+			return
+		}
+
+		code, err := s.redeemAuthCode(s.indieAuthCodes, r)
+		if err != nil {
+			indieAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+			return
+		}
+
+		if code.Scope == "" {
+			indieAuthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code was not issued with a scope")
+			return
+		}
+
+		user, err := s.db.GetUser(code.Username)
+		if err != nil {
+			log.WithError(err).Error("error loading user object")
+			indieAuthError(w, http.StatusInternalServerError, "server_error", "Error loading user")
+			return
+		}
+
+		// The token is limited to the scope granted and isn't accepted by
+		// the pod's native API
+		token, err := s.api.CreateScopedToken(user, code.Scope, r)
+		if err != nil {
+			log.WithError(err).Error("error creating token")
+			indieAuthError(w, http.StatusInternalServerError, "server_error", "Error creating token")
+			return
+		}
+
+		user.AddToken(token)
+		if err := s.db.SetToken(token.Signature, token); err != nil {
+			log.WithError(err).Error("error saving token object")
+			indieAuthError(w, http.StatusInternalServerError, "server_error", "Error creating token")
+			return
+		}
+		if err := s.db.SetUser(user.Username, user); err != nil {
+			log.WithError(err).Error("error saving user object")
+			indieAuthError(w, http.StatusInternalServerError, "server_error", "Error creating token")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": token.Value,
+			"token_type":   "Bearer",
+			"scope":        code.Scope,
+			"me":           URLForIndieAuthMe(s.config.BaseURL, user.Username),
+		})
+	}
+}
+
+// IndieAuthMetadataHandler serves the IndieAuth server metadata document
+func (s *Server) IndieAuthMetadataHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           fmt.Sprintf("%s/", strings.TrimSuffix(s.config.BaseURL, "/")),
+			"authorization_endpoint":           URLForIndieAuth(s.config.BaseURL, "auth"),
+			"token_endpoint":                   URLForIndieAuth(s.config.BaseURL, "token"),
+			"code_challenge_methods_supported": []string{"S256"},
+			"response_types_supported":         []string{"code", "id"},
+			"grant_types_supported":            []string{"authorization_code"},
+			"scopes_supported":                 []string{"profile", "create", "update", "delete", "media"},
+		})
+	}
+}
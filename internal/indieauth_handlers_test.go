@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndieAuthTokenHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestAuthServer(t)
+
+	const (
+		clientID    = "https://app.example.com/"
+		redirectURI = "https://app.example.com/callback"
+	)
+
+	code := issueTestCode(t, s.indieAuthCodes, clientID, redirectURI, "create")
+	w := postForm(s.IndieAuthTokenHandler(), "/indieauth/token", url.Values{
+		"grant_type":   {"authorization_code"},
+		"client_id":    {clientID},
+		"redirect_uri": {redirectURI},
+		"code":         {code},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal("create", res["scope"])
+	assert.Equal(URLForIndieAuthMe(s.config.BaseURL, "alice"), res["me"])
+	accessToken := res["access_token"]
+	require.NotEmpty(t, accessToken)
+
+	verify := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/indieauth/token", nil)
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		s.IndieAuthTokenHandler()(w, r, nil)
+		return w
+	}
+
+	w = verify()
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal("create", res["scope"])
+	assert.Equal(URLForIndieAuthMe(s.config.BaseURL, "alice"), res["me"])
+
+	// The token is limited to the scope granted
+	s.config.MaxUploadSize = 1 << 20
+	w = postForm(s.MicropubHandler(), "/micropub", url.Values{
+		"access_token": {accessToken},
+		"action":       {"delete"},
+		"url":          {"https://example.com/twt/abcdefg"},
+	})
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// ... and isn't accepted by the native API
+	endpoint := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/ping", nil)
+	r.Header.Set("Token", accessToken)
+	w = httptest.NewRecorder()
+	s.api.isAuthorized(endpoint)(w, r, nil)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Nil(s.api.getLoggedInUser(r))
+
+	// Revoked tokens no longer verify
+	user, err := s.db.GetUser("alice")
+	require.NoError(t, err)
+	user.Tokens = nil
+	require.NoError(t, s.db.SetUser("alice", user))
+
+	w = verify()
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
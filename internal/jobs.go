@@ -2,6 +2,8 @@ package internal
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/jointwt/twtxt/types"
 	"github.com/robfig/cron"
@@ -30,12 +32,16 @@ func InitJobs(conf *Config) {
 		"UpdateFeedSources": NewJobSpec("@every 15m", NewUpdateFeedSourcesJob),
 
 		"DeleteOldSessions": NewJobSpec("@hourly", NewDeleteOldSessionsJob),
+		"ExpireTasks":       NewJobSpec("@hourly", NewExpireTasksJob),
+		"RotateFeeds":       NewJobSpec("@daily", NewRotateFeedsJob),
 
-		"Stats": NewJobSpec("@daily", NewStatsJob),
+		"Stats":                NewJobSpec("@daily", NewStatsJob),
+		"CollectOrphanedMedia": NewJobSpec("@daily", NewCollectOrphanedMediaJob),
 
 		"CreateBots":       NewJobSpec("", NewCreateBotsJob),
 		"CreateAdminFeeds": NewJobSpec("", NewCreateAdminFeedsJob),
 		"RemoveEmails":     NewJobSpec("", NewRemoveEmailsJob),
+		"MigrateTwtHashes": NewJobSpec("", NewMigrateTwtHashesJob),
 	}
 
 	StartupJobs = map[string]JobSpec{
@@ -45,6 +51,7 @@ func InitJobs(conf *Config) {
 		"CreateAdminFeeds":  Jobs["CreateAdminFeeds"],
 		"DeleteOldSessions": Jobs["DeleteOldSessions"],
 		"RemoveEmails":      Jobs["RemoveEmails"],
+		"MigrateTwtHashes":  Jobs["MigrateTwtHashes"],
 	}
 
 }
@@ -339,6 +346,30 @@ func (job *DeleteOldSessionsJob) Run() {
 	}
 }
 
+type ExpireTasksJob struct {
+	conf    *Config
+	blogs   *BlogsCache
+	cache   *Cache
+	archive Archiver
+	db      Store
+}
+
+func NewExpireTasksJob(conf *Config, blogs *BlogsCache, cache *Cache, archive Archiver, db Store) cron.Job {
+	return &ExpireTasksJob{conf: conf, blogs: blogs, cache: cache, archive: archive, db: db}
+}
+
+func (job *ExpireTasksJob) Run() {
+	log.Info("expiring finished tasks")
+
+	expired, err := ExpireTasks(job.db, job.conf.TaskRetention)
+	if err != nil {
+		log.WithError(err).Error("error expiring finished tasks")
+		return
+	}
+
+	log.Infof("expired %d finished tasks", expired)
+}
+
 type RemoveEmailsJob struct {
 	conf    *Config
 	blogs   *BlogsCache
@@ -384,3 +415,102 @@ func (job *RemoveEmailsJob) Run() {
 
 	log.Info("finished removing emails from user accounts")
 }
+
+type RotateFeedsJob struct {
+	conf    *Config
+	blogs   *BlogsCache
+	cache   *Cache
+	archive Archiver
+	db      Store
+}
+
+func NewRotateFeedsJob(conf *Config, blogs *BlogsCache, cache *Cache, archive Archiver, db Store) cron.Job {
+	return &RotateFeedsJob{conf: conf, blogs: blogs, cache: cache, archive: archive, db: db}
+}
+
+// Run rotates local feeds that have grown past half of MaxFetchLimit so
+// that other pods and clients can always fetch a feed's recent twts in
+// full, older twts are reachable by following the feed's `# prev` chain.
+func (job *RotateFeedsJob) Run() {
+	names := []string{}
+
+	users, err := job.db.GetAllUsers()
+	if err != nil {
+		log.WithError(err).Warn("unable to get all users from database")
+		return
+	}
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+
+	feeds, err := job.db.GetAllFeeds()
+	if err != nil {
+		log.WithError(err).Warn("unable to get all feeds from database")
+		return
+	}
+	for _, feed := range feeds {
+		names = append(names, feed.Name)
+	}
+
+	names = append(names, specialUsernames...)
+	names = append(names, twtxtBots...)
+
+	rotated := 0
+	for _, name := range UniqStrings(names) {
+		fn := filepath.Join(job.conf.Data, feedsDir, name)
+		stat, err := os.Stat(fn)
+		if err != nil || stat.Size() <= job.conf.MaxFetchLimit/2 {
+			continue
+		}
+
+		ok, err := RotateFeed(job.conf, name, job.conf.MaxCacheItems)
+		if err != nil {
+			log.WithError(err).Errorf("error rotating feed %s", name)
+			continue
+		}
+		if ok {
+			rotated++
+		}
+	}
+
+	log.Infof("rotated %d feeds", rotated)
+}
+
+type MigrateTwtHashesJob struct {
+	conf    *Config
+	blogs   *BlogsCache
+	cache   *Cache
+	archive Archiver
+	db      Store
+}
+
+func NewMigrateTwtHashesJob(conf *Config, blogs *BlogsCache, cache *Cache, archive Archiver, db Store) cron.Job {
+	return &MigrateTwtHashesJob{conf: conf, blogs: blogs, cache: cache, archive: archive, db: db}
+}
+
+func (job *MigrateTwtHashesJob) Run() {
+	if err := MigrateTwtHashes(job.conf, job.db, job.archive); err != nil {
+		log.WithError(err).Error("error migrating twt hashes")
+	}
+}
+
+type CollectOrphanedMediaJob struct {
+	conf    *Config
+	blogs   *BlogsCache
+	cache   *Cache
+	archive Archiver
+	db      Store
+}
+
+func NewCollectOrphanedMediaJob(conf *Config, blogs *BlogsCache, cache *Cache, archive Archiver, db Store) cron.Job {
+	return &CollectOrphanedMediaJob{conf: conf, blogs: blogs, cache: cache, archive: archive, db: db}
+}
+
+// Run reports uploaded media that no local feed, blog post or message has
+// referenced for the orphaned media grace period and deletes it if the pod
+// is configured to delete orphaned media.
+func (job *CollectOrphanedMediaJob) Run() {
+	if _, err := CollectOrphanedMedia(job.conf); err != nil {
+		log.WithError(err).Error("error collecting orphaned media")
+	}
+}
@@ -259,26 +259,11 @@ func (s *Server) DelUserHandler() httprouter.Handle {
 
 							// Remove all uploaded media in a twt
 							for _, mediaPath := range mediaPaths {
-								// Delete .png
-								fn := filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.png", mediaPath))
-								if FileExists(fn) {
-									if err := os.Remove(fn); err != nil {
-										ctx.Error = true
-										ctx.Message = "An error occured whilst deleting your account"
-										s.render("error", w, ctx)
-										return
-									}
-								}
-
-								// Delete .webp
-								fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.webp", mediaPath))
-								if FileExists(fn) {
-									if err := os.Remove(fn); err != nil {
-										ctx.Error = true
-										ctx.Message = "An error occured whilst deleting your account"
-										s.render("error", w, ctx)
-										return
-									}
+								if err := ReleaseMedia(s.config, mediaPath, username); err != nil {
+									ctx.Error = true
+									ctx.Message = "An error occured whilst deleting your account"
+									s.render("error", w, ctx)
+									return
 								}
 							}
 						}
@@ -304,6 +289,14 @@ func (s *Server) DelUserHandler() httprouter.Handle {
 					}
 				}
 
+				// Delete feed's rotated (archived) twtxt files
+				if err := DeleteRotatedFeeds(s.config, nick); err != nil {
+					log.WithError(err).Error("error removing feed's rotated feeds")
+				}
+				if err := DeleteTwtMarkers(s.config, nick); err != nil {
+					log.WithError(err).Error("error removing feed's twt markers")
+				}
+
 				// Delete feed from cache
 				s.cache.Delete(feed.Source())
 			}
@@ -332,26 +325,11 @@ func (s *Server) DelUserHandler() httprouter.Handle {
 
 			// Remove all uploaded media in a twt
 			for _, mediaPath := range mediaPaths {
-				// Delete .png
-				fn := filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.png", mediaPath))
-				if FileExists(fn) {
-					if err := os.Remove(fn); err != nil {
-						log.WithError(err).Error("error removing media")
-						ctx.Error = true
-						ctx.Message = "An error occured whilst deleting your account"
-						s.render("error", w, ctx)
-					}
-				}
-
-				// Delete .webp
-				fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.webp", mediaPath))
-				if FileExists(fn) {
-					if err := os.Remove(fn); err != nil {
-						log.WithError(err).Error("error removing media")
-						ctx.Error = true
-						ctx.Message = "An error occured whilst deleting your account"
-						s.render("error", w, ctx)
-					}
+				if err := ReleaseMedia(s.config, mediaPath, username); err != nil {
+					log.WithError(err).Error("error removing media")
+					ctx.Error = true
+					ctx.Message = "An error occured whilst deleting your account"
+					s.render("error", w, ctx)
 				}
 			}
 		}
@@ -375,6 +353,14 @@ func (s *Server) DelUserHandler() httprouter.Handle {
 			}
 		}
 
+		// Delete user's rotated (archived) twtxt files
+		if err := DeleteRotatedFeeds(s.config, user.Username); err != nil {
+			log.WithError(err).Error("error removing user's rotated feeds")
+		}
+		if err := DeleteTwtMarkers(s.config, user.Username); err != nil {
+			log.WithError(err).Error("error removing user's twt markers")
+		}
+
 		// Delete user
 		if err := s.db.DelUser(user.Username); err != nil {
 			ctx.Error = true
@@ -450,3 +436,69 @@ func (s *Server) RstUserHandler() httprouter.Handle {
 		s.render("error", w, ctx)
 	}
 }
+
+// ManageTasksHandler lists the queued, running and failed tasks
+func (s *Server) ManageTasksHandler() httprouter.Handle {
+	isAdminUser := IsAdminUserFactory(s.config)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		if !isAdminUser(ctx.User) {
+			ctx.Error = true
+			ctx.Message = "You are not a Pod Owner!"
+			s.render("403", w, ctx)
+			return
+		}
+
+		tasks, err := s.tasks.Tasks()
+		if err != nil {
+			log.WithError(err).Error("error loading tasks")
+			ctx.Error = true
+			ctx.Message = "Error loading tasks"
+			s.render("error", w, ctx)
+			return
+		}
+
+		for _, task := range tasks {
+			switch task.State {
+			case TaskStateRunning:
+				ctx.RunningTasks = append(ctx.RunningTasks, task)
+			case TaskStatePending:
+				ctx.QueuedTasks = append(ctx.QueuedTasks, task)
+			case TaskStateFailed:
+				ctx.FailedTasks = append(ctx.FailedTasks, task)
+			}
+		}
+
+		s.render("manageTasks", w, ctx)
+	}
+}
+
+// CancelTaskHandler cancels a queued or running task
+func (s *Server) CancelTaskHandler() httprouter.Handle {
+	isAdminUser := IsAdminUserFactory(s.config)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		if !isAdminUser(ctx.User) {
+			ctx.Error = true
+			ctx.Message = "You are not a Pod Owner!"
+			s.render("403", w, ctx)
+			return
+		}
+
+		id := strings.TrimSpace(r.FormValue("id"))
+
+		if err := s.tasks.Cancel(id); err != nil {
+			log.WithError(err).Errorf("error cancelling task %s", id)
+			ctx.Error = true
+			ctx.Message = fmt.Sprintf("Error cancelling task %s: %s", id, err)
+			s.render("error", w, ctx)
+			return
+		}
+
+		http.Redirect(w, r, "/manage/tasks", http.StatusFound)
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+const (
+	twtMarkersDir = "markers"
+
+	// maxTwtMarkers is the maximum number of a feed's most recent twt
+	// markers that are kept, older markers are pruned
+	maxTwtMarkers = 1000
+)
+
+// twtMarkersMu serializes updates to the twt markers of local feeds
+var twtMarkersMu sync.Mutex
+
+// GetTwtMarkers returns the `# delete = <hash>` and
+// `# edit = <hash> <replacement>` markers recorded for a local feed, which
+// are served along with the feed so other pods can hide deleted twts and
+// show edited ones.
+func GetTwtMarkers(conf *Config, name string) string {
+	fn := filepath.Join(conf.Data, twtMarkersDir, name)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("error reading twt markers for %s", name)
+		}
+		return ""
+	}
+
+	return string(data)
+}
+
+// RecordTwtDelete records that the twt with the given hash has been deleted
+// from a local feed
+func RecordTwtDelete(conf *Config, name, hash string) error {
+	return appendTwtMarker(conf, name, lextwt.NewDeleteComment(hash))
+}
+
+// RecordTwtEdit records that the twt with the given hash in a local feed has
+// been replaced by the edited twt with the replacement hash
+func RecordTwtEdit(conf *Config, name, hash, replacement string) error {
+	return appendTwtMarker(conf, name, lextwt.NewEditComment(hash, replacement))
+}
+
+// DeleteTwtMarkers removes all recorded twt markers of a local feed
+func DeleteTwtMarkers(conf *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(conf.Data, twtMarkersDir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func appendTwtMarker(conf *Config, name string, marker *lextwt.Comment) error {
+	twtMarkersMu.Lock()
+	defer twtMarkersMu.Unlock()
+
+	p := filepath.Join(conf.Data, twtMarkersDir)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		log.WithError(err).Error("error creating twt markers directory")
+		return err
+	}
+
+	fn := filepath.Join(p, name)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	markers := strings.SplitAfter(string(data)+marker.Literal(), "\n")
+	if markers[len(markers)-1] == "" {
+		markers = markers[:len(markers)-1]
+	}
+	if len(markers) > maxTwtMarkers {
+		markers = markers[len(markers)-maxTwtMarkers:]
+	}
+
+	tf, err := ioutil.TempFile(p, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.WriteString(strings.Join(markers, "")); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), fn)
+}
@@ -0,0 +1,655 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jointwt/twtxt"
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	// mastodonDefaultLimit is the default number of statuses or
+	// notifications returned by the Mastodon-compatible API
+	mastodonDefaultLimit = 20
+
+	// mastodonMaxLimit is the maximum number of statuses or notifications a
+	// client can request per page
+	mastodonMaxLimit = 40
+
+	// mastodonCompatVersion is the Mastodon API version we claim to be
+	// compatible with. Clients feature detect on this.
+	mastodonCompatVersion = "3.0.0"
+
+	// mastodonOOBRedirectURI is used by clients that cannot receive a
+	// redirect and instead ask the user to copy the authorization code
+	mastodonOOBRedirectURI = "urn:ietf:wg:oauth:2.0:oob"
+)
+
+var subjectHashRegexp = regexp.MustCompile(`\(#([a-z0-9]+)\)`)
+
+type mastodonAccount struct {
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	Acct           string        `json:"acct"`
+	DisplayName    string        `json:"display_name"`
+	Locked         bool          `json:"locked"`
+	Bot            bool          `json:"bot"`
+	CreatedAt      time.Time     `json:"created_at"`
+	Note           string        `json:"note"`
+	URL            string        `json:"url"`
+	Avatar         string        `json:"avatar"`
+	AvatarStatic   string        `json:"avatar_static"`
+	Header         string        `json:"header"`
+	HeaderStatic   string        `json:"header_static"`
+	FollowersCount int           `json:"followers_count"`
+	FollowingCount int           `json:"following_count"`
+	StatusesCount  int           `json:"statuses_count"`
+	Emojis         []interface{} `json:"emojis"`
+	Fields         []interface{} `json:"fields"`
+}
+
+type mastodonMention struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Acct     string `json:"acct"`
+	URL      string `json:"url"`
+}
+
+type mastodonTag struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type mastodonMediaAttachment struct {
+	ID          string      `json:"id"`
+	Type        string      `json:"type"`
+	URL         *string     `json:"url"`
+	PreviewURL  *string     `json:"preview_url"`
+	RemoteURL   *string     `json:"remote_url"`
+	TextURL     *string     `json:"text_url"`
+	Meta        interface{} `json:"meta"`
+	Description *string     `json:"description"`
+	Blurhash    *string     `json:"blurhash"`
+}
+
+type mastodonStatus struct {
+	ID                 string                    `json:"id"`
+	URI                string                    `json:"uri"`
+	URL                string                    `json:"url"`
+	CreatedAt          time.Time                 `json:"created_at"`
+	Account            mastodonAccount           `json:"account"`
+	Content            string                    `json:"content"`
+	Text               string                    `json:"text,omitempty"`
+	Visibility         string                    `json:"visibility"`
+	Sensitive          bool                      `json:"sensitive"`
+	SpoilerText        string                    `json:"spoiler_text"`
+	MediaAttachments   []mastodonMediaAttachment `json:"media_attachments"`
+	Mentions           []mastodonMention         `json:"mentions"`
+	Tags               []mastodonTag             `json:"tags"`
+	Emojis             []interface{}             `json:"emojis"`
+	InReplyToID        *string                   `json:"in_reply_to_id"`
+	InReplyToAccountID *string                   `json:"in_reply_to_account_id"`
+	Reblog             *mastodonStatus           `json:"reblog"`
+	Card               interface{}               `json:"card"`
+	Poll               interface{}               `json:"poll"`
+	Language           *string                   `json:"language"`
+	RepliesCount       int                       `json:"replies_count"`
+	ReblogsCount       int                       `json:"reblogs_count"`
+	FavouritesCount    int                       `json:"favourites_count"`
+	Favourited         bool                      `json:"favourited"`
+	Reblogged          bool                      `json:"reblogged"`
+	Muted              bool                      `json:"muted"`
+	Bookmarked         bool                      `json:"bookmarked"`
+}
+
+type mastodonContext struct {
+	Ancestors   []mastodonStatus `json:"ancestors"`
+	Descendants []mastodonStatus `json:"descendants"`
+}
+
+type mastodonNotification struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Account   mastodonAccount `json:"account"`
+	Status    *mastodonStatus `json:"status"`
+}
+
+type mastodonRelationship struct {
+	ID                  string `json:"id"`
+	Following           bool   `json:"following"`
+	ShowingReblogs      bool   `json:"showing_reblogs"`
+	Notifying           bool   `json:"notifying"`
+	FollowedBy          bool   `json:"followed_by"`
+	Blocking            bool   `json:"blocking"`
+	BlockedBy           bool   `json:"blocked_by"`
+	Muting              bool   `json:"muting"`
+	MutingNotifications bool   `json:"muting_notifications"`
+	Requested           bool   `json:"requested"`
+	DomainBlocking      bool   `json:"domain_blocking"`
+	Endorsed            bool   `json:"endorsed"`
+	Note                string `json:"note"`
+}
+
+type mastodonApplication struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Website      string `json:"website"`
+	RedirectURI  string `json:"redirect_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	VapidKey     string `json:"vapid_key"`
+}
+
+type mastodonToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func mastodonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func mastodonJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// mastodonParseForm parses the request's form values. Mastodon clients send
+// parameters as query strings, form-encoded or JSON bodies interchangeably so
+// JSON bodies are merged into r.Form to be read with r.FormValue() as usual.
+func mastodonParseForm(r *http.Request) error {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "application/json" {
+		if ctype == "multipart/form-data" {
+			return r.ParseMultipartForm(32 << 20)
+		}
+		return r.ParseForm()
+	}
+
+	var params map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	for k, v := range params {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				r.Form.Add(fmt.Sprintf("%s[]", k), fmt.Sprint(e))
+			}
+		case nil:
+		default:
+			r.Form.Set(k, fmt.Sprint(v))
+		}
+	}
+
+	return nil
+}
+
+// mastodonFormValues returns the values of an array parameter which clients
+// send as either name[] or name
+func mastodonFormValues(r *http.Request, name string) []string {
+	if values := r.Form[fmt.Sprintf("%s[]", name)]; len(values) > 0 {
+		return values
+	}
+	return r.Form[name]
+}
+
+// mastodonHasScope reports whether the space separated scopes granted to a
+// client include the scope required, e.g: write grants write:statuses and
+// the legacy follow scope grants read:follows and write:follows
+func mastodonHasScope(granted, required string) bool {
+	for _, scope := range strings.Fields(granted) {
+		if scope == required || strings.HasPrefix(required, scope+":") {
+			return true
+		}
+		if scope == "follow" {
+			switch required {
+			case "read:follows", "write:follows", "write:blocks", "write:mutes":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mastodonValidScopes reports whether all of the scopes requested by a
+// client were registered by its application
+func mastodonValidScopes(requested, registered string) bool {
+	for _, scope := range strings.Fields(requested) {
+		if !mastodonHasScope(registered, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// twtSubjectHash returns the hash of the twt a twt is in reply to (if any)
+func twtSubjectHash(twt types.Twt) string {
+	if twt.Subject() == nil {
+		return ""
+	}
+	match := subjectHashRegexp.FindStringSubmatch(twt.Subject().String())
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// mastodonMediaType maps a media URI to a Mastodon attachment type
+func mastodonMediaType(uri string) string {
+	switch strings.ToLower(filepath.Ext(uri)) {
+	case ".mp4", ".webm", ".mov":
+		return "video"
+	case ".ogg", ".mp3", ".m4a", ".wav":
+		return "audio"
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return "image"
+	default:
+		return "unknown"
+	}
+}
+
+func newMastodonMediaAttachment(id, uri string) mastodonMediaAttachment {
+	attachment := mastodonMediaAttachment{ID: id, Type: "unknown"}
+	if uri != "" {
+		attachment.Type = mastodonMediaType(uri)
+		attachment.URL = &uri
+		attachment.PreviewURL = &uri
+	}
+	return attachment
+}
+
+// setMetadata describes the attachment with the metadata of the uploaded
+// media it is for
+func (a *mastodonMediaAttachment) setMetadata(meta *MediaMetadata) {
+	if meta == nil {
+		return
+	}
+
+	switch {
+	case meta.IsImage():
+		a.Type = "image"
+	case meta.Animated:
+		a.Type = "gifv"
+	case strings.HasPrefix(meta.ContentType, "video/"):
+		a.Type = "video"
+	case strings.HasPrefix(meta.ContentType, "audio/"):
+		a.Type = "audio"
+	}
+
+	if a.URL != nil {
+		if meta.IsImage() {
+			if _, ok := meta.Sizes["thumb"]; ok {
+				preview := *a.URL + "?size=thumb"
+				a.PreviewURL = &preview
+			}
+		} else if a.Type == "video" || a.Type == "gifv" {
+			preview := ReplaceExt(*a.URL, "")
+			a.PreviewURL = &preview
+		}
+	}
+
+	if meta.Description != "" {
+		a.Description = &meta.Description
+	}
+	if meta.Blurhash != "" {
+		a.Blurhash = &meta.Blurhash
+	}
+
+	info := func(width, height int) map[string]interface{} {
+		m := map[string]interface{}{}
+		if width > 0 && height > 0 {
+			m["width"] = width
+			m["height"] = height
+			m["size"] = fmt.Sprintf("%dx%d", width, height)
+			m["aspect"] = float64(width) / float64(height)
+		}
+		return m
+	}
+
+	original := info(meta.Width, meta.Height)
+	if meta.Duration > 0 {
+		original["duration"] = meta.Duration
+	}
+	m := map[string]interface{}{"original": original}
+	if thumb, ok := meta.Sizes["thumb"]; ok {
+		m["small"] = info(thumb.Width, thumb.Height)
+	}
+	a.Meta = m
+}
+
+// mastodonAccountID returns a stable account id for a twter. Local users and
+// feeds are identified by their name, external feeds by a hash of their url.
+func (s *Server) mastodonAccountID(twter types.Twter) string {
+	if strings.HasPrefix(twter.URL, s.config.BaseURL) {
+		nick := NormalizeUsername(filepath.Base(UserURL(twter.URL)))
+		if s.db.HasUser(nick) || s.db.HasFeed(nick) {
+			return nick
+		}
+	}
+	return FastHash(twter.URL)
+}
+
+// mastodonAcct returns a twter's acct (nick for local twters, nick@domain
+// for everyone else)
+func (s *Server) mastodonAcct(twter types.Twter) string {
+	if strings.HasPrefix(twter.URL, s.config.BaseURL) {
+		return twter.Nick
+	}
+	return fmt.Sprintf("%s@%s", twter.Nick, twter.Domain())
+}
+
+// lookupMastodonAccount resolves an account id as returned by
+// mastodonAccountID back to a twter searching the viewer's followings and the
+// cache for external feeds
+func (s *Server) lookupMastodonAccount(id string, viewer *User) (types.Twter, bool) {
+	if s.db.HasUser(id) {
+		user, err := s.db.GetUser(id)
+		if err == nil {
+			return user.Twter(), true
+		}
+	}
+
+	if s.db.HasFeed(id) {
+		feed, err := s.db.GetFeed(id)
+		if err == nil {
+			return types.Twter{Nick: feed.Name, URL: feed.URL}, true
+		}
+	}
+
+	if viewer != nil {
+		for nick, url := range viewer.Following {
+			if FastHash(url) == id {
+				return types.Twter{Nick: nick, URL: url}, true
+			}
+		}
+	}
+
+	for _, twt := range s.cache.GetAll() {
+		if twter := twt.Twter(); FastHash(twter.URL) == id {
+			return twter, true
+		}
+		for _, m := range twt.Mentions() {
+			if twter := m.Twter(); twter.URL != "" && FastHash(twter.URL) == id {
+				return twter, true
+			}
+		}
+	}
+
+	return types.Twter{}, false
+}
+
+func (s *Server) newMastodonAccount(twter types.Twter) mastodonAccount {
+	account := mastodonAccount{
+		ID:          s.mastodonAccountID(twter),
+		Username:    twter.Nick,
+		Acct:        s.mastodonAcct(twter),
+		DisplayName: twter.Nick,
+		Note:        twter.Tagline,
+		URL:         URLForExternalProfile(s.config, twter.Nick, twter.URL),
+		Avatar:      URLForExternalAvatar(s.config, twter.URL),
+		Emojis:      []interface{}{},
+		Fields:      []interface{}{},
+	}
+
+	if account.ID == twter.Nick && s.db.HasUser(twter.Nick) {
+		if user, err := s.db.GetUser(twter.Nick); err == nil {
+			account.CreatedAt = user.CreatedAt
+			account.Note = user.Tagline
+			account.URL = UserURL(user.URL)
+			account.Avatar = URLForAvatar(s.config.BaseURL, user.Username)
+			if user.IsFollowersPubliclyVisible {
+				account.FollowersCount = len(user.Followers)
+			}
+			if user.IsFollowingPubliclyVisible {
+				account.FollowingCount = len(user.Following)
+			}
+		}
+	} else if account.ID == twter.Nick && s.db.HasFeed(twter.Nick) {
+		if feed, err := s.db.GetFeed(twter.Nick); err == nil {
+			account.CreatedAt = feed.CreatedAt
+			account.Note = feed.Description
+			account.URL = UserURL(URLForUser(s.config.BaseURL, feed.Name))
+			account.Avatar = URLForAvatar(s.config.BaseURL, feed.Name)
+			account.FollowersCount = len(feed.Followers)
+			account.Bot = true
+		}
+	}
+
+	if account.CreatedAt.IsZero() {
+		account.CreatedAt = time.Unix(0, 0).UTC()
+	}
+
+	account.AvatarStatic = account.Avatar
+	account.StatusesCount = len(s.cache.GetByURL(twter.URL))
+
+	return account
+}
+
+func (s *Server) newMastodonStatus(twt types.Twt, viewer *User) mastodonStatus {
+	formatTwt := FormatTwtFactory(s.config)
+
+	status := mastodonStatus{
+		ID:               twt.Hash(),
+		URI:              URLForTwt(s.config.BaseURL, twt.Hash()),
+		URL:              URLForTwt(s.config.BaseURL, twt.Hash()),
+		CreatedAt:        twt.Created().UTC(),
+		Account:          s.newMastodonAccount(twt.Twter()),
+		Content:          string(formatTwt(twt)),
+		Sensitive:        twt.ContentWarning() != "",
+		SpoilerText:      twt.ContentWarning(),
+		Visibility:       "public",
+		MediaAttachments: []mastodonMediaAttachment{},
+		Mentions:         []mastodonMention{},
+		Tags:             []mastodonTag{},
+		Emojis:           []interface{}{},
+	}
+
+	if hash := twtSubjectHash(twt); hash != "" && hash != twt.Hash() {
+		status.InReplyToID = &hash
+		if parent, ok := s.cache.Lookup(hash); ok {
+			accountID := s.mastodonAccountID(parent.Twter())
+			status.InReplyToAccountID = &accountID
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range twt.Mentions() {
+		twter := m.Twter()
+		if seen[twter.URL] {
+			continue
+		}
+		seen[twter.URL] = true
+		status.Mentions = append(status.Mentions, mastodonMention{
+			ID:       s.mastodonAccountID(twter),
+			Username: twter.Nick,
+			Acct:     s.mastodonAcct(twter),
+			URL:      URLForExternalProfile(s.config, twter.Nick, twter.URL),
+		})
+	}
+
+	var tags types.TagList = twt.Tags()
+	for _, tag := range UniqStrings(tags.Tags()) {
+		if tag == "" || tag == status.ID || (status.InReplyToID != nil && tag == *status.InReplyToID) {
+			continue
+		}
+		status.Tags = append(status.Tags, mastodonTag{
+			Name: tag,
+			URL:  URLForTag(s.config.BaseURL, tag),
+		})
+	}
+
+	for _, link := range twt.Links() {
+		if media, ok := link.(interface{ IsMedia() bool }); ok && media.IsMedia() {
+			attachment := newMastodonMediaAttachment(FastHash(link.Target()), link.Target())
+			if strings.HasPrefix(link.Target(), s.config.BaseURL) {
+				attachment = s.newMastodonMediaAttachment(MediaName(link.Target()), link.Target())
+			}
+			status.MediaAttachments = append(status.MediaAttachments, attachment)
+		}
+	}
+
+	if viewer != nil {
+		status.Bookmarked = viewer.Bookmarked(twt.Hash())
+		status.Muted = viewer.HasMuted(twt.Twter().URL)
+	}
+
+	return status
+}
+
+func (s *Server) newMastodonStatuses(twts types.Twts, viewer *User) []mastodonStatus {
+	statuses := make([]mastodonStatus, 0, len(twts))
+	for _, twt := range twts {
+		statuses = append(statuses, s.newMastodonStatus(twt, viewer))
+	}
+	return statuses
+}
+
+func (s *Server) newMastodonRelationship(id string, twter types.Twter, user *User) mastodonRelationship {
+	relationship := mastodonRelationship{
+		ID:             id,
+		Following:      user.Follows(twter.URL),
+		ShowingReblogs: true,
+		Muting:         user.HasMuted(twter.URL),
+	}
+
+	if s.db.HasUser(id) {
+		if followee, err := s.db.GetUser(id); err == nil {
+			relationship.FollowedBy = followee.Follows(user.URL)
+		}
+	}
+
+	return relationship
+}
+
+func (s *Server) newMastodonInstance() map[string]interface{} {
+	return map[string]interface{}{
+		"uri":               HostnameFromURL(s.config.BaseURL),
+		"title":             s.config.Name,
+		"short_description": s.config.Description,
+		"description":       s.config.Description,
+		"email":             s.config.AdminEmail,
+		"version":           fmt.Sprintf("%s (compatible; twtxt %s)", mastodonCompatVersion, twtxt.FullVersion()),
+		"urls":              map[string]string{},
+		"stats": map[string]interface{}{
+			"user_count":   s.db.LenUsers(),
+			"status_count": s.cache.Count(),
+			"domain_count": 1,
+		},
+		"thumbnail":         URLForPage(s.config.BaseURL, "img/favicon.png"),
+		"languages":         []string{"en"},
+		"registrations":     s.config.OpenRegistrations,
+		"approval_required": false,
+		"invites_enabled":   false,
+		"configuration": map[string]interface{}{
+			"statuses": map[string]interface{}{
+				"max_characters":              s.config.MaxTwtLength,
+				"max_media_attachments":       4,
+				"characters_reserved_per_url": 0,
+			},
+			"media_attachments": map[string]interface{}{
+				"supported_mime_types": []string{
+					"image/jpeg", "image/png", "image/gif", "image/webp",
+					"video/mp4", "video/webm", "audio/mpeg", "audio/ogg",
+				},
+				"image_size_limit": s.config.MaxUploadSize,
+				"video_size_limit": s.config.MaxUploadSize,
+			},
+		},
+		"contact_account": nil,
+	}
+}
+
+// mastodonPaginate returns the page of twts (sorted newest first) selected by
+// the max_id, since_id, min_id and limit parameters and sets the Link header
+// clients use to fetch the next and previous pages.
+func (s *Server) mastodonPaginate(w http.ResponseWriter, r *http.Request, twts types.Twts) types.Twts {
+	limit := SafeParseInt(r.FormValue("limit"), mastodonDefaultLimit)
+	if limit <= 0 || limit > mastodonMaxLimit {
+		limit = mastodonDefaultLimit
+	}
+
+	indexOf := func(hash string) int {
+		for i, twt := range twts {
+			if twt.Hash() == hash {
+				return i
+			}
+		}
+		return -1
+	}
+
+	start, end := 0, len(twts)
+
+	if maxID := r.FormValue("max_id"); maxID != "" {
+		if i := indexOf(maxID); i >= 0 {
+			start = i + 1
+		}
+	}
+
+	if sinceID := r.FormValue("since_id"); sinceID != "" {
+		if i := indexOf(sinceID); i >= 0 && i < end {
+			end = i
+		}
+	}
+
+	if minID := r.FormValue("min_id"); minID != "" {
+		if i := indexOf(minID); i >= 0 && i < end {
+			end = i
+		}
+		// min_id returns the statuses immediately newer than min_id
+		if end-limit > start {
+			start = end - limit
+		}
+	}
+
+	if start > end {
+		start = end
+	}
+	if end-start > limit {
+		end = start + limit
+	}
+
+	page := twts[start:end]
+
+	if len(page) > 0 {
+		link := func(param, hash string) string {
+			q := url.Values{}
+			for k, v := range r.URL.Query() {
+				if k != "max_id" && k != "since_id" && k != "min_id" {
+					q[k] = v
+				}
+			}
+			q.Set(param, hash)
+			return fmt.Sprintf(
+				"%s%s?%s",
+				strings.TrimSuffix(s.config.BaseURL, "/"), r.URL.Path, q.Encode(),
+			)
+		}
+		w.Header().Set("Link", fmt.Sprintf(
+			`<%s>; rel="next", <%s>; rel="prev"`,
+			link("max_id", page[len(page)-1].Hash()),
+			link("min_id", page[0].Hash()),
+		))
+	}
+
+	return page
+}
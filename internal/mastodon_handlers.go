@@ -0,0 +1,1053 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt"
+	"github.com/jointwt/twtxt/internal/session"
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	// mastodonMediaWait is the maximum time the v2 media endpoint waits for
+	// media to be processed before responding with 202 Accepted and letting
+	// the client poll GET /api/v1/media/:id instead
+	mastodonMediaWait = 5 * time.Second
+)
+
+// mastodonUser authenticates a request made with an API token as a Bearer
+// token. Tokens revoked via /oauth/revoke are no longer accepted.
+func (s *Server) mastodonUser(r *http.Request) (*User, error) {
+	user, _, err := s.bearerUser(r)
+	return user, err
+}
+
+// bearerUser authenticates a request made with an API token as a Bearer
+// token and returns the scopes the token was granted, an empty scope is an
+// unrestricted API token. Tokens revoked by their user are not accepted.
+func (s *Server) bearerUser(r *http.Request) (*User, string, error) {
+	tokenString := micropubToken(r)
+	if tokenString == "" {
+		return nil, "", ErrInvalidToken
+	}
+
+	token, err := jwt.Parse(tokenString, s.api.jwtKeyFunc)
+	if err != nil || !token.Valid {
+		return nil, "", ErrInvalidToken
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	username, ok := claims["username"].(string)
+	if !ok {
+		return nil, "", ErrInvalidToken
+	}
+
+	user, err := s.db.GetUser(username)
+	if err != nil {
+		log.WithError(err).Error("error loading user object")
+		return nil, "", ErrInvalidToken
+	}
+
+	if !user.HasToken(token.Signature) {
+		return nil, "", ErrInvalidToken
+	}
+
+	// Every registered new user follows themselves
+	if user.Following == nil {
+		user.Following = make(map[string]string)
+	}
+	user.Following[user.Username] = user.URL
+
+	scope, _ := claims["scope"].(string)
+
+	return user, scope, nil
+}
+
+// isMastodonAuthorized requires a valid token granted the scope required
+func (s *Server) isMastodonAuthorized(required string, endpoint httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, scope, err := s.bearerUser(r)
+		if err != nil {
+			mastodonError(w, http.StatusUnauthorized, "The access token is invalid")
+			return
+		}
+
+		if scope != "" && !mastodonHasScope(scope, required) {
+			mastodonError(w, http.StatusForbidden, "This action is outside the authorized scopes")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UserContextKey, user)
+		endpoint(w, r.WithContext(ctx), p)
+	}
+}
+
+// createMastodonToken issues and persists a new API token for the user
+// limited to the scope granted
+func (s *Server) createMastodonToken(user *User, scope string, r *http.Request) (*Token, error) {
+	token, err := s.api.CreateScopedToken(user, scope, r)
+	if err != nil {
+		return nil, err
+	}
+
+	user.AddToken(token)
+	if err := s.db.SetToken(token.Signature, token); err != nil {
+		return nil, err
+	}
+	if err := s.db.SetUser(user.Username, user); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// lookupMastodonStatus finds a twt by its hash in the cache or archive
+func (s *Server) lookupMastodonStatus(hash string) (types.Twt, bool) {
+	if twt, ok := s.cache.Lookup(hash); ok {
+		return twt, true
+	}
+
+	if s.archive.Has(hash) {
+		twt, err := s.archive.Get(hash)
+		if err != nil {
+			log.WithError(err).Errorf("error fetching twt %s from archive", hash)
+			return types.NilTwt, false
+		}
+		return twt, true
+	}
+
+	return types.NilTwt, false
+}
+
+// MastodonAppsHandler registers a client application (POST /api/v1/apps)
+func (s *Server) MastodonAppsHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if err := mastodonParseForm(r); err != nil {
+			mastodonError(w, http.StatusBadRequest, "Error parsing request")
+			return
+		}
+
+		name := strings.TrimSpace(r.FormValue("client_name"))
+		redirectURIs := strings.Fields(r.FormValue("redirect_uris"))
+		if name == "" || len(redirectURIs) == 0 {
+			mastodonError(w, http.StatusUnprocessableEntity, "Validation failed: client_name and redirect_uris are required")
+			return
+		}
+
+		scopes := strings.Join(strings.Fields(r.FormValue("scopes")), " ")
+		if scopes == "" {
+			scopes = "read"
+		}
+
+		app := &App{
+			ClientID:     GenerateRandomToken(),
+			ClientSecret: GenerateRandomToken(),
+			Name:         name,
+			Website:      r.FormValue("website"),
+			RedirectURIs: redirectURIs,
+			Scopes:       scopes,
+			CreatedAt:    time.Now(),
+		}
+
+		if err := s.db.SetApp(app.ClientID, app); err != nil {
+			log.WithError(err).Error("error saving app object")
+			mastodonError(w, http.StatusInternalServerError, "Error registering application")
+			return
+		}
+
+		mastodonJSON(w, http.StatusOK, mastodonApplication{
+			ID:           app.ClientID,
+			Name:         app.Name,
+			Website:      app.Website,
+			RedirectURI:  strings.Join(app.RedirectURIs, "\n"),
+			ClientID:     app.ClientID,
+			ClientSecret: app.ClientSecret,
+		})
+	}
+}
+
+// MastodonInstanceHandler describes the pod (GET /api/v1/instance)
+func (s *Server) MastodonInstanceHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		mastodonJSON(w, http.StatusOK, s.newMastodonInstance())
+	}
+}
+
+// OAuthAuthorizeHandler asks the logged in user to authorize a registered
+// application to access their account (GET /oauth/authorize)
+func (s *Server) OAuthAuthorizeHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		if !ctx.Authenticated {
+			if sess := r.Context().Value(session.SessionKey); sess != nil {
+				_ = sess.(*session.Session).Set("redirect", r.URL.RequestURI())
+			}
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		app, err := s.db.GetApp(r.FormValue("client_id"))
+		if err != nil || r.FormValue("response_type") != "code" || !app.HasRedirectURI(r.FormValue("redirect_uri")) {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorOAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		scope := r.FormValue("scope")
+		if scope == "" {
+			scope = app.Scopes
+		}
+		if !mastodonValidScopes(scope, app.Scopes) {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorOAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		ctx.Title = s.tr(ctx, "OAuthTitle")
+		ctx.IndieAuth = IndieAuthRequest{
+			ClientID:            app.ClientID,
+			ClientName:          app.Name,
+			RedirectURI:         r.FormValue("redirect_uri"),
+			State:               r.FormValue("state"),
+			ResponseType:        "code",
+			Scope:               scope,
+			Scopes:              strings.Fields(scope),
+			CodeChallenge:       r.FormValue("code_challenge"),
+			CodeChallengeMethod: r.FormValue("code_challenge_method"),
+		}
+
+		s.render("oauth", w, ctx)
+	}
+}
+
+// OAuthApproveHandler issues an authorization code once the user has
+// authorized an application (POST /oauth/authorize)
+func (s *Server) OAuthApproveHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := NewContext(s.config, s.db, r)
+
+		app, err := s.db.GetApp(r.FormValue("client_id"))
+		redirectURI := r.FormValue("redirect_uri")
+		if err != nil || !app.HasRedirectURI(redirectURI) || !mastodonValidScopes(r.FormValue("scope"), app.Scopes) {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorOAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			ctx.Error = true
+			ctx.Message = s.tr(ctx, "ErrorOAuthInvalidRequest")
+			s.render("error", w, ctx)
+			return
+		}
+
+		var (
+			params = u.Query()
+			code   string
+		)
+
+		if r.FormValue("approve") == "true" {
+			data, err := json.Marshal(&IndieAuthCode{
+				Username:            ctx.Username,
+				ClientID:            app.ClientID,
+				RedirectURI:         redirectURI,
+				Scope:               r.FormValue("scope"),
+				CodeChallenge:       r.FormValue("code_challenge"),
+				CodeChallengeMethod: r.FormValue("code_challenge_method"),
+			})
+			if err != nil {
+				log.WithError(err).Error("error serializing oauth code")
+				ctx.Error = true
+				ctx.Message = s.tr(ctx, "ErrorOAuthInvalidRequest")
+				s.render("error", w, ctx)
+				return
+			}
+
+			code = GenerateRandomToken()
+			s.oauthCodes.SetString(code, string(data))
+			params.Set("code", code)
+		} else {
+			params.Set("error", "access_denied")
+		}
+
+		if redirectURI == mastodonOOBRedirectURI {
+			if code == "" {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			ctx.Error = false
+			ctx.Message = s.tr(ctx, "MsgOAuthCode", map[string]interface{}{
+				"ClientName": app.Name,
+				"Code":       code,
+			})
+			s.render("error", w, ctx)
+			return
+		}
+
+		if state := r.FormValue("state"); state != "" {
+			params.Set("state", state)
+		}
+
+		u.RawQuery = params.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+}
+
+// OAuthTokenHandler exchanges an authorization code (or a username and
+// password) for an API token (POST /oauth/token)
+func (s *Server) OAuthTokenHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if err := mastodonParseForm(r); err != nil {
+			indieAuthError(w, http.StatusBadRequest, "invalid_request", "Error parsing request")
+			return
+		}
+
+		app, err := s.db.GetApp(r.FormValue("client_id"))
+		if err != nil || subtle.ConstantTimeCompare([]byte(app.ClientSecret), []byte(r.FormValue("client_secret"))) != 1 {
+			indieAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+			return
+		}
+
+		var (
+			user  *User
+			scope string
+		)
+
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			code, err := s.redeemAuthCode(s.oauthCodes, r)
+			if err != nil {
+				indieAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+				return
+			}
+
+			if user, err = s.db.GetUser(code.Username); err != nil {
+				log.WithError(err).Error("error loading user object")
+				indieAuthError(w, http.StatusInternalServerError, "server_error", "Error loading user")
+				return
+			}
+			scope = code.Scope
+		case "password":
+			user, err = s.db.GetUser(NormalizeUsername(r.FormValue("username")))
+			if err != nil || s.pm.CheckPassword(user.Password, r.FormValue("password")) != nil {
+				indieAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid username or password")
+				return
+			}
+			scope = r.FormValue("scope")
+		default:
+			indieAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+			return
+		}
+
+		if scope == "" {
+			scope = app.Scopes
+		}
+		if !mastodonValidScopes(scope, app.Scopes) {
+			indieAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope was not registered by the application")
+			return
+		}
+
+		token, err := s.createMastodonToken(user, scope, r)
+		if err != nil {
+			log.WithError(err).Error("error creating token")
+			indieAuthError(w, http.StatusInternalServerError, "server_error", "Error creating token")
+			return
+		}
+
+		mastodonJSON(w, http.StatusOK, mastodonToken{
+			AccessToken: token.Value,
+			TokenType:   "Bearer",
+			Scope:       scope,
+			CreatedAt:   token.CreatedAt.Unix(),
+		})
+	}
+}
+
+// OAuthRevokeHandler revokes an API token (POST /oauth/revoke)
+func (s *Server) OAuthRevokeHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if err := mastodonParseForm(r); err != nil {
+			indieAuthError(w, http.StatusBadRequest, "invalid_request", "Error parsing request")
+			return
+		}
+
+		token, err := jwt.Parse(r.FormValue("token"), s.api.jwtKeyFunc)
+		if err != nil || !token.Valid {
+			// As per RFC 7009 invalid tokens do not cause an error response
+			mastodonJSON(w, http.StatusOK, map[string]string{})
+			return
+		}
+
+		claims := token.Claims.(jwt.MapClaims)
+		if username, ok := claims["username"].(string); ok {
+			if user, err := s.db.GetUser(username); err == nil {
+				var tokens []string
+				for _, signature := range user.Tokens {
+					if signature != token.Signature {
+						tokens = append(tokens, signature)
+					}
+				}
+				user.Tokens = tokens
+
+				if err := s.db.SetUser(user.Username, user); err != nil {
+					log.WithError(err).Error("error saving user object")
+				}
+			}
+		}
+
+		if err := s.db.DelToken(token.Signature); err != nil {
+			log.WithError(err).Warn("error deleting token")
+		}
+
+		mastodonJSON(w, http.StatusOK, map[string]string{})
+	}
+}
+
+// MastodonAccountHandler returns an account (GET /api/v1/accounts/:id). It
+// also serves verify_credentials and relationships which share the same
+// route prefix.
+func (s *Server) MastodonAccountHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, scope, err := s.bearerUser(r)
+
+		switch id := p.ByName("id"); id {
+		case "verify_credentials":
+			if err != nil {
+				mastodonError(w, http.StatusUnauthorized, "The access token is invalid")
+				return
+			}
+			if scope != "" && !mastodonHasScope(scope, "read:accounts") {
+				mastodonError(w, http.StatusForbidden, "This action is outside the authorized scopes")
+				return
+			}
+
+			account := s.newMastodonAccount(viewer.Twter())
+			mastodonJSON(w, http.StatusOK, struct {
+				mastodonAccount
+				Source map[string]interface{} `json:"source"`
+			}{account, map[string]interface{}{
+				"privacy":   "public",
+				"sensitive": false,
+				"language":  viewer.Lang,
+				"note":      viewer.Tagline,
+				"fields":    []interface{}{},
+			}})
+		case "relationships":
+			if err != nil {
+				mastodonError(w, http.StatusUnauthorized, "The access token is invalid")
+				return
+			}
+
+			_ = mastodonParseForm(r)
+
+			relationships := []mastodonRelationship{}
+			for _, id := range mastodonFormValues(r, "id") {
+				if twter, ok := s.lookupMastodonAccount(id, viewer); ok {
+					relationships = append(relationships, s.newMastodonRelationship(id, twter, viewer))
+				}
+			}
+			mastodonJSON(w, http.StatusOK, relationships)
+		default:
+			twter, ok := s.lookupMastodonAccount(id, viewer)
+			if !ok {
+				mastodonError(w, http.StatusNotFound, "Record not found")
+				return
+			}
+			mastodonJSON(w, http.StatusOK, s.newMastodonAccount(twter))
+		}
+	}
+}
+
+// MastodonAccountStatusesHandler returns an account's statuses
+// (GET /api/v1/accounts/:id/statuses)
+func (s *Server) MastodonAccountStatusesHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, _ := s.mastodonUser(r)
+
+		twter, ok := s.lookupMastodonAccount(p.ByName("id"), viewer)
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		twts := s.cache.GetByURL(twter.URL)
+		sort.Sort(twts)
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatuses(s.mastodonPaginate(w, r, twts), viewer))
+	}
+}
+
+// MastodonFollowHandler follows an account (POST /api/v1/accounts/:id/follow)
+func (s *Server) MastodonFollowHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		id := p.ByName("id")
+		twter, ok := s.lookupMastodonAccount(id, user)
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		if !user.Follows(twter.URL) {
+			if err := user.FollowAndValidate(s.config, twter.Nick, twter.URL); err != nil {
+				log.WithError(err).Errorf("error validating new feed @<%s %s>", twter.Nick, twter.URL)
+				mastodonError(w, http.StatusUnprocessableEntity, "Invalid feed")
+				return
+			}
+
+			if err := s.db.SetUser(user.Username, user); err != nil {
+				log.WithError(err).Error("error saving user object")
+				mastodonError(w, http.StatusInternalServerError, "Error following account")
+				return
+			}
+
+			s.notifyFollow(user, id, "FOLLOW")
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonRelationship(id, twter, user))
+	}
+}
+
+// MastodonUnfollowHandler unfollows an account
+// (POST /api/v1/accounts/:id/unfollow)
+func (s *Server) MastodonUnfollowHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		id := p.ByName("id")
+		twter, ok := s.lookupMastodonAccount(id, user)
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		if twter.URL != user.URL {
+			user.Unfollow(twter.URL)
+
+			if err := s.db.SetUser(user.Username, user); err != nil {
+				log.WithError(err).Error("error saving user object")
+				mastodonError(w, http.StatusInternalServerError, "Error unfollowing account")
+				return
+			}
+
+			s.notifyFollow(user, id, "UNFOLLOW")
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonRelationship(id, twter, user))
+	}
+}
+
+// notifyFollow updates the followers of a local user or feed the user has
+// (un)followed and announces it the same way the web interface does
+func (s *Server) notifyFollow(user *User, nick, verb string) {
+	if s.db.HasUser(nick) {
+		followee, err := s.db.GetUser(nick)
+		if err != nil {
+			log.WithError(err).Errorf("error loading user object for %s", nick)
+			return
+		}
+
+		if followee.Followers == nil {
+			followee.Followers = make(map[string]string)
+		}
+		if verb == "FOLLOW" {
+			followee.Followers[user.Username] = user.URL
+		} else {
+			delete(followee.Followers, user.Username)
+		}
+
+		if err := s.db.SetUser(followee.Username, followee); err != nil {
+			log.WithError(err).Warnf("error updating user object for followee %s", followee.Username)
+			return
+		}
+	} else if s.db.HasFeed(nick) {
+		feed, err := s.db.GetFeed(nick)
+		if err != nil {
+			log.WithError(err).Errorf("error loading feed object for %s", nick)
+			return
+		}
+
+		if verb == "FOLLOW" {
+			feed.Followers[user.Username] = user.URL
+		} else {
+			delete(feed.Followers, user.Username)
+		}
+
+		if err := s.db.SetFeed(feed.Name, feed); err != nil {
+			log.WithError(err).Warnf("error updating feed object for followee %s", feed.Name)
+			return
+		}
+	} else {
+		return
+	}
+
+	if _, err := AppendSpecial(
+		s.config, s.db,
+		twtxtBot,
+		fmt.Sprintf(
+			"%s: @<%s %s> from @<%s %s> using %s/%s",
+			verb,
+			nick, URLForUser(s.config.BaseURL, nick),
+			user.Username, URLForUser(s.config.BaseURL, user.Username),
+			"twtxt", twtxt.FullVersion(),
+		),
+	); err != nil {
+		log.WithError(err).Warnf("error appending special %s post", verb)
+	}
+}
+
+// MastodonHomeTimelineHandler returns the user's timeline
+// (GET /api/v1/timelines/home)
+func (s *Server) MastodonHomeTimelineHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		var twts types.Twts
+		for feed := range user.Sources() {
+			twts = append(twts, s.cache.GetByURL(feed.URL)...)
+		}
+		sort.Sort(twts)
+
+		twts = FilterTwts(user, twts)
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatuses(s.mastodonPaginate(w, r, twts), user))
+	}
+}
+
+// MastodonPublicTimelineHandler returns the pod's local timeline (Discover)
+// or with local=false every twt the pod knows about
+// (GET /api/v1/timelines/public)
+func (s *Server) MastodonPublicTimelineHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, _ := s.mastodonUser(r)
+
+		var twts types.Twts
+		if r.FormValue("local") == "true" || r.FormValue("local") == "1" {
+			twts = s.cache.GetByPrefix(s.config.BaseURL, false)
+		} else {
+			twts = s.cache.GetAll()
+		}
+		sort.Sort(twts)
+
+		twts = FilterTwts(viewer, twts)
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatuses(s.mastodonPaginate(w, r, twts), viewer))
+	}
+}
+
+// MastodonTagTimelineHandler returns twts with a given tag
+// (GET /api/v1/timelines/tag/:hashtag)
+func (s *Server) MastodonTagTimelineHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, _ := s.mastodonUser(r)
+
+		tag := strings.TrimPrefix(p.ByName("hashtag"), "#")
+
+		var twts types.Twts
+		// TODO: Improve this by making this an O(1) lookup on the tag
+		for _, twt := range s.cache.GetAll() {
+			var tags types.TagList = twt.Tags()
+			if HasString(UniqStrings(tags.Tags()), tag) {
+				twts = append(twts, twt)
+			}
+		}
+		sort.Sort(twts)
+
+		twts = FilterTwts(viewer, twts)
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatuses(s.mastodonPaginate(w, r, twts), viewer))
+	}
+}
+
+// MastodonPostStatusHandler posts a new twt (POST /api/v1/statuses)
+func (s *Server) MastodonPostStatusHandler() httprouter.Handle {
+	isLocalURL := IsLocalURLFactory(s.config)
+	isExternalFeed := IsExternalFeedFactory(s.config)
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		if err := mastodonParseForm(r); err != nil {
+			mastodonError(w, http.StatusBadRequest, "Error parsing request")
+			return
+		}
+
+		var parts []string
+
+		text := strings.TrimSpace(r.FormValue("status"))
+
+		if err := ValidateTwtLength(s.config, WithContentWarning(text, r.FormValue("spoiler_text"))); err != nil {
+			mastodonError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Validation failed: Text character limit of %d exceeded", s.config.MaxTwtLength))
+			return
+		}
+
+		if hash := r.FormValue("in_reply_to_id"); hash != "" {
+			if _, ok := s.lookupMastodonStatus(hash); !ok {
+				mastodonError(w, http.StatusNotFound, "Record not found")
+				return
+			}
+			if !strings.Contains(text, fmt.Sprintf("(#%s)", hash)) {
+				parts = append(parts, fmt.Sprintf("(#%s)", hash))
+			}
+		}
+
+		if text != "" {
+			parts = append(parts, text)
+		}
+
+		for _, id := range mastodonFormValues(r, "media_ids") {
+			uri, state, ok := s.lookupMastodonMedia(id, user)
+			if !ok || state != TaskStateComplete {
+				mastodonError(w, http.StatusUnprocessableEntity, "Media attachment not found or still processing")
+				return
+			}
+			var alt string
+			if meta := GetMediaMetadata(s.config, MediaName(uri)); meta != nil {
+				alt = mediaAltText(meta.Description)
+			}
+			parts = append(parts, fmt.Sprintf("![%s](%s)", alt, uri))
+		}
+
+		text = CleanTwt(strings.Join(parts, " "))
+		if text == "" {
+			mastodonError(w, http.StatusUnprocessableEntity, "Validation failed: Text can't be blank")
+			return
+		}
+
+		text = WithContentWarning(text, r.FormValue("spoiler_text"))
+
+		twt, err := AppendTwt(s.config, s.db, user, text)
+		if err != nil {
+			log.WithError(err).Error("error posting twt")
+			mastodonError(w, http.StatusInternalServerError, "Error posting status")
+			return
+		}
+
+		s.refreshUserTwts(user)
+
+		// WebMentions ...
+		for _, m := range twt.Mentions() {
+			twter := m.Twter()
+			if !isLocalURL(twter.URL) || isExternalFeed(twter.URL) {
+				if err := WebMention(twter.URL, URLForTwt(s.config.BaseURL, twt.Hash())); err != nil {
+					log.WithError(err).Warnf("error sending webmention to %s", twter.URL)
+				}
+			}
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatus(twt, user))
+	}
+}
+
+// MastodonStatusHandler returns a single status (GET /api/v1/statuses/:id)
+func (s *Server) MastodonStatusHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, _ := s.mastodonUser(r)
+
+		twt, ok := s.lookupMastodonStatus(p.ByName("id"))
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonStatus(twt, viewer))
+	}
+}
+
+// MastodonDeleteStatusHandler deletes a status (DELETE /api/v1/statuses/:id).
+// As twtxt feeds are append-only files only the user's last twt can be
+// deleted.
+func (s *Server) MastodonDeleteStatusHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		lastTwt, err := s.lastTwtForURL(user, URLForTwt(s.config.BaseURL, p.ByName("id")))
+		switch err {
+		case nil:
+		case ErrMicropubNotFound:
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		case ErrMicropubNotLastTwt:
+			mastodonError(w, http.StatusUnprocessableEntity, ErrMicropubNotLastTwt.Error())
+			return
+		default:
+			log.WithError(err).Error("error loading last twt")
+			mastodonError(w, http.StatusInternalServerError, "Error deleting status")
+			return
+		}
+
+		status := s.newMastodonStatus(lastTwt, user)
+		status.Text = UnparseTwtFactory(s.config)(fmt.Sprintf("%t", lastTwt))
+
+		if err := DeleteLastTwt(s.config, user); err != nil {
+			log.WithError(err).Error("error deleting last twt")
+			mastodonError(w, http.StatusInternalServerError, "Error deleting status")
+			return
+		}
+
+		if err := RecordTwtDelete(s.config, user.Username, lastTwt.Hash()); err != nil {
+			log.WithError(err).Warnf("error recording delete of twt %s", lastTwt.Hash())
+		}
+
+		s.refreshUserTwts(user)
+
+		mastodonJSON(w, http.StatusOK, status)
+	}
+}
+
+// MastodonStatusContextHandler returns the conversation a status is part of
+// split into the twts before and after it (GET /api/v1/statuses/:id/context)
+func (s *Server) MastodonStatusContextHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		viewer, _ := s.mastodonUser(r)
+
+		twt, ok := s.lookupMastodonStatus(p.ByName("id"))
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		// Conversations are flat and keyed by the hash of the twt that started them
+		hash := twtSubjectHash(twt)
+		if hash == "" {
+			hash = twt.Hash()
+		}
+
+		var twts types.Twts
+		seen := make(map[string]bool)
+		// TODO: Improve this by making this an O(1) lookup on the tag
+		for _, twt := range s.cache.GetAll() {
+			var tags types.TagList = twt.Tags()
+			if HasString(UniqStrings(tags.Tags()), hash) && !seen[twt.Hash()] {
+				twts = append(twts, twt)
+				seen[twt.Hash()] = true
+			}
+		}
+		if root, ok := s.lookupMastodonStatus(hash); ok && !seen[root.Hash()] {
+			twts = append(twts, root)
+		}
+		sort.Sort(sort.Reverse(twts))
+
+		res := mastodonContext{
+			Ancestors:   []mastodonStatus{},
+			Descendants: []mastodonStatus{},
+		}
+
+		for _, t := range FilterTwts(viewer, twts) {
+			switch {
+			case t.Hash() == twt.Hash():
+			case t.Created().Before(twt.Created()):
+				res.Ancestors = append(res.Ancestors, s.newMastodonStatus(t, viewer))
+			default:
+				res.Descendants = append(res.Descendants, s.newMastodonStatus(t, viewer))
+			}
+		}
+
+		mastodonJSON(w, http.StatusOK, res)
+	}
+}
+
+// MastodonNotificationsHandler returns the user's mentions as notifications
+// (GET /api/v1/notifications)
+func (s *Server) MastodonNotificationsHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+
+		_ = mastodonParseForm(r)
+
+		notifications := []mastodonNotification{}
+
+		only := mastodonFormValues(r, "types")
+		excluded := mastodonFormValues(r, "exclude_types")
+		if (len(only) > 0 && !HasString(only, "mention")) || HasString(excluded, "mention") {
+			mastodonJSON(w, http.StatusOK, notifications)
+			return
+		}
+
+		twts := s.cache.GetMentions(user)
+		sort.Sort(twts)
+
+		for _, twt := range s.mastodonPaginate(w, r, FilterTwts(user, twts)) {
+			status := s.newMastodonStatus(twt, user)
+			notifications = append(notifications, mastodonNotification{
+				ID:        twt.Hash(),
+				Type:      "mention",
+				CreatedAt: status.CreatedAt,
+				Account:   status.Account,
+				Status:    &status,
+			})
+		}
+
+		mastodonJSON(w, http.StatusOK, notifications)
+	}
+}
+
+// MastodonUploadMediaHandler uploads media through the media pipeline
+// (POST /api/v1/media and POST /api/v2/media). The v1 endpoint waits for the
+// media to be processed, v2 responds with 202 Accepted if processing takes
+// too long and the client polls GET /api/v1/media/:id.
+func (s *Server) MastodonUploadMediaHandler(wait time.Duration) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		// Limit request body to to abuse
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+		defer r.Body.Close()
+
+		mfile, headers, err := r.FormFile("file")
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				mastodonError(w, http.StatusRequestEntityTooLarge, "Media upload too large")
+				return
+			}
+			mastodonError(w, http.StatusUnprocessableEntity, "Validation failed: File can't be blank")
+			return
+		}
+		defer mfile.Close()
+
+		user := r.Context().Value(UserContextKey).(*User)
+		upload := NewUploadMetadata(user.Username, headers.Filename, r.FormValue("description"))
+
+		uuid, mediaURI, err := s.dispatchMediaTask(headers.Header.Get("Content-Type"), mfile, upload)
+		if err == ErrMediaQuotaExceeded {
+			mastodonError(w, http.StatusUnprocessableEntity, "Validation failed: Media quota exceeded")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("error processing media")
+			mastodonError(w, http.StatusUnprocessableEntity, "Validation failed: File content type is invalid")
+			return
+		}
+
+		// Identical media was already uploaded and processed
+		if mediaURI != "" {
+			mastodonJSON(w, http.StatusOK, s.newMastodonMediaAttachment(MediaName(mediaURI), mediaURI))
+			return
+		}
+
+		mediaURI, err = s.waitForMediaTask(uuid, wait)
+		if err != nil {
+			log.WithError(err).Error("error processing media")
+			mastodonError(w, http.StatusUnprocessableEntity, "Error processing media")
+			return
+		}
+
+		if mediaURI == "" {
+			mastodonJSON(w, http.StatusAccepted, newMastodonMediaAttachment(uuid, ""))
+			return
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonMediaAttachment(uuid, mediaURI))
+	}
+}
+
+// lookupMastodonMedia resolves a media attachment id, the id of the task
+// processing the media or once processed the media's name, to the media's
+// URI. The URI is empty while the media is still being processed. Only the
+// media's owner can look it up.
+func (s *Server) lookupMastodonMedia(id string, user *User) (string, TaskState, bool) {
+	if t, ok := s.tasks.Lookup(id); ok {
+		uri := t.Result().Data["mediaURI"]
+		if t.State() == TaskStateComplete {
+			meta := GetMediaMetadata(s.config, MediaName(uri))
+			if meta != nil && meta.Owner != "" && meta.Owner != user.Username {
+				return "", t.State(), false
+			}
+		}
+		return uri, t.State(), true
+	}
+
+	meta := GetMediaMetadata(s.config, id)
+	if meta == nil || meta.Owner != user.Username {
+		return "", TaskStateFailed, false
+	}
+	return meta.URL(s.config.BaseURL, id), TaskStateComplete, true
+}
+
+// newMastodonMediaAttachment returns the attachment for uploaded media
+// described by its metadata
+func (s *Server) newMastodonMediaAttachment(id, uri string) mastodonMediaAttachment {
+	attachment := newMastodonMediaAttachment(id, uri)
+	if uri != "" {
+		attachment.setMetadata(GetMediaMetadata(s.config, MediaName(uri)))
+	}
+	return attachment
+}
+
+// MastodonMediaHandler returns a media attachment (GET /api/v1/media/:id)
+// by the id of the task processing it or the media's name
+func (s *Server) MastodonMediaHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+		id := p.ByName("id")
+
+		uri, state, ok := s.lookupMastodonMedia(id, user)
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+
+		switch state {
+		case TaskStateComplete:
+			mastodonJSON(w, http.StatusOK, s.newMastodonMediaAttachment(id, uri))
+		case TaskStateFailed, TaskStateCancelled:
+			mastodonError(w, http.StatusUnprocessableEntity, "Error processing media")
+		default:
+			mastodonJSON(w, http.StatusPartialContent, newMastodonMediaAttachment(id, ""))
+		}
+	}
+}
+
+// MastodonUpdateMediaHandler updates the description (alt text) of a media
+// attachment (PUT /api/v1/media/:id)
+func (s *Server) MastodonUpdateMediaHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := r.Context().Value(UserContextKey).(*User)
+		id := p.ByName("id")
+
+		uri, state, ok := s.lookupMastodonMedia(id, user)
+		if !ok {
+			mastodonError(w, http.StatusNotFound, "Record not found")
+			return
+		}
+		if state != TaskStateComplete {
+			mastodonError(w, http.StatusUnprocessableEntity, "Media attachment is still processing")
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			mastodonError(w, http.StatusBadRequest, "Error parsing request")
+			return
+		}
+
+		if _, ok := r.Form["description"]; ok {
+			description := strings.TrimSpace(r.FormValue("description"))
+			_, err := UpdateMediaMetadata(s.config, MediaName(uri), func(meta *MediaMetadata) {
+				meta.Description = description
+			})
+			if err != nil {
+				log.WithError(err).Errorf("error updating media %s", uri)
+				mastodonError(w, http.StatusInternalServerError, "Error updating media")
+				return
+			}
+		}
+
+		mastodonJSON(w, http.StatusOK, s.newMastodonMediaAttachment(id, uri))
+	}
+}
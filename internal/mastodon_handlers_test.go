@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAuthServer returns a server with a store holding the user alice
+// that can issue authorization codes and API tokens
+func newTestAuthServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "twtxt-auth-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := NewStore("bitcask://" + dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", APISigningKey: "secret"}
+
+	user := NewUser()
+	user.Username = "alice"
+	user.URL = URLForUser(conf.BaseURL, "alice")
+	require.NoError(t, db.SetUser("alice", user))
+
+	return &Server{
+		config:         conf,
+		db:             db,
+		api:            &API{config: conf, db: db},
+		indieAuthCodes: NewTTLCache(indieAuthCodeTTL),
+		oauthCodes:     NewTTLCache(indieAuthCodeTTL),
+	}
+}
+
+// issueTestCode stores an authorization code for alice in codes
+func issueTestCode(t *testing.T, codes *TTLCache, clientID, redirectURI, scope string) string {
+	data, err := json.Marshal(&IndieAuthCode{
+		Username:    "alice",
+		ClientID:    clientID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+	})
+	require.NoError(t, err)
+
+	code := GenerateRandomToken()
+	codes.SetString(code, string(data))
+	return code
+}
+
+func postForm(handler httprouter.Handle, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+	return w
+}
+
+func TestOAuthTokenHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestAuthServer(t)
+
+	app := &App{
+		ClientID:     "client",
+		ClientSecret: "client-secret",
+		Name:         "Client",
+		RedirectURIs: []string{mastodonOOBRedirectURI},
+		Scopes:       "read write:statuses",
+		CreatedAt:    time.Now(),
+	}
+	require.NoError(t, s.db.SetApp(app.ClientID, app))
+
+	form := func(code string) url.Values {
+		return url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {app.ClientID},
+			"client_secret": {app.ClientSecret},
+			"redirect_uri":  {mastodonOOBRedirectURI},
+			"code":          {code},
+		}
+	}
+
+	// Codes issued to Mastodon clients can't be redeemed without the
+	// client's secret via the IndieAuth token endpoint
+	code := issueTestCode(t, s.oauthCodes, app.ClientID, mastodonOOBRedirectURI, "read")
+	w := postForm(s.IndieAuthTokenHandler(), "/indieauth/token", form(code))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	f := form(code)
+	f.Set("client_secret", "wrong")
+	w = postForm(s.OAuthTokenHandler(), "/oauth/token", f)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	// Nor can IndieAuth codes be redeemed by Mastodon clients
+	indieCode := issueTestCode(t, s.indieAuthCodes, app.ClientID, mastodonOOBRedirectURI, "read")
+	w = postForm(s.OAuthTokenHandler(), "/oauth/token", form(indieCode))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = postForm(s.OAuthTokenHandler(), "/oauth/token", form(code))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var token mastodonToken
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+	assert.Equal("read", token.Scope)
+
+	// Codes can only be used once
+	w = postForm(s.OAuthTokenHandler(), "/oauth/token", form(code))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	// The token is limited to the scope granted
+	endpoint := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	call := func(required, accessToken string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/test", nil)
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		s.isMastodonAuthorized(required, endpoint)(w, r, nil)
+		return w.Code
+	}
+	assert.Equal(http.StatusNoContent, call("read:statuses", token.AccessToken))
+	assert.Equal(http.StatusForbidden, call("write:statuses", token.AccessToken))
+	assert.Equal(http.StatusUnauthorized, call("read:statuses", "invalid"))
+}
+
+func TestOAuthTokenHandlerScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestAuthServer(t)
+
+	app := &App{
+		ClientID:     "client",
+		ClientSecret: "client-secret",
+		RedirectURIs: []string{mastodonOOBRedirectURI},
+		Scopes:       "read",
+	}
+	require.NoError(t, s.db.SetApp(app.ClientID, app))
+
+	// Scopes not registered by the application are rejected
+	code := issueTestCode(t, s.oauthCodes, app.ClientID, mastodonOOBRedirectURI, "read write")
+	w := postForm(s.OAuthTokenHandler(), "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {app.ClientID},
+		"client_secret": {app.ClientSecret},
+		"redirect_uri":  {mastodonOOBRedirectURI},
+		"code":          {code},
+	})
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "invalid_scope")
+}
+
+func TestMastodonHasScope(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(mastodonHasScope("read write", "write:statuses"))
+	assert.True(mastodonHasScope("write:statuses", "write:statuses"))
+	assert.False(mastodonHasScope("write:media", "write:statuses"))
+	assert.False(mastodonHasScope("write:statuses", "write"))
+	assert.True(mastodonHasScope("follow", "write:follows"))
+	assert.False(mastodonHasScope("", "read"))
+
+	assert.True(mastodonValidScopes("read write:media", "read write"))
+	assert.False(mastodonValidScopes("read follow", "read write"))
+}
+
+func TestLookupMastodonMedia(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-mastodon-media-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &Server{
+		config: &Config{Data: dir, BaseURL: "https://example.com"},
+		tasks:  NewDispatcher(1, 1),
+	}
+
+	_, err = UpdateMediaMetadata(s.config, "photo", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.ContentType = "image/webp"
+	})
+	require.NoError(t, err)
+
+	// Media can only be looked up by its owner
+	uri, state, ok := s.lookupMastodonMedia("photo", &User{Username: "alice"})
+	assert.True(ok)
+	assert.Equal(TaskStateComplete, state)
+	assert.Equal("https://example.com/media/photo", uri)
+
+	_, _, ok = s.lookupMastodonMedia("photo", &User{Username: "bob"})
+	assert.False(ok)
+}
+
+func TestMastodonUpdateMediaHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-mastodon-media-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &Server{
+		config: &Config{Data: dir, BaseURL: "https://example.com"},
+		tasks:  NewDispatcher(1, 1),
+	}
+
+	_, err = UpdateMediaMetadata(s.config, "photo", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.ContentType = "image/webp"
+	})
+	require.NoError(t, err)
+	defer forgetMediaMetadata("photo")
+
+	update := func(username, description string) *httptest.ResponseRecorder {
+		form := url.Values{"description": {description}}
+		r := httptest.NewRequest(http.MethodPut, "/api/v1/media/photo", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), UserContextKey, &User{Username: username}))
+		w := httptest.NewRecorder()
+		s.MastodonUpdateMediaHandler()(w, r, httprouter.Params{{Key: "id", Value: "photo"}})
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, update("alice", "A photo").Code)
+	assert.Equal(http.StatusNotFound, update("bob", "Not my photo").Code)
+
+	// Updating the description doesn't change who owns the media
+	meta := GetMediaMetadata(s.config, "photo")
+	require.NotNil(t, meta)
+	assert.Equal("A photo", meta.Description)
+	assert.Equal("alice", meta.Owner)
+}
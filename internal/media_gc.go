@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrMediaQuotaExceeded = errors.New("error: media quota exceeded")
+)
+
+// mediaReferenceRe matches references to uploaded media, any path into the
+// media directory counts so media is kept if there is any doubt
+var mediaReferenceRe = regexp.MustCompile(`/` + mediaDir + `/([A-Za-z0-9_-]+)`)
+
+// mediaBaseName returns the name of the uploaded media a file in the media
+// store belongs to, e.g: `<uuid>` for `<uuid>-thumb.webp` or `<uuid>.json`
+func mediaBaseName(fn string) string {
+	name := strings.TrimSuffix(fn, filepath.Ext(fn))
+	for size := range mediaSizes {
+		name = strings.TrimSuffix(name, "-"+size)
+	}
+	return name
+}
+
+// ReferencedMedia returns the names of all uploaded media referenced by
+// local feeds (including rotated feeds), blog posts and messages
+func ReferencedMedia(conf *Config) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	for _, dir := range []string{feedsDir, rotatedFeedsDir, blogsDir, msgsDir} {
+		err := filepath.Walk(filepath.Join(conf.Data, dir), func(fn string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			for _, match := range mediaReferenceRe.FindAllSubmatch(data, -1) {
+				referenced[mediaBaseName(string(match[1]))] = true
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Errorf("error finding media referenced in %s", dir)
+			return nil, err
+		}
+	}
+
+	return referenced, nil
+}
+
+// OrphanedMedia is uploaded media no twt, blog post or message references
+type OrphanedMedia struct {
+	Name     string
+	Owner    string
+	Size     int64
+	Modified time.Time
+}
+
+// FindOrphanedMedia returns uploaded media that has not been referenced for
+// at least the grace period (judged by when the media was last modified)
+func FindOrphanedMedia(conf *Config, gracePeriod time.Duration) ([]OrphanedMedia, error) {
+	referenced, err := ReferencedMedia(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := conf.Media().List()
+	if err != nil {
+		log.WithError(err).Error("error listing media")
+		return nil, err
+	}
+
+	media := make(map[string]*OrphanedMedia)
+	for _, file := range files {
+		name := mediaBaseName(file.Name)
+		if referenced[name] {
+			continue
+		}
+
+		// Media whose stored files other media shares is kept until the
+		// media sharing them is deleted
+		if shares, err := mediaIdx.Shares(conf, name); err != nil || shares > 0 {
+			continue
+		}
+
+		orphan, ok := media[name]
+		if !ok {
+			orphan = &OrphanedMedia{Name: name}
+			media[name] = orphan
+		}
+		orphan.Size += file.Size
+		if file.ModTime.After(orphan.Modified) {
+			orphan.Modified = file.ModTime
+		}
+	}
+
+	var orphans []OrphanedMedia
+	for name, orphan := range media {
+		if time.Since(orphan.Modified) < gracePeriod {
+			continue
+		}
+		if meta := GetMediaMetadata(conf, name); meta != nil {
+			orphan.Owner = meta.Owner
+		}
+		orphans = append(orphans, *orphan)
+	}
+
+	return orphans, nil
+}
+
+// CollectOrphanedMedia reports orphaned media and deletes it if the pod is
+// configured to, returns the orphaned media found
+func CollectOrphanedMedia(conf *Config) ([]OrphanedMedia, error) {
+	orphans, err := FindOrphanedMedia(conf, conf.OrphanedMediaGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, orphan := range orphans {
+		size += orphan.Size
+		log.Infof(
+			"orphaned media %s (owner: %q size: %s last modified: %s)",
+			orphan.Name, orphan.Owner, humanize.Bytes(uint64(orphan.Size)), orphan.Modified,
+		)
+	}
+	log.Infof("found %d orphaned media (%s)", len(orphans), humanize.Bytes(uint64(size)))
+
+	if !conf.DeleteOrphanedMedia {
+		return orphans, nil
+	}
+
+	deleted := 0
+	for _, orphan := range orphans {
+		if err := DeleteMedia(conf, orphan.Name); err != nil {
+			log.WithError(err).Errorf("error deleting orphaned media %s", orphan.Name)
+			continue
+		}
+		deleted++
+	}
+	log.Infof("deleted %d orphaned media", deleted)
+
+	// Recount usage as deleting media without metadata is not accounted for
+	mediaIdx.reset()
+
+	return orphans, nil
+}
+
+// MediaUsage returns the storage used by the user username's uploaded media
+func MediaUsage(conf *Config, username string) int64 {
+	usage, err := mediaIdx.Usage(conf, username)
+	if err != nil {
+		log.WithError(err).Errorf("error computing media usage for %s", username)
+	}
+	return usage
+}
+
+// CheckMediaQuota returns ErrMediaQuotaExceeded if storing size bytes of
+// processed media would take the user username over the pod's media quota
+func CheckMediaQuota(conf *Config, username string, size int64) error {
+	if conf.MediaQuota <= 0 || username == "" {
+		return nil
+	}
+
+	if MediaUsage(conf, username)+size > conf.MediaQuota {
+		return ErrMediaQuotaExceeded
+	}
+
+	return nil
+}
+
+// CheckMediaQuotaLeft returns ErrMediaQuotaExceeded if the user username has
+// no media quota left. Uploads are only checked against the quota once
+// processed (See: recordMediaUpload) as it's the size of the processed media
+// that counts towards a user's usage, not the size of what was uploaded.
+func CheckMediaQuotaLeft(conf *Config, username string) error {
+	return CheckMediaQuota(conf, username, 1)
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectOrphanedMedia(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-gc-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", OrphanedMediaGracePeriod: time.Hour}
+	store := conf.Media()
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"used.webp", "used-thumb.webp", "orphan.webp", "orphan-thumb.png", "video.webm", "new.webp"} {
+		require.NoError(t, store.Put(name, strings.NewReader("data")))
+		if !strings.HasPrefix(name, "new") {
+			require.NoError(t, os.Chtimes(filepath.Join(dir, mediaDir, name), old, old))
+		}
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, feedsDir), 0755))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, feedsDir, "alice"),
+		[]byte("2021-01-01T00:00:00Z\tLook ![a photo](https://example.com/media/used)\n"),
+		0644,
+	))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, msgsDir), 0755))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, msgsDir, "bob"),
+		[]byte("Subject: hi\n\nhttps://example.com/media/video.webm\n"),
+		0644,
+	))
+
+	orphans, err := CollectOrphanedMedia(conf)
+	require.NoError(t, err)
+	if assert.Len(orphans, 1) {
+		assert.Equal("orphan", orphans[0].Name)
+		assert.Equal(int64(8), orphans[0].Size)
+	}
+
+	// Orphans are only reported unless deleting them is enabled
+	_, err = store.Stat("orphan.webp")
+	assert.NoError(err)
+
+	conf.DeleteOrphanedMedia = true
+	_, err = CollectOrphanedMedia(conf)
+	require.NoError(t, err)
+
+	media, err := store.List()
+	require.NoError(t, err)
+	var names []string
+	for _, m := range media {
+		names = append(names, m.Name)
+	}
+	assert.ElementsMatch([]string{"used.webp", "used-thumb.webp", "video.webm", "new.webp"}, names)
+}
+
+func TestCheckMediaQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-quota-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mediaIdx.reset()
+	defer mediaIdx.reset()
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	_, err = UpdateMediaMetadata(conf, "photo", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.Size = 600
+	})
+	require.NoError(t, err)
+
+	assert.Equal(int64(600), MediaUsage(conf, "alice"))
+	assert.NoError(CheckMediaQuota(conf, "alice", 1000))
+
+	conf.MediaQuota = 1000
+	assert.NoError(CheckMediaQuota(conf, "alice", 400))
+	assert.Equal(ErrMediaQuotaExceeded, CheckMediaQuota(conf, "alice", 401))
+	assert.NoError(CheckMediaQuota(conf, "bob", 1000))
+
+	require.NoError(t, DeleteMedia(conf, "photo"))
+	assert.Equal(int64(0), MediaUsage(conf, "alice"))
+}
+
+func TestRecordMediaUploadQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-quota-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mediaIdx.reset()
+	defer mediaIdx.reset()
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", MediaQuota: 1000}
+
+	_, err = UpdateMediaMetadata(conf, "photo", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.Size = 600
+	})
+	require.NoError(t, err)
+	assert.NoError(CheckMediaQuotaLeft(conf, "alice"))
+
+	// Uploads are checked against the quota by the size they're stored as
+	process := func(name string, size int64) string {
+		require.NoError(t, conf.Media().Put(name+".webp", strings.NewReader("data")))
+		_, err := UpdateMediaMetadata(conf, name, func(meta *MediaMetadata) {
+			meta.ContentType = "image/webp"
+			meta.Size = size
+		})
+		require.NoError(t, err)
+		return "https://example.com/media/" + name + ".webp"
+	}
+
+	uri := process("large", 500)
+	assert.Equal(ErrMediaQuotaExceeded, recordMediaUpload(conf, uri, NewUploadMetadata("alice", "large.jpg", "")))
+	_, err = conf.Media().Stat("large.webp")
+	assert.Equal(ErrMediaNotFound, err)
+	assert.Equal(int64(600), MediaUsage(conf, "alice"))
+
+	uri = process("small", 400)
+	assert.NoError(recordMediaUpload(conf, uri, NewUploadMetadata("alice", "small.jpg", "")))
+	assert.Equal(int64(1000), MediaUsage(conf, "alice"))
+
+	// Users with no quota left can't upload at all
+	assert.Equal(ErrMediaQuotaExceeded, CheckMediaQuotaLeft(conf, "alice"))
+	assert.NoError(CheckMediaQuotaLeft(conf, "bob"))
+}
@@ -3,9 +3,10 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +15,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// mediaSignedURLExpiry is how long media is redirected to signed URLs for
+// when it is served directly by the media store
+const mediaSignedURLExpiry = time.Hour
+
 // MediaHandler ...
 func (s *Server) MediaHandler() httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -23,62 +28,92 @@ func (s *Server) MediaHandler() httprouter.Handle {
 			return
 		}
 
-		var fn string
-
 		switch filepath.Ext(name) {
 		case ".png":
 			metrics.Counter("media", "old_media").Inc()
 			w.Header().Set("Content-Type", "image/png")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		case ".webp":
 			w.Header().Set("Content-Type", "image/webp")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		case ".mp4":
 			w.Header().Set("Content-Type", "video/mp4")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		case ".webm":
 			w.Header().Set("Content-Type", "video/webm")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		case ".ogg":
 			w.Header().Set("Content-Type", "audio/ogg")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		case ".mp3":
 			w.Header().Set("Content-Type", "audio/mp3")
-			fn = filepath.Join(s.config.Data, mediaDir, name)
 		default:
+			w.Header().Set("Vary", "Accept")
 			if accept.PreferredContentTypeLike(r.Header, "image/webp") == "image/webp" {
 				w.Header().Set("Content-Type", "image/webp")
-				fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.webp", name))
+				name = fmt.Sprintf("%s.webp", name)
 			} else {
 				// Support older browsers like IE11 that don't support WebP :/
 				metrics.Counter("media", "old_media").Inc()
 				w.Header().Set("Content-Type", "image/png")
-				fn = filepath.Join(s.config.Data, mediaDir, fmt.Sprintf("%s.png", name))
+				name = fmt.Sprintf("%s.png", name)
+			}
+		}
+
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		meta := GetMediaMetadata(s.config, base)
+
+		// Serve a smaller size variant of images if requested and the image
+		// has one (images smaller than the size requested have none)
+		if size := r.URL.Query().Get("size"); size != "" {
+			if !ValidMediaSize(size) {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if meta != nil {
+				if _, ok := meta.Sizes[size]; ok {
+					name = MediaVariantName(name, size)
+				}
 			}
 		}
 
-		if !FileExists(fn) {
-			log.Warnf("media not found: %s", name)
-			http.Error(w, "Media Not Found", http.StatusNotFound)
+		suffix := strings.TrimPrefix(name, base)
+
+		// Media reusing the stored files of identical media is served from them
+		if meta != nil && meta.Source != "" {
+			name = meta.Source + suffix
+		}
+
+		store := s.config.Media()
+
+		// Offload serving media to the media store if it can serve it directly
+		if url, err := store.SignedURL(name, mediaSignedURLExpiry); err != nil {
+			log.WithError(err).Errorf("error signing media url for %s", name)
+		} else if url != "" {
+			w.Header().Del("Content-Type")
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int((mediaSignedURLExpiry/2).Seconds())))
+			http.Redirect(w, r, url, http.StatusFound)
 			return
 		}
 
-		fileInfo, err := os.Stat(fn)
+		info, err := store.Stat(name)
 		if err != nil {
+			if err == ErrMediaNotFound || err == ErrInvalidMediaName {
+				log.Warnf("media not found: %s", name)
+				http.Error(w, "Media Not Found", http.StatusNotFound)
+				return
+			}
 			log.WithError(err).Error("error reading media file info")
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		etag := fmt.Sprintf("W/\"%s-%s\"", r.RequestURI, fileInfo.ModTime().Format(time.RFC3339))
-		if match := r.Header.Get("If-None-Match"); match != "" {
-			if strings.Contains(match, etag) {
-				w.WriteHeader(http.StatusNotModified)
-				return
+		// Media is never modified once processed (new media gets a new name)
+		// so can be cached forever, its ETag is the hash of its content as
+		// recorded when it was processed
+		if meta != nil {
+			if hash, ok := meta.FileHashes[suffix]; ok {
+				w.Header().Set("Etag", fmt.Sprintf("%q", hash))
 			}
 		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 
-		f, err := os.Open(fn)
+		f, err := store.Get(name)
 		if err != nil {
 			log.WithError(err).Error("error opening media file")
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -86,15 +121,42 @@ func (s *Server) MediaHandler() httprouter.Handle {
 		}
 		defer f.Close()
 
-		w.Header().Set("Etag", etag)
-		w.Header().Set("Cache-Control", "public, max-age=7776000")
+		// Handles Range, conditional and HEAD requests
+		if rs, ok := f.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, name, info.ModTime, rs)
+			return
+		}
+
+		// Media that can't be seeked is served whole
+		if etag := w.Header().Get("Etag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
 
 		if r.Method == http.MethodHead {
 			return
 		}
 
-		http.ServeContent(w, r, filepath.Base(fn), fileInfo.ModTime(), f)
+		if _, err := io.Copy(w, f); err != nil {
+			log.WithError(err).Errorf("error serving media %s", name)
+		}
+	}
+}
+
+// etagMatches returns true if the If-None-Match header value match matches
+// etag using weak comparison
+func etagMatches(match, etag string) bool {
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
 	}
+	return false
 }
 
 // UploadMediaHandler ...
@@ -122,6 +184,15 @@ func (s *Server) UploadMediaHandler() httprouter.Handle {
 			return
 		}
 
+		ctx := NewContext(s.config, s.db, r)
+		upload := NewUploadMetadata(ctx.Username, headers.Filename, "")
+
+		if err := CheckMediaQuotaLeft(s.config, ctx.Username); err != nil {
+			log.Warnf("media quota exceeded for %s", ctx.Username)
+			http.Error(w, "Media Quota Exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		ctype := headers.Header.Get("Content-Type")
 
 		var uri URI
@@ -134,14 +205,19 @@ func (s *Server) UploadMediaHandler() httprouter.Handle {
 				return
 			}
 
-			uuid, err := s.tasks.Dispatch(NewImageTask(s.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching image processing task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(s.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := s.tasks.Dispatch(NewImageTask(s.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching image processing task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(s.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(s.config.BaseURL, uuid)
 		}
 
 		if strings.HasPrefix(ctype, "audio/") {
@@ -152,14 +228,19 @@ func (s *Server) UploadMediaHandler() httprouter.Handle {
 				return
 			}
 
-			uuid, err := s.tasks.Dispatch(NewAudioTask(s.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching audio transcoding task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(s.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := s.tasks.Dispatch(NewAudioTask(s.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching audio transcoding task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(s.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(s.config.BaseURL, uuid)
 		}
 
 		if strings.HasPrefix(ctype, "video/") {
@@ -170,14 +251,19 @@ func (s *Server) UploadMediaHandler() httprouter.Handle {
 				return
 			}
 
-			uuid, err := s.tasks.Dispatch(NewVideoTask(s.config, fn))
-			if err != nil {
-				log.WithError(err).Error("error dispatching vodeo transcode task")
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+			if mediaURI, ok := ReuseMedia(s.config, fn, upload); ok {
+				uri.Type = "mediaURI"
+				uri.Path = mediaURI
+			} else {
+				uuid, err := s.tasks.Dispatch(NewVideoTask(s.config, fn, upload))
+				if err != nil {
+					log.WithError(err).Error("error dispatching vodeo transcode task")
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				uri.Type = "taskURI"
+				uri.Path = URLForTask(s.config.BaseURL, uuid)
 			}
-			uri.Type = "taskURI"
-			uri.Path = URLForTask(s.config.BaseURL, uuid)
 		}
 
 		if uri.IsZero() {
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMediaHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-handler-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// PNGs are counted as old media served
+	metrics.NewCounter("media", "old_media", "Count of old Media (PNG) served")
+
+	s := &Server{config: &Config{Data: dir, BaseURL: "https://example.com"}}
+
+	// The hashes of processed media's files are recorded in its metadata
+	var fns []string
+	for name, content := range map[string]string{"photo.webp": "webp image", "photo.png": "png image"} {
+		fn := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(fn, []byte(content), 0644))
+		fns = append(fns, fn)
+	}
+	require.NoError(t, putMedia(s.config, mediaDir, fns...))
+	_, err = UpdateMediaMetadata(s.config, "photo", func(meta *MediaMetadata) {
+		meta.ContentType = "image/webp"
+		meta.FileHashes = mediaFilesHashes("photo", fns...)
+	})
+	require.NoError(t, err)
+	defer forgetMediaMetadata("photo")
+
+	serve := func(method, name string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/media/"+name, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.MediaHandler()(w, r, httprouter.Params{{Key: "name", Value: name}})
+		return w
+	}
+
+	w := serve(http.MethodGet, "photo", map[string]string{"Accept": "image/webp,*/*"})
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("webp image", w.Body.String())
+	assert.Equal("image/webp", w.Header().Get("Content-Type"))
+	assert.Equal("Accept", w.Header().Get("Vary"))
+	assert.Equal("public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.Equal("bytes", w.Header().Get("Accept-Ranges"))
+
+	etag := w.Header().Get("Etag")
+	hash, err := HashMedia(strings.NewReader("webp image"))
+	require.NoError(t, err)
+	assert.Equal(`"`+hash+`"`, etag)
+
+	// Clients that don't accept WebP get the PNG (with its own ETag)
+	w = serve(http.MethodGet, "photo", map[string]string{"Accept": "image/png"})
+	assert.Equal("png image", w.Body.String())
+	assert.NotEqual(etag, w.Header().Get("Etag"))
+
+	w = serve(http.MethodGet, "photo.webp", map[string]string{"Range": "bytes=5-"})
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("bytes 5-9/10", w.Header().Get("Content-Range"))
+	assert.Equal("image", w.Body.String())
+
+	w = serve(http.MethodGet, "photo.webp", map[string]string{"If-None-Match": etag})
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.String())
+
+	// Ranges are only honoured if the media hasn't changed
+	w = serve(http.MethodGet, "photo.webp", map[string]string{"Range": "bytes=0-3", "If-Range": `"stale"`})
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("webp image", w.Body.String())
+
+	w = serve(http.MethodHead, "photo.webp", nil)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("10", w.Header().Get("Content-Length"))
+	assert.Equal(etag, w.Header().Get("Etag"))
+	assert.Empty(w.Body.String())
+
+	w = serve(http.MethodHead, "missing.webp", nil)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	// Media whose hashes aren't known is served without an ETag
+	require.NoError(t, s.config.Media().Put("other.webp", strings.NewReader("webp image")))
+	w = serve(http.MethodGet, "other.webp", nil)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("Etag"))
+	assert.NotEmpty(w.Header().Get("Last-Modified"))
+
+	// Media sharing the stored files of identical media is served from them
+	_, err = UpdateMediaMetadata(s.config, "copy", func(meta *MediaMetadata) {
+		*meta = *GetMediaMetadata(s.config, "photo")
+		meta.Source = "photo"
+	})
+	require.NoError(t, err)
+	defer forgetMediaMetadata("copy")
+
+	w = serve(http.MethodGet, "copy", map[string]string{"Accept": "image/webp,*/*"})
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("webp image", w.Body.String())
+	assert.Equal(etag, w.Header().Get("Etag"))
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaIndex tracks the storage used by each user's uploaded media, the
+// media uploaded by the hash of its content as recorded in its metadata and
+// how many media share the stored files of other media, it is built on first
+// use from the media store
+type mediaIndex struct {
+	sync.Mutex
+
+	built  bool
+	usage  map[string]int64
+	hashes map[string]map[string]bool
+	shares map[string]int
+}
+
+var mediaIdx = &mediaIndex{}
+
+func (idx *mediaIndex) build(conf *Config) error {
+	files, err := conf.Media().List()
+	if err != nil {
+		return err
+	}
+
+	idx.usage = make(map[string]int64)
+	idx.hashes = make(map[string]map[string]bool)
+	idx.shares = make(map[string]int)
+	for _, file := range files {
+		if filepath.Ext(file.Name) != mediaMetadataExt {
+			continue
+		}
+		name := mediaBaseName(file.Name)
+		if meta := GetMediaMetadata(conf, name); meta != nil {
+			idx.add(name, meta)
+		}
+	}
+
+	idx.built = true
+
+	return nil
+}
+
+func (idx *mediaIndex) ensure(conf *Config) error {
+	if idx.built {
+		return nil
+	}
+	return idx.build(conf)
+}
+
+func (idx *mediaIndex) add(name string, meta *MediaMetadata) {
+	if meta.Owner != "" {
+		idx.usage[meta.Owner] += meta.Size
+	}
+	if meta.Hash != "" {
+		if idx.hashes[meta.Hash] == nil {
+			idx.hashes[meta.Hash] = make(map[string]bool)
+		}
+		idx.hashes[meta.Hash][name] = true
+	}
+	if meta.Source != "" {
+		idx.shares[meta.Source]++
+	}
+}
+
+// Usage returns the storage used by the user username's uploaded media
+func (idx *mediaIndex) Usage(conf *Config, username string) (int64, error) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if err := idx.ensure(conf); err != nil {
+		return 0, err
+	}
+
+	return idx.usage[username], nil
+}
+
+// Lookup returns the name of uploaded media whose content hashes to hash,
+// or an empty string if no such media has been uploaded
+func (idx *mediaIndex) Lookup(conf *Config, hash string) (string, error) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if err := idx.ensure(conf); err != nil {
+		return "", err
+	}
+
+	for name := range idx.hashes[hash] {
+		return name, nil
+	}
+
+	return "", nil
+}
+
+// Shares returns the number of media that share the stored files of the
+// media name
+func (idx *mediaIndex) Shares(conf *Config, name string) (int, error) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if err := idx.ensure(conf); err != nil {
+		return 0, err
+	}
+
+	return idx.shares[name], nil
+}
+
+// Add accounts for the uploaded media name described by meta
+func (idx *mediaIndex) Add(name string, meta *MediaMetadata) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if !idx.built {
+		return
+	}
+
+	idx.add(name, meta)
+}
+
+// Remove stops accounting for the uploaded media name described by meta
+func (idx *mediaIndex) Remove(name string, meta *MediaMetadata) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if !idx.built {
+		return
+	}
+
+	if meta.Owner != "" {
+		idx.usage[meta.Owner] -= meta.Size
+	}
+	if names := idx.hashes[meta.Hash]; meta.Hash != "" && names != nil {
+		delete(names, name)
+		if len(names) == 0 {
+			delete(idx.hashes, meta.Hash)
+		}
+	}
+	if meta.Source != "" {
+		if idx.shares[meta.Source]--; idx.shares[meta.Source] <= 0 {
+			delete(idx.shares, meta.Source)
+		}
+	}
+}
+
+func (idx *mediaIndex) reset() {
+	idx.Lock()
+	defer idx.Unlock()
+
+	idx.built = false
+}
+
+// HashMedia returns the hex encoded SHA256 hash of the media read from r
+func HashMedia(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashMediaFile returns the hex encoded SHA256 hash of the content of fn
+func HashMediaFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return HashMedia(f)
+}
+
+// ReuseMedia hashes the received upload fn and if identical media has
+// already been uploaded and processed removes fn and returns the URI of new
+// media sharing the existing media's stored files, with its own name and
+// metadata (e.g: owner and alt text) recorded from upload. Otherwise the hash
+// is recorded in upload so the media is found once processed.
+func ReuseMedia(conf *Config, fn string, upload *MediaMetadata) (string, bool) {
+	hash, err := HashMediaFile(fn)
+	if err != nil {
+		log.WithError(err).Warnf("error hashing uploaded media %s", fn)
+		return "", false
+	}
+
+	if upload == nil {
+		upload = &MediaMetadata{}
+	}
+	upload.Hash = hash
+
+	name, err := mediaIdx.Lookup(conf, hash)
+	if err != nil {
+		log.WithError(err).Warn("error looking up uploaded media")
+		return "", false
+	}
+	if name == "" {
+		return "", false
+	}
+
+	meta := GetMediaMetadata(conf, name)
+	if meta == nil {
+		return "", false
+	}
+
+	// Uploads that would exceed the uploader's quota are processed as usual
+	// to fail like any other upload would
+	if err := CheckMediaQuota(conf, upload.Owner, meta.Size); err != nil {
+		return "", false
+	}
+
+	source := name
+	if meta.Source != "" {
+		source = meta.Source
+	}
+
+	reused := shortuuid.New()
+	reusedMeta, err := UpdateMediaMetadata(conf, reused, func(m *MediaMetadata) {
+		*m = *meta
+		m.Owner = upload.Owner
+		m.Filename = upload.Filename
+		m.Description = upload.Description
+		m.Created = time.Now()
+		m.Source = source
+	})
+	if err != nil {
+		log.WithError(err).Warnf("error recording reuse of media %s", name)
+		return "", false
+	}
+
+	mediaIdx.Add(reused, reusedMeta)
+
+	if err := os.Remove(fn); err != nil {
+		log.WithError(err).Warnf("error removing duplicate upload %s", fn)
+	}
+
+	return reusedMeta.URL(conf.BaseURL, reused), true
+}
+
+// ReleaseMedia deletes the uploaded media name if it was uploaded by the
+// user username. Media without a recorded owner (uploaded before it was
+// recorded) is deleted outright.
+func ReleaseMedia(conf *Config, name, username string) error {
+	name = MediaName(name)
+
+	if meta := GetMediaMetadata(conf, name); meta != nil && meta.Owner != "" && meta.Owner != username {
+		return nil
+	}
+
+	return DeleteMedia(conf, name)
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReuseMedia(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-index-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mediaIdx.reset()
+	defer mediaIdx.reset()
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	upload := func(content string) string {
+		f, err := ioutil.TempFile("", "twtxt-upload-*")
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.WriteString(content)
+		require.NoError(t, err)
+		return f.Name()
+	}
+
+	fn := upload("photo")
+	defer os.Remove(fn)
+	hash, err := HashMediaFile(fn)
+	require.NoError(t, err)
+
+	require.NoError(t, conf.Media().Put("dedup.webp", strings.NewReader("processed")))
+	_, err = UpdateMediaMetadata(conf, "dedup", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.ContentType = "image/webp"
+		meta.Size = 9
+		meta.Hash = hash
+	})
+	require.NoError(t, err)
+
+	// Different content is processed as usual with its hash recorded
+	other := upload("another photo")
+	defer os.Remove(other)
+	meta := NewUploadMetadata("bob", "other.png", "")
+	_, ok := ReuseMedia(conf, other, meta)
+	assert.False(ok)
+	assert.NotEmpty(meta.Hash)
+	assert.FileExists(other)
+
+	// Identical media uploaded by others shares the stored files but has its
+	// own name and metadata
+	uri, ok := ReuseMedia(conf, fn, NewUploadMetadata("bob", "photo.png", "A photo"))
+	assert.True(ok)
+	assert.NoFileExists(fn)
+
+	bobs := MediaName(uri)
+	assert.NotEqual("dedup", bobs)
+	assert.Equal("https://example.com/media/"+bobs, uri)
+
+	meta = GetMediaMetadata(conf, bobs)
+	require.NotNil(t, meta)
+	assert.Equal("bob", meta.Owner)
+	assert.Equal("photo.png", meta.Filename)
+	assert.Equal("A photo", meta.Description)
+	assert.Equal("image/webp", meta.ContentType)
+	assert.Equal(hash, meta.Hash)
+	assert.Equal("dedup", meta.Source)
+
+	meta = GetMediaMetadata(conf, "dedup")
+	require.NotNil(t, meta)
+	assert.Equal("alice", meta.Owner)
+	assert.Empty(meta.Description)
+
+	assert.Equal(int64(9), MediaUsage(conf, "alice"))
+	assert.Equal(int64(9), MediaUsage(conf, "bob"))
+
+	fn = upload("photo")
+	defer os.Remove(fn)
+	uri, ok = ReuseMedia(conf, fn, NewUploadMetadata("carol", "", ""))
+	assert.True(ok)
+	carols := MediaName(uri)
+	meta = GetMediaMetadata(conf, carols)
+	require.NotNil(t, meta)
+	assert.Equal("dedup", meta.Source)
+
+	// Only the media's owner can release it
+	require.NoError(t, ReleaseMedia(conf, "dedup", "bob"))
+	assert.NotNil(GetMediaMetadata(conf, "dedup"))
+
+	// The stored files are kept whilst other media shares them
+	require.NoError(t, ReleaseMedia(conf, "dedup", "alice"))
+	assert.Nil(GetMediaMetadata(conf, "dedup"))
+	_, err = conf.Media().Stat("dedup.webp")
+	assert.NoError(err)
+	assert.Equal(int64(0), MediaUsage(conf, "alice"))
+
+	orphans, err := FindOrphanedMedia(conf, 0)
+	require.NoError(t, err)
+	for _, orphan := range orphans {
+		assert.NotEqual("dedup", orphan.Name)
+	}
+
+	require.NoError(t, ReleaseMedia(conf, bobs, "bob"))
+	assert.Nil(GetMediaMetadata(conf, bobs))
+	_, err = conf.Media().Stat("dedup.webp")
+	assert.NoError(err)
+
+	require.NoError(t, ReleaseMedia(conf, carols, "carol"))
+	assert.Nil(GetMediaMetadata(conf, carols))
+	_, err = conf.Media().Stat("dedup.webp")
+	assert.Equal(ErrMediaNotFound, err)
+}
@@ -0,0 +1,554 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/gift"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MediaThumbnailResolution is the width of the thumbnail variant of uploaded images
+	MediaThumbnailResolution = 240
+
+	// MediaMediumResolution is the width of the medium variant of uploaded images
+	MediaMediumResolution = 480
+
+	// MediaSizeFull is the size of uploaded images as they were processed
+	MediaSizeFull = "full"
+
+	// MediaWaveformPeaks is the number of peaks recorded of uploaded audio
+	MediaWaveformPeaks = 120
+
+	// MediaWaveformWidth and MediaWaveformHeight are the dimensions of the
+	// waveform image rendered for uploaded audio
+	MediaWaveformWidth  = MediaWaveformPeaks * 4
+	MediaWaveformHeight = 64
+
+	// mediaWaveformSampleRate is the sample rate audio is decoded at to find
+	// its peaks, high enough for the waveform's resolution
+	mediaWaveformSampleRate = 8000
+
+	mediaMetadataExt = ".json"
+)
+
+// mediaSizes are the size variants (other than full) uploaded images are
+// processed into by their width, these are served with `?size=`
+var mediaSizes = map[string]int{
+	"thumb":  MediaThumbnailResolution,
+	"medium": MediaMediumResolution,
+}
+
+// MediaSize is the dimensions of a size variant of an uploaded image
+type MediaSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// MediaMetadata is the record of uploaded media: who uploaded it, what it
+// is, the dimensions of the original image or video (for its aspect ratio)
+// and of the size variants it is available in. Metadata is stored alongside
+// the media as `<name>.json`
+type MediaMetadata struct {
+	Owner       string    `json:"owner,omitempty"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"content_type"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+
+	// Size is the total size of the files the media is stored as
+	Size int64 `json:"size,omitempty"`
+
+	// Hash is the SHA256 hash of the media as uploaded. Identical uploads
+	// reuse the stored files of the media processed first, their Source,
+	// whose files are kept until no other media shares them. Each upload is
+	// charged for the files' size as if it had been processed.
+	Hash   string `json:"hash,omitempty"`
+	Source string `json:"source,omitempty"`
+
+	// FileHashes are the SHA256 hashes of the files the media is stored as
+	// keyed by their suffix (e.g: .webp or -small.webp), which are computed
+	// when the media is processed and served as the files' ETags
+	FileHashes map[string]string `json:"file_hashes,omitempty"`
+
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+
+	// Animated is set for video transcoded from an animated image (GIF, WebP
+	// or APNG), which is rendered muted and looping like the image would be
+	Animated bool `json:"animated,omitempty"`
+
+	// Blurhash is a compact placeholder for images and video posters
+	// shown while they load (See: https://blurha.sh)
+	Blurhash string `json:"blurhash,omitempty"`
+
+	// Peaks are the peaks (between 0 and 1) of audio's waveform, which is
+	// stored as an image alongside the audio like video posters are
+	Peaks []float64 `json:"peaks,omitempty"`
+
+	Sizes map[string]MediaSize `json:"sizes,omitempty"`
+}
+
+// IsImage returns true if the metadata describes an image
+func (m *MediaMetadata) IsImage() bool {
+	return strings.HasPrefix(m.ContentType, "image/")
+}
+
+// URL returns the URL of the media name described by the metadata
+func (m *MediaMetadata) URL(baseURL, name string) string {
+	var ext string
+	switch {
+	case strings.HasPrefix(m.ContentType, "video/"):
+		ext = ".webm"
+	case strings.HasPrefix(m.ContentType, "audio/"):
+		ext = ".ogg"
+	}
+	return fmt.Sprintf("%s/%s/%s%s", strings.TrimSuffix(baseURL, "/"), mediaDir, name, ext)
+}
+
+// Srcset returns the srcset attribute for the media at uri with the size
+// variants available, smallest first
+func (m *MediaMetadata) Srcset(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	var names []string
+	for name := range m.Sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return m.Sizes[names[i]].Width < m.Sizes[names[j]].Width
+	})
+
+	var srcset []string
+	for _, name := range names {
+		if name == MediaSizeFull {
+			u.RawQuery = ""
+		} else {
+			u.RawQuery = url.Values{"size": []string{name}}.Encode()
+		}
+		srcset = append(srcset, fmt.Sprintf("%s %dw", u.String(), m.Sizes[name].Width))
+	}
+
+	return strings.Join(srcset, ", ")
+}
+
+// MediaName returns the name of uploaded media from its URI, the URI's last
+// path element without an extension
+func MediaName(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		uri = u.Path
+	}
+	name := path.Base(uri)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// MediaVariantName returns the name the size variant of the media name (with
+// an extension) is stored as, e.g: `<uuid>-thumb.webp`
+func MediaVariantName(name, size string) string {
+	if size == "" || size == MediaSizeFull {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), size, ext)
+}
+
+// ValidMediaSize returns true if size is a size uploaded images are served in
+func ValidMediaSize(size string) bool {
+	if size == MediaSizeFull {
+		return true
+	}
+	_, ok := mediaSizes[size]
+	return ok
+}
+
+// maxMediaMetadataCache is the maximum number of media whose metadata is
+// cached in memory
+const maxMediaMetadataCache = 10000
+
+var (
+	mediaMetadataMu    sync.RWMutex
+	mediaMetadataCache = make(map[string]*MediaMetadata)
+
+	mediaMetadataUpdateMu sync.Mutex
+)
+
+// GetMediaMetadata returns the metadata of the uploaded media name (without
+// an extension), or nil if there is none (e.g: for media uploaded before
+// metadata was recorded).
+func GetMediaMetadata(conf *Config, name string) *MediaMetadata {
+	mediaMetadataMu.RLock()
+	meta, ok := mediaMetadataCache[name]
+	mediaMetadataMu.RUnlock()
+	if ok {
+		return meta
+	}
+
+	// Misses aren't cached as anyone can request media that doesn't exist
+	f, err := conf.Media().Get(name + mediaMetadataExt)
+	if err != nil {
+		if err != ErrMediaNotFound {
+			log.WithError(err).Warnf("error reading metadata for media %s", name)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	meta = &MediaMetadata{}
+	if err := json.NewDecoder(f).Decode(meta); err != nil {
+		log.WithError(err).Warnf("error decoding metadata for media %s", name)
+		return nil
+	}
+
+	cacheMediaMetadata(name, meta)
+
+	return meta
+}
+
+// cacheMediaMetadata caches the metadata of the media name, evicting other
+// media's metadata once the cache is full
+func cacheMediaMetadata(name string, meta *MediaMetadata) {
+	mediaMetadataMu.Lock()
+	defer mediaMetadataMu.Unlock()
+
+	if _, ok := mediaMetadataCache[name]; !ok && len(mediaMetadataCache) >= maxMediaMetadataCache {
+		for evicted := range mediaMetadataCache {
+			delete(mediaMetadataCache, evicted)
+			break
+		}
+	}
+	mediaMetadataCache[name] = meta
+}
+
+// UpdateMediaMetadata updates the metadata of the uploaded media name (without
+// an extension) with update and stores it
+func UpdateMediaMetadata(conf *Config, name string, update func(meta *MediaMetadata)) (*MediaMetadata, error) {
+	mediaMetadataUpdateMu.Lock()
+	defer mediaMetadataUpdateMu.Unlock()
+
+	meta := &MediaMetadata{}
+	if current := GetMediaMetadata(conf, name); current != nil {
+		*meta = *current
+	} else {
+		meta.Created = time.Now()
+	}
+
+	update(meta)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conf.Media().Put(name+mediaMetadataExt, bytes.NewReader(data)); err != nil {
+		log.WithError(err).Errorf("error storing metadata for media %s", name)
+		return nil, err
+	}
+
+	cacheMediaMetadata(name, meta)
+
+	return meta, nil
+}
+
+// NewUploadMetadata returns the metadata of media being uploaded by owner
+// from the file filename (both optional) with the description (alt text)
+func NewUploadMetadata(owner, filename, description string) *MediaMetadata {
+	if filename != "" {
+		filename = filepath.Base(filename)
+	}
+	return &MediaMetadata{
+		Owner:       owner,
+		Filename:    filename,
+		Description: strings.TrimSpace(description),
+	}
+}
+
+// mediaAltText returns description as the alt text of a markdown image
+func mediaAltText(description string) string {
+	return strings.NewReplacer("[", "(", "]", ")", "\n", " ", "\r", "").Replace(description)
+}
+
+// recordMediaUpload records who uploaded the media at uri from which file in
+// its metadata once it has been processed. Media that would take its owner
+// over their media quota is deleted and ErrMediaQuotaExceeded returned.
+func recordMediaUpload(conf *Config, uri string, upload *MediaMetadata) error {
+	if upload == nil {
+		return nil
+	}
+
+	if meta := GetMediaMetadata(conf, MediaName(uri)); meta != nil {
+		if err := CheckMediaQuota(conf, upload.Owner, meta.Size); err != nil {
+			log.Warnf("media quota exceeded for %s, deleting media %s", upload.Owner, uri)
+			if err := DeleteMedia(conf, uri); err != nil {
+				log.WithError(err).Errorf("error deleting media %s", uri)
+			}
+			return err
+		}
+	}
+
+	meta, err := UpdateMediaMetadata(conf, MediaName(uri), func(meta *MediaMetadata) {
+		meta.Owner = upload.Owner
+		meta.Filename = upload.Filename
+		meta.Description = upload.Description
+		meta.Hash = upload.Hash
+	})
+	if err != nil {
+		log.WithError(err).Warnf("error recording upload of media %s", uri)
+		return nil
+	}
+
+	mediaIdx.Add(MediaName(uri), meta)
+
+	return nil
+}
+
+// forgetMediaMetadata removes the cached metadata of the media name
+func forgetMediaMetadata(name string) {
+	mediaMetadataMu.Lock()
+	delete(mediaMetadataCache, name)
+	mediaMetadataMu.Unlock()
+}
+
+// mediaFilesSize returns the total size of the files fns
+func mediaFilesSize(fns ...string) int64 {
+	var size int64
+	for _, fn := range fns {
+		if info, err := os.Stat(fn); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// mediaFilesHashes returns the hashes of the files fns of the media stored
+// as name keyed by their suffix
+func mediaFilesHashes(name string, fns ...string) map[string]string {
+	hashes := make(map[string]string)
+	for _, fn := range fns {
+		suffix := strings.TrimPrefix(filepath.Base(fn), name)
+		if suffix == filepath.Base(fn) {
+			continue
+		}
+		hash, err := HashMediaFile(fn)
+		if err != nil {
+			log.WithError(err).Warnf("error hashing media file %s", fn)
+			continue
+		}
+		hashes[suffix] = hash
+	}
+	return hashes
+}
+
+// writeMediaMetadata writes meta for the media file fn as fn's sidecar file
+// and returns its filename
+func writeMediaMetadata(fn string, meta *MediaMetadata) (string, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	mfn := ReplaceExt(fn, mediaMetadataExt)
+	if err := ioutil.WriteFile(mfn, data, 0644); err != nil {
+		return "", err
+	}
+
+	return mfn, nil
+}
+
+// encodeImage encodes img as a WebP image fn and a PNG image (for older
+// browsers) alongside it and returns their filenames
+func encodeImage(fn string, img image.Image) ([]string, error) {
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Lossless: true}); err != nil {
+		log.WithError(err).Error("error reencoding image")
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		log.WithError(err).Error("error writing output file")
+		return nil, err
+	}
+
+	fns := []string{fn}
+	if err := ImageToPng(fn); err != nil {
+		log.WithError(err).Warnf("error reencoding image to PNG (for older browsers: %s", fn)
+	} else {
+		fns = append(fns, ReplaceExt(fn, ".png"))
+	}
+
+	return fns, nil
+}
+
+// processImageVariants writes the size variants of the processed image img
+// (written to fn) smaller than img, records their dimensions in meta and
+// returns the filenames written
+func processImageVariants(fn string, img image.Image, meta *MediaMetadata) ([]string, error) {
+	bounds := img.Bounds().Size()
+
+	var fns []string
+
+	for size, width := range mediaSizes {
+		if bounds.X <= width {
+			continue
+		}
+
+		g := gift.New(gift.Resize(width, 0, gift.LanczosResampling))
+		variant := image.NewRGBA(g.Bounds(img.Bounds()))
+		g.Draw(variant, img)
+
+		vfns, err := encodeImage(MediaVariantName(fn, size), variant)
+		if err != nil {
+			return nil, err
+		}
+		fns = append(fns, vfns...)
+
+		meta.Sizes[size] = MediaSize{Width: variant.Bounds().Dx(), Height: variant.Bounds().Dy()}
+	}
+
+	return fns, nil
+}
+
+// ProbeDuration returns the duration of the audio or video fn in seconds
+func ProbeDuration(conf *Config, fn string) (float64, error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if conf.TranscoderTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), conf.TranscoderTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	out, err := exec.CommandContext(
+		ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		fn,
+	).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// ProbePeaks returns n peaks (between 0 and 1) of the audio fn's waveform
+func ProbePeaks(conf *Config, fn string, n int) ([]float64, error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if conf.TranscoderTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), conf.TranscoderTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	pcm, err := exec.CommandContext(
+		ctx, "ffmpeg",
+		"-i", fn,
+		"-ac", "1",
+		"-ar", strconv.Itoa(mediaWaveformSampleRate),
+		"-f", "s16le",
+		"-loglevel", "quiet",
+		"-",
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return audioPeaks(pcm, n), nil
+}
+
+// audioPeaks returns n peaks (between 0 and 1) of the signed 16-bit little
+// endian mono samples pcm, each the loudest sample of its share of pcm
+func audioPeaks(pcm []byte, n int) []float64 {
+	samples := len(pcm) / 2
+	if samples == 0 || n <= 0 {
+		return nil
+	}
+
+	peaks := make([]float64, n)
+	for i := 0; i < samples; i++ {
+		sample := math.Abs(float64(int16(binary.LittleEndian.Uint16(pcm[i*2:]))) / math.MaxInt16)
+		bucket := i * n / samples
+		if sample > peaks[bucket] {
+			peaks[bucket] = math.Min(1, sample)
+		}
+	}
+
+	// Two decimal places is plenty for drawing the waveform
+	for i, peak := range peaks {
+		peaks[i] = math.Round(peak*100) / 100
+	}
+
+	return peaks
+}
+
+// mediaWaveformColor is the color of waveform bars, legible on both the
+// light and dark themes
+var mediaWaveformColor = color.RGBA{R: 0x88, G: 0x88, B: 0x88, A: 0xff}
+
+// drawWaveform draws peaks as a waveform image, a bar per peak centered
+// vertically on a transparent background
+func drawWaveform(peaks []float64) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, MediaWaveformWidth, MediaWaveformHeight))
+	if len(peaks) == 0 {
+		return img
+	}
+
+	barWidth := MediaWaveformWidth / len(peaks)
+	for i, peak := range peaks {
+		// Silence is drawn as a line so the waveform spans the whole image
+		height := int(math.Max(1, peak*MediaWaveformHeight))
+		top := (MediaWaveformHeight - height) / 2
+
+		bar := image.Rect(i*barWidth, top, (i+1)*barWidth-1, top+height)
+		draw.Draw(img, bar, image.NewUniform(mediaWaveformColor), image.Point{}, draw.Src)
+	}
+
+	return img
+}
+
+// FormatMediaDuration formats a duration of audio or video in seconds like
+// players do, e.g: 1:05 or 1:02:03
+func FormatMediaDuration(seconds float64) string {
+	d := time.Duration(math.Round(seconds)) * time.Second
+
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	sec := int(d % time.Minute / time.Second)
+
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%d:%02d", m, sec)
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+func TestProcessImageVariants(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-variants-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "upload.png")
+	f, err := os.Create(fn)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, 1000, 500))))
+	f.Close()
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	opts := &ImageOptions{Resize: true, Width: MediaResolution, Height: 0, Variants: true}
+	uri, err := ProcessImage(conf, fn, mediaDir, "", opts)
+	require.NoError(t, err)
+
+	name := filepath.Base(uri)
+
+	meta := GetMediaMetadata(conf, name)
+	require.NotNil(t, meta)
+	assert.Equal(1000, meta.Width)
+	assert.Equal(500, meta.Height)
+	assert.Equal(MediaSize{Width: MediaResolution, Height: 360}, meta.Sizes[MediaSizeFull])
+	assert.Equal(MediaSize{Width: MediaMediumResolution, Height: 240}, meta.Sizes["medium"])
+	assert.Equal(MediaSize{Width: MediaThumbnailResolution, Height: 120}, meta.Sizes["thumb"])
+	assert.Equal("image/webp", meta.ContentType)
+	assert.Equal("#000000", BlurhashColor(meta.Blurhash))
+
+	require.NoError(t, recordMediaUpload(conf, uri, NewUploadMetadata("alice", "/tmp/photo.jpg", "A [black] box")))
+	meta = GetMediaMetadata(conf, name)
+	require.NotNil(t, meta)
+	assert.Equal("alice", meta.Owner)
+	assert.Equal("photo.jpg", meta.Filename)
+	assert.Equal(1000, meta.Width)
+
+	for _, variant := range []string{name + ".webp", name + "-thumb.webp", name + "-medium.png"} {
+		_, err := conf.Media().Stat(variant)
+		assert.NoError(err, variant)
+	}
+
+	html := RenderImage(conf, uri, "")
+	assert.Contains(html, `alt="A [black] box"`)
+	assert.Contains(html, `width="720" height="360" style="background-color: #000000"`)
+	assert.Contains(html, uri+"?size=thumb 240w, "+uri+"?size=medium 480w, "+uri+" 720w")
+
+	require.NoError(t, DeleteMedia(conf, name))
+	media, err := conf.Media().List()
+	require.NoError(t, err)
+	assert.Empty(media)
+	assert.Nil(GetMediaMetadata(conf, name))
+}
+
+func TestMediaVariantName(t *testing.T) {
+	assert.Equal(t, "abc-thumb.webp", MediaVariantName("abc.webp", "thumb"))
+	assert.Equal(t, "abc.webp", MediaVariantName("abc.webp", MediaSizeFull))
+	assert.Equal(t, "abc-medium", MediaVariantName("abc", "medium"))
+}
+
+func TestBlurhash(t *testing.T) {
+	assert := assert.New(t)
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = []uint8{0x33, 0x66, 0x99, 0xff}[i%4]
+	}
+
+	hash := Blurhash(img, 4, 3)
+	assert.Len(hash, 28)
+	assert.Equal("#336699", BlurhashColor(hash))
+
+	assert.Equal("", BlurhashColor("!!"))
+}
+
+func TestMediaName(t *testing.T) {
+	assert.Equal(t, "abc", MediaName("https://example.com/media/abc"))
+	assert.Equal(t, "abc", MediaName("https://example.com/media/abc.webm?size=thumb"))
+	assert.Equal(t, "A box (black)", mediaAltText("A box [black]"))
+}
+
+func TestAudioPeaks(t *testing.T) {
+	// A quiet first half and loud (negative) second half
+	pcm := make([]byte, 8)
+	for i, sample := range []int16{1000, -3276, -32768, 16384} {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+
+	assert.Equal(t, []float64{0.1, 1}, audioPeaks(pcm, 2))
+	assert.Equal(t, []float64{0.03, 0.1, 1, 0.5}, audioPeaks(pcm, 4))
+	assert.Nil(t, audioPeaks(nil, 2))
+
+	img := drawWaveform(audioPeaks(pcm, 2))
+	assert.Equal(t, image.Rect(0, 0, MediaWaveformWidth, MediaWaveformHeight), img.Bounds())
+	// Bars are centered vertically, the loud half reaches the top
+	_, _, _, a := img.At(MediaWaveformWidth-2, 0).RGBA()
+	assert.NotZero(t, a)
+	_, _, _, a = img.At(1, 0).RGBA()
+	assert.Zero(t, a)
+}
+
+func TestFormatMediaDuration(t *testing.T) {
+	assert.Equal(t, "0:00", FormatMediaDuration(0))
+	assert.Equal(t, "0:05", FormatMediaDuration(4.6))
+	assert.Equal(t, "1:05", FormatMediaDuration(65))
+	assert.Equal(t, "1:02:03", FormatMediaDuration(3723))
+}
+
+func TestRenderUploadedMedia(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-render-media-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	_, err = UpdateMediaMetadata(conf, "podcast", func(meta *MediaMetadata) {
+		meta.ContentType = "audio/ogg"
+		meta.Duration = 65
+		meta.Peaks = []float64{0.5, 1}
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.Media().Put("podcast.ogg", strings.NewReader("ogg audio")))
+
+	_, err = UpdateMediaMetadata(conf, "clip", func(meta *MediaMetadata) {
+		meta.ContentType = "video/webm"
+		meta.Width, meta.Height = 640, 360
+		meta.Duration = 3
+	})
+	require.NoError(t, err)
+
+	html := RenderAudio(conf, "https://example.com/media/podcast.ogg")
+	assert.Contains(html, `<img alt="Waveform" src="https://example.com/media/podcast" width="240" height="32" loading="lazy">`)
+	assert.Contains(html, `<audio controls="controls" preload="none" title="Duration: 1:05">`)
+
+	html = RenderVideo(conf, "https://example.com/media/clip.webm")
+	assert.Contains(html, `<video controls playsinline preload="none" poster="https://example.com/media/clip" width="640" height="360" title="Duration: 0:03">`)
+
+	enclosure := mediaEnclosure(conf, "Listen ![](https://example.com/media/podcast.ogg) and ![](https://example.com/media/clip.webm)")
+	if assert.NotNil(enclosure) {
+		assert.Equal("https://example.com/media/podcast.ogg", enclosure.Url)
+		assert.Equal("audio/ogg", enclosure.Type)
+		assert.Equal("9", enclosure.Length)
+	}
+	assert.Nil(mediaEnclosure(conf, "![](https://elsewhere.com/media/podcast.ogg)"))
+}
+
+func TestGetMediaMetadataMisses(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-metadata-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	// Misses are not cached so metadata stored later is found
+	assert.Nil(GetMediaMetadata(conf, "missing"))
+	mediaMetadataMu.RLock()
+	_, ok := mediaMetadataCache["missing"]
+	mediaMetadataMu.RUnlock()
+	assert.False(ok)
+
+	require.NoError(t, conf.Media().Put("missing"+mediaMetadataExt, strings.NewReader(`{"owner":"alice"}`)))
+	meta := GetMediaMetadata(conf, "missing")
+	require.NotNil(t, meta)
+	assert.Equal("alice", meta.Owner)
+	forgetMediaMetadata("missing")
+}
+
+func TestMediaMetadataEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-media-metadata-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+	api := &API{config: conf}
+
+	created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = UpdateMediaMetadata(conf, "photo", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.Filename = "holiday.jpg"
+		meta.ContentType = "image/webp"
+		meta.Width = 640
+		meta.Height = 480
+		meta.Created = created
+	})
+	require.NoError(t, err)
+	defer forgetMediaMetadata("photo")
+
+	get := func(username, name string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/metadata/"+name, nil)
+		r = r.WithContext(context.WithValue(r.Context(), UserContextKey, &User{Username: username}))
+		w := httptest.NewRecorder()
+		api.MediaMetadataEndpoint()(w, r, httprouter.Params{{Key: "name", Value: name}})
+		return w
+	}
+
+	w := get("alice", "photo.webp")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var res types.MediaMetadataResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(types.MediaMetadataResponse{
+		Name:        "photo",
+		Owner:       "alice",
+		Filename:    "holiday.jpg",
+		ContentType: "image/webp",
+		Width:       640,
+		Height:      480,
+		Created:     created,
+	}, res)
+
+	// Metadata is only returned to the media's owner
+	assert.Equal(http.StatusNotFound, get("bob", "photo").Code)
+	assert.Equal(http.StatusNotFound, get("alice", "missing").Code)
+}
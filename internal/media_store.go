@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrInvalidMediaStore = errors.New("error: invalid media store")
+	ErrMediaNotFound     = errors.New("error: media not found")
+	ErrInvalidMediaName  = errors.New("error: invalid media name")
+)
+
+// MediaInfo describes a media file held in a MediaStore
+type MediaInfo struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// MediaStore stores uploaded media (images, audio and video) by name, e.g:
+// `<uuid>.webp`, so that media can live off the app server.
+type MediaStore interface {
+	// Put stores the media read from r as name, replacing any existing media
+	Put(name string, r io.Reader) error
+
+	// Get returns a reader for the media stored as name, which is also an
+	// io.Seeker if the store supports seeking. ErrMediaNotFound is returned
+	// if there is no such media.
+	Get(name string) (io.ReadCloser, error)
+
+	// Stat returns information about the media stored as name
+	Stat(name string) (MediaInfo, error)
+
+	// Delete deletes the media stored as name
+	Delete(name string) error
+
+	// List returns information about all media in the store
+	List() ([]MediaInfo, error)
+
+	// SignedURL returns a URL the media stored as name can be fetched from
+	// directly for the given duration, or an empty string if the store's
+	// media can only be served by the pod itself
+	SignedURL(name string, expires time.Duration) (string, error)
+}
+
+// NewMediaStore returns the media store configured by the uri store:
+//
+//	file://                  local disk, under the data directory
+//	file:///path/to/media    local disk, under /path/to/media
+//	s3://key:secret@host/bucket?region=...&secure=false&prefix=...
+func NewMediaStore(conf *Config, store string) (MediaStore, error) {
+	u, err := ParseURI(store)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing media store uri: %s", err)
+	}
+
+	switch u.Type {
+	case "file":
+		if u.Path == "" {
+			return newDiskMediaStore(filepath.Join(conf.Data, mediaDir))
+		}
+		return newDiskMediaStore(u.Path)
+	case "s3":
+		return newS3MediaStore(store)
+	default:
+		return nil, ErrInvalidMediaStore
+	}
+}
+
+// validMediaName returns true if name is a valid media name, a single path
+// element so media cannot be read or written outside of the store
+func validMediaName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+func mediaContentType(name string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+// diskMediaStore stores media as files in a directory on local disk
+type diskMediaStore struct {
+	path string
+}
+
+var _ MediaStore = (*diskMediaStore)(nil)
+
+func newDiskMediaStore(path string) (*diskMediaStore, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.WithError(err).Errorf("error creating media directory %s", path)
+		return nil, err
+	}
+	return &diskMediaStore{path: path}, nil
+}
+
+func (s *diskMediaStore) Put(name string, r io.Reader) error {
+	if !validMediaName(name) {
+		return ErrInvalidMediaName
+	}
+
+	// Write to a temporary file first so media is never served half written
+	tf, err := ioutil.TempFile(s.path, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := io.Copy(tf, r); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tf.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), filepath.Join(s.path, name))
+}
+
+func (s *diskMediaStore) Get(name string) (io.ReadCloser, error) {
+	if !validMediaName(name) {
+		return nil, ErrInvalidMediaName
+	}
+
+	f, err := os.Open(filepath.Join(s.path, name))
+	if os.IsNotExist(err) {
+		return nil, ErrMediaNotFound
+	}
+	return f, err
+}
+
+func (s *diskMediaStore) Stat(name string) (MediaInfo, error) {
+	if !validMediaName(name) {
+		return MediaInfo{}, ErrInvalidMediaName
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(s.path, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return MediaInfo{}, ErrMediaNotFound
+		}
+		return MediaInfo{}, err
+	}
+
+	return MediaInfo{
+		Name:        name,
+		Size:        fileInfo.Size(),
+		ModTime:     fileInfo.ModTime(),
+		ContentType: mediaContentType(name),
+	}, nil
+}
+
+func (s *diskMediaStore) Delete(name string) error {
+	if !validMediaName(name) {
+		return ErrInvalidMediaName
+	}
+
+	err := os.Remove(filepath.Join(s.path, name))
+	if os.IsNotExist(err) {
+		return ErrMediaNotFound
+	}
+	return err
+}
+
+func (s *diskMediaStore) List() ([]MediaInfo, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var media []MediaInfo
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+		media = append(media, MediaInfo{
+			Name:        fileInfo.Name(),
+			Size:        fileInfo.Size(),
+			ModTime:     fileInfo.ModTime(),
+			ContentType: mediaContentType(fileInfo.Name()),
+		})
+	}
+
+	return media, nil
+}
+
+func (s *diskMediaStore) SignedURL(name string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// Media returns the store uploaded media is kept in, media is stored on
+// local disk under the data directory if no store has been configured.
+func (c *Config) Media() MediaStore {
+	c.mediaOnce.Do(func() {
+		if c.media != nil {
+			return
+		}
+		store, err := newDiskMediaStore(filepath.Join(c.Data, mediaDir))
+		if err != nil {
+			log.WithError(err).Error("error creating default media store")
+		}
+		c.media = store
+	})
+	return c.media
+}
+
+// mediaWorkDir returns the directory files for resource are written to as
+// they are processed. Uploaded media is processed in a temporary directory
+// (which the caller must remove) to then be put into the media store with
+// putMedia, other resources (e.g: avatars) are written to the data directory.
+func mediaWorkDir(conf *Config, resource string) (string, error) {
+	if resource == mediaDir {
+		return ioutil.TempDir("", "twtxt-media-*")
+	}
+
+	p := filepath.Join(conf.Data, resource)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		log.WithError(err).Errorf("error creating %s directory", resource)
+		return "", err
+	}
+	return p, nil
+}
+
+// putMedia puts the processed files fns for resource into the media store,
+// files for other resources are left where they were written.
+func putMedia(conf *Config, resource string, fns ...string) error {
+	if resource != mediaDir {
+		return nil
+	}
+
+	for _, fn := range fns {
+		if err := putMediaFile(conf.Media(), fn); err != nil {
+			log.WithError(err).Errorf("error storing media %s", filepath.Base(fn))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func putMediaFile(store MediaStore, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(filepath.Base(fn), f)
+}
+
+// DeleteMedia deletes the uploaded media name (a media URI's name with or
+// without an extension) along with its metadata and the files it is stored
+// as in all formats and sizes, unless other media shares them. Media that
+// shares another's stored files deletes them once nothing else uses them.
+func DeleteMedia(conf *Config, name string) error {
+	name = MediaName(name)
+
+	meta := GetMediaMetadata(conf, name)
+
+	if err := conf.Media().Delete(name + mediaMetadataExt); err != nil && err != ErrMediaNotFound {
+		return err
+	}
+	forgetMediaMetadata(name)
+
+	source := name
+	if meta != nil {
+		mediaIdx.Remove(name, meta)
+		if meta.Source != "" {
+			source = meta.Source
+		}
+	}
+
+	if source != name && GetMediaMetadata(conf, source) != nil {
+		return nil
+	}
+	if shares, err := mediaIdx.Shares(conf, source); err != nil || shares > 0 {
+		return err
+	}
+
+	var names []string
+	for _, ext := range []string{".png", ".webp"} {
+		for size := range mediaSizes {
+			names = append(names, MediaVariantName(source+ext, size))
+		}
+	}
+	for _, ext := range []string{".png", ".webp", ".webm", ".mp4", ".ogg", ".mp3"} {
+		names = append(names, source+ext)
+	}
+
+	for _, name := range names {
+		err := conf.Media().Delete(name)
+		if err != nil && err != ErrMediaNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadsDir is where received uploads are kept until processed
+	uploadsDir = "uploads"
+
+	imageTaskKind = "image"
+	audioTaskKind = "audio"
+	videoTaskKind = "video"
+)
+
+// mediaTaskRetryPolicy retries media processing that failed because the
+// transcoder timed out (e.g: whilst the pod was busy), other failures (e.g:
+// invalid media) fail the same way every time
+var mediaTaskRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     10 * time.Second,
+	MaxBackoff:  time.Minute,
+	Retryable: func(err error) bool {
+		var timeout *ErrTranscodeTimeout
+		return errors.As(err, &timeout)
+	},
+}
+
+// spoolUpload moves the received upload fn into the data directory so it
+// survives restarts until it has been processed and returns its filename
+func spoolUpload(conf *Config, fn string) string {
+	if conf.Data == "" {
+		return fn
+	}
+
+	dir := filepath.Join(conf.Data, uploadsDir)
+	if filepath.Dir(fn) == dir {
+		return fn
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.WithError(err).Warn("error creating uploads directory")
+		return fn
+	}
+
+	sfn := filepath.Join(dir, filepath.Base(fn))
+	if err := os.Rename(fn, sfn); err != nil {
+		// The temporary directory may be on another filesystem
+		if err := copyUpload(fn, sfn); err != nil {
+			log.WithError(err).Warnf("error spooling upload %s", fn)
+			return fn
+		}
+		if err := os.Remove(fn); err != nil {
+			log.WithError(err).Warnf("error removing temporary upload %s", fn)
+		}
+	}
+
+	return sfn
+}
+
+func copyUpload(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
+
+// mediaTaskArgs returns the arguments a media task processing the upload fn
+// is recreated from when it is resumed
+func mediaTaskArgs(fn string, upload *MediaMetadata) TaskData {
+	args := TaskData{"fn": fn}
+	if upload != nil {
+		if data, err := json.Marshal(upload); err == nil {
+			args["upload"] = string(data)
+		}
+	}
+	return args
+}
+
+// loadMediaTaskArgs returns the upload and its metadata a media task was
+// dispatched with from its arguments
+func loadMediaTaskArgs(args TaskData) (string, *MediaMetadata, error) {
+	fn := args["fn"]
+	if _, err := os.Stat(fn); err != nil {
+		return "", nil, err
+	}
+
+	var upload *MediaMetadata
+	if data := args["upload"]; data != "" {
+		upload = &MediaMetadata{}
+		if err := json.Unmarshal([]byte(data), upload); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return fn, upload, nil
+}
+
+// RegisterMediaTasks registers the media processing tasks with the
+// dispatcher d so they are resumed if the pod restarts before they finish
+func RegisterMediaTasks(conf *Config, d *Dispatcher) {
+	factories := map[string]func(conf *Config, fn string, upload *MediaMetadata) Task{
+		imageTaskKind: func(conf *Config, fn string, upload *MediaMetadata) Task {
+			return NewImageTask(conf, fn, upload)
+		},
+		audioTaskKind: func(conf *Config, fn string, upload *MediaMetadata) Task {
+			return NewAudioTask(conf, fn, upload)
+		},
+		videoTaskKind: func(conf *Config, fn string, upload *MediaMetadata) Task {
+			return NewVideoTask(conf, fn, upload)
+		},
+	}
+
+	for kind, newTask := range factories {
+		newTask := newTask
+		d.RegisterTask(kind, func(args TaskData) (Task, error) {
+			fn, upload, err := loadMediaTaskArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			return newTask(conf, fn, upload), nil
+		})
+	}
+}
+
+// removeUpload removes the upload fn a media task failed to process or was
+// cancelled before processing so they don't accumulate in the uploads
+// directory
+func removeUpload(fn string) {
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnf("error removing failed upload %s", fn)
+	}
+}
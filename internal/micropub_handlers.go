@@ -0,0 +1,817 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	// micropubMediaWait is the maximum time the Micropub media endpoint
+	// waits for a media processing task before handing back the task URI
+	micropubMediaWait = 30 * time.Second
+)
+
+var (
+	// ErrMicropubNotFound is returned when a Micropub request refers to a
+	// post (by url) that does not exist on this pod
+	ErrMicropubNotFound = errors.New("error: post not found")
+
+	// ErrMicropubForbidden is returned when a Micropub request refers to a
+	// post (by url) not owned by the authenticated user
+	ErrMicropubForbidden = errors.New("error: post not owned by user")
+
+	// ErrMicropubNotLastTwt is returned when attempting to update or delete a
+	// twt that is not the user's last twt (twtxt feeds are append-only)
+	ErrMicropubNotLastTwt = errors.New("error: only the last twt can be updated or deleted")
+)
+
+// micropubRequest is a normalized Micropub request regardless of whether it
+// was sent form-encoded, as multipart/form-data or as JSON.
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+
+	Action  string                   `json:"action"`
+	URL     string                   `json:"url"`
+	Replace map[string][]interface{} `json:"replace"`
+	Add     map[string][]interface{} `json:"add"`
+}
+
+// Get returns the first value of a property as a string
+func (req *micropubRequest) Get(name string) string {
+	values := req.Properties[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return micropubValue(values[0])
+}
+
+// GetAll returns all values of a property as strings
+func (req *micropubRequest) GetAll(name string) []string {
+	var values []string
+	for _, v := range req.Properties[name] {
+		if s := micropubValue(v); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// micropubValue flattens a Micropub property value into a string. Values are
+// either plain strings or objects such as `{"html": "..."}` for content or
+// `{"value": "...", "alt": "..."}` for photos.
+func micropubValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"html", "value", "url"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func micropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func micropubJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).Error("error serializing micropub response")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// micropubToken returns the bearer token of a Micropub request which is
+// either provided in the Authorization header or as the `access_token`
+// form parameter. The API's `Token` header is also accepted.
+func micropubToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if token := r.Header.Get("Token"); token != "" {
+		return token
+	}
+
+	return r.FormValue("access_token")
+}
+
+// micropubUser authenticates a Micropub request using the pod's API tokens
+// and returns the scopes the token was granted, an empty scope is an
+// unrestricted API token. Tokens revoked by their user are not accepted.
+func (s *Server) micropubUser(r *http.Request) (*User, string, error) {
+	return s.bearerUser(r)
+}
+
+// micropubAllowed returns true if a token granted scope may perform a
+// Micropub action, tokens without a scope are unrestricted API tokens
+func micropubAllowed(scope string, required ...string) bool {
+	return scope == "" || indieAuthHasScope(scope, required...)
+}
+
+// parseMicropubRequest parses a form-encoded, multipart or JSON Micropub
+// request. Files attached to multipart requests are returned separately keyed
+// by property name so they can be fed through the media pipeline.
+func parseMicropubRequest(r *http.Request, maxUploadSize int64) (*micropubRequest, map[string][]*multipart.FileHeader, error) {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	req := &micropubRequest{Properties: make(map[string][]interface{})}
+
+	if ctype == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, nil, err
+		}
+		if req.Properties == nil {
+			req.Properties = make(map[string][]interface{})
+		}
+		return req, nil, nil
+	}
+
+	files := make(map[string][]*multipart.FileHeader)
+
+	if ctype == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			return nil, nil, err
+		}
+		for key, fhs := range r.MultipartForm.File {
+			name := strings.TrimSuffix(key, "[]")
+			files[name] = append(files[name], fhs...)
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return nil, nil, err
+	}
+
+	for key, values := range r.PostForm {
+		switch key {
+		case "access_token":
+			continue
+		case "h":
+			if len(values) > 0 {
+				req.Type = []string{fmt.Sprintf("h-%s", values[0])}
+			}
+		case "action":
+			req.Action = r.PostForm.Get(key)
+		case "url":
+			req.URL = r.PostForm.Get(key)
+		default:
+			name := strings.TrimSuffix(key, "[]")
+			for _, value := range values {
+				req.Properties[name] = append(req.Properties[name], value)
+			}
+		}
+	}
+
+	return req, files, nil
+}
+
+// dispatchMediaTask receives an uploaded media file and dispatches the appropriate processing task for it returning the task's id.
+// upload is recorded as the media's metadata once it has been processed. If
+// identical media has already been processed its URI is returned instead.
+func (s *Server) dispatchMediaTask(ctype string, r io.Reader, upload *MediaMetadata) (string, string, error) {
+	if err := CheckMediaQuotaLeft(s.config, upload.Owner); err != nil {
+		return "", "", err
+	}
+
+	var (
+		fn      string
+		err     error
+		newTask func(fn string) Task
+	)
+
+	switch {
+	case strings.HasPrefix(ctype, "image/"):
+		fn, err = ReceiveImage(r)
+		newTask = func(fn string) Task {
+			return NewImageTask(s.config, fn, upload)
+		}
+	case strings.HasPrefix(ctype, "audio/"):
+		fn, err = ReceiveAudio(r)
+		newTask = func(fn string) Task {
+			return NewAudioTask(s.config, fn, upload)
+		}
+	case strings.HasPrefix(ctype, "video/"):
+		fn, err = ReceiveVideo(r)
+		newTask = func(fn string) Task {
+			return NewVideoTask(s.config, fn, upload)
+		}
+	default:
+		return "", "", fmt.Errorf("error: unsupported media type %q", ctype)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if mediaURI, ok := ReuseMedia(s.config, fn, upload); ok {
+		return "", mediaURI, nil
+	}
+
+	uuid, err := s.tasks.Dispatch(newTask(fn))
+	if err != nil {
+		return "", "", err
+	}
+
+	return uuid, "", nil
+}
+
+// waitForMediaTask waits up to timeout for a media task to complete and
+// returns the resulting media URI.
+func (s *Server) waitForMediaTask(uuid string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		t, ok := s.tasks.Lookup(uuid)
+		if !ok {
+			return "", fmt.Errorf("error: task %s not found", uuid)
+		}
+
+		switch t.State() {
+		case TaskStateComplete:
+			return t.Result().Data["mediaURI"], nil
+		case TaskStateFailed, TaskStateCancelled:
+			return "", t.Error()
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return "", nil
+}
+
+// uploadMicropubMedia feeds a file attached to a Micropub request through
+// the media pipeline and returns the URI of the processed media.
+func (s *Server) uploadMicropubMedia(fh *multipart.FileHeader, user *User) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	upload := NewUploadMetadata(user.Username, fh.Filename, "")
+
+	uuid, mediaURI, err := s.dispatchMediaTask(fh.Header.Get("Content-Type"), f, upload)
+	if err != nil {
+		return "", err
+	}
+	if mediaURI != "" {
+		return mediaURI, nil
+	}
+
+	mediaURI, err = s.waitForMediaTask(uuid, micropubMediaWait)
+	if err != nil {
+		return "", err
+	}
+	if mediaURI == "" {
+		return "", fmt.Errorf("error: timed out processing media %s", fh.Filename)
+	}
+
+	return mediaURI, nil
+}
+
+// twtHashFromURL returns the hash of a local twt permalink URL
+func (s *Server) twtHashFromURL(u string) (string, bool) {
+	prefix := fmt.Sprintf("%s/twt/", strings.TrimSuffix(s.config.BaseURL, "/"))
+	if !strings.HasPrefix(u, prefix) {
+		return "", false
+	}
+	hash := strings.Trim(strings.TrimPrefix(u, prefix), "/")
+	return hash, hash != ""
+}
+
+// blogPostFromURL returns the blog post for a local blog post URL
+func (s *Server) blogPostFromURL(u string) (*BlogPost, bool) {
+	prefix := fmt.Sprintf("%s/blog/", strings.TrimSuffix(s.config.BaseURL, "/"))
+	if !strings.HasPrefix(u, prefix) {
+		return nil, false
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(u, prefix), "/"), "/")
+	if len(parts) != 5 {
+		return nil, false
+	}
+
+	blogPost := BlogPostFromParams(s.config, httprouter.Params{
+		{Key: "author", Value: parts[0]},
+		{Key: "year", Value: parts[1]},
+		{Key: "month", Value: parts[2]},
+		{Key: "date", Value: parts[3]},
+		{Key: "slug", Value: parts[4]},
+	})
+
+	if !s.blogs.Has(blogPost.Hash()) {
+		return nil, false
+	}
+
+	if err := blogPost.Load(s.config); err != nil {
+		log.WithError(err).Errorf("error loading blog post %s", blogPost)
+		return nil, false
+	}
+
+	return blogPost, true
+}
+
+// lastTwtForURL returns the user's last twt if it matches the twt permalink
+func (s *Server) lastTwtForURL(user *User, u string) (types.Twt, error) {
+	hash, ok := s.twtHashFromURL(u)
+	if !ok {
+		return types.NilTwt, ErrMicropubNotFound
+	}
+
+	if _, inCache := s.cache.Lookup(hash); !inCache {
+		if !s.archive.Has(hash) {
+			return types.NilTwt, ErrMicropubNotFound
+		}
+	}
+
+	lastTwt, _, err := GetLastTwt(s.config, user)
+	if err != nil {
+		return types.NilTwt, err
+	}
+
+	if lastTwt.IsZero() || lastTwt.Hash() != hash {
+		return types.NilTwt, ErrMicropubNotLastTwt
+	}
+
+	return lastTwt, nil
+}
+
+// micropubNoteText builds the text of a twt from a Micropub h-entry note
+func (s *Server) micropubNoteText(req *micropubRequest) string {
+	var parts []string
+
+	if reply := req.Get("in-reply-to"); reply != "" {
+		if hash, ok := s.twtHashFromURL(reply); ok {
+			parts = append(parts, fmt.Sprintf("(#%s)", hash))
+		}
+	}
+
+	if content := req.Get("content"); content != "" {
+		parts = append(parts, content)
+	}
+
+	for _, photo := range req.GetAll("photo") {
+		parts = append(parts, fmt.Sprintf("![](%s)", photo))
+	}
+	for _, media := range append(req.GetAll("video"), req.GetAll("audio")...) {
+		parts = append(parts, fmt.Sprintf("![](%s)", media))
+	}
+
+	for _, category := range req.GetAll("category") {
+		category = strings.TrimPrefix(strings.TrimSpace(category), "#")
+		if category != "" && !strings.ContainsAny(category, " \t") {
+			parts = append(parts, fmt.Sprintf("#%s", category))
+		}
+	}
+
+	return CleanTwt(strings.Join(parts, " "))
+}
+
+// refreshUserTwts updates the cache with the user's own feed
+func (s *Server) refreshUserTwts(user *User) {
+	// Update user's own timeline with their own new post.
+	s.cache.FetchTwts(s.config, s.archive, user.Source(), nil)
+
+	// Re-populate/Warm cache with local twts for this pod
+	s.cache.GetByPrefix(s.config.BaseURL, true)
+}
+
+// MicropubHandler implements a Micropub (https://www.w3.org/TR/micropub/)
+// endpoint. Notes are posted as twts and articles (entries with a name) are
+// written as blog posts.
+func (s *Server) MicropubHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, scope, err := s.micropubUser(r)
+		if err != nil {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "No valid access token provided")
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			s.micropubQuery(w, r, user)
+			return
+		}
+
+		// Limit request body to to abuse
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+		defer r.Body.Close()
+
+		req, files, err := parseMicropubRequest(r, s.config.MaxUploadSize)
+		if err != nil {
+			log.WithError(err).Error("error parsing micropub request")
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Error parsing request")
+			return
+		}
+
+		action := req.Action
+		if action == "" {
+			action = "create"
+		}
+		if !micropubAllowed(scope, action) {
+			micropubError(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("Token was not granted the %q scope", action))
+			return
+		}
+
+		switch action {
+		case "create":
+			for _, name := range []string{"photo", "video", "audio"} {
+				for _, fh := range files[name] {
+					mediaURI, err := s.uploadMicropubMedia(fh, user)
+					if err != nil {
+						log.WithError(err).Error("error processing micropub media")
+						micropubError(w, http.StatusBadRequest, "invalid_request", "Error processing media")
+						return
+					}
+					req.Properties[name] = append(req.Properties[name], mediaURI)
+				}
+			}
+			s.micropubCreate(w, user, req)
+		case "update":
+			s.micropubUpdate(w, user, req)
+		case "delete":
+			s.micropubDelete(w, user, req)
+		default:
+			micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Unsupported action %q", req.Action))
+		}
+	}
+}
+
+func (s *Server) micropubQuery(w http.ResponseWriter, r *http.Request, user *User) {
+	switch r.FormValue("q") {
+	case "config":
+		micropubJSON(w, map[string]interface{}{
+			"media-endpoint": URLForMicropubMedia(s.config.BaseURL),
+			"syndicate-to":   []interface{}{},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Twt"},
+				{"type": "article", "name": "Blog Post"},
+				{"type": "photo", "name": "Photo"},
+				{"type": "video", "name": "Video"},
+				{"type": "audio", "name": "Audio"},
+			},
+		})
+	case "syndicate-to":
+		micropubJSON(w, map[string]interface{}{"syndicate-to": []interface{}{}})
+	case "source":
+		u := r.FormValue("url")
+
+		if blogPost, ok := s.blogPostFromURL(u); ok {
+			micropubJSON(w, map[string]interface{}{
+				"type": []string{"h-entry"},
+				"properties": map[string]interface{}{
+					"name":      []string{blogPost.Title},
+					"content":   []string{blogPost.Content()},
+					"published": []string{blogPost.Created().Format(time.RFC3339)},
+					"author":    []string{URLForUser(s.config.BaseURL, blogPost.Author)},
+					"url":       []string{blogPost.URL(s.config.BaseURL)},
+				},
+			})
+			return
+		}
+
+		hash, ok := s.twtHashFromURL(u)
+		if !ok {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Invalid or missing url")
+			return
+		}
+
+		twt, inCache := s.cache.Lookup(hash)
+		if !inCache {
+			var err error
+			if twt, err = s.archive.Get(hash); err != nil {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "Post not found")
+				return
+			}
+		}
+
+		micropubJSON(w, map[string]interface{}{
+			"type": []string{"h-entry"},
+			"properties": map[string]interface{}{
+				"content":   []string{UnparseTwtFactory(s.config)(fmt.Sprintf("%t", twt))},
+				"published": []string{twt.Created().Format(time.RFC3339)},
+				"author":    []string{twt.Twter().URL},
+				"url":       []string{URLForTwt(s.config.BaseURL, twt.Hash())},
+			},
+		})
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported query")
+	}
+}
+
+func (s *Server) micropubCreate(w http.ResponseWriter, user *User, req *micropubRequest) {
+	if len(req.Type) > 0 && req.Type[0] != "h-entry" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Unsupported type %q", req.Type[0]))
+		return
+	}
+
+	if name := strings.TrimSpace(req.Get("name")); name != "" {
+		content := req.Get("content")
+		if content == "" {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "No content provided")
+			return
+		}
+
+		blogPost, err := WriteBlog(s.config, user, name, content)
+		if err != nil {
+			log.WithError(err).Error("error creating blog post")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error creating blog post")
+			return
+		}
+
+		if req.Get("post-status") != "draft" {
+			blogPost.Publish()
+
+			if err := blogPost.Save(s.config); err != nil {
+				log.WithError(err).Error("error saving blog post")
+				micropubError(w, http.StatusInternalServerError, "server_error", "Error publishing blog post")
+				return
+			}
+
+			twtText := fmt.Sprintf("[%s](%s)", blogPost.Title, blogPost.URL(s.config.BaseURL))
+			if _, err := AppendSpecial(s.config, s.db, blogPost.Author, twtText); err != nil {
+				log.WithError(err).Error("error posting blog post twt")
+				micropubError(w, http.StatusInternalServerError, "server_error", "Error posting announcement twt for new blog post")
+				return
+			}
+
+			s.refreshUserTwts(user)
+		}
+
+		// Update blogs cache
+		s.blogs.Add(blogPost)
+
+		w.Header().Set("Location", blogPost.URL(s.config.BaseURL))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	text := s.micropubNoteText(req)
+	if text == "" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "No content provided")
+		return
+	}
+
+	if err := ValidateTwtLength(s.config, req.Get("content")); err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Content exceeds the maximum length of %d", s.config.MaxTwtLength))
+		return
+	}
+
+	twt, err := AppendTwt(s.config, s.db, user, text)
+	if err != nil {
+		log.WithError(err).Error("error posting twt")
+		micropubError(w, http.StatusInternalServerError, "server_error", "Error posting twt")
+		return
+	}
+
+	s.refreshUserTwts(user)
+
+	// WebMentions ...
+	isLocalURL := IsLocalURLFactory(s.config)
+	isExternalFeed := IsExternalFeedFactory(s.config)
+	for _, m := range twt.Mentions() {
+		twter := m.Twter()
+		if !isLocalURL(twter.URL) || isExternalFeed(twter.URL) {
+			if err := WebMention(twter.URL, URLForTwt(s.config.BaseURL, twt.Hash())); err != nil {
+				log.WithError(err).Warnf("error sending webmention to %s", twter.URL)
+			}
+		}
+	}
+
+	w.Header().Set("Location", URLForTwt(s.config.BaseURL, twt.Hash()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) micropubUpdate(w http.ResponseWriter, user *User, req *micropubRequest) {
+	replace := &micropubRequest{Properties: req.Replace}
+	add := &micropubRequest{Properties: req.Add}
+
+	if blogPost, ok := s.blogPostFromURL(req.URL); ok {
+		if blogPost.Author != user.Username && !user.OwnsFeed(blogPost.Author) {
+			micropubError(w, http.StatusForbidden, "forbidden", ErrMicropubForbidden.Error())
+			return
+		}
+
+		if name := replace.Get("name"); name != "" {
+			blogPost.Title = name
+		}
+
+		content := blogPost.Content()
+		if c := replace.Get("content"); c != "" {
+			content = c
+		}
+		if c := add.Get("content"); c != "" {
+			content = fmt.Sprintf("%s\n\n%s", content, c)
+		}
+
+		blogPost.Reset()
+		if _, err := blogPost.WriteString(strings.ReplaceAll(strings.TrimSpace(content), "\r\n", "\n")); err != nil {
+			log.WithError(err).Error("error writing blog post content")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error updating blog post")
+			return
+		}
+
+		if err := blogPost.Save(s.config); err != nil {
+			log.WithError(err).Error("error saving blog post")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error updating blog post")
+			return
+		}
+
+		// Update blogs cache
+		s.blogs.Add(blogPost)
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	lastTwt, err := s.lastTwtForURL(user, req.URL)
+	if err != nil {
+		if err == ErrMicropubNotFound || err == ErrMicropubNotLastTwt {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		} else {
+			log.WithError(err).Error("error loading last twt")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error updating twt")
+		}
+		return
+	}
+
+	text := UnparseTwtFactory(s.config)(fmt.Sprintf("%t", lastTwt))
+	if c := replace.Get("content"); c != "" {
+		text = c
+	}
+	if c := add.Get("content"); c != "" {
+		text = fmt.Sprintf("%s %s", text, c)
+	}
+	for _, category := range add.GetAll("category") {
+		text = fmt.Sprintf("%s #%s", text, strings.TrimPrefix(category, "#"))
+	}
+
+	text = CleanTwt(text)
+	if text == "" {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "No content provided")
+		return
+	}
+
+	if err := ValidateTwtLength(s.config, text); err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Content exceeds the maximum length of %d", s.config.MaxTwtLength))
+		return
+	}
+
+	if err := DeleteLastTwt(s.config, user); err != nil {
+		log.WithError(err).Error("error deleting last twt")
+		micropubError(w, http.StatusInternalServerError, "server_error", "Error updating twt")
+		return
+	}
+
+	twt, err := AppendTwt(s.config, s.db, user, text, lastTwt.Created())
+	if err != nil {
+		log.WithError(err).Error("error posting twt")
+		micropubError(w, http.StatusInternalServerError, "server_error", "Error updating twt")
+		return
+	}
+
+	if err := RecordTwtEdit(s.config, user.Username, lastTwt.Hash(), twt.Hash()); err != nil {
+		log.WithError(err).Warnf("error recording edit of twt %s", lastTwt.Hash())
+	}
+
+	s.refreshUserTwts(user)
+
+	// The twt hash changes when its content is edited
+	w.Header().Set("Location", URLForTwt(s.config.BaseURL, twt.Hash()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) micropubDelete(w http.ResponseWriter, user *User, req *micropubRequest) {
+	if blogPost, ok := s.blogPostFromURL(req.URL); ok {
+		if blogPost.Author != user.Username && !user.OwnsFeed(blogPost.Author) {
+			micropubError(w, http.StatusForbidden, "forbidden", ErrMicropubForbidden.Error())
+			return
+		}
+
+		if err := blogPost.Delete(s.config); err != nil {
+			log.WithError(err).Error("error deleting blog post")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error deleting blog post")
+			return
+		}
+
+		// Update blogs cache
+		s.blogs.Delete(blogPost.Hash())
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	lastTwt, err := s.lastTwtForURL(user, req.URL)
+	if err != nil {
+		if err == ErrMicropubNotFound || err == ErrMicropubNotLastTwt {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		} else {
+			log.WithError(err).Error("error loading last twt")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error deleting twt")
+		}
+		return
+	}
+
+	if err := DeleteLastTwt(s.config, user); err != nil {
+		log.WithError(err).Error("error deleting last twt")
+		micropubError(w, http.StatusInternalServerError, "server_error", "Error deleting twt")
+		return
+	}
+
+	if err := RecordTwtDelete(s.config, user.Username, lastTwt.Hash()); err != nil {
+		log.WithError(err).Warnf("error recording delete of twt %s", lastTwt.Hash())
+	}
+
+	s.refreshUserTwts(user)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MicropubMediaHandler implements the Micropub media endpoint on top of the
+// existing media processing pipeline.
+func (s *Server) MicropubMediaHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user, scope, err := s.micropubUser(r)
+		if err != nil {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "No valid access token provided")
+			return
+		}
+
+		// Clients granted only create may still attach media to their posts
+		if !micropubAllowed(scope, "media", "create") {
+			micropubError(w, http.StatusForbidden, "insufficient_scope", "Token was not granted the \"media\" scope")
+			return
+		}
+
+		// Limit request body to to abuse
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+		defer r.Body.Close()
+
+		mfile, headers, err := r.FormFile("file")
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				log.Warnf("request too large for media upload from %s", FormatRequest(r))
+				micropubError(w, http.StatusRequestEntityTooLarge, "invalid_request", "Media Upload Too Large")
+				return
+			}
+			log.WithError(err).Error("error parsing form file")
+			micropubError(w, http.StatusBadRequest, "invalid_request", "No file provided")
+			return
+		}
+		defer mfile.Close()
+
+		upload := NewUploadMetadata(user.Username, headers.Filename, "")
+
+		uuid, mediaURI, err := s.dispatchMediaTask(headers.Header.Get("Content-Type"), mfile, upload)
+		if err == ErrMediaQuotaExceeded {
+			micropubError(w, http.StatusRequestEntityTooLarge, "invalid_request", "Media Quota Exceeded")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Errorf("error dispatching media task for %s", user.Username)
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported media type")
+			return
+		}
+
+		if mediaURI == "" {
+			mediaURI, err = s.waitForMediaTask(uuid, micropubMediaWait)
+		}
+		if err != nil {
+			log.WithError(err).Error("error processing media")
+			micropubError(w, http.StatusInternalServerError, "server_error", "Error processing media")
+			return
+		}
+
+		// Still processing, hand back the task so the client can poll it
+		if mediaURI == "" {
+			w.Header().Set("Location", URLForTask(s.config.BaseURL, uuid))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		w.Header().Set("Location", mediaURI)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
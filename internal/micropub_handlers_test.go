@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+// newTestMicropubServer returns a server that serves alice's feed so twts
+// posted via Micropub are picked up by the cache, and an API token for alice
+func newTestMicropubServer(t *testing.T) (*Server, string) {
+	lextwt.DefaultTwtManager()
+	registerTestCacheMetrics()
+
+	s := newTestAuthServer(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(s.config.Data, feedsDir, "alice"))
+	}))
+	t.Cleanup(srv.Close)
+
+	s.config.BaseURL = srv.URL
+	s.config.MaxFetchLimit = 1 << 20
+	s.config.MaxTwtLength = 288
+	s.config.MaxUploadSize = 1 << 20
+
+	archive, err := NewDiskArchiver(filepath.Join(s.config.Data, "archive"))
+	require.NoError(t, err)
+	s.archive = archive
+	s.cache = &Cache{Twts: make(map[string]*Cached)}
+
+	user, err := s.db.GetUser("alice")
+	require.NoError(t, err)
+	user.URL = URLForUser(s.config.BaseURL, "alice")
+
+	token, err := s.api.CreateToken(user, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.NoError(t, err)
+	user.AddToken(token)
+	require.NoError(t, s.db.SetToken(token.Signature, token))
+	require.NoError(t, s.db.SetUser("alice", user))
+
+	return s, token.Value
+}
+
+func TestMicropubHandlerAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	s, accessToken := newTestMicropubServer(t)
+
+	query := func(accessToken string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/micropub?q=config", nil)
+		if accessToken != "" {
+			r.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		w := httptest.NewRecorder()
+		s.MicropubHandler()(w, r, nil)
+		return w
+	}
+
+	assert.Equal(http.StatusUnauthorized, query("").Code)
+	assert.Equal(http.StatusUnauthorized, query("invalid").Code)
+
+	w := query(accessToken)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(URLForMicropubMedia(s.config.BaseURL), config["media-endpoint"])
+
+	// Tokens revoked by the user are no longer accepted
+	user, err := s.db.GetUser("alice")
+	require.NoError(t, err)
+	user.Tokens = nil
+	require.NoError(t, s.db.SetUser("alice", user))
+
+	assert.Equal(http.StatusUnauthorized, query(accessToken).Code)
+
+	w = postForm(s.MicropubHandler(), "/micropub", url.Values{
+		"access_token": {accessToken},
+		"h":            {"entry"},
+		"content":      {"Hello World"},
+	})
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	assert.False(FeedExists(s.config, "alice"))
+}
+
+func TestMicropubHandlerCreateDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	s, accessToken := newTestMicropubServer(t)
+
+	w := postForm(s.MicropubHandler(), "/micropub", url.Values{
+		"access_token": {accessToken},
+		"h":            {"entry"},
+		"content":      {"Hello World"},
+	})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	twts, err := GetAllTwts(s.config, "alice")
+	require.NoError(t, err)
+	require.Len(t, twts, 1)
+	assert.Equal(URLForTwt(s.config.BaseURL, twts[0].Hash()), w.Header().Get("Location"))
+	assert.Equal("Hello World", fmt.Sprintf("%t", twts[0]))
+
+	w = postForm(s.MicropubHandler(), "/micropub", url.Values{
+		"access_token": {accessToken},
+		"h":            {"entry"},
+	})
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	// Only the user's own twts can be deleted
+	del := url.Values{
+		"access_token": {accessToken},
+		"action":       {"delete"},
+		"url":          {URLForTwt(s.config.BaseURL, "abcdefg")},
+	}
+	w = postForm(s.MicropubHandler(), "/micropub", del)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	del.Set("url", URLForTwt(s.config.BaseURL, twts[0].Hash()))
+	w = postForm(s.MicropubHandler(), "/micropub", del)
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	twts, err = GetAllTwts(s.config, "alice")
+	require.NoError(t, err)
+	assert.Empty(twts)
+}
+
+func TestMicropubHandlerMultipartMedia(t *testing.T) {
+	assert := assert.New(t)
+
+	s, accessToken := newTestMicropubServer(t)
+
+	mediaIdx.reset()
+	defer mediaIdx.reset()
+
+	var photo bytes.Buffer
+	require.NoError(t, png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+
+	// The photo has already been processed, so uploads of it are reused
+	// rather than dispatched
+	f, err := ioutil.TempFile("", "twtxt-upload-*")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(photo.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	hash, err := HashMediaFile(f.Name())
+	require.NoError(t, err)
+
+	require.NoError(t, s.config.Media().Put("dedup.webp", strings.NewReader("processed")))
+	_, err = UpdateMediaMetadata(s.config, "dedup", func(meta *MediaMetadata) {
+		meta.Owner = "alice"
+		meta.ContentType = "image/webp"
+		meta.Size = 9
+		meta.Hash = hash
+	})
+	require.NoError(t, err)
+	defer forgetMediaMetadata("dedup")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("h", "entry"))
+	require.NoError(t, mw.WriteField("content", "Hello World"))
+	for _, name := range []string{"photo[]", "photo[]"} {
+		hdr := make(textproto.MIMEHeader)
+		hdr.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="photo.png"`, name))
+		hdr.Set("Content-Type", "image/png")
+		part, err := mw.CreatePart(hdr)
+		require.NoError(t, err)
+		_, err = part.Write(photo.Bytes())
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/micropub", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	s.MicropubHandler()(w, r, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	twts, err := GetAllTwts(s.config, "alice")
+	require.NoError(t, err)
+	require.Len(t, twts, 1)
+
+	text := fmt.Sprintf("%t", twts[0])
+	assert.True(strings.HasPrefix(text, "Hello World ![]("), text)
+	assert.Equal(2, strings.Count(text, "![]("+s.config.BaseURL+"/media/"), text)
+}
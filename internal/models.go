@@ -61,6 +61,8 @@ type User struct {
 	SMTPToken string `default:""`
 	POP3Token string `default:""`
 
+	IndieAuthMe string `default:""`
+
 	Bookmarks map[string]string `default:"{}"`
 	Followers map[string]string `default:"{}"`
 	Following map[string]string `default:"{}"`
@@ -76,6 +78,7 @@ type Token struct {
 	Signature string
 	Value     string
 	UserAgent string
+	Scope     string
 	CreatedAt time.Time
 	ExpiresAt time.Time
 }
@@ -101,6 +104,104 @@ func (t *Token) Bytes() ([]byte, error) {
 	return data, nil
 }
 
+// App is a client application registered through the Mastodon-compatible
+// API (POST /api/v1/apps) that may request access tokens on behalf of users
+type App struct {
+	ClientID     string
+	ClientSecret string
+	Name         string
+	Website      string
+	RedirectURIs []string `default:"[]"`
+	Scopes       string   `default:"read"`
+	CreatedAt    time.Time
+}
+
+func LoadApp(data []byte) (app *App, err error) {
+	app = &App{}
+	if err := defaults.Set(app); err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &app); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// HasRedirectURI returns true if uri is one of the app's registered redirect uris
+func (a *App) HasRedirectURI(uri string) bool {
+	for _, u := range a.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) Bytes() ([]byte, error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// TaskRecord is the recorded state of a dispatched task, tasks are recorded
+// so their results survive restarts and unfinished tasks can be resumed
+type TaskRecord struct {
+	ID string
+
+	// Kind and Args recreate resumable tasks (See: ResumableTask)
+	Kind string
+	Args TaskData `default:"{}"`
+
+	Priority TaskPriority
+	Attempts int
+
+	State TaskState
+	Error string
+	Data  TaskData `default:"{}"`
+
+	Created time.Time
+	Updated time.Time
+}
+
+func LoadTaskRecord(data []byte) (record *TaskRecord, err error) {
+	record = &TaskRecord{}
+	if err := defaults.Set(record); err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Finished returns true if the task has completed, failed or was cancelled
+func (r *TaskRecord) Finished() bool {
+	return r.State == TaskStateComplete || r.State == TaskStateFailed || r.State == TaskStateCancelled
+}
+
+// Result returns the result of the task as it was recorded
+func (r *TaskRecord) Result() TaskResult {
+	return TaskResult{
+		State: r.State.String(),
+		Error: r.Error,
+		Data:  r.Data,
+	}
+}
+
+func (r *TaskRecord) Bytes() ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func CreateFeed(conf *Config, db Store, user *User, name string, force bool) error {
 	if user != nil {
 		if !force && len(user.Feeds) > maxUserFeeds {
@@ -430,6 +531,15 @@ func (u *User) Follow(nick, url string) {
 	}
 }
 
+func (u *User) Unfollow(url string) {
+	for nick, following := range u.Following {
+		if following == url {
+			delete(u.Following, nick)
+		}
+	}
+	delete(u.sources, NormalizeURL(url))
+}
+
 func (u *User) FollowAndValidate(conf *Config, nick, url string) error {
 	if err := ValidateFeed(conf, nick, url); err != nil {
 		return err
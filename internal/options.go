@@ -4,6 +4,8 @@ import (
 	"net/url"
 	"regexp"
 	"time"
+
+	"github.com/jointwt/twtxt/types"
 )
 
 const (
@@ -24,6 +26,10 @@ const (
 	// DefaultStore is the default data store used for accounts, sessions, etc
 	DefaultStore = "bitcask://twtxt.db"
 
+	// DefaultMediaStore is the default store used for uploaded media, local
+	// disk under the data directory
+	DefaultMediaStore = "file://"
+
 	// DefaultBaseURL is the default Base URL for the app used to construct feed URLs
 	DefaultBaseURL = "http://0.0.0.0:8000"
 
@@ -77,6 +83,10 @@ const (
 	// of twts in memory
 	DefaultMaxCacheItems = DefaultTwtsPerPage * 3 // We get bored after paging thorughh > 3 pages :D
 
+	// DefaultTwtHashVersion is the default version of the hash local twts
+	// are hashed with
+	DefaultTwtHashVersion = types.LegacyTwtHashVersion
+
 	// DefaultMsgPerPage is the server's default msgs per page to display
 	DefaultMsgsPerPage = 20
 
@@ -86,6 +96,21 @@ const (
 	// DefaultMaxUploadSize is the default maximum upload size permitted
 	DefaultMaxUploadSize = 1 << 24 // ~16MB (enough for high-res photos)
 
+	// DefaultMediaQuota is the default storage quota for each user's uploaded
+	// media in bytes (zero is unlimited)
+	DefaultMediaQuota = 0
+
+	// DefaultOrphanedMediaGracePeriod is how long uploaded media must have
+	// been unreferenced by any twt, blog post or message to be orphaned
+	DefaultOrphanedMediaGracePeriod = 7 * 24 * time.Hour // 7 days
+
+	// DefaultDeleteOrphanedMedia is the default for whether or not to delete
+	// orphaned media (otherwise orphaned media is only reported)
+	DefaultDeleteOrphanedMedia = false
+
+	// DefaultTaskRetention is how long the records of finished tasks are kept
+	DefaultTaskRetention = 7 * 24 * time.Hour // 7 days
+
 	// DefaultSessionCacheTTL is the server's default session cache ttl
 	DefaultSessionCacheTTL = 1 * time.Hour
 
@@ -102,6 +127,10 @@ const (
 	DefaultSMTPBind = "0.0.0.0:8025"
 	DefaultPOP3Bind = "0.0.0.0:8110"
 
+	// DefaultFingerBind is the default interface and port for the Finger
+	// service, which is disabled by default
+	DefaultFingerBind = ""
+
 	// Default SMTP configuration
 	DefaultSMTPHost = "smtp.gmail.com"
 	DefaultSMTPPort = 587
@@ -155,6 +184,7 @@ func NewConfig() *Config {
 		Logo:              DefaultLogo,
 		Description:       DefaultMetaDescription,
 		Store:             DefaultStore,
+		MediaStore:        DefaultMediaStore,
 		Theme:             DefaultTheme,
 		BaseURL:           DefaultBaseURL,
 		AdminUser:         DefaultAdminUser,
@@ -164,6 +194,8 @@ func NewConfig() *Config {
 		TwtPrompts:        DefaultTwtPrompts,
 		TwtsPerPage:       DefaultTwtsPerPage,
 		MaxTwtLength:      DefaultMaxTwtLength,
+		MediaQuota:        DefaultMediaQuota,
+		TwtHashVersion:    DefaultTwtHashVersion,
 		MsgsPerPage:       DefaultMsgsPerPage,
 		OpenProfiles:      DefaultOpenProfiles,
 		OpenRegistrations: DefaultOpenRegistrations,
@@ -173,6 +205,11 @@ func NewConfig() *Config {
 		SMTPPort:          DefaultSMTPPort,
 		SMTPUser:          DefaultSMTPUser,
 		SMTPPass:          DefaultSMTPPass,
+
+		OrphanedMediaGracePeriod: DefaultOrphanedMediaGracePeriod,
+		DeleteOrphanedMedia:      DefaultDeleteOrphanedMedia,
+
+		TaskRetention: DefaultTaskRetention,
 	}
 }
 
@@ -211,6 +248,14 @@ func WithStore(store string) Option {
 	}
 }
 
+// WithMediaStore sets the store to use for uploaded media
+func WithMediaStore(store string) Option {
+	return func(cfg *Config) error {
+		cfg.MediaStore = store
+		return nil
+	}
+}
+
 // WithBaseURL sets the Base URL used for constructing feed URLs
 func WithBaseURL(baseURL string) Option {
 	return func(cfg *Config) error {
@@ -337,6 +382,14 @@ func WithMaxCacheItems(maxCacheItems int) Option {
 	}
 }
 
+// WithTwtHashVersion sets the version of the hash local twts are hashed with
+func WithTwtHashVersion(version int) Option {
+	return func(cfg *Config) error {
+		cfg.TwtHashVersion = version
+		return nil
+	}
+}
+
 // WithOpenProfiles sets whether or not to have open user profiles
 func WithOpenProfiles(openProfiles bool) Option {
 	return func(cfg *Config) error {
@@ -353,6 +406,31 @@ func WithMaxUploadSize(maxUploadSize int64) Option {
 	}
 }
 
+// WithMediaQuota sets the storage quota for each user's uploaded media
+func WithMediaQuota(quota int64) Option {
+	return func(cfg *Config) error {
+		cfg.MediaQuota = quota
+		return nil
+	}
+}
+
+// WithOrphanedMediaGracePeriod sets how long uploaded media must have been
+// unreferenced to be orphaned
+func WithOrphanedMediaGracePeriod(gracePeriod time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.OrphanedMediaGracePeriod = gracePeriod
+		return nil
+	}
+}
+
+// WithDeleteOrphanedMedia sets whether or not to delete orphaned media
+func WithDeleteOrphanedMedia(deleteOrphanedMedia bool) Option {
+	return func(cfg *Config) error {
+		cfg.DeleteOrphanedMedia = deleteOrphanedMedia
+		return nil
+	}
+}
+
 // WithSessionCacheTTL sets the server's session cache ttl
 func WithSessionCacheTTL(cacheTTL time.Duration) Option {
 	return func(cfg *Config) error {
@@ -401,6 +479,14 @@ func WithPOP3Bind(pop3Bind string) Option {
 	}
 }
 
+// WithFingerBind sets the interface and port to bind to for Finger
+func WithFingerBind(fingerBind string) Option {
+	return func(cfg *Config) error {
+		cfg.FingerBind = fingerBind
+		return nil
+	}
+}
+
 // WithSMTPHost sets the SMTPHost to use for sending email
 func WithSMTPHost(host string) Option {
 	return func(cfg *Config) error {
@@ -449,6 +535,14 @@ func WithMaxFetchLimit(limit int64) Option {
 	}
 }
 
+// WithTaskRetention sets how long the records of finished tasks are kept
+func WithTaskRetention(retention time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.TaskRetention = retention
+		return nil
+	}
+}
+
 // WithAPISessionTime sets the API session time for tokens
 func WithAPISessionTime(duration time.Duration) Option {
 	return func(cfg *Config) error {
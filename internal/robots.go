@@ -22,6 +22,7 @@ Allow: /support
 Allow: /search
 Allow: /external
 Allow: /atom.xml
+Allow: /rss.xml
 Allow: /media
 `
 
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	rotatedFeedsDir = "rotated"
+	rotatedHeadFile = "prev"
+)
+
+// RotatedFeedPrev returns the hash of the last twt and file name of the
+// most recently rotated (archived) twtxt file of a local feed, which is
+// advertised in the feed with a `# prev = <hash> <url>` comment.
+func RotatedFeedPrev(conf *Config, name string) (string, string, bool) {
+	fn := filepath.Join(conf.Data, rotatedFeedsDir, name, rotatedHeadFile)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("error reading rotated feed head for %s", name)
+		}
+		return "", "", false
+	}
+
+	sp := strings.Fields(string(data))
+	if len(sp) != 2 {
+		log.Warnf("invalid rotated feed head for %s: %q", name, string(data))
+		return "", "", false
+	}
+
+	return sp[0], sp[1], true
+}
+
+// GetRotatedFeeds returns the file names of all rotated (archived) twtxt
+// files of a local feed, oldest first.
+func GetRotatedFeeds(conf *Config, name string) ([]string, error) {
+	p := filepath.Join(conf.Data, rotatedFeedsDir, name)
+
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	var fns []string
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() || fileInfo.Name() == rotatedHeadFile || strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+		fns = append(fns, fileInfo.Name())
+	}
+
+	return fns, nil
+}
+
+// DeleteRotatedFeeds removes all rotated (archived) twtxt files of a local
+// feed
+func DeleteRotatedFeeds(conf *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(conf.Data, rotatedFeedsDir, name))
+}
+
+// RotateFeed moves all but the newest keep twts of a local feed into a new
+// archived twtxt file which links to the previously archived file (if any)
+// with a `# prev = <hash> <url>` comment, forming a chain clients can walk
+// to retrieve a feed's full history. Returns true if the feed was rotated.
+func RotateFeed(conf *Config, name string, keep int) (bool, error) {
+	fn := filepath.Join(conf.Data, feedsDir, name)
+
+	// Twts appended whilst rotating would be lost
+	defer lockFeed(name)()
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false, err
+	}
+
+	pr, err := types.ReadPreambleFeed(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	preamble := pr.Preamble()
+
+	var (
+		lines []string // the feed's comments and twts in order
+		twts  []int    // the indexes of the feed's twts in lines
+	)
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(conf.MaxFetchLimit))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			twts = append(twts, len(lines))
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	if len(twts) <= keep {
+		return false, nil
+	}
+
+	var old []string
+	for _, i := range twts[:len(twts)-keep] {
+		old = append(old, lines[i])
+	}
+
+	// Comments stay where they are relative to the twts kept, those amongst
+	// the archived twts are kept just before them
+	kept := len(lines)
+	if keep > 0 {
+		kept = twts[len(twts)-keep]
+	}
+	var current []string
+	for _, line := range lines[:kept] {
+		if strings.HasPrefix(line, "#") {
+			current = append(current, line)
+		}
+	}
+	current = append(current, lines[kept:]...)
+
+	twter := localTwter(conf, types.Twter{Nick: name, URL: URLForUser(conf.BaseURL, name)})
+	last, err := types.ParseLine(old[len(old)-1], twter)
+	if err != nil {
+		return false, fmt.Errorf("error parsing last twt to rotate for %s: %w", name, err)
+	}
+
+	p := filepath.Join(conf.Data, rotatedFeedsDir, name)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		log.WithError(err).Error("error creating rotated feeds directory")
+		return false, err
+	}
+
+	archived := &bytes.Buffer{}
+	fmt.Fprintf(archived, "# nick = %s\n", twter.Nick)
+	fmt.Fprintf(archived, "# url = %s\n", twter.URL)
+	if twter.HashVersion > types.LegacyTwtHashVersion {
+		fmt.Fprintf(archived, "# hash_version = %d\n", twter.HashVersion)
+	}
+	if hash, prev, ok := RotatedFeedPrev(conf, name); ok {
+		fmt.Fprintf(archived, "# prev = %s %s\n", hash, URLForRotatedFeed(conf.BaseURL, name, prev))
+	}
+	archived.WriteString("#\n")
+	for _, line := range old {
+		archived.WriteString(line + "\n")
+	}
+
+	archivedFn := fmt.Sprintf("twtxt-%s.txt", last.Hash())
+	if err := ioutil.WriteFile(filepath.Join(p, archivedFn), archived.Bytes(), 0644); err != nil {
+		return false, err
+	}
+
+	rotated := &bytes.Buffer{}
+	if preamble != "" {
+		rotated.WriteString(preamble + "\n\n")
+	}
+	for _, line := range current {
+		rotated.WriteString(line + "\n")
+	}
+
+	tmpFn := filepath.Join(p, ".current")
+	if err := ioutil.WriteFile(tmpFn, rotated.Bytes(), 0644); err != nil {
+		return false, err
+	}
+
+	head := fmt.Sprintf("%s %s\n", last.Hash(), archivedFn)
+	tmpHeadFn := filepath.Join(p, "."+rotatedHeadFile)
+	if err := ioutil.WriteFile(tmpHeadFn, []byte(head), 0644); err != nil {
+		os.Remove(tmpFn)
+		return false, err
+	}
+
+	// The head is only updated once the feed no longer has the archived twts
+	// so the feed never links to an archive it overlaps with
+	if err := os.Rename(tmpFn, fn); err != nil {
+		os.Remove(tmpHeadFn)
+		return false, err
+	}
+
+	if err := os.Rename(tmpHeadFn, filepath.Join(p, rotatedHeadFile)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
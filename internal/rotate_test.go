@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+func TestRotateFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	dir, err := ioutil.TempDir("", "twtxt-rotate-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", MaxFetchLimit: 1 << 20}
+	user := &User{Username: "alice"}
+
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, err := AppendTwt(conf, nil, user, fmt.Sprintf("Hello %d", i), ts.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+
+	ok, err := RotateFeed(conf, "alice", 2)
+	require.NoError(t, err)
+	assert.True(ok)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, feedsDir, "alice"))
+	require.NoError(t, err)
+	assert.Equal(2, strings.Count(string(data), "Hello"))
+
+	hash, fn, ok := RotatedFeedPrev(conf, "alice")
+	require.True(t, ok)
+	assert.Equal(fmt.Sprintf("twtxt-%s.txt", hash), fn)
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, rotatedFeedsDir, "alice", fn))
+	require.NoError(t, err)
+	assert.Equal(3, strings.Count(string(data), "Hello"))
+	assert.NotContains(string(data), "# prev")
+
+	// Feeds with no more than keep twts are not rotated
+	ok, err = RotateFeed(conf, "alice", 2)
+	require.NoError(t, err)
+	assert.False(ok)
+
+	// Subsequent rotations link to the previously rotated file
+	for i := 5; i < 8; i++ {
+		_, err := AppendTwt(conf, nil, user, fmt.Sprintf("Hello %d", i), ts.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+	ok, err = RotateFeed(conf, "alice", 2)
+	require.NoError(t, err)
+	assert.True(ok)
+
+	_, next, ok := RotatedFeedPrev(conf, "alice")
+	require.True(t, ok)
+	data, err = ioutil.ReadFile(filepath.Join(dir, rotatedFeedsDir, "alice", next))
+	require.NoError(t, err)
+	assert.Contains(string(data), fmt.Sprintf("# prev = %s %s", hash, URLForRotatedFeed(conf.BaseURL, "alice", fn)))
+
+	fns, err := GetRotatedFeeds(conf, "alice")
+	require.NoError(t, err)
+	assert.Len(fns, 2)
+
+	twts, err := GetAllTwts(conf, "alice")
+	require.NoError(t, err)
+	assert.Len(twts, 8)
+}
+
+func TestRotateFeedComments(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	dir, err := ioutil.TempDir("", "twtxt-rotate-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", MaxFetchLimit: 1 << 20}
+
+	feed := strings.Join([]string{
+		"# nick = alice",
+		"",
+		"# description = Hello",
+		"2021-01-01T00:00:00Z\tHello 0",
+		"# refs = 1",
+		"2021-01-01T01:00:00Z\tHello 1",
+		"2021-01-01T02:00:00Z\tHello 2",
+		"# refs = 2",
+		"2021-01-01T03:00:00Z\tHello 3",
+		"# refs = 3",
+		"",
+	}, "\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, feedsDir), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, feedsDir, "alice"), []byte(feed), 0644))
+
+	ok, err := RotateFeed(conf, "alice", 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Comments amongst the kept twts stay where they were
+	data, err := ioutil.ReadFile(filepath.Join(dir, feedsDir, "alice"))
+	require.NoError(t, err)
+	assert.Equal(strings.Join([]string{
+		"# nick = alice",
+		"",
+		"# description = Hello",
+		"# refs = 1",
+		"2021-01-01T02:00:00Z\tHello 2",
+		"# refs = 2",
+		"2021-01-01T03:00:00Z\tHello 3",
+		"# refs = 3",
+		"",
+	}, "\n"), string(data))
+}
+
+func TestRotateFeedLocksFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	dir, err := ioutil.TempDir("", "twtxt-rotate-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com", MaxFetchLimit: 1 << 20}
+	user := &User{Username: "alice"}
+
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, err := AppendTwt(conf, nil, user, fmt.Sprintf("Hello %d", i), ts.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+
+	// The feed is rotated only once whoever is writing to it is done, so
+	// twts appended meanwhile are not lost
+	unlock := lockFeed("alice")
+
+	rotated := make(chan bool)
+	go func() {
+		ok, err := RotateFeed(conf, "alice", 2)
+		assert.NoError(err)
+		rotated <- ok
+	}()
+
+	select {
+	case <-rotated:
+		t.Fatal("feed rotated whilst locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, feedsDir, "alice"), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(f, "%s\tHello 5\n", ts.Add(5*time.Hour).Format(time.RFC3339))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	unlock()
+
+	assert.True(<-rotated)
+
+	twts, err := GetAllTwts(conf, "alice")
+	require.NoError(t, err)
+	assert.Len(twts, 6)
+}
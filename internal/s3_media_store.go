@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion    = "us-east-1"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+	s3MaxSignedURLAge  = 7 * 24 * time.Hour
+)
+
+// s3MediaStore stores media as objects in an S3 compatible object store
+// (AWS S3, MinIO, etc) using path style requests signed with AWS Signature
+// Version 4.
+type s3MediaStore struct {
+	client *http.Client
+
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+var _ MediaStore = (*s3MediaStore)(nil)
+
+// newS3MediaStore returns a media store for the uri
+// s3://key:secret@host[:port]/bucket?region=...&secure=false&prefix=...
+func newS3MediaStore(uri string) (*s3MediaStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing media store uri: %s", err)
+	}
+
+	bucket := strings.Trim(u.Path, "/")
+	if u.Host == "" || bucket == "" || strings.Contains(bucket, "/") {
+		return nil, ErrInvalidMediaStore
+	}
+
+	secretKey, _ := u.User.Password()
+
+	scheme := "https"
+	if secure, err := strconv.ParseBool(u.Query().Get("secure")); err == nil && !secure {
+		scheme = "http"
+	}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	return &s3MediaStore{
+		client:    &http.Client{Timeout: time.Minute * 5},
+		endpoint:  &url.URL{Scheme: scheme, Host: u.Host},
+		bucket:    bucket,
+		prefix:    strings.Trim(u.Query().Get("prefix"), "/"),
+		region:    region,
+		accessKey: u.User.Username(),
+		secretKey: secretKey,
+	}, nil
+}
+
+func (s *s3MediaStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3MediaStore) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	u.Path = "/" + path.Join(s.bucket, s.key(name))
+	return &u
+}
+
+func (s *s3MediaStore) do(method string, u *url.URL, body io.Reader, size int64, ctype string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", ctype)
+	}
+
+	s.sign(req, time.Now().UTC())
+
+	return s.client.Do(req)
+}
+
+func (s *s3MediaStore) Put(name string, r io.Reader) error {
+	if !validMediaName(name) {
+		return ErrInvalidMediaName
+	}
+
+	// Objects must be uploaded with a known length
+	var (
+		body io.Reader
+		size int64
+	)
+	if seeker, ok := r.(io.Seeker); ok {
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		start, err := seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		body, size = r, end-start
+	} else {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	res, err := s.do(http.MethodPut, s.objectURL(name), body, size, mediaContentType(name))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return s3Error(res)
+}
+
+func (s *s3MediaStore) Get(name string) (io.ReadCloser, error) {
+	if !validMediaName(name) {
+		return nil, ErrInvalidMediaName
+	}
+
+	res, err := s.do(http.MethodGet, s.objectURL(name), nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s *s3MediaStore) Stat(name string) (MediaInfo, error) {
+	if !validMediaName(name) {
+		return MediaInfo{}, ErrInvalidMediaName
+	}
+
+	res, err := s.do(http.MethodHead, s.objectURL(name), nil, 0, "")
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer res.Body.Close()
+
+	if err := s3Error(res); err != nil {
+		return MediaInfo{}, err
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	ctype := res.Header.Get("Content-Type")
+	if ctype == "" {
+		ctype = mediaContentType(name)
+	}
+
+	return MediaInfo{
+		Name:        name,
+		Size:        res.ContentLength,
+		ModTime:     modTime,
+		ContentType: ctype,
+	}, nil
+}
+
+func (s *s3MediaStore) Delete(name string) error {
+	if !validMediaName(name) {
+		return ErrInvalidMediaName
+	}
+
+	// S3 does not report deleting objects that do not exist
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+
+	res, err := s.do(http.MethodDelete, s.objectURL(name), nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return s3Error(res)
+}
+
+// s3ListBucketResult is the response of a ListObjectsV2 request
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3MediaStore) List() ([]MediaInfo, error) {
+	var (
+		media []MediaInfo
+		token string
+	)
+
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+
+	for {
+		u := *s.endpoint
+		u.Path = "/" + s.bucket
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		res, err := s.do(http.MethodGet, &u, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s3Error(res); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if !validMediaName(name) {
+				continue
+			}
+			media = append(media, MediaInfo{
+				Name:        name,
+				Size:        obj.Size,
+				ModTime:     obj.LastModified,
+				ContentType: mediaContentType(name),
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return media, nil
+}
+
+// SignedURL returns a presigned URL for fetching the media stored as name
+// directly from the object store
+func (s *s3MediaStore) SignedURL(name string, expires time.Duration) (string, error) {
+	if !validMediaName(name) {
+		return "", ErrInvalidMediaName
+	}
+
+	if expires <= 0 || expires > s3MaxSignedURLAge {
+		expires = s3MaxSignedURLAge
+	}
+
+	now := time.Now().UTC()
+
+	u := s.objectURL(name)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3SigningAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3EscapeQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", s.signature(now, canonicalRequest))
+	u.RawQuery = s3EscapeQuery(query)
+
+	return u.String(), nil
+}
+
+func (s *s3MediaStore) scope(t time.Time) string {
+	return strings.Join([]string{t.Format("20060102"), s.region, "s3", "aws4_request"}, "/")
+}
+
+// signature returns the AWS Signature Version 4 signature of a canonical
+// request made at time t
+func (s *s3MediaStore) signature(t time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// sign signs req with an AWS Signature Version 4 Authorization header, the
+// payload is not signed.
+func (s *s3MediaStore) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           t.Format("20060102T150405Z"),
+	}
+	if ctype := req.Header.Get("Content-Type"); ctype != "" {
+		headers["content-type"] = ctype
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3EscapeQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, s.accessKey, s.scope(t), signedHeaders,
+		s.signature(t, canonicalRequest),
+	))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapeQuery encodes query sorted by key with spaces escaped as %20 as
+// canonical requests require
+func s3EscapeQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// s3Error returns the error of an unsuccessful response from the store
+func s3Error(res *http.Response) error {
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrMediaNotFound
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("error: media store responded %s: %s", res.Status, bytes.TrimSpace(msg))
+}
@@ -95,6 +95,15 @@ type Server struct {
 	// SMTP Service
 	smtpService *SMTPService
 
+	// Finger Service
+	fingerService *FingerService
+
+	// IndieAuth authorization codes
+	indieAuthCodes *TTLCache
+
+	// OAuth authorization codes issued to Mastodon clients
+	oauthCodes *TTLCache
+
 	// Passwords
 	pm passwords.Passwords
 
@@ -134,6 +143,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	s.cron.Stop()
 	s.tasks.Stop()
 	s.smtpService.Stop()
+	s.fingerService.Stop()
 
 	if err := s.server.Shutdown(ctx); err != nil {
 		log.WithError(err).Error("error shutting down server")
@@ -555,6 +565,8 @@ func (s *Server) initRoutes() {
 	s.router.HEAD("/user/:nick/avatar", s.AvatarHandler())
 	s.router.HEAD("/user/:nick/twtxt.txt", s.TwtxtHandler())
 	s.router.GET("/user/:nick/twtxt.txt", s.TwtxtHandler())
+	s.router.HEAD("/user/:nick/archive/:name", s.RotatedTwtxtHandler())
+	s.router.GET("/user/:nick/archive/:name", s.RotatedTwtxtHandler())
 	s.router.GET("/user/:nick/followers", s.FollowersHandler())
 	s.router.GET("/user/:nick/following", s.FollowingHandler())
 	s.router.GET("/user/:nick/bookmarks", s.BookmarksHandler())
@@ -573,8 +585,30 @@ func (s *Server) initRoutes() {
 	// Syndication Formats (RSS, Atom, JSON Feed)
 	s.router.HEAD("/atom.xml", s.SyndicationHandler())
 	s.router.HEAD("/user/:nick/atom.xml", s.SyndicationHandler())
+	s.router.HEAD("/search/atom.xml", s.TagSyndicationHandler())
+	s.router.HEAD("/blogs/:author/atom.xml", s.BlogsSyndicationHandler())
 	s.router.GET("/atom.xml", s.SyndicationHandler())
 	s.router.GET("/user/:nick/atom.xml", s.SyndicationHandler())
+	s.router.GET("/search/atom.xml", s.TagSyndicationHandler())
+	s.router.GET("/blogs/:author/atom.xml", s.BlogsSyndicationHandler())
+
+	s.router.HEAD("/rss.xml", s.SyndicationHandler())
+	s.router.HEAD("/user/:nick/rss.xml", s.SyndicationHandler())
+	s.router.HEAD("/search/rss.xml", s.TagSyndicationHandler())
+	s.router.HEAD("/blogs/:author/rss.xml", s.BlogsSyndicationHandler())
+	s.router.GET("/rss.xml", s.SyndicationHandler())
+	s.router.GET("/user/:nick/rss.xml", s.SyndicationHandler())
+	s.router.GET("/search/rss.xml", s.TagSyndicationHandler())
+	s.router.GET("/blogs/:author/rss.xml", s.BlogsSyndicationHandler())
+
+	s.router.HEAD("/feed.json", s.SyndicationHandler())
+	s.router.HEAD("/user/:nick/feed.json", s.SyndicationHandler())
+	s.router.HEAD("/search/feed.json", s.TagSyndicationHandler())
+	s.router.HEAD("/blogs/:author/feed.json", s.BlogsSyndicationHandler())
+	s.router.GET("/feed.json", s.SyndicationHandler())
+	s.router.GET("/user/:nick/feed.json", s.SyndicationHandler())
+	s.router.GET("/search/feed.json", s.TagSyndicationHandler())
+	s.router.GET("/blogs/:author/feed.json", s.BlogsSyndicationHandler())
 
 	s.router.GET("/feed/:name/manage", s.am.MustAuth(s.ManageFeedHandler()))
 	s.router.POST("/feed/:name/manage", s.am.MustAuth(s.ManageFeedHandler()))
@@ -603,6 +637,52 @@ func (s *Server) initRoutes() {
 	// Task State
 	s.router.GET("/task/:uuid", s.TaskHandler())
 
+	// Micropub
+	s.router.GET("/micropub", s.MicropubHandler())
+	s.router.POST("/micropub", s.MicropubHandler())
+	s.router.POST("/micropub/media", s.MicropubMediaHandler())
+
+	// IndieAuth
+	s.router.POST("/indieauth/login", s.IndieAuthLoginHandler())
+	s.router.GET("/indieauth/callback", s.IndieAuthCallbackHandler())
+	s.router.GET("/indieauth/auth", s.IndieAuthAuthorizeHandler())
+	s.router.POST("/indieauth/auth", s.IndieAuthVerifyHandler())
+	s.router.POST("/indieauth/approve", s.am.MustAuth(s.IndieAuthApproveHandler()))
+	s.router.GET("/indieauth/token", s.IndieAuthTokenHandler())
+	s.router.POST("/indieauth/token", s.IndieAuthTokenHandler())
+	s.router.GET("/.well-known/oauth-authorization-server", s.IndieAuthMetadataHandler())
+
+	// Mastodon-compatible client API
+	s.router.GET("/oauth/authorize", s.OAuthAuthorizeHandler())
+	s.router.POST("/oauth/authorize", s.am.MustAuth(s.OAuthApproveHandler()))
+	s.router.POST("/oauth/token", s.OAuthTokenHandler())
+	s.router.POST("/oauth/revoke", s.OAuthRevokeHandler())
+
+	s.router.POST("/api/v1/apps", s.MastodonAppsHandler())
+	s.router.GET("/api/v1/instance", s.MastodonInstanceHandler())
+
+	// NB: /api/v1/accounts/:id also serves verify_credentials and relationships
+	s.router.GET("/api/v1/accounts/:id", s.MastodonAccountHandler())
+	s.router.GET("/api/v1/accounts/:id/statuses", s.MastodonAccountStatusesHandler())
+	s.router.POST("/api/v1/accounts/:id/follow", s.isMastodonAuthorized("write:follows", s.MastodonFollowHandler()))
+	s.router.POST("/api/v1/accounts/:id/unfollow", s.isMastodonAuthorized("write:follows", s.MastodonUnfollowHandler()))
+
+	s.router.GET("/api/v1/timelines/home", s.isMastodonAuthorized("read:statuses", s.MastodonHomeTimelineHandler()))
+	s.router.GET("/api/v1/timelines/public", s.MastodonPublicTimelineHandler())
+	s.router.GET("/api/v1/timelines/tag/:hashtag", s.MastodonTagTimelineHandler())
+
+	s.router.POST("/api/v1/statuses", s.isMastodonAuthorized("write:statuses", s.MastodonPostStatusHandler()))
+	s.router.GET("/api/v1/statuses/:id", s.MastodonStatusHandler())
+	s.router.DELETE("/api/v1/statuses/:id", s.isMastodonAuthorized("write:statuses", s.MastodonDeleteStatusHandler()))
+	s.router.GET("/api/v1/statuses/:id/context", s.MastodonStatusContextHandler())
+
+	s.router.GET("/api/v1/notifications", s.isMastodonAuthorized("read:notifications", s.MastodonNotificationsHandler()))
+
+	s.router.POST("/api/v1/media", s.isMastodonAuthorized("write:media", s.MastodonUploadMediaHandler(micropubMediaWait)))
+	s.router.POST("/api/v2/media", s.isMastodonAuthorized("write:media", s.MastodonUploadMediaHandler(mastodonMediaWait)))
+	s.router.GET("/api/v1/media/:id", s.isMastodonAuthorized("write:media", s.MastodonMediaHandler()))
+	s.router.PUT("/api/v1/media/:id", s.isMastodonAuthorized("write:media", s.MastodonUpdateMediaHandler()))
+
 	// User/Feed Lookups
 	s.router.GET("/lookup", s.am.MustAuth(s.LookupHandler()))
 
@@ -636,6 +716,9 @@ func (s *Server) initRoutes() {
 	s.router.POST("/manage/deluser", s.DelUserHandler())
 	s.router.POST("/manage/rstuser", s.RstUserHandler())
 
+	s.router.GET("/manage/tasks", s.ManageTasksHandler())
+	s.router.POST("/manage/tasks/cancel", s.CancelTaskHandler())
+
 	s.router.GET("/deleteFeeds", s.DeleteAccountHandler())
 	s.router.POST("/delete", s.am.MustAuth(s.DeleteAllHandler()))
 
@@ -649,6 +732,19 @@ func (s *Server) initRoutes() {
 	s.router.POST("/report", s.ReportHandler())
 }
 
+// gzipHandler compresses responses except for media, media is already
+// compressed and is served as is so byte ranges of it can be requested
+func gzipHandler(h http.Handler) http.Handler {
+	gz := gziphandler.GzipHandler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/"+mediaDir+"/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gz.ServeHTTP(w, r)
+	})
+}
+
 // NewServer ...
 func NewServer(bind string, options ...Option) (*Server, error) {
 	config := NewConfig()
@@ -712,6 +808,13 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 		return nil, err
 	}
 
+	media, err := NewMediaStore(config, config.MediaStore)
+	if err != nil {
+		log.WithError(err).Error("error creating media store")
+		return nil, err
+	}
+	config.media = media
+
 	if err := db.Merge(); err != nil {
 		log.WithError(err).Error("error merging store")
 		return nil, err
@@ -734,7 +837,8 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 
 	am := auth.NewManager(auth.NewOptions("/login", "/register"))
 
-	tasks := NewDispatcher(10, 100) // TODO: Make this configurable?
+	tasks := NewPersistentDispatcher(db, 10, 100) // TODO: Make this configurable?
+	RegisterMediaTasks(config, tasks)
 
 	pm := passwords.NewScryptPasswords(nil)
 
@@ -756,8 +860,22 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 
 	smtpService := NewSMTPService(config, db, pm, msgs, tasks)
 
+	fingerService := NewFingerService(config, db)
+
 	csrfHandler := nosurf.New(router)
 	csrfHandler.ExemptGlob("/api/v1/*")
+	// Nested API paths (e.g: /api/v1/accounts/:id/follow) aren't matched by
+	// the glob above
+	csrfHandler.ExemptRegexp("^/api/v[12]/")
+	csrfHandler.ExemptPath("/micropub")
+	csrfHandler.ExemptGlob("/micropub/*")
+	csrfHandler.ExemptPath("/indieauth/token")
+	csrfHandler.ExemptPath("/oauth/token")
+	csrfHandler.ExemptPath("/oauth/revoke")
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		// Clients redeem authorization codes without a session
+		return r.URL.Path == "/indieauth/auth" && r.Method == http.MethodPost
+	})
 
 	server := &Server{
 		bind:    bind,
@@ -771,7 +889,7 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 				Prefix:               "twtxt",
 				RemoteAddressHeaders: []string{"X-Forwarded-For"},
 			}).Handler(
-				gziphandler.GzipHandler(
+				gzipHandler(
 					sm.Handler(csrfHandler),
 				),
 			),
@@ -786,6 +904,15 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 		// SMTP Servicee
 		smtpService: smtpService,
 
+		// Finger Service
+		fingerService: fingerService,
+
+		// IndieAuth authorization codes
+		indieAuthCodes: NewTTLCache(indieAuthCodeTTL),
+
+		// OAuth authorization codes issued to Mastodon clients
+		oauthCodes: NewTTLCache(indieAuthCodeTTL),
+
 		// Blogs Cache
 		blogs: blogs,
 
@@ -831,12 +958,21 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 	server.tasks.Start()
 	log.Info("started task dispatcher")
 
+	if err := server.tasks.Resume(); err != nil {
+		log.WithError(err).Error("error resuming unfinished tasks")
+	}
+
 	server.pop3Service.Start()
 	log.Info("started POP3 service")
 
 	server.smtpService.Start()
 	log.Info("started SMTP service")
 
+	if server.config.FingerBind != "" {
+		server.fingerService.Start()
+		log.Infof("started Finger service on %s", server.config.FingerBind)
+	}
+
 	server.setupWebMentions()
 	log.Infof("started webmentions processor")
 
@@ -864,6 +1000,8 @@ func NewServer(bind string, options ...Option) (*Server, error) {
 	log.Infof("SMTP From: %s", server.config.SMTPFrom)
 	log.Infof("Max Fetch Limit: %s", humanize.Bytes(uint64(server.config.MaxFetchLimit)))
 	log.Infof("Max Upload Size: %s", humanize.Bytes(uint64(server.config.MaxUploadSize)))
+	log.Infof("Media Quota: %s", humanize.Bytes(uint64(server.config.MediaQuota)))
+	log.Infof("Task Retention: %s", server.config.TaskRetention)
 	log.Infof("API Session Time: %s", server.config.APISessionTime)
 
 	// Warn about user registration being disabled.
@@ -567,6 +567,22 @@ function pollForTask(taskURL, delay, maxDelay, timeout, errorCallback, successCa
   });
 }
 
+// pollForMedia waits for an uploaded media file to be processed, identical
+// media uploaded before is returned as a mediaURI straight away
+function pollForMedia(uri, errorCallback, successCallback) {
+  if (uri.Type === "mediaURI") {
+    successCallback({
+      state: "complete",
+      data: {
+        mediaURI: uri.Path
+      }
+    });
+    return;
+  }
+
+  pollForTask(uri.Path, 1000, 30000, Date.now() + maxTaskWait, errorCallback, successCallback);
+}
+
 u("#uploadImage").on("change", function(e) {
   u("#uploadImageButton").removeClass("icss-camera");
   u("#uploadImageButton").addClass("icss-spinner icss-pulse");
@@ -581,11 +597,8 @@ u("#uploadImage").on("change", function(e) {
       var el = u("textarea#text");
       var text = document.getElementById("text");
 
-      pollForTask(
-        data.Path,
-        1000,
-        30000,
-        Date.now() + maxTaskWait,
+      pollForMedia(
+        data,
         function(errorData) {
           u("#uploadImageButton").removeClass("icss-spinner icss-pulse");
           u("#uploadImageButton").addClass("icss-camera");
@@ -635,11 +648,8 @@ u("#uploadAudio").on("change", function(e) {
       var el = u("textarea#text");
       var text = document.getElementById("text");
 
-      pollForTask(
-        data.Path,
-        1000,
-        30000,
-        Date.now() + maxTaskWait,
+      pollForMedia(
+        data,
         function(errorData) {
           u("#uploadAudioButton").removeClass("icss-spinner icss-pulse");
           u("#uploadAudioButton").addClass("icss-microphone");
@@ -689,11 +699,8 @@ u("#uploadVideo").on("change", function(e) {
       var el = u("textarea#text");
       var text = document.getElementById("text");
 
-      pollForTask(
-        data.Path,
-        1000,
-        30000,
-        Date.now() + maxTaskWait,
+      pollForMedia(
+        data,
         function(errorData) {
           u("#uploadVideoButton").removeClass("icss-spinner icss-pulse");
           u("#uploadVideoButton").addClass("icss-video-camera");
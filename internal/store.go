@@ -13,6 +13,8 @@ var (
 	ErrTokenNotFound  = errors.New("error: token not found")
 	ErrFeedNotFound   = errors.New("error: feed not found")
 	ErrInvalidSession = errors.New("error: invalid session")
+	ErrAppNotFound    = errors.New("error: app not found")
+	ErrTaskNotFound   = errors.New("error: task not found")
 )
 
 type Store interface {
@@ -48,6 +50,16 @@ type Store interface {
 	SetToken(signature string, token *Token) error
 	DelToken(signature string) error
 	LenTokens() int64
+
+	HasApp(clientID string) bool
+	GetApp(clientID string) (*App, error)
+	SetApp(clientID string, app *App) error
+	DelApp(clientID string) error
+
+	GetTask(id string) (*TaskRecord, error)
+	SetTask(id string, record *TaskRecord) error
+	DelTask(id string) error
+	GetAllTasks() ([]*TaskRecord, error)
 }
 
 func NewStore(store string) (Store, error) {
@@ -0,0 +1,540 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomarkdown/markdown"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/gorilla/feeds"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rickb777/accept"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	atomContentType     = "application/atom+xml"
+	rssContentType      = "application/rss+xml"
+	jsonFeedContentType = "application/feed+json"
+
+	jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+)
+
+// syndicationFormats maps the file name a feed is served under to its
+// content type, in the order they are advertised as alternates.
+var syndicationFormats = []struct {
+	Name  string
+	Type  string
+	Label string
+}{
+	{"atom.xml", atomContentType, "Atom"},
+	{"rss.xml", rssContentType, "RSS"},
+	{"feed.json", jsonFeedContentType, "JSON"},
+}
+
+// syndicationFormat returns the content type of the feed requested by the
+// last path element of the request (atom.xml, rss.xml or feed.json), or
+// Atom if the path is not a known feed file name.
+func syndicationFormat(r *http.Request) string {
+	name := path.Base(r.URL.Path)
+	for _, format := range syndicationFormats {
+		if format.Name == name {
+			return format.Type
+		}
+	}
+	return atomContentType
+}
+
+// preferredSyndicationFormat returns the content type of the feed format a
+// client asked for via the Accept header, or an empty string if the client
+// prefers HTML (as browsers do) or did not ask for a feed at all.
+func preferredSyndicationFormat(r *http.Request) string {
+	hdr := r.Header.Get("Accept")
+	if hdr == "" {
+		return ""
+	}
+
+	codings, err := accept.Parse(hdr)
+	if err != nil {
+		return ""
+	}
+
+	var (
+		best  string
+		bestQ float64
+		htmlQ float64
+	)
+
+	for _, coding := range codings.IfAccepted() {
+		switch coding.Name {
+		case "text/html", "application/xhtml+xml", "text/*", "*/*":
+			if coding.QValue > htmlQ {
+				htmlQ = coding.QValue
+			}
+		case atomContentType, rssContentType, jsonFeedContentType:
+			if coding.QValue > bestQ {
+				best, bestQ = coding.Name, coding.QValue
+			}
+		}
+	}
+
+	if best == "" || bestQ <= htmlQ {
+		return ""
+	}
+	return best
+}
+
+// syndicationAlternatives returns the alternates advertising every feed
+// format served under prefix, e.g: https://example.com/user/prologic
+func syndicationAlternatives(title, prefix string, query url.Values) types.Alternatives {
+	var alternatives types.Alternatives
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, format := range syndicationFormats {
+		u := fmt.Sprintf("%s/%s", prefix, format.Name)
+		if len(query) > 0 {
+			u = fmt.Sprintf("%s?%s", u, query.Encode())
+		}
+		alternatives = append(alternatives, types.Alternative{
+			Type:  format.Type,
+			Title: fmt.Sprintf("%s %s Feed", title, format.Label),
+			URL:   u,
+		})
+	}
+
+	return alternatives
+}
+
+// TwtsToFeedItems converts twts into syndication feed items
+func TwtsToFeedItems(conf *Config, twts types.Twts) []*feeds.Item {
+	formatTwt := FormatTwtFactory(conf)
+	formatTwtText := FormatTwtTextFactory(conf)
+
+	var items []*feeds.Item
+
+	for _, twt := range twts {
+		url := URLForTwt(conf.BaseURL, twt.Hash())
+		item := &feeds.Item{
+			Id:          url,
+			Title:       strings.Join(strings.Fields(formatTwtText(twt)), " "),
+			Link:        &feeds.Link{Href: url},
+			Author:      &feeds.Author{Name: twt.Twter().Nick},
+			Description: string(formatTwt(twt)),
+			Created:     twt.Created(),
+		}
+
+		// Uploaded audio and video are enclosed so podcast clients and feed
+		// readers can fetch it (the poster or waveform is in the description)
+		item.Enclosure = mediaEnclosure(conf, fmt.Sprintf("%t", twt))
+
+		// Twts with a content warning are summarized by their warning so
+		// readers can collapse them
+		if cw := twt.ContentWarning(); cw != "" {
+			item.Title = fmt.Sprintf("CW: %s", cw)
+			item.Content = item.Description
+			item.Description = html.EscapeString(cw)
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// mediaEnclosure returns the enclosure of the first uploaded audio or video
+// embedded in text, or nil if there is none
+func mediaEnclosure(conf *Config, text string) *feeds.Enclosure {
+	isLocalURL := IsLocalURLFactory(conf)
+
+	for _, match := range markdownImageRe.FindAllStringSubmatch(text, -1) {
+		uri := match[1]
+		if !isLocalURL(uri) {
+			continue
+		}
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+
+		meta := localMediaMetadata(conf, u)
+		if meta == nil || meta.IsImage() {
+			continue
+		}
+
+		// The media is enclosed in the format it's recorded as
+		uri = meta.URL(conf.BaseURL, MediaName(u.Path))
+		info, err := conf.Media().Stat(path.Base(uri))
+		if err != nil {
+			log.WithError(err).Warnf("error reading info of media %s", uri)
+			continue
+		}
+
+		return &feeds.Enclosure{
+			Url:    uri,
+			Type:   meta.ContentType,
+			Length: fmt.Sprintf("%d", info.Size),
+		}
+	}
+
+	return nil
+}
+
+// BlogPostsToFeedItems converts published blog posts into syndication feed
+// items, drafts are skipped.
+func BlogPostsToFeedItems(conf *Config, blogPosts BlogPosts) []*feeds.Item {
+	var items []*feeds.Item
+
+	for _, blogPost := range blogPosts {
+		if blogPost.Draft() {
+			continue
+		}
+
+		url := blogPost.URL(conf.BaseURL)
+		items = append(items, &feeds.Item{
+			Id:          url,
+			Title:       blogPost.Title,
+			Link:        &feeds.Link{Href: url},
+			Author:      &feeds.Author{Name: blogPost.Author},
+			Description: string(renderBlogPostHTML(blogPost)),
+			Created:     blogPost.Published(),
+			Updated:     blogPost.Modified(),
+		},
+		)
+	}
+
+	return items
+}
+
+func renderBlogPostHTML(blogPost *BlogPost) []byte {
+	extensions := parser.CommonExtensions |
+		parser.NoEmptyLineBeforeBlock |
+		parser.AutoHeadingIDs |
+		parser.HardLineBreak |
+		parser.Footnotes
+
+	mdParser := parser.NewWithExtensions(extensions)
+
+	opts := mdhtml.RendererOptions{
+		Flags:     mdhtml.CommonFlags,
+		Generator: "",
+	}
+	renderer := mdhtml.NewRenderer(opts)
+
+	return markdown.ToHTML(blogPost.Bytes(), mdParser, renderer)
+}
+
+// JSONFeed is a JSON Feed version 1.1 document
+// See: https://jsonfeed.org/version/1.1
+type JSONFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url,omitempty"`
+	FeedURL     string           `json:"feed_url,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Authors     []JSONFeedAuthor `json:"authors,omitempty"`
+	Items       []JSONFeedItem   `json:"items"`
+}
+
+// JSONFeedAuthor is the author of a JSON Feed or one of its items
+type JSONFeedAuthor struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// JSONFeedItem is a single item of a JSON Feed
+type JSONFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html,omitempty"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published,omitempty"`
+	DateModified  string           `json:"date_modified,omitempty"`
+	Authors       []JSONFeedAuthor `json:"authors,omitempty"`
+
+	Attachments []JSONFeedAttachment `json:"attachments,omitempty"`
+}
+
+// JSONFeedAttachment is a file attached to an item of a JSON Feed
+type JSONFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// NewJSONFeed converts a feed into a JSON Feed 1.1 document
+func NewJSONFeed(feed *feeds.Feed, feedURL string) *JSONFeed {
+	jsonFeed := &JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       feed.Title,
+		FeedURL:     feedURL,
+		Description: feed.Description,
+		Items:       []JSONFeedItem{},
+	}
+
+	if feed.Link != nil {
+		jsonFeed.HomePageURL = feed.Link.Href
+	}
+	if feed.Author != nil {
+		jsonFeed.Authors = []JSONFeedAuthor{{Name: feed.Author.Name, URL: jsonFeed.HomePageURL}}
+	}
+
+	for _, item := range feed.Items {
+		jsonItem := JSONFeedItem{
+			ID:          item.Id,
+			ContentHTML: item.Description,
+		}
+		if item.Link != nil {
+			jsonItem.URL = item.Link.Href
+		}
+		// Twts have no title of their own, their "title" is their content.
+		if item.Title != item.Description {
+			jsonItem.Title = item.Title
+		}
+		if item.Content != "" {
+			// Item descriptions are HTML (as Atom summaries are), JSON
+			// Feed summaries are plain text
+			jsonItem.ContentHTML = item.Content
+			jsonItem.Summary = html.UnescapeString(item.Description)
+		}
+		if !item.Created.IsZero() {
+			jsonItem.DatePublished = item.Created.Format(time.RFC3339)
+		}
+		if !item.Updated.IsZero() {
+			jsonItem.DateModified = item.Updated.Format(time.RFC3339)
+		}
+		if item.Author != nil {
+			jsonItem.Authors = []JSONFeedAuthor{{Name: item.Author.Name}}
+		}
+		if item.Enclosure != nil {
+			size, _ := strconv.ParseInt(item.Enclosure.Length, 10, 64)
+			jsonItem.Attachments = []JSONFeedAttachment{{
+				URL:         item.Enclosure.Url,
+				MimeType:    item.Enclosure.Type,
+				SizeInBytes: size,
+			}}
+		}
+		jsonFeed.Items = append(jsonFeed.Items, jsonItem)
+	}
+
+	return jsonFeed
+}
+
+// writeFeed serializes feed in the given format (one of the syndication
+// content types) and writes it to the response.
+func (s *Server) writeFeed(w http.ResponseWriter, r *http.Request, format string, feed *feeds.Feed) {
+	var lastModified time.Time
+	for _, item := range feed.Items {
+		if item.Created.After(lastModified) {
+			lastModified = item.Created
+		}
+		if item.Updated.After(lastModified) {
+			lastModified = item.Updated
+		}
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=utf-8", format))
+	w.Header().Set("Vary", "Accept")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method == http.MethodHead {
+		defer r.Body.Close()
+		return
+	}
+
+	var (
+		data string
+		err  error
+	)
+
+	switch format {
+	case rssContentType:
+		data, err = feed.ToRss()
+	case jsonFeedContentType:
+		feedURL := fmt.Sprintf("%s%s", strings.TrimSuffix(s.config.BaseURL, "/"), r.URL.RequestURI())
+		var buf []byte
+		buf, err = json.Marshal(NewJSONFeed(feed, feedURL))
+		data = string(buf)
+	default:
+		data, err = feed.ToAtom()
+	}
+	if err != nil {
+		log.WithError(err).Error("error serializing feed")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write([]byte(data))
+}
+
+// TwtsFeed builds the feed of twts of a local user or feed, or of the whole
+// pod if nick is empty.
+func (s *Server) TwtsFeed(nick string) (*feeds.Feed, error) {
+	var (
+		twts    types.Twts
+		profile types.Profile
+	)
+
+	if nick != "" {
+		if s.db.HasUser(nick) {
+			user, err := s.db.GetUser(nick)
+			if err != nil {
+				return nil, err
+			}
+			profile = user.Profile(s.config.BaseURL, nil)
+		} else if s.db.HasFeed(nick) {
+			feed, err := s.db.GetFeed(nick)
+			if err != nil {
+				return nil, err
+			}
+			profile = feed.Profile(s.config.BaseURL, nil)
+		} else {
+			return nil, ErrFeedNotFound
+		}
+		twts = s.cache.GetByURL(profile.URL)
+	} else {
+		twts = s.cache.GetByPrefix(s.config.BaseURL, false)
+
+		profile = types.Profile{
+			Type:     "Local",
+			Username: s.config.Name,
+			Tagline:  "", // TODO: Maybe Twtxt Pods should have a configurable description?
+			URL:      s.config.BaseURL,
+		}
+	}
+
+	// feed author.email
+	email := ""
+	if nick == "" {
+		email = s.config.AdminEmail
+	}
+
+	return &feeds.Feed{
+		Title:       fmt.Sprintf("%s Twtxt Feed", profile.Username),
+		Link:        &feeds.Link{Href: profile.URL},
+		Description: profile.Tagline,
+		Author:      &feeds.Author{Name: profile.Username, Email: email},
+		Created:     time.Now(),
+		Items:       TwtsToFeedItems(s.config, twts),
+	}, nil
+}
+
+// TagFeed builds the feed of twts tagged with tag
+func (s *Server) TagFeed(tag string) *feeds.Feed {
+	var twts types.Twts
+
+	seen := make(map[string]bool)
+	for _, twt := range s.cache.GetAll() {
+		var tags types.TagList = twt.Tags()
+		if HasString(UniqStrings(tags.Tags()), tag) && !seen[twt.Hash()] {
+			twts = append(twts, twt)
+			seen[twt.Hash()] = true
+		}
+	}
+	sort.Sort(twts)
+
+	return &feeds.Feed{
+		Title:   fmt.Sprintf("#%s on %s", tag, s.config.Name),
+		Link:    &feeds.Link{Href: URLForTag(s.config.BaseURL, tag)},
+		Author:  &feeds.Author{Name: s.config.Name, Email: s.config.AdminEmail},
+		Created: time.Now(),
+		Items:   TwtsToFeedItems(s.config, twts),
+	}
+}
+
+// BlogsFeed builds the feed of published blog posts by author
+func (s *Server) BlogsFeed(author string) (*feeds.Feed, error) {
+	if !s.db.HasUser(author) && !s.db.HasFeed(author) {
+		return nil, ErrFeedNotFound
+	}
+
+	blogPosts, err := GetBlogPostsByAuthor(s.config, author)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(blogPosts)
+
+	return &feeds.Feed{
+		Title:   fmt.Sprintf("%s's Twt Blog", author),
+		Link:    &feeds.Link{Href: URLForBlogs(s.config.BaseURL, author)},
+		Author:  &feeds.Author{Name: author},
+		Created: time.Now(),
+		Items:   BlogPostsToFeedItems(s.config, blogPosts),
+	}, nil
+}
+
+// SyndicationHandler serves the Atom, RSS or JSON Feed of the pod or of a
+// local user or feed
+func (s *Server) SyndicationHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.syndicateTwts(w, r, NormalizeUsername(p.ByName("nick")), syndicationFormat(r))
+	}
+}
+
+// TagSyndicationHandler serves the Atom, RSS or JSON Feed of a tag search
+func (s *Server) TagSyndicationHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.syndicateTag(w, r, r.URL.Query().Get("tag"), syndicationFormat(r))
+	}
+}
+
+// BlogsSyndicationHandler serves the Atom, RSS or JSON Feed of a user's
+// blog posts
+func (s *Server) BlogsSyndicationHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		s.syndicateBlogs(w, r, NormalizeUsername(p.ByName("author")), syndicationFormat(r))
+	}
+}
+
+func (s *Server) syndicateTwts(w http.ResponseWriter, r *http.Request, nick, format string) {
+	feed, err := s.TwtsFeed(nick)
+	if err != nil {
+		if err == ErrFeedNotFound {
+			http.Error(w, "Feed Not Found", http.StatusNotFound)
+			return
+		}
+		log.WithError(err).Errorf("error loading feeds for %s", nick)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeFeed(w, r, format, feed)
+}
+
+func (s *Server) syndicateTag(w http.ResponseWriter, r *http.Request, tag, format string) {
+	if tag == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	s.writeFeed(w, r, format, s.TagFeed(tag))
+}
+
+func (s *Server) syndicateBlogs(w http.ResponseWriter, r *http.Request, author, format string) {
+	feed, err := s.BlogsFeed(author)
+	if err != nil {
+		if err == ErrFeedNotFound {
+			http.Error(w, "Feed Not Found", http.StatusNotFound)
+			return
+		}
+		log.WithError(err).Errorf("error loading blog posts for %s", author)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeFeed(w, r, format, feed)
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/feeds"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+func TestPreferredSyndicationFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		accept   string
+		expected string
+	}{
+		{"none", "", ""},
+		{"firefox", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8", ""},
+		{"chrome", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9", ""},
+		{"atom", "application/atom+xml", atomContentType},
+		{"rss", "application/rss+xml", rssContentType},
+		{"json", "application/feed+json", jsonFeedContentType},
+		{"feed over html", "application/rss+xml, text/html;q=0.9", rssContentType},
+		{"html over feed", "text/html, application/rss+xml;q=0.9", ""},
+		{"tie with html", "application/atom+xml, text/html", ""},
+		{"tie with wildcard", "application/atom+xml;q=0.5, */*;q=0.5", ""},
+		{"best feed", "application/atom+xml;q=0.5, application/feed+json;q=0.8", jsonFeedContentType},
+		{"not acceptable", "application/rss+xml;q=0", ""},
+		{"other", "application/json", ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.accept != "" {
+				r.Header.Set("Accept", testCase.accept)
+			}
+			assert.Equal(t, testCase.expected, preferredSyndicationFormat(r))
+		})
+	}
+}
+
+func TestSyndicationFormat(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/atom.xml", atomContentType},
+		{"/rss.xml", rssContentType},
+		{"/feed.json", jsonFeedContentType},
+		{"/user/alice/rss.xml", rssContentType},
+		{"/search/feed.json?tag=go", jsonFeedContentType},
+		{"/blogs/alice/atom.xml", atomContentType},
+		{"/user/alice/twtxt.txt", atomContentType},
+	}
+
+	for _, testCase := range testCases {
+		r := httptest.NewRequest(http.MethodGet, testCase.path, nil)
+		assert.Equal(t, testCase.expected, syndicationFormat(r), testCase.path)
+	}
+}
+
+func TestNewJSONFeed(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	feed := &feeds.Feed{
+		Title:       "alice Twtxt Feed",
+		Link:        &feeds.Link{Href: "https://example.com/user/alice/twtxt.txt"},
+		Description: "Hello",
+		Author:      &feeds.Author{Name: "alice"},
+		Items: []*feeds.Item{
+			{
+				Id:          "https://example.com/twt/a",
+				Title:       "Hello World",
+				Link:        &feeds.Link{Href: "https://example.com/twt/a"},
+				Author:      &feeds.Author{Name: "alice"},
+				Description: "<p>Hello World</p>",
+				Created:     created,
+			},
+			{
+				Id:          "https://example.com/twt/b",
+				Title:       "CW: spoilers",
+				Link:        &feeds.Link{Href: "https://example.com/twt/b"},
+				Description: "spoilers &amp; more",
+				Content:     "<p>The butler did it</p>",
+				Created:     created,
+				Updated:     created.Add(time.Hour),
+				Enclosure: &feeds.Enclosure{
+					Url:    "https://example.com/media/c.mp4",
+					Type:   "video/mp4",
+					Length: "1024",
+				},
+			},
+		},
+	}
+
+	jsonFeed := NewJSONFeed(feed, "https://example.com/user/alice/feed.json")
+	assert.Equal(jsonFeedVersion, jsonFeed.Version)
+	assert.Equal("alice Twtxt Feed", jsonFeed.Title)
+	assert.Equal("https://example.com/user/alice/twtxt.txt", jsonFeed.HomePageURL)
+	assert.Equal("https://example.com/user/alice/feed.json", jsonFeed.FeedURL)
+	assert.Equal([]JSONFeedAuthor{{Name: "alice", URL: jsonFeed.HomePageURL}}, jsonFeed.Authors)
+	require.Len(t, jsonFeed.Items, 2)
+
+	item := jsonFeed.Items[0]
+	assert.Equal("https://example.com/twt/a", item.ID)
+	assert.Equal("https://example.com/twt/a", item.URL)
+	assert.Equal("Hello World", item.Title)
+	assert.Equal("<p>Hello World</p>", item.ContentHTML)
+	assert.Empty(item.Summary)
+	assert.Equal("2021-01-02T03:04:05Z", item.DatePublished)
+	assert.Empty(item.DateModified)
+	assert.Empty(item.Attachments)
+
+	item = jsonFeed.Items[1]
+	assert.Equal("CW: spoilers", item.Title)
+	assert.Equal("<p>The butler did it</p>", item.ContentHTML)
+	assert.Equal("spoilers & more", item.Summary)
+	assert.Equal("2021-01-02T04:04:05Z", item.DateModified)
+	assert.Equal([]JSONFeedAttachment{{
+		URL:         "https://example.com/media/c.mp4",
+		MimeType:    "video/mp4",
+		SizeInBytes: 1024,
+	}}, item.Attachments)
+
+	// Feeds without items still have an (empty) items list
+	data, err := json.Marshal(NewJSONFeed(&feeds.Feed{Title: "Empty"}, ""))
+	require.NoError(t, err)
+	assert.JSONEq(`{"version": "https://jsonfeed.org/version/1.1", "title": "Empty", "items": []}`, string(data))
+}
+
+func TestWriteFeed(t *testing.T) {
+	s := &Server{config: &Config{BaseURL: "https://example.com/"}}
+
+	created := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	feed := &feeds.Feed{
+		Title:   "alice Twtxt Feed",
+		Link:    &feeds.Link{Href: "https://example.com/user/alice/twtxt.txt"},
+		Created: time.Now(),
+		Items: []*feeds.Item{
+			{Id: "a", Title: "Hello", Link: &feeds.Link{Href: "a"}, Description: "Hello", Created: created},
+			{Id: "b", Title: "World", Link: &feeds.Link{Href: "b"}, Description: "World", Created: created, Updated: created.Add(time.Hour)},
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{atomContentType, `<feed xmlns="http://www.w3.org/2005/Atom"`},
+		{rssContentType, `<rss version="2.0"`},
+		{jsonFeedContentType, `"feed_url":"https://example.com/user/alice/feed.json"`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.format, func(t *testing.T) {
+			assert := assert.New(t)
+
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				r := httptest.NewRequest(method, "/user/alice/feed.json", nil)
+				w := httptest.NewRecorder()
+				s.writeFeed(w, r, testCase.format, feed)
+
+				assert.Equal(http.StatusOK, w.Code)
+				assert.Equal(testCase.format+"; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Equal("Accept", w.Header().Get("Vary"))
+				assert.Equal("Sat, 02 Jan 2021 04:04:05 GMT", w.Header().Get("Last-Modified"))
+
+				if method == http.MethodHead {
+					assert.Empty(w.Body.String())
+				} else {
+					assert.Contains(w.Body.String(), testCase.expected)
+				}
+			}
+		})
+	}
+
+	// Feeds without items have no Last-Modified time
+	r := httptest.NewRequest(http.MethodGet, "/atom.xml", nil)
+	w := httptest.NewRecorder()
+	s.writeFeed(w, r, atomContentType, &feeds.Feed{Title: "Empty", Link: &feeds.Link{}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Last-Modified"))
+}
+
+func TestTagSyndicationHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	s := newTestAuthServer(t)
+	s.config.Name = "example.com"
+	s.cache = &Cache{Twts: make(map[string]*Cached)}
+
+	alice := types.Twter{Nick: "alice", URL: URLForUser(s.config.BaseURL, "alice")}
+	var twts types.Twts
+	for _, line := range []string{
+		"2021-01-01T00:00:00Z\tHello #go",
+		"2021-01-02T00:00:00Z\tHello #rust",
+	} {
+		twt, err := lextwt.ParseLine(line, alice)
+		require.NoError(t, err)
+		twts = append(twts, twt)
+	}
+	s.cache.Twts[alice.URL] = &Cached{Twts: twts}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/search/feed.json?tag=go", nil)
+	s.TagSyndicationHandler()(w, r, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var jsonFeed JSONFeed
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jsonFeed))
+	assert.Equal("#go on example.com", jsonFeed.Title)
+	require.Len(t, jsonFeed.Items, 1)
+	assert.Equal(URLForTwt(s.config.BaseURL, twts[0].Hash()), jsonFeed.Items[0].ID)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/search/atom.xml", nil)
+	s.TagSyndicationHandler()(w, r, nil)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestBlogsSyndicationHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestAuthServer(t)
+
+	published, err := WriteBlogAs(s.config, "alice", "Hello World", "Hello from my blog")
+	require.NoError(t, err)
+	published.Publish()
+	require.NoError(t, published.Save(s.config))
+
+	_, err = WriteBlogAs(s.config, "alice", "Draft", "Not yet")
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/blogs/alice/rss.xml", nil)
+	s.BlogsSyndicationHandler()(w, r, httprouter.Params{{Key: "author", Value: "alice"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(rssContentType+"; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "<title>Hello World</title>")
+	assert.Contains(w.Body.String(), published.URL(s.config.BaseURL))
+	assert.Equal(1, strings.Count(w.Body.String(), "<item>"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/blogs/bob/rss.xml", nil)
+	s.BlogsSyndicationHandler()(w, r, httprouter.Params{{Key: "author", Value: "bob"}})
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/user/bob/atom.xml", nil)
+	s.SyndicationHandler()(w, r, httprouter.Params{{Key: "nick", Value: "bob"}})
+	assert.Equal(http.StatusNotFound, w.Code)
+}
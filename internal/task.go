@@ -1,6 +1,10 @@
 package internal
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type TaskState int
 
@@ -9,6 +13,7 @@ const (
 	TaskStateRunning
 	TaskStateComplete
 	TaskStateFailed
+	TaskStateCancelled
 )
 
 func (t TaskState) String() string {
@@ -21,11 +26,61 @@ func (t TaskState) String() string {
 		return "complete"
 	case TaskStateFailed:
 		return "failed"
+	case TaskStateCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// TaskPriority determines the order queued tasks are run in, tasks with a
+// higher priority are run before tasks with a lower priority
+type TaskPriority int
+
+const (
+	TaskPriorityLow TaskPriority = iota
+	TaskPriorityNormal
+	TaskPriorityHigh
+)
+
+func (p TaskPriority) String() string {
+	switch p {
+	case TaskPriorityLow:
+		return "low"
+	case TaskPriorityNormal:
+		return "normal"
+	case TaskPriorityHigh:
+		return "high"
 	default:
 		return "unknown"
 	}
 }
 
+// RetryPolicy is how many times a failed task is attempted and how long to
+// wait between attempts, the wait doubles after every attempt up to MaxBackoff
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	// Retryable reports whether the error a task failed with is transient
+	// so the task is retried, all errors are retried if nil
+	Retryable func(err error) bool
+}
+
+// Delay returns how long to wait before retrying a task that failed on the
+// given attempt
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return delay
+}
+
 type TaskData map[string]string
 
 type TaskResult struct {
@@ -45,3 +100,65 @@ type Task interface {
 	Error() error
 	Run() error
 }
+
+// ResumableTask is a task that can be recreated from its kind and arguments,
+// unfinished resumable tasks are resumed when the pod restarts
+type ResumableTask interface {
+	Task
+
+	Kind() string
+	Args() TaskData
+}
+
+// PrioritizedTask is a task with a priority other than TaskPriorityNormal
+type PrioritizedTask interface {
+	Task
+
+	Priority() TaskPriority
+}
+
+// RetryableTask is a task that is retried according to its retry policy
+// when it fails
+type RetryableTask interface {
+	Task
+
+	RetryPolicy() RetryPolicy
+}
+
+// CancellableTask is a task that can be cancelled
+type CancellableTask interface {
+	Task
+
+	Cancel()
+	Cancelled() bool
+}
+
+// CleanupTask is a task that cleans up after itself once it has failed for
+// the last time or was cancelled
+type CleanupTask interface {
+	Task
+
+	Cleanup()
+}
+
+// TaskFactory recreates a resumable task from its arguments
+type TaskFactory func(args TaskData) (Task, error)
+
+// recordedTask is a task only known by its record, e.g: one that finished
+// before the pod restarted
+type recordedTask struct {
+	record *TaskRecord
+}
+
+func (t *recordedTask) String() string     { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *recordedTask) ID() string         { return t.record.ID }
+func (t *recordedTask) State() TaskState   { return t.record.State }
+func (t *recordedTask) Result() TaskResult { return t.record.Result() }
+func (t *recordedTask) Run() error         { return nil }
+
+func (t *recordedTask) Error() error {
+	if t.record.Error == "" {
+		return nil
+	}
+	return errors.New(t.record.Error)
+}
@@ -57,6 +57,12 @@ func NewTemplateManager(conf *Config, translator *Translator, blogs *BlogsCache,
 	funcMap["formatForDateTime"] = FormatForDateTime
 	funcMap["urlForBlog"] = URLForBlogFactory(conf, blogs)
 	funcMap["urlForConv"] = URLForConvFactory(conf, cache, archive)
+	funcMap["twtHistory"] = func(twt types.Twt) types.Twts {
+		return cache.GetEditHistory(archive, twt.Hash())
+	}
+	funcMap["urlForIndieAuthMe"] = func(username string) string {
+		return URLForIndieAuthMe(conf.BaseURL, username)
+	}
 	funcMap["isAdminUser"] = IsAdminUserFactory(conf)
 	funcMap["twtType"] = func(twt types.Twt) string { return fmt.Sprintf("%T", twt) }
 
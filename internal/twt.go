@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	read_file_last_line "github.com/prologic/read-file-last-line"
@@ -20,7 +21,21 @@ const (
 	feedsDir = "feeds"
 )
 
+// feedLocks serializes writes to local feeds (appending, deleting and
+// rotating twts) by feed name
+var feedLocks sync.Map
+
+// lockFeed locks the local feed name for writing and returns a func that
+// unlocks it
+func lockFeed(name string) func() {
+	mu, _ := feedLocks.LoadOrStore(name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
 func DeleteLastTwt(conf *Config, user *User) error {
+	defer lockFeed(user.Username)()
+
 	p := filepath.Join(conf.Data, feedsDir)
 	if err := os.MkdirAll(p, 0755); err != nil {
 		log.WithError(err).Error("error creating feeds directory")
@@ -46,7 +61,7 @@ func DeleteLastTwt(conf *Config, user *User) error {
 func AppendSpecial(conf *Config, db Store, specialUsername, text string, args ...interface{}) (types.Twt, error) {
 	user := &User{Username: specialUsername}
 	user.Following = make(map[string]string)
-	return AppendTwt(conf, db, user, text, args)
+	return AppendTwt(conf, db, user, text, args...)
 }
 
 func AppendTwt(conf *Config, db Store, user *User, text string, args ...interface{}) (types.Twt, error) {
@@ -63,6 +78,8 @@ func AppendTwt(conf *Config, db Store, user *User, text string, args ...interfac
 
 	fn := filepath.Join(p, user.Username)
 
+	defer lockFeed(user.Username)()
+
 	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		return types.NilTwt, err
@@ -77,7 +94,7 @@ func AppendTwt(conf *Config, db Store, user *User, text string, args ...interfac
 		}
 	}
 
-	twt := types.MakeTwt(user.Twter(), now, strings.TrimSpace(text))
+	twt := types.MakeTwt(localTwter(conf, user.Twter()), now, strings.TrimSpace(text))
 
 	twt.ExpandLinks(conf, NewFeedLookup(conf, db, user))
 	if _, err = fmt.Fprintf(f, "%+l\n", twt); err != nil {
@@ -115,7 +132,7 @@ func GetLastTwt(conf *Config, user *User) (twt types.Twt, offset int, err error)
 		return
 	}
 
-	twt, err = types.ParseLine(string(data), user.Twter())
+	twt, err = types.ParseLine(string(data), localTwter(conf, user.Twter()))
 
 	return
 }
@@ -159,7 +176,24 @@ func GetFeedCount(conf *Config, name string) (int, error) {
 	return LineCount(f)
 }
 
+// localTwter returns the Twter of a local feed, whose twts are hashed with
+// the pod's configured twt hash version
+func localTwter(conf *Config, twter types.Twter) types.Twter {
+	twter.HashVersion = conf.TwtHashVersion
+	return twter
+}
+
 func GetAllTwts(conf *Config, name string) (types.Twts, error) {
+	twter := localTwter(conf, types.Twter{
+		Nick: name,
+		URL:  URLForUser(conf.BaseURL, name),
+	})
+	return getAllTwts(conf, name, twter)
+}
+
+// getAllTwts returns all twts of a local feed (including rotated twts)
+// parsed as twts of twter
+func getAllTwts(conf *Config, name string, twter types.Twter) (types.Twts, error) {
 	p := filepath.Join(conf.Data, feedsDir)
 	if err := os.MkdirAll(p, 0755); err != nil {
 		log.WithError(err).Error("error creating feeds directory")
@@ -168,10 +202,6 @@ func GetAllTwts(conf *Config, name string) (types.Twts, error) {
 
 	var twts types.Twts
 
-	twter := types.Twter{
-		Nick: name,
-		URL:  URLForUser(conf.BaseURL, name),
-	}
 	fn := filepath.Join(p, name)
 	f, err := os.Open(fn)
 	if err != nil {
@@ -187,5 +217,26 @@ func GetAllTwts(conf *Config, name string) (types.Twts, error) {
 	twts = append(twts, t.Twts()...)
 	f.Close()
 
+	// Include twts rotated into archived twtxt files
+	fns, err := GetRotatedFeeds(conf, name)
+	if err != nil {
+		log.WithError(err).Warnf("error listing rotated feeds for %s", name)
+		return twts, nil
+	}
+	for _, fn := range fns {
+		f, err := os.Open(filepath.Join(conf.Data, rotatedFeedsDir, name, fn))
+		if err != nil {
+			log.WithError(err).Warnf("error opening rotated feed: %s", fn)
+			continue
+		}
+		t, err := types.ParseFile(f, twter)
+		f.Close()
+		if err != nil {
+			log.WithError(err).Errorf("error processing rotated feed %s", fn)
+			continue
+		}
+		twts = append(twts, t.Twts()...)
+	}
+
 	return twts, nil
 }
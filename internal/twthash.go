@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+const (
+	twtHashVersionFile   = "twt_hash_version"
+	twtHashMigrationFile = "twt_hash_migration"
+)
+
+var (
+	migratedTwtHashesMu sync.RWMutex
+	migratedTwtHashes   map[string]string
+)
+
+// GetTwtHashVersion returns the version of the hash local twts were last
+// hashed with, which is the legacy version if it has never been changed.
+func GetTwtHashVersion(conf *Config) int {
+	data, err := ioutil.ReadFile(filepath.Join(conf.Data, twtHashVersionFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("error reading twt hash version")
+		}
+		return types.LegacyTwtHashVersion
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.WithError(err).Warnf("invalid twt hash version %q", string(data))
+		return types.LegacyTwtHashVersion
+	}
+
+	return version
+}
+
+// SetTwtHashVersion records the version of the hash local twts are hashed with
+func SetTwtHashVersion(conf *Config, version int) error {
+	fn := filepath.Join(conf.Data, twtHashVersionFile)
+	return ioutil.WriteFile(fn, []byte(fmt.Sprintf("%d\n", version)), 0644)
+}
+
+// LookupMigratedTwtHash returns the hash a local twt has been re-keyed to by
+// a twt hash migration, so that old permalinks and conversations still work.
+func LookupMigratedTwtHash(conf *Config, hash string) (string, bool) {
+	migratedTwtHashesMu.RLock()
+	loaded := migratedTwtHashes != nil
+	newHash, ok := migratedTwtHashes[hash]
+	migratedTwtHashesMu.RUnlock()
+
+	if loaded {
+		return newHash, ok
+	}
+
+	migratedTwtHashesMu.Lock()
+	defer migratedTwtHashesMu.Unlock()
+
+	if migratedTwtHashes == nil {
+		migratedTwtHashes = loadMigratedTwtHashes(conf)
+	}
+
+	newHash, ok = migratedTwtHashes[hash]
+	return newHash, ok
+}
+
+func loadMigratedTwtHashes(conf *Config) map[string]string {
+	hashes := make(map[string]string)
+
+	f, err := os.Open(filepath.Join(conf.Data, twtHashMigrationFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("error reading twt hash migrations")
+		}
+		return hashes
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if sp := strings.Fields(scanner.Text()); len(sp) == 2 {
+			hashes[sp[0]] = sp[1]
+		}
+	}
+
+	// Follow chains of migrations (e.g: v1 -> v2 -> v3) to the latest hash
+	for hash, newHash := range hashes {
+		for i := 0; i < len(hashes); i++ {
+			next, ok := hashes[newHash]
+			if !ok {
+				break
+			}
+			newHash = next
+		}
+		hashes[hash] = newHash
+	}
+
+	return hashes
+}
+
+func recordMigratedTwtHashes(conf *Config, hashes map[string]string) error {
+	fn := filepath.Join(conf.Data, twtHashMigrationFile)
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for oldHash, newHash := range hashes {
+		fmt.Fprintf(w, "%s %s\n", oldHash, newHash)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// Reload the migrations on next lookup
+	migratedTwtHashesMu.Lock()
+	migratedTwtHashes = nil
+	migratedTwtHashesMu.Unlock()
+
+	return nil
+}
+
+// MigrateTwtHashes re-keys the twts of all local feeds that were hashed with
+// a different hash version to the pod's configured version. Archived twts
+// are moved to their new hash and users' bookmarks updated.
+func MigrateTwtHashes(conf *Config, db Store, archive Archiver) error {
+	from := GetTwtHashVersion(conf)
+	if from == conf.TwtHashVersion {
+		return nil
+	}
+
+	log.Infof("migrating twt hashes from v%d to v%d", from, conf.TwtHashVersion)
+
+	feeds, err := GetAllFeeds(conf)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string)
+	for _, name := range feeds {
+		twter := types.Twter{Nick: name, URL: URLForUser(conf.BaseURL, name)}
+
+		old := twter
+		old.HashVersion = from
+
+		oldTwts, err := getAllTwts(conf, name, old)
+		if err != nil {
+			log.WithError(err).Warnf("error reading twts of %s to migrate", name)
+			continue
+		}
+
+		newTwts, err := getAllTwts(conf, name, localTwter(conf, twter))
+		if err != nil || len(newTwts) != len(oldTwts) {
+			log.WithError(err).Warnf("error reading twts of %s to migrate", name)
+			continue
+		}
+
+		for i, twt := range newTwts {
+			oldHash, newHash := oldTwts[i].Hash(), twt.Hash()
+			if oldHash == newHash {
+				continue
+			}
+			hashes[oldHash] = newHash
+
+			if !archive.Has(oldHash) {
+				continue
+			}
+			if !archive.Has(newHash) {
+				if err := archive.Archive(twt); err != nil {
+					log.WithError(err).Warnf("error archiving twt %s as %s", oldHash, newHash)
+					continue
+				}
+			}
+			if err := archive.Del(oldHash); err != nil {
+				log.WithError(err).Warnf("error deleting archived twt %s", oldHash)
+			}
+		}
+	}
+
+	users, err := db.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		changed := false
+		for hash, value := range user.Bookmarks {
+			if newHash, ok := hashes[hash]; ok {
+				delete(user.Bookmarks, hash)
+				user.Bookmarks[newHash] = value
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := db.SetUser(user.Username, user); err != nil {
+			log.WithError(err).Warnf("error saving migrated bookmarks of %s", user.Username)
+		}
+	}
+
+	if err := recordMigratedTwtHashes(conf, hashes); err != nil {
+		return err
+	}
+
+	log.Infof("migrated %d twt hashes from v%d to v%d", len(hashes), from, conf.TwtHashVersion)
+
+	return SetTwtHashVersion(conf, conf.TwtHashVersion)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+)
+
+func TestMigrateTwtHashes(t *testing.T) {
+	assert := assert.New(t)
+
+	lextwt.DefaultTwtManager()
+
+	dir, err := ioutil.TempDir("", "twtxt-twthash-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewStore("bitcask://" + filepath.Join(dir, "db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	archive, err := NewDiskArchiver(filepath.Join(dir, "archive"))
+	require.NoError(t, err)
+
+	defer func() {
+		migratedTwtHashesMu.Lock()
+		migratedTwtHashes = nil
+		migratedTwtHashesMu.Unlock()
+	}()
+
+	conf := &Config{
+		Data:           dir,
+		BaseURL:        "https://example.com",
+		MaxFetchLimit:  1 << 20,
+		TwtHashVersion: types.LegacyTwtHashVersion,
+	}
+
+	// Nothing to migrate whilst the version is unchanged
+	require.NoError(t, MigrateTwtHashes(conf, db, archive))
+	assert.Equal(types.LegacyTwtHashVersion, GetTwtHashVersion(conf))
+
+	user := NewUser()
+	user.Username = "alice"
+	user.URL = URLForUser(conf.BaseURL, "alice")
+	user.Bookmarks = make(map[string]string)
+
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	first, err := AppendTwt(conf, db, user, "Hello", ts)
+	require.NoError(t, err)
+	second, err := AppendTwt(conf, db, user, "World", ts.Add(time.Hour))
+	require.NoError(t, err)
+
+	require.NoError(t, archive.Archive(first))
+	user.Bookmark(second.Hash())
+	require.NoError(t, db.SetUser(user.Username, user))
+
+	conf.TwtHashVersion = 2
+	require.NoError(t, MigrateTwtHashes(conf, db, archive))
+	assert.Equal(2, GetTwtHashVersion(conf))
+
+	twts, err := GetAllTwts(conf, "alice")
+	require.NoError(t, err)
+	require.Len(t, twts, 2)
+	newFirst, newSecond := twts[0].Hash(), twts[1].Hash()
+	if twts[0].Created().After(twts[1].Created()) {
+		newFirst, newSecond = newSecond, newFirst
+	}
+	assert.Len(newFirst, 12)
+
+	// Archived twts are moved to their new hash
+	assert.False(archive.Has(first.Hash()))
+	assert.True(archive.Has(newFirst))
+
+	// Bookmarks are updated
+	user, err = db.GetUser("alice")
+	require.NoError(t, err)
+	assert.NotContains(user.Bookmarks, second.Hash())
+	assert.Contains(user.Bookmarks, newSecond)
+
+	// Old hashes still resolve to the twts' new hashes
+	hash, ok := LookupMigratedTwtHash(conf, first.Hash())
+	assert.True(ok)
+	assert.Equal(newFirst, hash)
+	hash, ok = LookupMigratedTwtHash(conf, second.Hash())
+	assert.True(ok)
+	assert.Equal(newSecond, hash)
+
+	// Migrating again is a no-op
+	require.NoError(t, MigrateTwtHashes(conf, db, archive))
+	assert.True(archive.Has(newFirst))
+}
+
+func TestLoadMigratedTwtHashesChains(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "twtxt-twthash-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir}
+
+	// Hashes migrated more than once resolve to their latest hash
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, twtHashMigrationFile),
+		[]byte("aaaaaaa bbbbbbbbbbbb\nbbbbbbbbbbbb cccccccccccc\n"),
+		0644,
+	))
+
+	hashes := loadMigratedTwtHashes(conf)
+	assert.Equal("cccccccccccc", hashes["aaaaaaa"])
+	assert.Equal("cccccccccccc", hashes["bbbbbbbbbbbb"])
+}
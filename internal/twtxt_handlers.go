@@ -25,8 +25,12 @@ const defaultPreambleTemplate = `# Twtxt is an open, distributed microblogging p
 # url         = {{ .Profile.URL }}
 # avatar      = {{ .Profile.AvatarURL }}
 # description = {{ .Profile.Tagline }}
+{{- if .Profile.BlogsURL }}
+# link        = Blog {{ .Profile.BlogsURL }}
+{{- end }}
 #
 {{- if .Profile.ShowFollowing }}
+# following   = {{ len .Profile.Following }}
 {{ range $nick, $url := .Profile.Following -}}
 # follow = {{ $nick }} {{ $url }}
 {{ end -}}
@@ -184,6 +188,30 @@ func (s *Server) TwtxtHandler() httprouter.Handle {
 			log.WithError(err).Warn("error rendering twtxt preamble")
 		}
 
+		// Advertise the version of the hash our twts are hashed with
+		if s.config.TwtHashVersion > types.LegacyTwtHashVersion {
+			if preamble != "" && !strings.HasSuffix(preamble, "\n") {
+				preamble += "\n"
+			}
+			preamble += fmt.Sprintf("# hash_version = %d\n", s.config.TwtHashVersion)
+		}
+
+		// Link to the most recently rotated (archived) twtxt file
+		if hash, prev, ok := RotatedFeedPrev(s.config, nick); ok {
+			if preamble != "" && !strings.HasSuffix(preamble, "\n") {
+				preamble += "\n"
+			}
+			preamble += fmt.Sprintf("# prev = %s %s\n", hash, URLForRotatedFeed(s.config.BaseURL, nick, prev))
+		}
+
+		// Announce twts that have been deleted or edited
+		if markers := GetTwtMarkers(s.config, nick); markers != "" {
+			if preamble != "" && !strings.HasSuffix(preamble, "\n") {
+				preamble += "\n"
+			}
+			preamble += markers
+		}
+
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", int64(len(preamble))+fileInfo.Size()))
 		w.Header().Set("Link", fmt.Sprintf(`<%s/user/%s/webmention>; rel="webmention"`, s.config.BaseURL, nick))
@@ -199,3 +227,60 @@ func (s *Server) TwtxtHandler() httprouter.Handle {
 		_, _ = io.Copy(w, pr)
 	}
 }
+
+// RotatedTwtxtHandler serves the rotated (archived) twtxt files of a local
+// feed linked to by its `# prev` chain
+func (s *Server) RotatedTwtxtHandler() httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		nick := NormalizeUsername(p.ByName("nick"))
+		name := p.ByName("name")
+		if nick == "" || name == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		dir, err := securejoin.SecureJoin(filepath.Join(s.config.Data, rotatedFeedsDir), nick)
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		fn, err := securejoin.SecureJoin(dir, name)
+		if err != nil || name == rotatedHeadFile || strings.HasPrefix(name, ".") {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		fileInfo, err := os.Stat(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "Feed Not Found", http.StatusNotFound)
+				return
+			}
+
+			log.WithError(err).Error("os.Stat() error")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(fn)
+		if err != nil {
+			log.WithError(err).Error("error opening rotated feed")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+		w.Header().Set("Last-Modified", fileInfo.ModTime().UTC().Format(http.TimeFormat))
+		// Rotated feeds never change once written
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		_, _ = io.Copy(w, f)
+	}
+}
@@ -1,12 +1,14 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base32"
 	"errors"
 	"fmt"
+	"html"
 	"html/template"
 	"image"
 	"io"
@@ -17,6 +19,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -25,26 +28,23 @@ import (
 	"syscall"
 	text_template "text/template"
 	"time"
+	"unicode/utf8"
 
 	// Blank import so we can handle image/jpeg
 	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/audiolion/ipip"
 	"github.com/bakape/thumbnailer/v2"
 	"github.com/chai2010/webp"
 	"github.com/disintegration/gift"
 	"github.com/disintegration/imageorient"
-	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/ast"
-	"github.com/gomarkdown/markdown/html"
-	"github.com/gomarkdown/markdown/parser"
 	"github.com/goware/urlx"
 	"github.com/h2non/filetype"
 	"github.com/jointwt/twtxt"
 	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
 	shortuuid "github.com/lithammer/shortuuid/v3"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/nullrocks/identicon"
@@ -114,6 +114,7 @@ var (
 	ErrFeedNameTooLong  = errors.New("error: feed name is too long")
 	ErrInvalidUsername  = errors.New("error: invalid username")
 	ErrUsernameTooLong  = errors.New("error: username is too long")
+	ErrTwtTooLong       = errors.New("error: twt is too long")
 	ErrInvalidUserAgent = errors.New("error: invalid twtxt user agent")
 	ErrReservedUsername = errors.New("error: username is reserved")
 	ErrInvalidImage     = errors.New("error: invalid image")
@@ -213,6 +214,42 @@ func ImageToPng(fn string) error {
 	return nil
 }
 
+// HasExternalAvatar returns true if an avatar for the external feed uri has
+// already been downloaded and cached
+func HasExternalAvatar(conf *Config, uri string) bool {
+	fn := filepath.Join(conf.Data, externalDir, fmt.Sprintf("%s.webp", Slugify(uri)))
+	return FileExists(fn)
+}
+
+// DownloadExternalAvatar downloads and caches the avatar source advertised
+// by the external feed uri (via its `# avatar = ` metadata) and returns the
+// pod's URL for it, or an empty string if it could not be downloaded.
+func DownloadExternalAvatar(conf *Config, uri, source string) string {
+	base, err := url.Parse(uri)
+	if err != nil {
+		log.WithError(err).Errorf("error parsing uri: %s", uri)
+		return ""
+	}
+
+	ref, err := url.Parse(source)
+	if err != nil {
+		log.WithError(err).Errorf("error parsing avatar url %s for %s", source, uri)
+		return ""
+	}
+	source = base.ResolveReference(ref).String()
+
+	opts := &ImageOptions{Resize: true, Width: AvatarResolution, Height: AvatarResolution}
+	if _, err := DownloadImage(conf, source, externalDir, Slugify(uri), opts); err != nil {
+		log.WithError(err).
+			WithField("uri", uri).
+			WithField("source", source).
+			Error("error downloading external avatar")
+		return ""
+	}
+
+	return URLForExternalAvatar(conf, uri)
+}
+
 func GetExternalAvatar(conf *Config, nick, uri string) string {
 	slug := Slugify(uri)
 
@@ -346,22 +383,40 @@ func CmdExists(cmd string) bool {
 
 // RunCmd ...
 func RunCmd(timeout time.Duration, command string, args ...string) error {
+	return RunCmdContext(context.Background(), timeout, command, args...)
+}
+
+// RunCmdContext is like RunCmd but also kills the command if ctx is done
+func RunCmdContext(parent context.Context, timeout time.Duration, command string, args ...string) error {
+	return runCmd(parent, timeout, nil, command, args...)
+}
+
+// runCmd runs the command like RunCmdContext writing its standard output to
+// stdout if set
+func runCmd(parent context.Context, timeout time.Duration, stdout io.Writer, command string, args ...string) error {
 	var (
 		ctx    context.Context
 		cancel context.CancelFunc
 	)
 
 	if timeout > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		ctx, cancel = context.WithTimeout(parent, timeout)
 	} else {
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(parent)
 	}
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, command, args...)
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+	var out bytes.Buffer
+	if stdout != nil {
+		cmd.Stdout = stdout
+	} else {
+		cmd.Stdout = &out
+	}
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			if ws, ok := exitError.Sys().(syscall.WaitStatus); ok && ws.Signal() == syscall.SIGKILL {
 				err = &ErrCommandKilled{Err: err, Signal: ws.Signal()}
@@ -372,7 +427,7 @@ func RunCmd(timeout time.Duration, command string, args ...string) error {
 
 		log.
 			WithError(err).
-			WithField("out", string(out)).
+			WithField("out", out.String()).
 			Errorf("error running command")
 
 		return err
@@ -381,6 +436,111 @@ func RunCmd(timeout time.Duration, command string, args ...string) error {
 	return nil
 }
 
+// transcodeProgress reports the overall progress of concurrently running
+// ffmpeg transcodes of the same media as a percentage, from the progress
+// ffmpeg reports with `-progress` relative to the media's duration
+type transcodeProgress struct {
+	sync.Mutex
+
+	duration float64
+	done     []int
+	report   func(int)
+}
+
+// newTranscodeProgress returns the progress of n transcodes of the media fn
+// reported to report, the progress is not reported if report is nil or the
+// media's duration is unknown
+func newTranscodeProgress(conf *Config, fn string, n int, report func(int)) *transcodeProgress {
+	p := &transcodeProgress{done: make([]int, n), report: report}
+
+	if report != nil {
+		duration, err := ProbeDuration(conf, fn)
+		if err != nil {
+			log.WithError(err).Warnf("error probing duration of %s, not reporting progress", fn)
+		}
+		p.duration = duration
+	}
+
+	return p
+}
+
+// run runs the i-th transcode with ffmpeg's args like RunCmdContext
+func (p *transcodeProgress) run(ctx context.Context, timeout time.Duration, i int, args ...string) error {
+	if p.report == nil || p.duration <= 0 {
+		return RunCmdContext(ctx, timeout, "ffmpeg", args...)
+	}
+
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	w := &ffmpegProgressWriter{
+		duration: p.duration,
+		progress: func(progress int) { p.update(i, progress) },
+	}
+	return runCmd(ctx, timeout, w, "ffmpeg", args...)
+}
+
+func (p *transcodeProgress) update(i, progress int) {
+	p.Lock()
+	defer p.Unlock()
+
+	if progress <= p.done[i] {
+		return
+	}
+	p.done[i] = progress
+
+	total := 0
+	for _, done := range p.done {
+		total += done
+	}
+	p.report(total / len(p.done))
+}
+
+// ffmpegProgressWriter parses the `key=value` lines of progress ffmpeg
+// writes with `-progress` and reports how much of the media of the given
+// duration (in seconds) has been transcoded as a percentage
+type ffmpegProgressWriter struct {
+	buf      []byte
+	duration float64
+	progress func(int)
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.parse(strings.TrimSpace(string(w.buf[:i])))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *ffmpegProgressWriter) parse(line string) {
+	sp := strings.SplitN(line, "=", 2)
+	if len(sp) != 2 {
+		return
+	}
+
+	switch key, value := sp[0], sp[1]; key {
+	case "out_time_us", "out_time_ms":
+		// Both are in microseconds (out_time_ms is misnamed)
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || us < 0 {
+			return
+		}
+		progress := int(float64(us) / 1e6 / w.duration * 100)
+		if progress > 100 {
+			progress = 100
+		}
+		w.progress(progress)
+	case "progress":
+		if value == "end" {
+			w.progress(100)
+		}
+	}
+}
+
 // RenderHTML ...
 func RenderHTML(tpl string, ctx *Context) (string, error) {
 	t := template.Must(template.New("tpl").Parse(tpl))
@@ -562,10 +722,140 @@ func IsVideo(fn string) bool {
 	return filetype.IsVideo(head)
 }
 
+// IsAnimatedImage returns true if fn is an animated GIF, WebP or PNG (APNG)
+func IsAnimatedImage(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		log.WithError(err).Warnf("error opening file %s", fn)
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 21)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("GIF8")):
+		return isAnimatedGIF(f)
+	case bytes.HasPrefix(head, []byte("RIFF")) && string(head[8:12]) == "WEBP":
+		// Animated WebP is in the extended format with the animation flag set
+		return string(head[12:16]) == "VP8X" && head[20]&0x02 != 0
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return isAPNG(f)
+	default:
+		return false
+	}
+}
+
+// isAnimatedGIF returns true if the GIF f has more than one frame. The
+// frames are counted by walking the GIF's blocks without decoding them, so
+// GIFs with many large frames can't exhaust memory.
+func isAnimatedGIF(f io.ReadSeeker) bool {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	r := bufio.NewReader(f)
+
+	// skipColorTable skips the color table of a logical screen or image
+	// descriptor with the given flags if it has one
+	skipColorTable := func(flags byte) bool {
+		if flags&0x80 == 0 {
+			return true
+		}
+		_, err := r.Discard(3 << ((flags & 0x07) + 1))
+		return err == nil
+	}
+
+	// skipSubBlocks skips data sub-blocks up to and including the terminator
+	skipSubBlocks := func() bool {
+		for {
+			size, err := r.ReadByte()
+			if err != nil {
+				return false
+			}
+			if size == 0 {
+				return true
+			}
+			if _, err := r.Discard(int(size)); err != nil {
+				return false
+			}
+		}
+	}
+
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil || !skipColorTable(header[10]) {
+		return false
+	}
+
+	frames := 0
+	for {
+		separator, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		switch separator {
+		case 0x2C: // Image descriptor
+			if frames++; frames > 1 {
+				return true
+			}
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil || !skipColorTable(descriptor[8]) {
+				return false
+			}
+			// LZW minimum code size followed by the image data
+			if _, err := r.ReadByte(); err != nil || !skipSubBlocks() {
+				return false
+			}
+		case 0x21: // Extension
+			if _, err := r.ReadByte(); err != nil || !skipSubBlocks() {
+				return false
+			}
+		default: // Trailer (or garbage)
+			return false
+		}
+	}
+}
+
+// isAPNG returns true if the PNG f has an animation control chunk, which
+// APNG requires to appear before the image data
+func isAPNG(f io.ReadSeeker) bool {
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		return false
+	}
+
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return false
+		}
+
+		switch string(chunk[4:8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+
+		// Skip the chunk's data and CRC
+		length := int64(chunk[0])<<24 | int64(chunk[1])<<16 | int64(chunk[2])<<8 | int64(chunk[3])
+		if _, err := f.Seek(length+4, io.SeekCurrent); err != nil {
+			return false
+		}
+	}
+}
+
 type ImageOptions struct {
 	Resize bool
 	Width  int
 	Height int
+
+	// Variants also processes the thumbnail and medium size variants of the
+	// image along with its metadata (dimensions)
+	Variants bool
 }
 
 type AudioOptions struct {
@@ -573,11 +863,35 @@ type AudioOptions struct {
 	Channels   int
 	Samplerate int
 	Bitrate    int
+
+	// Context cancels transcoding when done if set
+	Context context.Context
+
+	// Progress is called with the percentage of the audio transcoded if set
+	Progress func(int)
+}
+
+// transcodeContext returns the context transcoding is cancelled by
+func transcodeContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
 }
 
 type VideoOptions struct {
 	Resize bool
 	Size   int
+
+	// Animated transcodes an animated image into a silent video that is
+	// rendered looping like the image would
+	Animated bool
+
+	// Context cancels transcoding when done if set
+	Context context.Context
+
+	// Progress is called with the percentage of the video transcoded if set
+	Progress func(int)
 }
 
 func DownloadImage(conf *Config, url string, resource, name string, opts *ImageOptions) (string, error) {
@@ -668,11 +982,13 @@ func receiveFile(r io.Reader, filePattern string) (*os.File, error) {
 }
 
 func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *AudioOptions) (string, error) {
-	p := filepath.Join(conf.Data, resource)
-	if err := os.MkdirAll(p, 0755); err != nil {
-		log.WithError(err).Errorf("error creating %s directory", resource)
+	p, err := mediaWorkDir(conf, resource)
+	if err != nil {
 		return "", err
 	}
+	if resource == mediaDir {
+		defer os.RemoveAll(p)
+	}
 
 	var ofn string
 
@@ -692,6 +1008,8 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 
 	wg := sync.WaitGroup{}
 
+	progress := newTranscodeProgress(conf, ifn, 2, opts.Progress)
+
 	TranscodeOGG := func(ctx context.Context, errs chan error) {
 		defer wg.Done()
 
@@ -707,16 +1025,13 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 
 		args = append(args, []string{
 			"-c:a", "libvorbis",
+			"-map_metadata", "-1",
 			"-strict", "-2",
 			"-loglevel", "quiet",
 			of.Name(),
 		}...)
 
-		if err := RunCmd(
-			conf.TranscoderTimeout,
-			"ffmpeg",
-			args...,
-		); err != nil {
+		if err := progress.run(ctx, conf.TranscoderTimeout, 0, args...); err != nil {
 			log.WithError(err).Error("error transcoding audio")
 			errs <- err
 			return
@@ -726,12 +1041,14 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 	TranscodeMP3 := func(ctx context.Context, errs chan error) {
 		defer wg.Done()
 
-		if err := RunCmd(
+		if err := progress.run(
+			ctx,
 			conf.TranscoderTimeout,
-			"ffmpeg",
+			1,
 			"-y",
 			"-i", ifn,
 			"-acodec", "mp3",
+			"-map_metadata", "-1",
 			"-strict", "-2",
 			"-loglevel", "quiet",
 			ReplaceExt(ofn, ".mp3"),
@@ -752,8 +1069,8 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 
 	wg.Add(2)
 
-	go TranscodeOGG(ctx, errChan)
-	go TranscodeMP3(ctx, errChan)
+	go TranscodeOGG(transcodeContext(opts.Context), errChan)
+	go TranscodeMP3(transcodeContext(opts.Context), errChan)
 
 	go func(ctx context.Context) {
 		for {
@@ -785,6 +1102,38 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 		return "", err
 	}
 
+	fns := []string{ofn, ReplaceExt(ofn, ".mp3")}
+
+	if resource == mediaDir {
+		meta := &MediaMetadata{ContentType: "audio/ogg", Created: time.Now()}
+		if meta.Duration, err = ProbeDuration(conf, ofn); err != nil {
+			log.WithError(err).Warnf("error probing duration of audio %s", ofn)
+		}
+
+		// The waveform is rendered in place of the player until it's played
+		if meta.Peaks, err = ProbePeaks(conf, ofn, MediaWaveformPeaks); err != nil {
+			log.WithError(err).Warnf("error probing peaks of audio %s", ofn)
+		} else if wfns, err := encodeImage(ReplaceExt(ofn, ".webp"), drawWaveform(meta.Peaks)); err != nil {
+			log.WithError(err).Warnf("error drawing waveform of audio %s", ofn)
+		} else {
+			fns = append(fns, wfns...)
+		}
+
+		meta.Size = mediaFilesSize(fns...)
+		meta.FileHashes = mediaFilesHashes(filepath.Base(ReplaceExt(ofn, "")), fns...)
+
+		mfn, err := writeMediaMetadata(ofn, meta)
+		if err != nil {
+			log.WithError(err).Errorf("error writing metadata for %s", ofn)
+			return "", err
+		}
+		fns = append(fns, mfn)
+	}
+
+	if err := putMedia(conf, resource, fns...); err != nil {
+		return "", err
+	}
+
 	return fmt.Sprintf(
 		"%s/%s/%s",
 		strings.TrimSuffix(conf.BaseURL, "/"),
@@ -793,11 +1142,13 @@ func TranscodeAudio(conf *Config, ifn string, resource, name string, opts *Audio
 }
 
 func ProcessImage(conf *Config, ifn string, resource, name string, opts *ImageOptions) (string, error) {
-	p := filepath.Join(conf.Data, resource)
-	if err := os.MkdirAll(p, 0755); err != nil {
-		log.WithError(err).Error("error creating avatars directory")
+	p, err := mediaWorkDir(conf, resource)
+	if err != nil {
 		return "", err
 	}
+	if resource == mediaDir {
+		defer os.RemoveAll(p)
+	}
 
 	var ofn string
 
@@ -842,24 +1193,46 @@ func ProcessImage(conf *Config, ifn string, resource, name string, opts *ImageOp
 
 	g.Draw(newImg, img)
 
-	of, err := os.OpenFile(ofn, os.O_WRONLY|os.O_CREATE, 0644)
+	// Images are re-encoded from their pixels alone which strips any EXIF
+	// metadata (such as GPS location) from uploads
+	fns, err := encodeImage(ofn, newImg)
 	if err != nil {
-		log.WithError(err).Error("error opening output file")
 		return "", err
 	}
-	defer of.Close()
 
-	if err := webp.Encode(of, newImg, &webp.Options{Lossless: true}); err != nil {
-		log.WithError(err).Error("error reencoding image")
-		return "", err
-	}
+	if resource == mediaDir {
+		meta := &MediaMetadata{
+			ContentType: "image/webp",
+			Created:     time.Now(),
+			Width:       img.Bounds().Dx(),
+			Height:      img.Bounds().Dy(),
+			Blurhash:    Blurhash(newImg, 4, 3),
+			Sizes: map[string]MediaSize{
+				MediaSizeFull: {Width: newImg.Bounds().Dx(), Height: newImg.Bounds().Dy()},
+			},
+		}
 
-	// Re-encode to PNG (for older browsers)
-	if err := of.Close(); err != nil {
-		log.WithError(err).Warnf("error closing file %s", ofn)
+		if opts != nil && opts.Variants {
+			vfns, err := processImageVariants(ofn, newImg, meta)
+			if err != nil {
+				return "", err
+			}
+			fns = append(fns, vfns...)
+		}
+
+		meta.Size = mediaFilesSize(fns...)
+		meta.FileHashes = mediaFilesHashes(filepath.Base(ReplaceExt(ofn, "")), fns...)
+
+		mfn, err := writeMediaMetadata(ofn, meta)
+		if err != nil {
+			log.WithError(err).Errorf("error writing metadata for %s", ofn)
+			return "", err
+		}
+		fns = append(fns, mfn)
 	}
-	if err := ImageToPng(ofn); err != nil {
-		log.WithError(err).Warnf("error reencoding image to PNG (for older browsers: %s", ofn)
+
+	if err := putMedia(conf, resource, fns...); err != nil {
+		return "", err
 	}
 
 	return fmt.Sprintf(
@@ -870,11 +1243,13 @@ func ProcessImage(conf *Config, ifn string, resource, name string, opts *ImageOp
 }
 
 func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *VideoOptions) (string, error) {
-	p := filepath.Join(conf.Data, resource)
-	if err := os.MkdirAll(p, 0755); err != nil {
-		log.WithError(err).Errorf("error creating %s directory", resource)
+	p, err := mediaWorkDir(conf, resource)
+	if err != nil {
 		return "", err
 	}
+	if resource == mediaDir {
+		defer os.RemoveAll(p)
+	}
 
 	var ofn string
 
@@ -894,6 +1269,8 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 
 	wg := sync.WaitGroup{}
 
+	progress := newTranscodeProgress(conf, ifn, 2, opts.Progress)
+
 	TranscodeWebM := func(ctx context.Context, errs chan error) {
 		defer wg.Done()
 
@@ -916,22 +1293,23 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 			}...)
 		}
 
+		if opts.Animated {
+			args = append(args, "-an")
+		}
+
 		args = append(args, []string{
 			"-c:v", "libvpx",
 			"-c:a", "libvorbis",
 			"-crf", "18",
 			"-r", "24",
 			"-preset", "ultrafast",
+			"-map_metadata", "-1",
 			"-strict", "-2",
 			"-loglevel", "quiet",
 			ofn,
 		}...)
 
-		if err := RunCmd(
-			conf.TranscoderTimeout,
-			"ffmpeg",
-			args...,
-		); err != nil {
+		if err := progress.run(ctx, conf.TranscoderTimeout, 0, args...); err != nil {
 			log.WithError(err).Error("error transcoding video")
 			errs <- err
 			return
@@ -941,25 +1319,38 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 	TranscodeMP4 := func(ctx context.Context, errs chan error) {
 		defer wg.Done()
 
-		if err := RunCmd(
-			conf.TranscoderTimeout,
-			"ffmpeg",
-			"-y",
-			"-i", ifn,
+		args := []string{"-y", "-i", ifn}
+
+		if opts.Animated {
+			// H.264 needs even dimensions and a pixel format all browsers play
+			args = append(args, []string{
+				"-an",
+				"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+				"-pix_fmt", "yuv420p",
+				"-movflags", "+faststart",
+			}...)
+		}
+
+		args = append(args, []string{
 			"-r", "24",
 			"-preset", "ultrafast",
 			"-vcodec", "h264",
 			"-acodec", "aac",
+			"-map_metadata", "-1",
 			"-strict", "-2",
 			"-loglevel", "quiet",
 			ReplaceExt(ofn, ".mp4"),
-		); err != nil {
+		}...)
+
+		if err := progress.run(ctx, conf.TranscoderTimeout, 1, args...); err != nil {
 			log.WithError(err).Error("error transcoding video")
 			errs <- err
 			return
 		}
 	}
 
+	meta := &MediaMetadata{ContentType: "video/webm", Animated: opts.Animated, Created: time.Now()}
+
 	GeneratePoster := func(ctx context.Context, errs chan error) {
 		defer wg.Done()
 
@@ -972,13 +1363,17 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 		defer f.Close()
 
 		// Generate poster / thumbnail
-		_, thumb, err := thumbnailer.Process(f, thumbnailerOpts)
+		src, thumb, err := thumbnailer.Process(f, thumbnailerOpts)
 		if err != nil {
 			log.WithError(err).Error("error generating video poster thumbnail")
 			errs <- err
 			return
 		}
 
+		meta.Width, meta.Height = int(src.Width), int(src.Height)
+		meta.Duration = src.Length.Seconds()
+		meta.Blurhash = Blurhash(thumb, 4, 3)
+
 		pf, err := os.OpenFile(ReplaceExt(ofn, ".webp"), os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
 			log.WithError(err).Error("error opening thumbnail output file")
@@ -1010,8 +1405,8 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 
 	wg.Add(3)
 
-	go TranscodeWebM(ctx, errChan)
-	go TranscodeMP4(ctx, errChan)
+	go TranscodeWebM(transcodeContext(opts.Context), errChan)
+	go TranscodeMP4(transcodeContext(opts.Context), errChan)
 	go GeneratePoster(ctx, errChan)
 
 	go func(ctx context.Context) {
@@ -1044,6 +1439,32 @@ func TranscodeVideo(conf *Config, ifn string, resource, name string, opts *Video
 		return "", err
 	}
 
+	fns := []string{ofn, ReplaceExt(ofn, ".mp4"), ReplaceExt(ofn, ".webp"), ReplaceExt(ofn, ".png")}
+
+	if resource == mediaDir {
+		// Not every container records its duration where the thumbnailer
+		// looks for it
+		if meta.Duration == 0 && !opts.Animated {
+			if meta.Duration, err = ProbeDuration(conf, ofn); err != nil {
+				log.WithError(err).Warnf("error probing duration of video %s", ofn)
+			}
+		}
+
+		meta.Size = mediaFilesSize(fns...)
+		meta.FileHashes = mediaFilesHashes(filepath.Base(ReplaceExt(ofn, "")), fns...)
+
+		mfn, err := writeMediaMetadata(ofn, meta)
+		if err != nil {
+			log.WithError(err).Errorf("error writing metadata for %s", ofn)
+			return "", err
+		}
+		fns = append(fns, mfn)
+	}
+
+	if err := putMedia(conf, resource, fns...); err != nil {
+		return "", err
+	}
+
 	return fmt.Sprintf(
 		"%s/%s/%s",
 		strings.TrimSuffix(conf.BaseURL, "/"),
@@ -1303,6 +1724,16 @@ func URLForExternalProfile(conf *Config, nick, uri string) string {
 	)
 }
 
+// URLForRotatedFeed returns the URL of a rotated (archived) twtxt file of a
+// local feed
+func URLForRotatedFeed(baseURL, name, fn string) string {
+	return fmt.Sprintf(
+		"%s/user/%s/archive/%s",
+		strings.TrimSuffix(baseURL, "/"),
+		name, fn,
+	)
+}
+
 func URLForExternalAvatar(conf *Config, uri string) string {
 	return fmt.Sprintf(
 		"%s/externalAvatar?uri=%s",
@@ -1363,7 +1794,11 @@ func URLForConvFactory(conf *Config, cache *Cache, archive Archiver) func(twt ty
 		}
 
 		if _, ok := cache.Lookup(hash); !ok && !archive.Has(hash) {
-			return ""
+			newHash, ok := LookupMigratedTwtHash(conf, hash)
+			if !ok {
+				return ""
+			}
+			hash = newHash
 		}
 
 		return fmt.Sprintf(
@@ -1390,6 +1825,38 @@ func URLForTask(baseURL, uuid string) string {
 	)
 }
 
+func URLForMicropub(baseURL string) string {
+	return fmt.Sprintf(
+		"%s/micropub",
+		strings.TrimSuffix(baseURL, "/"),
+	)
+}
+
+func URLForMicropubMedia(baseURL string) string {
+	return fmt.Sprintf(
+		"%s/micropub/media",
+		strings.TrimSuffix(baseURL, "/"),
+	)
+}
+
+// URLForIndieAuthMe returns the canonical IndieAuth profile URL (me) of a
+// local user which is their profile page
+func URLForIndieAuthMe(baseURL, username string) string {
+	return fmt.Sprintf(
+		"%s/user/%s/",
+		strings.TrimSuffix(baseURL, "/"),
+		username,
+	)
+}
+
+func URLForIndieAuth(baseURL, path string) string {
+	return fmt.Sprintf(
+		"%s/indieauth/%s",
+		strings.TrimSuffix(baseURL, "/"),
+		path,
+	)
+}
+
 func URLForWhoFollows(baseURL string, feed types.Feed, feedFollowers int) string {
 	return fmt.Sprintf(
 		"%s/whoFollows?followers=%d&token=%s",
@@ -1436,37 +1903,9 @@ func ValidateUsername(username string) error {
 
 // UnparseTwtFactory is the opposite of CleanTwt and ExpandMentions/ExpandTags
 func UnparseTwtFactory(conf *Config) func(text string) string {
-	isLocalURL := IsLocalURLFactory(conf)
+	formatText := FormatTwtTextFactory(conf)
 	return func(text string) string {
-		text = strings.ReplaceAll(text, "\u2028", "\n")
-
-		re := regexp.MustCompile(`(@|#)<([^ ]+) *([^>]+)>`)
-		return re.ReplaceAllStringFunc(text, func(match string) string {
-			parts := re.FindStringSubmatch(match)
-			prefix, nick, uri := parts[1], parts[2], parts[3]
-
-			switch prefix {
-			case "@":
-				if uri != "" && !isLocalURL(uri) {
-					u, err := url.Parse(uri)
-					if err != nil {
-						log.WithField("uri", uri).Warn("UnparseTwt(): error parsing uri")
-						return match
-					}
-					return fmt.Sprintf("@%s@%s", nick, u.Hostname())
-				}
-				return fmt.Sprintf("@%s", nick)
-			case "#":
-				return fmt.Sprintf("#%s", nick)
-			default:
-				log.
-					WithField("prefix", prefix).
-					WithField("nick", nick).
-					WithField("uri", uri).
-					Warn("UnprocessTwt(): invalid prefix")
-			}
-			return match
-		})
+		return formatText(types.MakeTwt(types.Twter{}, time.Time{}, CleanTwt(text)))
 	}
 }
 
@@ -1478,13 +1917,60 @@ func FilterTwts(user *User, twts types.Twts) (filtered types.Twts) {
 	return user.Filter(twts)
 }
 
-// CleanTwt cleans a twt's text, replacing new lines with spaces and
-// stripping surrounding spaces.
+// CleanTwt cleans a twt's text, normalizing new lines and encoding them as
+// the Unicode line separator (U+2028) and stripping surrounding spaces.
 func CleanTwt(text string) string {
 	text = strings.TrimSpace(text)
 	text = strings.ReplaceAll(text, "\r\n", "\n")
-	text = strings.ReplaceAll(text, "\n", "\u2028")
-	return text
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.ReplaceAll(text, "\u2029", "\n\n")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.Join(lines, "\u2028")
+}
+
+// TwtLength returns the length of a twt's text in characters as counted
+// against MaxTwtLength, a new line counts as a single character.
+func TwtLength(text string) int {
+	return utf8.RuneCountInString(CleanTwt(text))
+}
+
+// ValidateTwtLength returns ErrTwtTooLong if the twt's text exceeds the
+// configured MaxTwtLength (if any).
+func ValidateTwtLength(conf *Config, text string) error {
+	if conf.MaxTwtLength > 0 && TwtLength(text) > conf.MaxTwtLength {
+		return ErrTwtTooLong
+	}
+	return nil
+}
+
+// leadingMentionsAndSubjectRe matches the mentions and subject a twt's
+// text starts with (if any), e.g: `@<bob https://bob.com/twtxt.txt> (#abc) `
+var leadingMentionsAndSubjectRe = regexp.MustCompile(`^(?:@(?:<[^>]*>|[^\s(,]+) +)*(?:\([^)]*\) *)?`)
+
+// WithContentWarning marks a twt's text as sensitive by inserting the
+// content warning cw as `(CW: cw)` after any leading mentions and subject so
+// that replies still thread. The text is returned as is if cw is empty or
+// the text already has a content warning.
+func WithContentWarning(text, cw string) string {
+	cw = strings.Join(strings.Fields(strings.NewReplacer("(", "", ")", "").Replace(cw)), " ")
+	if cw == "" || types.MakeTwt(types.Twter{}, time.Time{}, text).ContentWarning() != "" {
+		return text
+	}
+
+	prefix := leadingMentionsAndSubjectRe.FindString(text)
+	if prefix != "" && !strings.HasSuffix(prefix, " ") {
+		prefix += " "
+	}
+
+	return strings.TrimRight(
+		fmt.Sprintf("%s(CW: %s) %s", prefix, cw, strings.TrimLeft(text[len(strings.TrimRight(prefix, " ")):], " ")),
+		" ",
+	)
 }
 
 // RenderAudio ...
@@ -1502,6 +1988,26 @@ func RenderAudio(conf *Config, uri string) string {
 		u.Path = ReplaceExt(u.Path, ".mp3")
 		mp3URI := u.String()
 
+		// Uploaded audio is shown as its waveform and duration and only
+		// loaded once played
+		if meta := localMediaMetadata(conf, u); meta != nil {
+			var waveform string
+			if len(meta.Peaks) > 0 {
+				u.Path = ReplaceExt(u.Path, "")
+				waveform = fmt.Sprintf(
+					`<img alt="Waveform" src="%s" width="%d" height="%d" loading="lazy">
+`,
+					u.String(), MediaWaveformWidth/2, MediaWaveformHeight/2,
+				)
+			}
+
+			return fmt.Sprintf(`%s<audio controls="controls" preload="none"%s>
+  <source type="audio/ogg" src="%s"></source>
+  <source type="audio/mp3" src="%s"></source>
+  Your browser does not support the audio element.
+</audio>`, waveform, mediaDurationTitle(meta), oggURI, mp3URI)
+		}
+
 		return fmt.Sprintf(`<audio controls="controls">
   <source type="audio/ogg" src="%s"></source>
   <source type="audio/mp3" src="%s"></source>
@@ -1534,6 +2040,25 @@ func RenderVideo(conf *Config, uri string) string {
 		u.Path = ReplaceExt(u.Path, "")
 		posterURI := u.String()
 
+		if meta := localMediaMetadata(conf, u); meta != nil {
+			// Video transcoded from an animated image plays like the image would
+			if meta.Animated {
+				return fmt.Sprintf(`<video autoplay loop muted playsinline preload="auto" poster="%s"%s>
+    <source type="video/webm" src="%s" />
+    <source type="video/mp4" src="%s" />
+    Your browser does not support the video element.
+  </video>`, posterURI, mediaDimensions(meta), webmURI, mp4URI)
+			}
+
+			// Uploaded video is shown as its poster and duration and only
+			// loaded once played
+			return fmt.Sprintf(`<video controls playsinline preload="none" poster="%s"%s%s>
+    <source type="video/webm" src="%s" />
+    <source type="video/mp4" src="%s" />
+    Your browser does not support the video element.
+  </video>`, posterURI, mediaDimensions(meta), mediaDurationTitle(meta), webmURI, mp4URI)
+		}
+
 		return fmt.Sprintf(`<video controls playsinline preload="auto" poster="%s">
     <source type="video/webm" src="%s" />
     <source type="video/mp4" src="%s" />
@@ -1547,6 +2072,73 @@ func RenderVideo(conf *Config, uri string) string {
     </video>`, uri)
 }
 
+// localMediaMetadata returns the metadata of the uploaded media at the local
+// URL u, or nil if u isn't uploaded media or it has no metadata
+func localMediaMetadata(conf *Config, u *url.URL) *MediaMetadata {
+	if path.Base(path.Dir(u.Path)) != mediaDir {
+		return nil
+	}
+	return GetMediaMetadata(conf, MediaName(u.Path))
+}
+
+// mediaDimensions returns the width and height attributes of media with
+// known dimensions so the layout does not shift as it loads
+func mediaDimensions(meta *MediaMetadata) string {
+	if meta.Width <= 0 || meta.Height <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(` width="%d" height="%d"`, meta.Width, meta.Height)
+}
+
+// mediaDurationTitle returns the title attribute of audio or video with a
+// known duration
+func mediaDurationTitle(meta *MediaMetadata) string {
+	if meta.Duration <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(` title="Duration: %s"`, FormatMediaDuration(meta.Duration))
+}
+
+// mediaPlaceholderStyleRe matches the style of placeholders for images
+var mediaPlaceholderStyleRe = regexp.MustCompile(`^background-color: #[0-9a-f]{6}$`)
+
+// RenderImage renders an image, uploaded images are rendered with their size
+// variants and dimensions so smaller screens load smaller images and the
+// layout does not shift as images load.
+func RenderImage(conf *Config, uri, alt string) string {
+	isLocalURL := IsLocalURLFactory(conf)
+
+	if isLocalURL(uri) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			log.WithError(err).Warnf("error parsing uri: %s", uri)
+			return ""
+		}
+
+		if path.Base(path.Dir(u.Path)) == mediaDir {
+			if meta := GetMediaMetadata(conf, path.Base(u.Path)); meta != nil && meta.IsImage() {
+				if alt == "" {
+					alt = html.EscapeString(meta.Description)
+				}
+
+				// The placeholder is the image's average color (from its blurhash)
+				var placeholder string
+				if color := BlurhashColor(meta.Blurhash); color != "" {
+					placeholder = fmt.Sprintf(` style="background-color: %s"`, color)
+				}
+
+				full := meta.Sizes[MediaSizeFull]
+				return fmt.Sprintf(
+					`<img alt="%s" src="%s" srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx" width="%d" height="%d"%s loading=lazy>`,
+					alt, uri, meta.Srcset(uri), full.Width, full.Width, full.Width, full.Height, placeholder,
+				)
+			}
+		}
+	}
+
+	return fmt.Sprintf(`<img alt="%s" src="%s" loading=lazy>`, alt, uri)
+}
+
 // PreprocessMedia ...
 func PreprocessMedia(conf *Config, u *url.URL, alt string) string {
 	var html string
@@ -1570,6 +2162,8 @@ func PreprocessMedia(conf *Config, u *url.URL, alt string) string {
 			html = RenderVideo(conf, u.String())
 		case ".mp3", ".ogg":
 			html = RenderAudio(conf, u.String())
+		case "":
+			html = RenderImage(conf, u.String(), alt)
 		default:
 			src := u.String()
 			html = fmt.Sprintf(`<img alt="%s" src="%s" loading=lazy>`, alt, src)
@@ -1605,138 +2199,109 @@ func FormatForDateTime(t time.Time) string {
 	return format
 }
 
+// TwtResolvers returns the resolvers used to render twts, linking mentions
+// and tags to their pages on this pod and embedding whitelisted media.
+func TwtResolvers(conf *Config) lextwt.Resolvers {
+	resolvers := lextwt.NewResolvers(conf)
+	resolvers.Media = func(l *lextwt.Link) string {
+		u, err := url.Parse(l.Target())
+		if err != nil {
+			log.WithError(err).Warn("TwtResolvers: error parsing url")
+			return ""
+		}
+		return PreprocessMedia(conf, u, html.EscapeString(l.Text()))
+	}
+	return resolvers
+}
+
 // FormatTwtFactory formats a twt into a valid HTML snippet
 func FormatTwtFactory(conf *Config) func(twt types.Twt) template.HTML {
-	return func(twt types.Twt) template.HTML {
-		renderHookProcessURLs := func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
-			// Ensure only whitelisted ![](url) images
-			image, ok := node.(*ast.Image)
-			if ok && entering {
-				u, err := url.Parse(string(image.Destination))
-				if err != nil {
-					log.WithError(err).Warn("TwtFactory: error parsing url")
-					return ast.GoToNext, false
-				}
-
-				html := PreprocessMedia(conf, u, string(image.Title))
-
-				_, _ = io.WriteString(w, html)
-
-				return ast.SkipChildren, true
-			}
-
-			span, ok := node.(*ast.HTMLSpan)
-			if !ok {
-				return ast.GoToNext, false
-			}
-
-			leaf := span.Leaf
-			doc, err := goquery.NewDocumentFromReader(bytes.NewReader(leaf.Literal))
-			if err != nil {
-				log.WithError(err).Warn("error parsing HTMLSpan")
-				return ast.GoToNext, false
-			}
-
-			// Ensure only whitelisted img src=(s) and fix non-secure links
-			img := doc.Find("img")
-			if img.Length() > 0 {
-				src, ok := img.Attr("src")
-				if !ok {
-					return ast.GoToNext, false
-				}
-
-				alt, _ := img.Attr("alt")
+	renderer := lextwt.NewHTMLRenderer(TwtResolvers(conf))
+
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id", "controls").OnElements("audio")
+	p.AllowAttrs("id", "controls", "playsinline", "preload", "poster").OnElements("video")
+	p.AllowAttrs("autoplay", "loop", "muted", "width", "height", "title").OnElements("video")
+	p.AllowAttrs("preload", "title").OnElements("audio")
+	p.AllowAttrs("src", "type").OnElements("source")
+	p.AllowAttrs("target").OnElements("a")
+	p.AllowAttrs("class").OnElements("i")
+	p.AllowAttrs("alt", "loading").OnElements("a", "img")
+	p.AllowAttrs("srcset", "sizes").OnElements("img")
+	p.AllowAttrs("style").Matching(mediaPlaceholderStyleRe).OnElements("img")
 
-				u, err := url.Parse(src)
-				if err != nil {
-					log.WithError(err).Warn("error parsing URL")
-					return ast.GoToNext, false
-				}
-
-				html := PreprocessMedia(conf, u, alt)
-
-				_, _ = io.WriteString(w, html)
+	return func(twt types.Twt) template.HTML {
+		return template.HTML(p.Sanitize(lextwt.RenderString(renderer, twt)))
+	}
+}
 
-				return ast.GoToNext, true
+// FormatTwtTextFactory formats a twt into plain text, rendering mentions as
+// @nick (or @nick@domain for external feeds) and tags as #tag
+func FormatTwtTextFactory(conf *Config) func(twt types.Twt) string {
+	isLocalURL := IsLocalURLFactory(conf)
+	renderer := lextwt.NewTextRenderer(lextwt.Resolvers{
+		Mention: func(m *lextwt.Mention) lextwt.Resolved {
+			res := lextwt.DefaultMentionResolver(m)
+			if m.Target() == "" || isLocalURL(m.Target()) {
+				res.Domain = ""
+			} else if m.Name() != "" {
+				res.Domain = m.Domain()
 			}
+			return res
+		},
+	})
 
-			// Let it go! Lget it go!
-			return ast.GoToNext, false
-		}
-
-		extensions := parser.CommonExtensions | parser.HardLineBreak | parser.NoEmptyLineBeforeBlock
-		mdParser := parser.NewWithExtensions(extensions)
-
-		htmlFlags := html.CommonFlags | html.HrefTargetBlank
-		opts := html.RendererOptions{
-			Flags:          htmlFlags,
-			Generator:      "",
-			RenderNodeHook: renderHookProcessURLs,
-		}
-		renderer := html.NewRenderer(opts)
-
-		twt.ExpandLinks(conf, nil)
-		md := []byte(twt.FormatText(types.HTMLFmt, conf))
-		maybeUnsafeHTML := markdown.ToHTML(md, mdParser, renderer)
-
-		p := bluemonday.UGCPolicy()
-		p.AllowAttrs("id", "controls").OnElements("audio")
-		p.AllowAttrs("id", "controls", "playsinline", "preload", "poster").OnElements("video")
-		p.AllowAttrs("src", "type").OnElements("source")
-		p.AllowAttrs("target").OnElements("a")
-		p.AllowAttrs("class").OnElements("i")
-		p.AllowAttrs("alt", "loading").OnElements("a", "img")
-		p.AllowAttrs("style").OnElements("a", "code", "img", "p", "pre", "span")
-		html := p.SanitizeBytes(maybeUnsafeHTML)
-
-		return template.HTML(html)
+	return func(twt types.Twt) string {
+		return lextwt.RenderString(renderer, twt)
 	}
 }
 
-// FormatMentionsAndTags turns `@<nick URL>` into `<a href="URL">@nick</a>`
-// and `#<tag URL>` into `<a href="URL">#tag</a>` and a `!<hash URL>`
-// into a `<a href="URL">!hash</a>`.
+// FormatMentionsAndTags formats the mentions (`@<nick URL>`) and tags
+// (`#<tag URL>`) in text as links in the given format. Local mentions are
+// rendered as nick@domain and others as @nick in plain text.
 func FormatMentionsAndTags(conf *Config, text string, format TwtTextFormat) string {
 	isLocalURL := IsLocalURLFactory(conf)
-	re := regexp.MustCompile(`(@|#)<([^ ]+) *([^>]+)>`)
-	return re.ReplaceAllStringFunc(text, func(match string) string {
-		parts := re.FindStringSubmatch(match)
-		prefix, nick, url := parts[1], parts[2], parts[3]
-
-		if format == TextFmt {
-			switch prefix {
-			case "@":
-				if isLocalURL(url) && strings.HasSuffix(url, "/twtxt.txt") {
-					return fmt.Sprintf("%s@%s", nick, conf.baseURL.Hostname())
-				}
-				return fmt.Sprintf("@%s", nick)
-			default:
-				return fmt.Sprintf("%s%s", prefix, nick)
-			}
-		}
+	isLocalFeed := func(uri string) bool {
+		return isLocalURL(uri) && strings.HasSuffix(uri, "/twtxt.txt")
+	}
 
-		if format == HTMLFmt {
-			switch prefix {
-			case "@":
-				if isLocalURL(url) && strings.HasSuffix(url, "/twtxt.txt") {
-					return fmt.Sprintf(`<a href="%s">@%s</a>`, UserURL(url), nick)
+	var renderer lextwt.Renderer
+	switch format {
+	case TextFmt:
+		renderer = lextwt.NewTextRenderer(lextwt.Resolvers{
+			Mention: func(m *lextwt.Mention) lextwt.Resolved {
+				if isLocalFeed(m.Target()) {
+					return lextwt.Resolved{Text: m.Name(), Domain: HostnameFromURL(conf.BaseURL)}
 				}
-				return fmt.Sprintf(`<a href="%s">@%s</a>`, URLForExternalProfile(conf, nick, url), nick)
-			default:
-				return fmt.Sprintf(`<a href="%s">%s%s</a>`, url, prefix, nick)
-			}
+				return lextwt.Resolved{Text: "@" + m.Name()}
+			},
+		})
+	case HTMLFmt:
+		resolvers := TwtResolvers(conf)
+		mention := resolvers.Mention
+		resolvers.Mention = func(m *lextwt.Mention) lextwt.Resolved {
+			res := mention(m)
+			res.Domain = ""
+			return res
 		}
+		renderer = lextwt.NewHTMLRenderer(resolvers)
+	default:
+		renderer = lextwt.NewMarkdownRenderer(lextwt.Resolvers{
+			Mention: func(m *lextwt.Mention) lextwt.Resolved {
+				res := lextwt.DefaultMentionResolver(m)
+				res.Domain = ""
+				// Using (#) anchors to add the nick to URL for now. The Fluter app needs it since
+				// 	the Markdown plugin doesn't include the link text that contains the nick in its onTap callback
+				// https://github.com/flutter/flutter_markdown/issues/286
+				if res.URL != "" && m.Name() != "" {
+					res.URL += "#" + m.Name()
+				}
+				return res
+			},
+		})
+	}
 
-		switch prefix {
-		case "@":
-			// Using (#) anchors to add the nick to URL for now. The Fluter app needs it since
-			// 	the Markdown plugin doesn't include the link text that contains the nick in its onTap callback
-			// https://github.com/flutter/flutter_markdown/issues/286
-			return fmt.Sprintf(`[@%s](%s#%s)`, nick, url, nick)
-		default:
-			return fmt.Sprintf(`[%s%s](%s)`, prefix, nick, url)
-		}
-	})
+	return lextwt.RenderString(renderer, types.MakeTwt(types.Twter{}, time.Time{}, text))
 }
 
 // FormatRequest generates ascii representation of a request
@@ -1752,23 +2317,23 @@ func FormatRequest(r *http.Request) string {
 	)
 }
 
+// markdownImageRe matches markdown images capturing their url
+var markdownImageRe = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)\)`)
+
+// GetMediaNamesFromText returns the names of uploaded media embedded in text
+// as markdown images (with or without alt text)
 func GetMediaNamesFromText(text string) []string {
 
 	var mediaNames []string
 
-	textSplit := strings.Split(text, "![](")
+	for _, match := range markdownImageRe.FindAllStringSubmatch(text, -1) {
+		mediaURL := match[1]
 
-	for i, textSplitItem := range textSplit {
-		if i > 0 {
-			mediaEndIndex := strings.Index(textSplitItem, ")")
-			mediaURL := textSplitItem[:mediaEndIndex]
-
-			mediaURLSplit := strings.Split(mediaURL, "media/")
-			for j, mediaURLSplitItem := range mediaURLSplit {
-				if j > 0 {
-					mediaPath := mediaURLSplitItem
-					mediaNames = append(mediaNames, mediaPath)
-				}
+		mediaURLSplit := strings.Split(mediaURL, "media/")
+		for j, mediaURLSplitItem := range mediaURLSplit {
+			if j > 0 {
+				mediaPath := mediaURLSplitItem
+				mediaNames = append(mediaNames, mediaPath)
 			}
 		}
 	}
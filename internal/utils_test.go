@@ -1,11 +1,22 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jointwt/twtxt/types/lextwt"
 )
 
 func TestDetectFollowerFromUserAgent(t *testing.T) {
@@ -44,6 +55,8 @@ func TestDetectFollowerFromUserAgent(t *testing.T) {
 }
 
 func TestFormatMentionsAndTags(t *testing.T) {
+	lextwt.DefaultTwtManager()
+
 	conf := &Config{BaseURL: "http://0.0.0.0:8000"}
 
 	testCases := []struct {
@@ -54,7 +67,7 @@ func TestFormatMentionsAndTags(t *testing.T) {
 		{
 			text:     "@<test http://0.0.0.0:8000/user/test/twtxt.txt>",
 			format:   HTMLFmt,
-			expected: `<a href="http://0.0.0.0:8000/user/test">@test</a>`,
+			expected: `<p><a href="http://0.0.0.0:8000/user/test">@test</a></p>`,
 		},
 		{
 			text:     "@<test http://0.0.0.0:8000/user/test/twtxt.txt>",
@@ -64,7 +77,7 @@ func TestFormatMentionsAndTags(t *testing.T) {
 		{
 			text:     "@<iamexternal http://iamexternal.com/twtxt.txt>",
 			format:   HTMLFmt,
-			expected: fmt.Sprintf(`<a href="%s">@iamexternal</a>`, URLForExternalProfile(conf, "iamexternal", "http://iamexternal.com/twtxt.txt")),
+			expected: fmt.Sprintf(`<p><a href="%s">@iamexternal</a></p>`, html.EscapeString(URLForExternalProfile(conf, "iamexternal", "http://iamexternal.com/twtxt.txt"))),
 		},
 		{
 			text:     "@<iamexternal http://iamexternal.com/twtxt.txt>",
@@ -74,13 +87,23 @@ func TestFormatMentionsAndTags(t *testing.T) {
 		{
 			text:     "#<test http://0.0.0.0:8000/search?tag=test>",
 			format:   HTMLFmt,
-			expected: `<a href="http://0.0.0.0:8000/search?tag=test">#test</a>`,
+			expected: `<p><a href="http://0.0.0.0:8000/search?tag=test">#test</a></p>`,
 		},
 		{
 			text:     "#<test http://0.0.0.0:8000/search?tag=test>",
 			format:   MarkdownFmt,
 			expected: `[#test](http://0.0.0.0:8000/search?tag=test)`,
 		},
+		{
+			text:     "@<test http://0.0.0.0:8000/user/test/twtxt.txt> @<iamexternal http://iamexternal.com/twtxt.txt> #<test http://0.0.0.0:8000/search?tag=test>",
+			format:   TextFmt,
+			expected: "test@0.0.0.0 @iamexternal #test",
+		},
+		{
+			text:     "# Hello @<test http://0.0.0.0:8000/user/test/twtxt.txt>",
+			format:   HTMLFmt,
+			expected: `<h1>Hello <a href="http://0.0.0.0:8000/user/test">@test</a></h1>`,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -118,3 +141,142 @@ func TestIsLocalURL(t *testing.T) {
 	}
 
 }
+
+func TestWithContentWarning(t *testing.T) {
+	lextwt.DefaultTwtManager()
+
+	testCases := []struct {
+		text     string
+		cw       string
+		expected string
+	}{
+		{"hello", "", "hello"},
+		{"hello", "spoilers", "(CW: spoilers) hello"},
+		{"@<bob https://bob.com/twtxt.txt> (#abcdefg) hi", "food", "@<bob https://bob.com/twtxt.txt> (#abcdefg) (CW: food) hi"},
+		{"@bob hi", " (nsfw)\n", "@bob (CW: nsfw) hi"},
+		{"(CW: already) hi", "again", "(CW: already) hi"},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, WithContentWarning(testCase.text, testCase.cw))
+	}
+}
+
+func TestIsAnimatedImage(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	}
+
+	var still, animated bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&still, &gif.GIF{Image: []*image.Paletted{frame()}, Delay: []int{0}}))
+	require.NoError(t, gif.EncodeAll(&animated, &gif.GIF{Image: []*image.Paletted{frame(), frame()}, Delay: []int{10, 10}}))
+
+	var stillPNG bytes.Buffer
+	require.NoError(t, png.Encode(&stillPNG, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+
+	// An APNG has an acTL chunk between the IHDR chunk and the image data
+	ihdrEnd := 8 + 8 + 13 + 4
+	acTL := []byte{0, 0, 0, 8, 'a', 'c', 'T', 'L', 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0}
+	apng := append(append(append([]byte{}, stillPNG.Bytes()[:ihdrEnd]...), acTL...), stillPNG.Bytes()[ihdrEnd:]...)
+
+	// A GIF claiming two huge frames, which are never decoded
+	huge := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	for i := 0; i < 2; i++ {
+		huge = append(huge, 0x21, 0xf9, 4, 0, 10, 0, 0, 0)
+		huge = append(huge, 0x2c, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 2, 2, 0x4c, 0x01, 0)
+	}
+	huge = append(huge, 0x3b)
+
+	webpHeader := func(flags byte) []byte {
+		header := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+		return append(header, flags, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{"still gif", still.Bytes(), false},
+		{"animated gif", animated.Bytes(), true},
+		{"huge animated gif", huge, true},
+		{"truncated gif", animated.Bytes()[:20], false},
+		{"still png", stillPNG.Bytes(), false},
+		{"apng", apng, true},
+		{"still webp", webpHeader(0x10), false},
+		{"animated webp", webpHeader(0x12), true},
+		{"not an image", []byte("hello world, this is not an image"), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "twtxt-animated-*")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			_, err = f.Write(testCase.data)
+			require.NoError(t, err)
+			f.Close()
+
+			assert.Equal(t, testCase.expected, IsAnimatedImage(f.Name()))
+		})
+	}
+}
+
+func TestRenderVideoAnimated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "twtxt-render-video-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Config{Data: dir, BaseURL: "https://example.com"}
+
+	_, err = UpdateMediaMetadata(conf, "animated", func(meta *MediaMetadata) {
+		meta.ContentType = "video/webm"
+		meta.Animated = true
+	})
+	require.NoError(t, err)
+
+	html := RenderVideo(conf, "https://example.com/media/animated.webm")
+	assert.Contains(t, html, "<video autoplay loop muted playsinline")
+	assert.NotContains(t, html, "controls")
+	assert.Contains(t, html, `poster="https://example.com/media/animated"`)
+
+	html = RenderVideo(conf, "https://example.com/media/video.webm")
+	assert.Contains(t, html, "<video controls playsinline")
+}
+
+func TestFFmpegProgressWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var reported []int
+	w := &ffmpegProgressWriter{duration: 10, progress: func(progress int) { reported = append(reported, progress) }}
+
+	// Lines may be split across writes
+	for _, s := range []string{
+		"frame=1\nout_time_us=2500", "000\nprogress=continue\n",
+		"out_time_ms=5000000\nout_time=00:00:05.000000\n",
+		"out_time_us=N/A\nout_time_us=12000000\n",
+		"progress=end\n",
+	} {
+		n, err := w.Write([]byte(s))
+		assert.NoError(err)
+		assert.Equal(len(s), n)
+	}
+
+	assert.Equal([]int{25, 50, 100, 100}, reported)
+}
+
+func TestTranscodeProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	var reported []int
+	p := &transcodeProgress{duration: 10, done: make([]int, 2), report: func(progress int) { reported = append(reported, progress) }}
+
+	// The overall progress of all transcodes is reported, never going back
+	p.update(0, 50)
+	p.update(1, 20)
+	p.update(1, 10)
+	p.update(0, 100)
+	p.update(1, 100)
+
+	assert.Equal([]int{25, 35, 60, 100}, reported)
+}
@@ -10,27 +10,40 @@ import (
 type VideoTask struct {
 	*BaseTask
 
-	conf *Config
-	fn   string
+	conf   *Config
+	fn     string
+	upload *MediaMetadata
 }
 
-func NewVideoTask(conf *Config, fn string) *VideoTask {
-	return &VideoTask{
+func NewVideoTask(conf *Config, fn string, upload *MediaMetadata) *VideoTask {
+	task := &VideoTask{
 		BaseTask: NewBaseTask(),
 
-		conf: conf,
-		fn:   fn,
+		conf:   conf,
+		fn:     spoolUpload(conf, fn),
+		upload: upload,
 	}
+
+	// Transcoding takes a while, so image uploads (which are quick) are
+	// processed first whilst the uploader waits
+	task.SetPriority(TaskPriorityNormal)
+
+	return task
 }
 
-func (t *VideoTask) String() string { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *VideoTask) String() string           { return fmt.Sprintf("%T: %s", t, t.ID()) }
+func (t *VideoTask) Kind() string             { return videoTaskKind }
+func (t *VideoTask) Args() TaskData           { return mediaTaskArgs(t.fn, t.upload) }
+func (t *VideoTask) RetryPolicy() RetryPolicy { return mediaTaskRetryPolicy }
+func (t *VideoTask) Cleanup()                 { removeUpload(t.fn) }
 func (t *VideoTask) Run() error {
 	defer t.Done()
 	t.SetState(TaskStateRunning)
+	t.SetProgress(0)
 
 	log.Infof("starting video transcode task for %s", t.fn)
 
-	opts := &VideoOptions{} // Resize: true, Size: MediaResolution}
+	opts := &VideoOptions{Context: t.Context(), Progress: t.setTranscodeProgress} // Resize: true, Size: MediaResolution}
 	mediaURI, err := TranscodeVideo(t.conf, t.fn, mediaDir, "", opts)
 	if err != nil {
 		log.WithError(err).Errorf("error transcoding video %s", t.fn)
@@ -42,7 +55,12 @@ func (t *VideoTask) Run() error {
 		log.WithError(err).Warn("error removing temporary video file")
 	}
 
+	if err := recordMediaUpload(t.conf, mediaURI, t.upload); err != nil {
+		return t.Fail(err)
+	}
+
 	t.SetData("mediaURI", mediaURI)
+	t.SetProgress(100)
 
 	return nil
 }
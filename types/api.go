@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"time"
 )
 
 // AuthRequest ...
@@ -54,9 +55,14 @@ func NewRegisterRequest(r io.Reader) (req RegisterRequest, err error) {
 }
 
 // PostRequest ...
+//
+// Text may contain new lines which are encoded as the Unicode line
+// separator (U+2028), a blank line separates paragraphs. ContentWarning
+// optionally marks the twt as sensitive, collapsing it behind the warning.
 type PostRequest struct {
-	PostAs string `json:"post_as"`
-	Text   string `json:"text"`
+	PostAs         string `json:"post_as"`
+	Text           string `json:"text"`
+	ContentWarning string `json:"content_warning,omitempty"`
 }
 
 // NewPostRequest ...
@@ -263,3 +269,68 @@ func NewReportRequest(r io.Reader) (req ReportRequest, err error) {
 	err = json.Unmarshal(body, &req)
 	return
 }
+
+// Task ...
+type Task struct {
+	ID       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	Priority string            `json:"priority"`
+	Attempts int               `json:"attempts"`
+	State    string            `json:"state"`
+	Error    string            `json:"error"`
+	Data     map[string]string `json:"data"`
+	Created  time.Time         `json:"created"`
+	Updated  time.Time         `json:"updated"`
+}
+
+// TasksResponse ...
+type TasksResponse struct {
+	Tasks []Task `json:"tasks"`
+}
+
+// Bytes ...
+func (res TasksResponse) Bytes() ([]byte, error) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// MediaMetadataResponse ...
+type MediaMetadataResponse struct {
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Description string    `json:"description,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Duration    float64   `json:"duration,omitempty"`
+	Blurhash    string    `json:"blurhash,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// Bytes ...
+func (res MediaMetadataResponse) Bytes() ([]byte, error) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// TaskRequest ...
+type TaskRequest struct {
+	ID string `json:"id"`
+}
+
+// NewTaskRequest ...
+func NewTaskRequest(r io.Reader) (req TaskRequest, err error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &req)
+	return
+}
@@ -0,0 +1,198 @@
+// Package difftwt implements a TwtManager for differential testing of the
+// twt parsers. Twts are parsed with lextwt (whose results are used) and every
+// line is also parsed with the legacy retwt parser, any divergence in their
+// hashes, mentions, tags or subjects is reported.
+package difftwt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/lextwt"
+	"github.com/jointwt/twtxt/types/retwt"
+)
+
+// Divergence is a difference in how lextwt and retwt parse a twt
+type Divergence struct {
+	// Line is the (1-based) line of the feed the twt is on
+	Line int
+
+	// Field is what differs, one of parse, created, hash, mentions, tags
+	// or subject
+	Field string
+
+	Lextwt string
+	Retwt  string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("%d: %s differs: lextwt %q != retwt %q", d.Line, d.Field, d.Lextwt, d.Retwt)
+}
+
+// Reporter is called with the divergences found in a feed
+type Reporter func(twter types.Twter, divergences []Divergence)
+
+// LogReporter logs divergences as warnings
+func LogReporter(twter types.Twter, divergences []Divergence) {
+	for _, d := range divergences {
+		log.
+			WithField("feed", twter.URL).
+			WithField("line", d.Line).
+			Warnf("parser divergence: %s", d)
+	}
+}
+
+// DiffLine parses a twt line with both parsers and returns the divergences
+func DiffLine(n int, line string, twter types.Twter) []Divergence {
+	lt, lerr := lextwt.ParseLine(line, twter)
+	rt, rerr := retwt.ParseLine(line, twter)
+
+	lok := lerr == nil && lt != nil && !lt.IsZero()
+	rok := rerr == nil && rt != nil && !rt.IsZero()
+	if !lok || !rok {
+		if lok == rok {
+			return nil
+		}
+		return []Divergence{{n, "parse", parseResult(lok, lerr), parseResult(rok, rerr)}}
+	}
+
+	var divergences []Divergence
+	diff := func(field, l, r string) {
+		if l != r {
+			divergences = append(divergences, Divergence{n, field, l, r})
+		}
+	}
+
+	diff("created", lt.Created().Format(time.RFC3339), rt.Created().Format(time.RFC3339))
+	diff("hash", lt.Hash(), rt.Hash())
+	diff("mentions", mentions(lt), mentions(rt))
+	diff("tags", tags(lt), tags(rt))
+	diff("subject", subject(lt), subject(rt))
+
+	return divergences
+}
+
+// DiffFile parses every twt of a feed with both parsers and returns the
+// divergences. Twts are parsed as twts of the feed's Twter once its
+// metadata (e.g: `# url`) has been applied, as pods do.
+func DiffFile(data []byte, twter types.Twter) []Divergence {
+	if f, err := lextwt.ParseFile(bytes.NewReader(data), twter); err == nil {
+		twter = f.Twter()
+	}
+
+	var divergences []Divergence
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		divergences = append(divergences, DiffLine(n, line, twter)...)
+	}
+
+	return divergences
+}
+
+func parseResult(ok bool, err error) string {
+	switch {
+	case ok:
+		return "ok"
+	case err != nil:
+		return err.Error()
+	default:
+		return "no twt"
+	}
+}
+
+func mentions(twt types.Twt) string {
+	var lis []string
+	for _, m := range twt.Mentions() {
+		twter := m.Twter()
+		lis = append(lis, strings.TrimSpace(twter.Nick+" "+twter.URL))
+	}
+	sort.Strings(lis)
+	return strings.Join(lis, ", ")
+}
+
+func tags(twt types.Twt) string {
+	tags := twt.Tags()
+	lis := tags.Tags()
+	sort.Strings(lis)
+	return strings.Join(lis, ", ")
+}
+
+func subject(twt types.Twt) string {
+	if s := twt.Subject(); s != nil {
+		return s.String()
+	}
+	return ""
+}
+
+type difftwtManager struct {
+	report Reporter
+}
+
+var _ types.TwtManager = (*difftwtManager)(nil)
+
+// DefaultTwtManager sets the TwtManager to parse twts with lextwt whilst
+// logging how retwt diverges
+func DefaultTwtManager() {
+	types.SetTwtManager(NewTwtManager(LogReporter))
+}
+
+// NewTwtManager returns a TwtManager that parses twts with lextwt and calls
+// report with how retwt diverges
+func NewTwtManager(report Reporter) types.TwtManager {
+	return &difftwtManager{report: report}
+}
+
+func (m *difftwtManager) DecodeJSON(b []byte) (types.Twt, error) { return lextwt.DecodeJSON(b) }
+func (m *difftwtManager) ParseLine(line string, twter types.Twter) (types.Twt, error) {
+	if divergences := DiffLine(1, line, twter); len(divergences) > 0 {
+		m.report(twter, divergences)
+	}
+	return lextwt.ParseLine(line, twter)
+}
+func (m *difftwtManager) ParseFile(r io.Reader, twter types.Twter) (types.TwtFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m.diff(data, twter)
+	return lextwt.ParseFile(bytes.NewReader(data), twter)
+}
+func (m *difftwtManager) ScanFile(r io.Reader, twter types.Twter) types.TwtScanner {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.WithError(err).Warnf("error reading feed %s", twter.URL)
+	}
+	m.diff(data, twter)
+	return lextwt.NewScanner(bytes.NewReader(data), twter)
+}
+func (m *difftwtManager) MakeTwt(twter types.Twter, ts time.Time, text string) types.Twt {
+	elems, err := lextwt.ParseText(text)
+	if err != nil {
+		return types.NilTwt
+	}
+	return lextwt.NewTwt(twter, lextwt.NewDateTime(ts, ""), elems...)
+}
+
+func (m *difftwtManager) diff(data []byte, twter types.Twter) {
+	if divergences := DiffFile(data, twter); len(divergences) > 0 {
+		m.report(twter, divergences)
+	}
+}
@@ -0,0 +1,33 @@
+package difftwt_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jointwt/twtxt/types"
+	"github.com/jointwt/twtxt/types/difftwt"
+)
+
+func TestDiffFile(t *testing.T) {
+	assert := assert.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+
+	feed := "# nick = example\n" +
+		"\n" +
+		"2020-12-25T16:55:57Z\tHello @<bob https://bob.com/twtxt.txt> #twtxt\n" +
+		"2020-12-25T17:55:57Z\t(#abcdefg) a reply\n" +
+		"2020-12-25T18:55:57Z    separated by spaces\n"
+
+	divergences := difftwt.DiffFile([]byte(feed), twter)
+	if assert.NotEmpty(divergences) {
+		for _, d := range divergences {
+			assert.Equal(5, d.Line, d.String())
+		}
+	}
+
+	assert.Empty(difftwt.DiffLine(1, "2020-12-25T18:55:57Z\tseparated by a tab", twter))
+
+	assert.Empty(difftwt.DiffLine(1, "# a comment", twter))
+}
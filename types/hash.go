@@ -0,0 +1,80 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// LegacyTwtHashVersion is the version of the hash used for twts of feeds
+	// that do not advertise a `# hash_version`, a 7 character truncated
+	// base32 encoded blake2b-256 hash.
+	LegacyTwtHashVersion = 1
+)
+
+// TwtHashAlgorithms are the supported algorithms twts may be hashed with
+var TwtHashAlgorithms = map[string]func([]byte) []byte{
+	"blake2b-256": func(b []byte) []byte { sum := blake2b.Sum256(b); return sum[:] },
+	"sha256":      func(b []byte) []byte { sum := sha256.Sum256(b); return sum[:] },
+}
+
+// TwtHashVersion describes how twts are hashed. Feeds advertise the version
+// their twts are hashed with with `# hash_version = <version>` so every pod
+// computes the same hashes for them.
+type TwtHashVersion struct {
+	Version   int
+	Algorithm string
+	Length    int
+}
+
+// Hash returns the hash of a twt given its author's feed URL, timestamp and
+// literal text
+func (v TwtHashVersion) Hash(uri string, created time.Time, text string) string {
+	payload := fmt.Sprintf(
+		"%s\n%s\n%s",
+		uri,
+		created.Format(time.RFC3339),
+		text,
+	)
+	sum := TwtHashAlgorithms[v.Algorithm]([]byte(payload))
+
+	// Base32 is URL-safe, unlike Base64, and shorter than hex.
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	hash := strings.ToLower(encoding.EncodeToString(sum))
+	return hash[len(hash)-v.Length:]
+}
+
+func (v TwtHashVersion) String() string {
+	return fmt.Sprintf("v%d (%s/%d)", v.Version, v.Algorithm, v.Length)
+}
+
+// twtHashVersions are the known twt hash versions. Feeds only advertise
+// the version of their hashes so versions can't be configured per pod, new
+// versions (e.g: to lengthen hashes as collisions become likely) are added
+// here for every pod to know them.
+var twtHashVersions = map[int]TwtHashVersion{
+	LegacyTwtHashVersion: {LegacyTwtHashVersion, "blake2b-256", TwtHashLength},
+	2:                    {2, "blake2b-256", 12},
+}
+
+// LookupTwtHashVersion returns the known twt hash version
+func LookupTwtHashVersion(version int) (TwtHashVersion, bool) {
+	v, ok := twtHashVersions[version]
+	return v, ok
+}
+
+// TwtHash returns the hash of a twt by twter with the version of the hash
+// twter's feed advertises, falling back to the legacy version if it does
+// not advertise one (or it is unknown).
+func TwtHash(twter Twter, created time.Time, text string) string {
+	v, ok := LookupTwtHashVersion(twter.HashVersion)
+	if !ok {
+		v, _ = LookupTwtHashVersion(LegacyTwtHashVersion)
+	}
+	return v.Hash(twter.URL, created, text)
+}
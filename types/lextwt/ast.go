@@ -1,7 +1,6 @@
 package lextwt
 
 import (
-	"encoding/base32"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -11,7 +10,6 @@ import (
 	"time"
 
 	"github.com/jointwt/twtxt/types"
-	"golang.org/x/crypto/blake2b"
 )
 
 func init() {
@@ -47,6 +45,19 @@ func NewComment(comment string) *Comment {
 func NewCommentValue(comment, key, value string) *Comment {
 	return &Comment{comment, key, value}
 }
+
+// NewDeleteComment returns a `# delete = <hash>` marker announcing that the
+// twt with the given hash has been deleted from the feed.
+func NewDeleteComment(hash string) *Comment {
+	return NewCommentValue("# delete = "+hash, "delete", hash)
+}
+
+// NewEditComment returns a `# edit = <hash> <replacement>` marker announcing
+// that the twt with the given hash has been replaced by an edited twt.
+func NewEditComment(hash, replacement string) *Comment {
+	value := hash + " " + replacement
+	return NewCommentValue("# edit = "+value, "edit", value)
+}
 func (n Comment) IsNil() bool     { return n.comment == "" }
 func (n Comment) Literal() string { return n.comment + "\n" }
 func (n Comment) String() string  { return n.Literal() }
@@ -445,6 +456,60 @@ func (n *Subject) String() string {
 	return fmt.Sprintf("%c", n)
 }
 
+// ContentWarning marks a twt as sensitive with a subject-style element
+// `(CW: warning)` that clients collapse the twt behind
+type ContentWarning struct {
+	lit  string
+	text string
+}
+
+var _ Elem = (*ContentWarning)(nil)
+
+// NewContentWarning returns a content warning with the given warning text
+func NewContentWarning(text string) *ContentWarning {
+	return &ContentWarning{lit: "(CW: " + text + ")", text: text}
+}
+
+// contentWarningPrefix is the (case insensitive) prefix of a subject that
+// makes it a content warning
+const contentWarningPrefix = "cw:"
+
+// asContentWarning returns the content warning a subject of the form
+// `(CW: warning)` is, or nil if it is a regular subject
+func (n *Subject) asContentWarning() *ContentWarning {
+	if n == nil || n.tag != nil || len(n.subject) < len(contentWarningPrefix) {
+		return nil
+	}
+	if !strings.EqualFold(n.subject[:len(contentWarningPrefix)], contentWarningPrefix) {
+		return nil
+	}
+	text := strings.TrimSpace(n.subject[len(contentWarningPrefix):])
+	if text == "" {
+		return nil
+	}
+	return &ContentWarning{lit: n.Literal(), text: text}
+}
+
+func (n *ContentWarning) Clone() Elem {
+	if n == nil {
+		return nil
+	}
+	return &ContentWarning{n.lit, n.text}
+}
+func (n *ContentWarning) IsNil() bool     { return n == nil }
+func (n *ContentWarning) Literal() string { return n.lit }
+func (n *ContentWarning) Text() string    { return n.text }
+func (n *ContentWarning) Format(state fmt.State, r rune) {
+	if r == 'l' {
+		_, _ = state.Write([]byte(n.lit))
+		return
+	}
+	_, _ = state.Write([]byte("(CW: " + n.text + ")"))
+}
+func (n *ContentWarning) String() string {
+	return fmt.Sprintf("%c", n)
+}
+
 type Text struct {
 	lit string
 }
@@ -589,9 +654,11 @@ type Twt struct {
 	links      []*Link
 	hash       string
 	subject    *Subject
+	cw         *ContentWarning
 	twter      *types.Twter
 	pos        int
 	hasSubject bool
+	hasCW      bool
 	isProxy    bool
 }
 
@@ -644,7 +711,7 @@ func (twt *Twt) append(elem Elem) {
 			twt.subject = elem
 			twt.hasSubject = true
 
-		case *Mention:
+		case *Mention, *ContentWarning:
 		case *Text:
 			if !elem.IsSpace() {
 				twt.hasSubject = true
@@ -654,6 +721,23 @@ func (twt *Twt) append(elem Elem) {
 		}
 	}
 
+	// Likewise a content warning must lead the twt's text
+	if !twt.hasCW {
+		switch elem := elem.(type) {
+		case *ContentWarning:
+			twt.cw = elem
+			twt.hasCW = true
+
+		case *Mention, *Subject:
+		case *Text:
+			if !elem.IsSpace() {
+				twt.hasCW = true
+			}
+		default:
+			twt.hasCW = true
+		}
+	}
+
 	if subject, ok := elem.(*Subject); ok {
 		if subject.tag != nil {
 			twt.tags = append(twt.tags, subject.tag)
@@ -769,18 +853,20 @@ func (twt Twt) MarshalJSON() ([]byte, error) {
 		Hash     string   `json:"hash"`
 		Tags     []string `json:"tags"`
 		Subject  string   `json:"subject"`
+		Summary  string   `json:"summary,omitempty"`
 		Mentions []string `json:"mentions"`
 		Links    []string `json:"links"`
 	}{
 		Twter:        twt.Twter(),
 		Text:         twt.Text(),
 		Created:      twt.Created(),
-		MarkdownText: twt.FormatText(types.MarkdownFmt, nil),
+		MarkdownText: RenderString(NewMarkdownRenderer(Resolvers{}), &twt),
 
 		// Dynamic Fields
 		Hash:     twt.Hash(),
 		Tags:     tags.Tags(),
 		Subject:  fmt.Sprintf("%c", twt.Subject()),
+		Summary:  twt.ContentWarning(),
 		Mentions: twt.Mentions().Mentions(),
 		Links:    twt.Links().Links(),
 	})
@@ -934,18 +1020,7 @@ func (twt Twt) Hash() string {
 		return twt.hash
 	}
 
-	payload := fmt.Sprintf(
-		"%s\n%s\n%s",
-		twt.Twter().URL,
-		twt.Created().Format(time.RFC3339),
-		twt.LiteralText(),
-	)
-	sum := blake2b.Sum256([]byte(payload))
-
-	// Base32 is URL-safe, unlike Base64, and shorter than hex.
-	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
-	hash := strings.ToLower(encoding.EncodeToString(sum[:]))
-	twt.hash = hash[len(hash)-types.TwtHashLength:]
+	twt.hash = types.TwtHash(twt.Twter(), twt.Created(), twt.LiteralText())
 
 	return twt.hash
 }
@@ -955,6 +1030,15 @@ func (twt Twt) Subject() types.Subject {
 	}
 	return twt.subject
 }
+func (twt Twt) ContentWarning() string {
+	if twt.cw == nil {
+		return ""
+	}
+	return twt.cw.Text()
+}
+
+// ContentWarningElem returns the twt's content warning element, if it has one
+func (twt Twt) ContentWarningElem() *ContentWarning { return twt.cw }
 
 // Twts typedef to be able to attach sort methods
 type Twts []*Twt
@@ -16,55 +16,114 @@ func DefaultTwtManager() {
 
 // ParseFile and return time & count limited twts + comments
 func ParseFile(r io.Reader, twter types.Twter) (types.TwtFile, error) {
+	s := NewScanner(r, twter)
 
-	f := &lextwtFile{twter: &twter}
+	var twts types.Twts
+	for {
+		twt, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		twts = append(twts, twt)
+	}
 
-	nTwts, nErrors := 0, 0
+	f := s.file()
+	f.twts = twts
 
-	lexer := NewLexer(r)
-	parser := NewParser(lexer)
-	parser.SetTwter(&twter)
+	return f, nil
+}
+
+// Scanner parses a feed incrementally yielding one twt at a time, so that
+// very large feeds can be processed with bounded memory. Metadata comments
+// are applied to the feed's Twter as they are read.
+type Scanner struct {
+	parser *parser
+	twter  *types.Twter
+
+	twters   []*types.Twter
+	comments Comments
+
+	nTwts, nErrors int
+}
+
+var _ types.TwtScanner = (*Scanner)(nil)
+
+// NewScanner returns a new Scanner reading a feed from r
+func NewScanner(r io.Reader, twter types.Twter) *Scanner {
+	s := &Scanner{twter: &twter}
+
+	s.parser = NewParser(NewLexer(r))
+	s.parser.SetTwter(s.twter)
+
+	return s
+}
 
-	for !parser.IsEOF() {
-		line := parser.ParseLine()
+// Next returns the next twt of the feed or io.EOF once there are no more
+func (s *Scanner) Next() (types.Twt, error) {
+	for !s.parser.IsEOF() {
+		line := s.parser.ParseLine()
 
 		switch e := line.(type) {
 		case *Comment:
-			f.comments = append(f.comments, e)
+			s.comments = append(s.comments, e)
+			switch e.Key() {
+			case "nick", "url", "twturl", "description", "avatar", "hash_version":
+				s.applyMetadata()
+			}
 		case *Twt:
 			if e.IsNil() {
-				log.Errorf("invalid feed or bad line parsing %#v", twter)
-				nErrors++
+				log.Errorf("invalid feed or bad line parsing %#v", *s.twter)
+				s.nErrors++
 				continue
 			}
 
-			nTwts++
-			f.twts = append(f.twts, e)
+			s.nTwts++
 
 			// If the twt has an override twter add to authors.
-			if e.twter.URL != f.twter.URL {
+			if e.twter.URL != s.twter.URL {
 				found := false
-				for i := range f.twters {
-					if f.twters[i].URL == e.twter.URL {
+				for i := range s.twters {
+					if s.twters[i].URL == e.twter.URL {
 						found = true
 						// de-dup the elements twter with the file one.
-						e.twter = f.twters[i]
+						e.twter = s.twters[i]
 					}
 				}
 				// only add to authors if not seen before.
 				if !found {
-					f.twters = append(f.twters, e.twter)
+					s.twters = append(s.twters, e.twter)
 				}
 			}
+
+			return e, nil
 		}
 	}
-	nErrors += len(parser.Errs())
 
-	if nTwts == 0 && nErrors > 0 {
-		log.Warnf("erroneous feed dtected (%d twts parsed %d errors)", nTwts, nErrors)
-		return nil, types.ErrInvalidFeed
+	if s.nTwts == 0 && s.nErrors+len(s.parser.Errs()) > 0 {
+		log.Warnf("erroneous feed dtected (%d twts parsed %d errors)", s.nTwts, s.nErrors+len(s.parser.Errs()))
+		return types.NilTwt, types.ErrInvalidFeed
 	}
 
+	return types.NilTwt, io.EOF
+}
+
+// Twter returns the Twter shared by all twts of the feed, changes to it
+// (e.g: resolving its avatar) apply to all twts read.
+func (s *Scanner) Twter() *types.Twter { return s.twter }
+
+// File returns the feed's metadata read so far without its twts
+func (s *Scanner) File() types.TwtFile { return s.file() }
+
+func (s *Scanner) file() *lextwtFile {
+	return &lextwtFile{twter: s.twter, twters: s.twters, comments: s.comments}
+}
+
+func (s *Scanner) applyMetadata() {
+	f := s.file()
+
 	if v, ok := f.Info().GetN("nick", 0); ok {
 		log.Debugf("override nick %s with %s", f.twter.Nick, v.Value())
 		f.twter.Nick = v.Value()
@@ -78,8 +137,21 @@ func ParseFile(r io.Reader, twter types.Twter) (types.TwtFile, error) {
 		f.twter.URL = v.Value()
 	}
 
-	return f, nil
+	if v := f.Description(); v != "" {
+		f.twter.Tagline = v
+	}
+
+	// Twts are hashed with the hash version the feed advertises (if known)
+	if v := types.MetaHashVersion(f.Info()); v > 0 {
+		if _, ok := types.LookupTwtHashVersion(v); ok {
+			f.twter.HashVersion = v
+		}
+	}
+
+	// The advertised avatar (See: Avatar()) is not used as the Twter's as is,
+	// callers refer to their own (e.g: locally cached) copy of it instead.
 }
+
 func ParseLine(line string, twter types.Twter) (twt types.Twt, err error) {
 	if line == "" {
 		return types.NilTwt, nil
@@ -108,6 +180,9 @@ func (*lextwtManager) ParseLine(line string, twter types.Twter) (twt types.Twt,
 func (*lextwtManager) ParseFile(r io.Reader, twter types.Twter) (types.TwtFile, error) {
 	return ParseFile(r, twter)
 }
+func (*lextwtManager) ScanFile(r io.Reader, twter types.Twter) types.TwtScanner {
+	return NewScanner(r, twter)
+}
 func (*lextwtManager) MakeTwt(twter types.Twter, ts time.Time, text string) types.Twt {
 	dt := NewDateTime(ts, "")
 	elems, err := ParseText(text)
@@ -139,3 +214,14 @@ func (r *lextwtFile) Twter() types.Twter      { return *r.twter }
 func (r *lextwtFile) Authors() []*types.Twter { return r.twters }
 func (r *lextwtFile) Info() types.Info        { return r.comments }
 func (r *lextwtFile) Twts() types.Twts        { return r.twts }
+
+func (r *lextwtFile) Nick() string            { return types.MetaValue(r.comments, "nick") }
+func (r *lextwtFile) URL() string             { return types.MetaValue(r.comments, "url") }
+func (r *lextwtFile) Avatar() string          { return types.MetaValue(r.comments, "avatar") }
+func (r *lextwtFile) Description() string     { return types.MetaValue(r.comments, "description") }
+func (r *lextwtFile) Links() []types.FeedLink { return types.MetaLinks(r.comments) }
+func (r *lextwtFile) Refresh() time.Duration  { return types.MetaRefresh(r.comments) }
+func (r *lextwtFile) Following() int          { return types.MetaFollowing(r.comments) }
+func (r *lextwtFile) Prev() (string, string)  { return types.MetaPrev(r.comments) }
+func (r *lextwtFile) Deleted() []string       { return types.MetaDeleted(r.comments) }
+func (r *lextwtFile) Edits() []types.TwtEdit  { return types.MetaEdits(r.comments) }
@@ -987,6 +987,110 @@ func TestParseFile(t *testing.T) {
 	}
 }
 
+func TestParseFileMetadata(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+
+	f, err := lextwt.ParseFile(strings.NewReader(`# nick        = example
+# url         = https://example.com/twtxt.txt
+# url         = https://mirror.example.com/twtxt.txt
+# avatar      = https://example.com/avatar.png
+# description = Just an example
+# link        = My Blog https://example.com/blog
+# link        = https://example.com
+# refresh     = 3600
+# following   = 2
+# follow      = xuu https://txt.sour.is/users/xuu.txt
+# follow      = prologic https://twtxt.net/user/prologic/twtxt.txt
+
+2016-02-03T23:05:00Z	welcome to twtxt!
+`), twter)
+	is.NoErr(err)
+
+	is.Equal(f.Nick(), "example")
+	is.Equal(f.URL(), "https://example.com/twtxt.txt")
+	is.Equal(f.Avatar(), "https://example.com/avatar.png")
+	is.Equal(f.Description(), "Just an example")
+	is.Equal(f.Links(), []types.FeedLink{
+		{Text: "My Blog", URL: "https://example.com/blog"},
+		{Text: "", URL: "https://example.com"},
+	})
+	is.Equal(f.Refresh(), time.Hour)
+	is.Equal(f.Following(), 2)
+	is.Equal(len(f.Info().Followers()), 2)
+
+	is.Equal(f.Twter().Tagline, "Just an example")
+	is.Equal(f.Twter().Avatar, "") // the advertised avatar is only cached by pods
+	is.Equal(f.Twts()[0].Twter().Tagline, "Just an example")
+}
+
+func TestParseFileMarkers(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+
+	feed := "# nick = example\n" +
+		lextwt.NewDeleteComment("o6dsrga").Literal() +
+		lextwt.NewEditComment("xsosbfa", "4v3jb4a").Literal() +
+		"\n2016-02-03T23:05:00Z	welcome to twtxt!\n"
+
+	f, err := lextwt.ParseFile(strings.NewReader(feed), twter)
+	is.NoErr(err)
+
+	is.Equal(f.Deleted(), []string{"o6dsrga"})
+	is.Equal(f.Edits(), []types.TwtEdit{{Hash: "xsosbfa", Replacement: "4v3jb4a"}})
+	is.Equal(len(f.Twts()), 1)
+}
+
+func TestParseFileHashVersion(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+	line := "2016-02-03T23:05:00Z	welcome to twtxt!\n"
+
+	f, err := lextwt.ParseFile(strings.NewReader(line), twter)
+	is.NoErr(err)
+	is.Equal(f.Twts()[0].Hash(), "u7em4da")
+
+	f, err = lextwt.ParseFile(strings.NewReader("# hash_version = 2\n"+line), twter)
+	is.NoErr(err)
+	is.Equal(f.Twter().HashVersion, 2)
+	is.Equal(len(f.Twts()[0].Hash()), 12)
+	is.True(strings.HasSuffix(f.Twts()[0].Hash(), "u7em4da"))
+
+	// Unknown versions fall back to the legacy hash
+	f, err = lextwt.ParseFile(strings.NewReader("# hash_version = 42\n"+line), twter)
+	is.NoErr(err)
+	is.Equal(f.Twts()[0].Hash(), "u7em4da")
+}
+
+func TestScanner(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "https://example.com/twtxt.txt"}
+
+	s := lextwt.NewScanner(strings.NewReader(`# nick = override
+2016-02-03T23:05:00Z	welcome to twtxt!
+2016-02-04T13:30:00Z	second twt
+`), twter)
+
+	twt, err := s.Next()
+	is.NoErr(err)
+	is.Equal(twt.Twter().Nick, "override")
+	is.Equal(fmt.Sprintf("%t", twt), "welcome to twtxt!")
+
+	twt, err = s.Next()
+	is.NoErr(err)
+	is.Equal(fmt.Sprintf("%t", twt), "second twt")
+
+	_, err = s.Next()
+	is.Equal(err, io.EOF)
+
+	is.Equal(s.File().Nick(), "override")
+	is.Equal(len(s.File().Twts()), 0)
+}
+
 func parseTime(s string) time.Time {
 	if dt, err := time.Parse(time.RFC3339, s); err == nil {
 		return dt
@@ -1027,6 +1131,147 @@ func TestExpandLinks(t *testing.T) {
 	}
 }
 
+func TestRender(t *testing.T) {
+	twter := types.Twter{Nick: "example", URL: "http://example.com/example.txt"}
+	resolvers := lextwt.NewResolvers(mockFmtOpts{localURL: "http://example.com"})
+
+	twt := lextwt.NewTwt(
+		twter,
+		lextwt.NewDateTime(parseTime("2021-01-24T02:19:54Z"), "2021-01-24T02:19:54Z"),
+		lextwt.NewMention("bob", "http://example.com/user/bob/twtxt.txt"),
+		lextwt.NewText(" hi "),
+		lextwt.NewTag("go", ""),
+		lextwt.NewText(" **<b>**"),
+		lextwt.LineSeparator,
+		lextwt.NewMention("alice", "https://other.com/alice.txt"),
+		lextwt.NewText(" "),
+		lextwt.NewLink("site", "https://other.com", lextwt.LinkStandard),
+	)
+
+	tests := []struct {
+		renderer lextwt.Renderer
+		expected string
+	}{
+		{
+			renderer: lextwt.NewHTMLRenderer(resolvers),
+			expected: `<p><a href="http://example.com/user/bob">@bob</a> hi <a href="http://example.com/search?tag=go">#go</a> <strong>&lt;b&gt;</strong><br />` + "\n" +
+				`<a href="http://example.com/external?uri=https://other.com/alice.txt&amp;nick=alice">@alice<em>@other.com</em></a> <a href="https://other.com" target="_blank" rel="nofollow noopener">site</a></p>`,
+		},
+		{
+			renderer: lextwt.NewTextRenderer(resolvers),
+			expected: "@bob hi #go **<b>**\n@alice@other.com [site](https://other.com)",
+		},
+		{
+			renderer: lextwt.NewMarkdownRenderer(resolvers),
+			expected: "[@bob](http://example.com/user/bob) hi [#go](http://example.com/search?tag=go) **<b>**  \n" +
+				"[@alice@other.com](http://example.com/external?uri=https://other.com/alice.txt&nick=alice) [site](https://other.com)",
+		},
+		{
+			renderer: lextwt.NewGemtextRenderer(resolvers),
+			expected: "@bob hi #go **<b>**\n@alice@other.com site\n\n" +
+				"=> http://example.com/user/bob @bob\n" +
+				"=> http://example.com/search?tag=go #go\n" +
+				"=> http://example.com/external?uri=https://other.com/alice.txt&nick=alice @alice@other.com\n" +
+				"=> https://other.com site",
+		},
+	}
+
+	is := is.New(t)
+
+	for i, tt := range tests {
+		t.Logf("TestRender %d", i)
+		is.Equal(lextwt.RenderString(tt.renderer, twt), tt.expected)
+	}
+}
+
+func TestRenderMultiLine(t *testing.T) {
+	is := is.New(t)
+
+	elems, err := lextwt.ParseText("one\u2028two\u2028\u2028three\u2028```\u2028a < b\u2028```")
+	is.NoErr(err)
+
+	twter := types.Twter{Nick: "example", URL: "http://example.com/example.txt"}
+	twt := lextwt.NewTwt(
+		twter,
+		lextwt.NewDateTime(parseTime("2021-01-24T02:19:54Z"), "2021-01-24T02:19:54Z"),
+		elems...,
+	)
+
+	is.Equal(
+		lextwt.RenderString(lextwt.NewHTMLRenderer(lextwt.Resolvers{}), twt),
+		"<p>one<br />\ntwo</p>\n<p>three</p>\n<pre><code>a &lt; b</code></pre>",
+	)
+	is.Equal(
+		lextwt.RenderString(lextwt.NewMarkdownRenderer(lextwt.Resolvers{}), twt),
+		"one  \ntwo\n\nthree\n```\na < b\n```",
+	)
+	is.Equal(
+		lextwt.RenderString(lextwt.NewTextRenderer(lextwt.Resolvers{}), twt),
+		"one\ntwo\n\nthree\n```\na < b\n```",
+	)
+}
+
+func TestRenderBlocks(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "http://example.com/example.txt"}
+
+	tests := []struct {
+		text string
+		html string
+	}{
+		{"# Title\u2028intro", "<h1>Title</h1>\n<p>intro</p>"},
+		{"intro\u2028### Sub #<go http://example.com/search?tag=go>", `<p>intro</p>` + "\n" + `<h3>Sub <a href="http://example.com/search?tag=go">#go</a></h3>`},
+		{"- one\u2028* **two**\u2028after", "<ul>\n<li>one</li>\n<li><strong>two</strong></li>\n</ul>\n<p>after</p>"},
+		{"1. one\u20282. two\u2028\u2028- three", "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n<ul>\n<li>three</li>\n</ul>"},
+		{"> a < b\u2028> @<bob http://bob.com/twtxt.txt>\u2028c", `<blockquote>a &lt; b<br />` + "\n" + `<a href="http://bob.com/twtxt.txt">@bob</a></blockquote>` + "\n<p>c</p>"},
+		{"#go and -1 > 0", "<p>#go and -1 &gt; 0</p>"},
+	}
+
+	for _, tt := range tests {
+		elems, err := lextwt.ParseText(tt.text)
+		is.NoErr(err)
+
+		twt := lextwt.NewTwt(
+			twter,
+			lextwt.NewDateTime(parseTime("2021-01-24T02:19:54Z"), "2021-01-24T02:19:54Z"),
+			elems...,
+		)
+		is.Equal(lextwt.RenderString(lextwt.NewHTMLRenderer(lextwt.Resolvers{}), twt), tt.html)
+	}
+}
+
+func TestContentWarning(t *testing.T) {
+	is := is.New(t)
+
+	twter := types.Twter{Nick: "example", URL: "http://example.com/example.txt"}
+
+	tests := []struct {
+		line string
+		cw   string
+		subj string
+		html string
+	}{
+		{"2021-01-24T02:19:54Z\t(CW: spoilers) the butler did it", "spoilers", "", "<p>the butler did it</p>"},
+		{"2021-01-24T02:19:54Z\t@<bob https://bob.com/twtxt.txt> (#abcdefg) (cw: food) hi", "food", "(#abcdefg)", `<p><a href="https://bob.com/twtxt.txt">@bob</a> (#abcdefg) hi</p>`},
+		{"2021-01-24T02:19:54Z\t(CW: nested) (#abcdefg) hi", "nested", "(#abcdefg)", "<p>(#abcdefg) hi</p>"},
+		{"2021-01-24T02:19:54Z\thi (CW: not leading)", "", "", "<p>hi (CW: not leading)</p>"},
+		{"2021-01-24T02:19:54Z\t(CW:) hi", "", "(CW:)", "<p>(CW:) hi</p>"},
+	}
+
+	for _, tt := range tests {
+		twt, err := lextwt.ParseLine(tt.line, twter)
+		is.NoErr(err)
+		is.Equal(twt.ContentWarning(), tt.cw)
+		if tt.subj == "" {
+			// By default the subject is the twt's own hash
+			tt.subj = "(#" + twt.Hash() + ")"
+		}
+		is.Equal(twt.Subject().String(), tt.subj)
+		is.Equal(lextwt.RenderString(lextwt.NewHTMLRenderer(lextwt.Resolvers{}), twt), tt.html)
+	}
+}
+
 type mockFmtOpts struct {
 	localURL string
 }
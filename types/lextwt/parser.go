@@ -283,6 +283,7 @@ func (p *parser) ParseDateTime() *DateTime {
 //   @... -> ParseMention
 //   Text -> ParseText
 //   (...) -> ParseSubject
+//   (CW: ...) -> ParseSubject as ContentWarning
 //   `...` -> ParseCode
 //   Text :// ... -> ParseLink
 //   [...](...) -> ParseLink
@@ -300,7 +301,12 @@ func (p *parser) ParseElem() Elem {
 	case TokLS:
 		e = p.ParseLineSeparator()
 	case TokLPAREN:
-		e = p.ParseSubject()
+		subject := p.ParseSubject()
+		if cw := subject.asContentWarning(); cw != nil {
+			e = cw
+		} else {
+			e = subject
+		}
 	case TokHASH:
 		e = p.ParseTag()
 	case TokAT:
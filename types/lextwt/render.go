@@ -0,0 +1,612 @@
+package lextwt
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/jointwt/twtxt/types"
+)
+
+// Renderer renders the text of a twt by walking its AST
+type Renderer interface {
+	Render(w io.Writer, twt types.Twt) error
+}
+
+// Resolved is a mention, tag or link resolved for rendering
+type Resolved struct {
+	// Text to render, e.g: @nick or #tag
+	Text string
+
+	// Domain qualifies the text of a mention, e.g: @nick@domain
+	Domain string
+
+	// URL to link to, the text is rendered without a link if empty
+	URL string
+}
+
+// Resolvers resolve the mentions, tags and links of a twt when rendering.
+// Any resolver left nil uses the element's own text and target.
+type Resolvers struct {
+	Mention func(m *Mention) Resolved
+	Tag     func(t *Tag) Resolved
+	Link    func(l *Link) Resolved
+
+	// Media returns the HTML to embed a media link (e.g: an image) with, it
+	// is only used when rendering HTML and must return safe HTML.
+	Media func(l *Link) string
+}
+
+func (r Resolvers) mention(m *Mention) Resolved {
+	if r.Mention != nil {
+		return r.Mention(m)
+	}
+	return DefaultMentionResolver(m)
+}
+
+func (r Resolvers) tag(t *Tag) Resolved {
+	if r.Tag != nil {
+		return r.Tag(t)
+	}
+	return DefaultTagResolver(t)
+}
+
+func (r Resolvers) link(l *Link) Resolved {
+	if r.Link != nil {
+		return r.Link(l)
+	}
+	return DefaultLinkResolver(l)
+}
+
+// DefaultMentionResolver resolves a mention to @nick linking to its feed
+func DefaultMentionResolver(m *Mention) Resolved {
+	if m.name == "" {
+		if u := m.URL(); u != nil && u.Hostname() != "" {
+			return Resolved{Text: "@" + u.Hostname(), URL: m.target}
+		}
+		return Resolved{Text: "@" + m.target, URL: m.target}
+	}
+	return Resolved{Text: "@" + m.name, Domain: m.domain, URL: m.target}
+}
+
+// DefaultTagResolver resolves a tag to #tag linking to its target
+func DefaultTagResolver(t *Tag) Resolved {
+	if t.tag == "" {
+		if u, err := t.URL(); err == nil && u.Hostname() != "" {
+			return Resolved{Text: u.Hostname() + u.Path, URL: t.target}
+		}
+		return Resolved{Text: t.target, URL: t.target}
+	}
+	return Resolved{Text: "#" + t.tag, URL: t.target}
+}
+
+// DefaultLinkResolver resolves a link to its text (or target if it has none)
+// linking to its target
+func DefaultLinkResolver(l *Link) Resolved {
+	if l.text == "" {
+		return Resolved{Text: l.target, URL: l.target}
+	}
+	return Resolved{Text: l.text, URL: l.target}
+}
+
+// NewResolvers returns Resolvers linking local mentions to the user's
+// profile, external mentions to their external profile and tags to the
+// tag's search results as configured by opts.
+func NewResolvers(opts types.FmtOpts) Resolvers {
+	return Resolvers{
+		Mention: func(m *Mention) Resolved {
+			res := DefaultMentionResolver(m)
+			if m.target == "" {
+				return res
+			}
+			if opts.IsLocalURL(m.target) && strings.HasSuffix(m.target, "/twtxt.txt") {
+				res.Domain, res.URL = "", opts.UserURL(m.target)
+				return res
+			}
+			if res.Domain == "" && m.name != "" {
+				if u := m.URL(); u != nil {
+					res.Domain = u.Hostname()
+				}
+			}
+			res.URL = opts.ExternalURL(m.name, m.target)
+			return res
+		},
+		Tag: func(t *Tag) Resolved {
+			res := DefaultTagResolver(t)
+			if t.target == "" && t.tag != "" {
+				res.URL = opts.URLForTag(t.tag)
+			}
+			return res
+		},
+	}
+}
+
+// RenderString renders a twt with r returning the result as a string
+func RenderString(r Renderer, twt types.Twt) string {
+	var b strings.Builder
+	if err := r.Render(&b, twt); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// twtElems returns the AST of a twt parsing it's text if it was not parsed
+// by lextwt.
+func twtElems(twt types.Twt) []Elem {
+	if twt, ok := twt.(*Twt); ok {
+		if twt.isProxy {
+			return append([]Elem{NewMention(twt.twter.Nick, twt.twter.URL), NewText(" ")}, twt.msg...)
+		}
+		return twt.msg
+	}
+
+	elems, _ := ParseText(strings.ReplaceAll(fmt.Sprintf("%t", twt), "\n", "\u2028"))
+	return elems
+}
+
+// mentionText returns the text of a resolved mention qualified by its domain
+func mentionText(r Resolved) string {
+	if r.Domain == "" {
+		return r.Text
+	}
+	return r.Text + "@" + r.Domain
+}
+
+var (
+	strongRe = regexp.MustCompile(`\*\*([^*\s](?:[^*]*[^*\s])?)\*\*`)
+	emRe     = regexp.MustCompile(`(^|[^\w*])[*_]([^*_\s](?:[^*_]*[^*_\s])?)[*_]($|[^\w*])`)
+	delRe    = regexp.MustCompile(`~~([^~\s](?:[^~]*[^~\s])?)~~`)
+
+	// blockRe matches the marker a heading, blockquote or list item line
+	// starts with
+	blockRe = regexp.MustCompile(`^(?:(#{1,6}) +|(>) ?|([-*+]) +|\d+\. +)`)
+)
+
+// htmlRenderer renders twts as sanitized HTML
+type htmlRenderer struct {
+	resolvers Resolvers
+}
+
+// NewHTMLRenderer returns a Renderer producing sanitized HTML. Text is
+// escaped, supporting **strong**, *emphasis* and ~~strikethrough~~, line
+// separators become line breaks and blank lines separate paragraphs. Lines
+// starting with "# " (up to six #), "> ", "- " (or "* ", "+ ") and "1. " are
+// rendered as headings, blockquotes and unordered and ordered lists.
+func NewHTMLRenderer(resolvers Resolvers) Renderer {
+	return &htmlRenderer{resolvers: resolvers}
+}
+
+func (r *htmlRenderer) Render(w io.Writer, twt types.Twt) error {
+	var b strings.Builder
+
+	elems := twtElems(twt)
+
+	// The twt's content warning is rendered by the caller as the summary the
+	// twt is collapsed behind
+	cw := twt.ContentWarning()
+	trimSpace := false
+
+	// block is the closing tag of the open block (paragraph, heading, list
+	// item or blockquote) and list the open list (ul or ol) if any
+	block, list := "", ""
+	lineStart, lineBreak := true, false
+
+	closeBlock := func() {
+		if block != "" {
+			b.WriteString(block + "\n")
+			block = ""
+		}
+	}
+	closeList := func() {
+		closeBlock()
+		if list != "" {
+			fmt.Fprintf(&b, "</%s>\n", list)
+			list = ""
+		}
+	}
+	para := func() {
+		if block == "" {
+			closeList()
+			b.WriteString("<p>")
+			block = "</p>"
+		}
+	}
+
+	// startLine opens the block the line starting with elem belongs to,
+	// returning elem with any block marker (e.g: "# ") removed
+	startLine := func(elem Elem) Elem {
+		breakLine := lineBreak
+		lineStart, lineBreak = false, false
+
+		text, ok := elem.(*Text)
+		if !ok {
+			if block == "</blockquote>" {
+				closeBlock()
+			} else if breakLine && block != "" && !isCodeBlock(elem) {
+				b.WriteString("<br />\n")
+			}
+			return elem
+		}
+
+		m := blockRe.FindStringSubmatch(text.lit)
+		switch {
+		case m == nil:
+			if block == "</blockquote>" {
+				closeBlock()
+			} else if breakLine && block != "" {
+				b.WriteString("<br />\n")
+			}
+			return elem
+		case m[1] != "":
+			closeList()
+			fmt.Fprintf(&b, "<h%d>", len(m[1]))
+			block = fmt.Sprintf("</h%d>", len(m[1]))
+		case m[2] != "":
+			if block == "</blockquote>" {
+				b.WriteString("<br />\n")
+			} else {
+				closeList()
+				b.WriteString("<blockquote>")
+				block = "</blockquote>"
+			}
+		default:
+			kind := "ul"
+			if m[3] == "" {
+				kind = "ol"
+			}
+			closeBlock()
+			if list != kind {
+				closeList()
+				fmt.Fprintf(&b, "<%s>\n", kind)
+				list = kind
+			}
+			b.WriteString("<li>")
+			block = "</li>"
+		}
+		return NewText(text.lit[len(m[0]):])
+	}
+
+	link := func(href, text, class string) {
+		fmt.Fprintf(&b, `<a href="%s"`, html.EscapeString(href))
+		if class != "" {
+			fmt.Fprintf(&b, ` class="%s"`, class)
+		}
+		fmt.Fprintf(&b, `>%s</a>`, text)
+	}
+
+	for i := 0; i < len(elems); i++ {
+		elem := elems[i]
+		if lineStart && elem != LineSeparator {
+			elem = startLine(elem)
+		}
+
+		switch e := elem.(type) {
+		case *lineSeparator:
+			// Consecutive line separators end the paragraph (or list)
+			if i+1 < len(elems) && elems[i+1] == LineSeparator {
+				for i+1 < len(elems) && elems[i+1] == LineSeparator {
+					i++
+				}
+				closeList()
+				lineStart, lineBreak = true, false
+				continue
+			}
+			// Headings and list items end with their line, a paragraph's
+			// lines are broken only if the next line doesn't start a block
+			if block != "</p>" && block != "</blockquote>" {
+				closeBlock()
+			}
+			lineStart, lineBreak = true, true
+		case *Code:
+			if e.codeType == CodeBlock {
+				closeList()
+				lit := strings.ReplaceAll(e.lit, "\u2028", "\n")
+				fmt.Fprintf(&b, "<pre><code>%s</code></pre>\n", html.EscapeString(strings.Trim(lit, "\n")))
+				continue
+			}
+			para()
+			fmt.Fprintf(&b, "<code>%s</code>", html.EscapeString(e.lit))
+		case *Mention:
+			para()
+			res := r.resolvers.mention(e)
+			text := html.EscapeString(res.Text)
+			if res.Domain != "" {
+				text += "<em>@" + html.EscapeString(res.Domain) + "</em>"
+			}
+			if res.URL == "" {
+				b.WriteString(text)
+				continue
+			}
+			link(res.URL, text, "")
+		case *Tag:
+			para()
+			r.renderTag(&b, e, link)
+		case *ContentWarning:
+			if cw != "" && e.text == cw {
+				cw, trimSpace = "", true
+				continue
+			}
+			para()
+			b.WriteString(html.EscapeString(e.String()))
+		case *Subject:
+			para()
+			b.WriteString("(")
+			if e.tag != nil {
+				r.renderTag(&b, e.tag, link)
+			} else {
+				b.WriteString(html.EscapeString(e.subject))
+			}
+			b.WriteString(")")
+		case *Link:
+			para()
+			if e.linkType == LinkMedia && r.resolvers.Media != nil {
+				b.WriteString(r.resolvers.Media(e))
+				continue
+			}
+			res := r.resolvers.link(e)
+			if res.URL == "" || !isSafeURL(res.URL) {
+				b.WriteString(html.EscapeString(res.Text))
+				continue
+			}
+			if e.linkType == LinkMedia {
+				fmt.Fprintf(
+					&b, `<img alt="%s" src="%s" loading="lazy" />`,
+					html.EscapeString(e.text), html.EscapeString(res.URL),
+				)
+				continue
+			}
+			fmt.Fprintf(
+				&b, `<a href="%s" target="_blank" rel="nofollow noopener">%s</a>`,
+				html.EscapeString(res.URL), html.EscapeString(res.Text),
+			)
+		case *Text:
+			lit := e.lit
+			if trimSpace {
+				lit, trimSpace = strings.TrimLeft(lit, " "), false
+			}
+			if block == "" {
+				if lit = strings.TrimLeft(lit, " \t"); lit == "" {
+					continue
+				}
+			}
+			para()
+			b.WriteString(formatInline(html.EscapeString(lit)))
+		}
+	}
+	closeList()
+
+	_, err := io.WriteString(w, strings.TrimSuffix(b.String(), "\n"))
+	return err
+}
+
+func (r *htmlRenderer) renderTag(b *strings.Builder, t *Tag, link func(href, text, class string)) {
+	res := r.resolvers.tag(t)
+	if res.URL == "" {
+		b.WriteString(html.EscapeString(res.Text))
+		return
+	}
+	link(res.URL, html.EscapeString(res.Text), "")
+}
+
+// formatInline applies inline **strong**, *emphasis* and ~~strikethrough~~
+// to already escaped text
+func formatInline(s string) string {
+	s = strongRe.ReplaceAllString(s, "<strong>$1</strong>")
+	s = emRe.ReplaceAllString(s, "$1<em>$2</em>$3")
+	s = delRe.ReplaceAllString(s, "<del>$1</del>")
+	return s
+}
+
+// isCodeBlock returns true if elem is a code block
+func isCodeBlock(elem Elem) bool {
+	code, ok := elem.(*Code)
+	return ok && code.codeType == CodeBlock
+}
+
+// isSafeURL returns true if uri is safe to link to (i.e: not javascript:)
+func isSafeURL(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "gopher", "gemini", "mailto", "xmpp":
+		return true
+	default:
+		return false
+	}
+}
+
+// textRenderer renders twts as plain text
+type textRenderer struct {
+	resolvers Resolvers
+}
+
+// NewTextRenderer returns a Renderer producing plain text. Mentions and tags
+// are rendered as their resolved text, links and code as written and line
+// separators as new lines.
+func NewTextRenderer(resolvers Resolvers) Renderer {
+	return &textRenderer{resolvers: resolvers}
+}
+
+func (r *textRenderer) Render(w io.Writer, twt types.Twt) error {
+	var b strings.Builder
+
+	for _, elem := range twtElems(twt) {
+		switch e := elem.(type) {
+		case *lineSeparator:
+			b.WriteString("\n")
+		case *Code:
+			b.WriteString(e.String())
+		case *Mention:
+			b.WriteString(mentionText(r.resolvers.mention(e)))
+		case *Tag:
+			b.WriteString(r.resolvers.tag(e).Text)
+		case *Subject:
+			if e.tag != nil {
+				fmt.Fprintf(&b, "(%s)", r.resolvers.tag(e.tag).Text)
+			} else {
+				fmt.Fprintf(&b, "(%s)", e.subject)
+			}
+		default:
+			b.WriteString(elem.Literal())
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownRenderer renders twts as markdown
+type markdownRenderer struct {
+	resolvers Resolvers
+}
+
+// NewMarkdownRenderer returns a Renderer producing markdown with mentions,
+// tags and links rendered as markdown links.
+func NewMarkdownRenderer(resolvers Resolvers) Renderer {
+	return &markdownRenderer{resolvers: resolvers}
+}
+
+func (r *markdownRenderer) Render(w io.Writer, twt types.Twt) error {
+	var b strings.Builder
+
+	mdLink := func(text, href string) {
+		if href == "" {
+			b.WriteString(text)
+			return
+		}
+		fmt.Fprintf(&b, "[%s](%s)", text, href)
+	}
+
+	elems := twtElems(twt)
+	for i := 0; i < len(elems); i++ {
+		switch e := elems[i].(type) {
+		case *lineSeparator:
+			// Consecutive line separators separate paragraphs, a single
+			// line separator is a hard line break
+			if i+1 < len(elems) && elems[i+1] == LineSeparator {
+				for i+1 < len(elems) && elems[i+1] == LineSeparator {
+					i++
+				}
+				b.WriteString("\n\n")
+				continue
+			}
+			if i+1 < len(elems) && isCodeBlock(elems[i+1]) {
+				b.WriteString("\n")
+				continue
+			}
+			b.WriteString("  \n")
+		case *Code:
+			if e.codeType == CodeBlock {
+				if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+					b.WriteString("\n")
+				}
+				lit := strings.Trim(strings.ReplaceAll(e.lit, "\u2028", "\n"), "\n")
+				fmt.Fprintf(&b, "```\n%s\n```\n", lit)
+				continue
+			}
+			b.WriteString(e.Literal())
+		case *Mention:
+			res := r.resolvers.mention(e)
+			mdLink(mentionText(res), res.URL)
+		case *Tag:
+			res := r.resolvers.tag(e)
+			mdLink(res.Text, res.URL)
+		case *Subject:
+			b.WriteString("(")
+			if e.tag != nil {
+				res := r.resolvers.tag(e.tag)
+				mdLink(res.Text, res.URL)
+			} else {
+				b.WriteString(e.subject)
+			}
+			b.WriteString(")")
+		case *Link:
+			res := r.resolvers.link(e)
+			switch {
+			case e.linkType == LinkMedia:
+				fmt.Fprintf(&b, "![%s](%s)", e.text, res.URL)
+			case e.linkType == LinkStandard:
+				mdLink(res.Text, res.URL)
+			default:
+				fmt.Fprintf(&b, "<%s>", res.URL)
+			}
+		default:
+			b.WriteString(elems[i].Literal())
+		}
+	}
+
+	_, err := io.WriteString(w, strings.TrimSuffix(b.String(), "\n"))
+	return err
+}
+
+// gemtextRenderer renders twts as gemtext (text/gemini)
+type gemtextRenderer struct {
+	resolvers Resolvers
+}
+
+// NewGemtextRenderer returns a Renderer producing gemtext. As gemtext has no
+// inline links the text is followed by a link line for each mention, tag and
+// link in the twt.
+func NewGemtextRenderer(resolvers Resolvers) Renderer {
+	return &gemtextRenderer{resolvers: resolvers}
+}
+
+func (r *gemtextRenderer) Render(w io.Writer, twt types.Twt) error {
+	var b strings.Builder
+
+	var links []string
+	addLink := func(text, href string) {
+		if href != "" {
+			links = append(links, fmt.Sprintf("=> %s %s", href, text))
+		}
+	}
+
+	for _, elem := range twtElems(twt) {
+		switch e := elem.(type) {
+		case *lineSeparator:
+			b.WriteString("\n")
+		case *Code:
+			if e.codeType == CodeBlock {
+				lit := strings.Trim(strings.ReplaceAll(e.lit, "\u2028", "\n"), "\n")
+				fmt.Fprintf(&b, "\n```\n%s\n```\n", lit)
+				continue
+			}
+			b.WriteString(e.lit)
+		case *Mention:
+			res := r.resolvers.mention(e)
+			b.WriteString(mentionText(res))
+			addLink(mentionText(res), res.URL)
+		case *Tag:
+			res := r.resolvers.tag(e)
+			b.WriteString(res.Text)
+			addLink(res.Text, res.URL)
+		case *Subject:
+			if e.tag != nil {
+				res := r.resolvers.tag(e.tag)
+				fmt.Fprintf(&b, "(%s)", res.Text)
+				addLink(res.Text, res.URL)
+			} else {
+				fmt.Fprintf(&b, "(%s)", e.subject)
+			}
+		case *Link:
+			res := r.resolvers.link(e)
+			b.WriteString(res.Text)
+			addLink(res.Text, res.URL)
+		default:
+			b.WriteString(elem.Literal())
+		}
+	}
+
+	text := strings.TrimSpace(b.String())
+	if len(links) > 0 {
+		text += "\n\n" + strings.Join(links, "\n")
+	}
+
+	_, err := io.WriteString(w, text)
+	return err
+}
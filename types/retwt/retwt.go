@@ -2,19 +2,18 @@ package retwt
 
 import (
 	"bufio"
-	"encoding/base32"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jointwt/twtxt/types"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/blake2b"
 )
 
 func init() {
@@ -25,12 +24,15 @@ var (
 	tagsRe    = regexp.MustCompile(`#([-\w]+)`)
 	subjectRe = regexp.MustCompile(`^(@(?:<.*>|[a-zA-Z0-9][a-zA-Z0-9_-]+)[, ]*)*(\(.*?\))(.*)`)
 
+	contentWarningRe = regexp.MustCompile(`^(@(?:<.*?>|[a-zA-Z0-9][a-zA-Z0-9_-]+)[, ]*)*(\(#[^)]*\)\s*)?\((?i:cw):([^)]*)\)`)
+
 	uriTagsRe     = regexp.MustCompile(`#<(.*?) .*?>`)
 	uriMentionsRe = regexp.MustCompile(`@<(.*?) (.*?)>`)
 )
 
 type reTwt struct {
-	twter   types.Twter
+	// twter is shared by all twts read by the same Scanner
+	twter   *types.Twter
 	text    string
 	created time.Time
 
@@ -51,7 +53,7 @@ func (twt reTwt) GobEncode() ([]byte, error) {
 		Text    string      `json:"text"`
 		Created time.Time   `json:"created"`
 		Hash    string      `json:"hash"`
-	}{twt.twter, twt.text, twt.created, twt.hash}
+	}{twt.Twter(), twt.text, twt.created, twt.hash}
 
 	if twt.text == "" {
 		return nil, fmt.Errorf("empty twt: %v", twt)
@@ -67,7 +69,7 @@ func (twt *reTwt) GobDecode(data []byte) error {
 	}{}
 	err := json.Unmarshal(data, &enc)
 
-	twt.twter = enc.Twter
+	twt.twter = &enc.Twter
 	twt.text = enc.Text
 	twt.created = enc.Created
 	twt.hash = enc.Hash
@@ -80,10 +82,11 @@ func (twt reTwt) String() string {
 }
 
 func NewReTwt(twter types.Twter, text string, created time.Time) *reTwt {
-	return &reTwt{twter: twter, text: text, created: created}
+	return &reTwt{twter: &twter, text: text, created: created}
 }
 func (twt reTwt) Clone() types.Twt {
-	return &reTwt{twter: twt.twter, text: twt.text, created: twt.created}
+	twter := twt.Twter()
+	return &reTwt{twter: &twter, text: twt.text, created: twt.created}
 }
 
 func DecodeJSON(data []byte) (types.Twt, error) {
@@ -121,24 +124,58 @@ func ParseLine(line string, twter types.Twter) (twt types.Twt, err error) {
 
 	text := parts[3]
 
-	twt = &reTwt{twter: twter, created: created, text: text}
+	twt = &reTwt{twter: &twter, created: created, text: text}
 
 	return
 }
 
 func ParseFile(r io.Reader, twter types.Twter) (*retwtFile, error) {
-	scanner := bufio.NewScanner(r)
-
-	nTwts, nErrors := 0, 0
+	s := NewScanner(r, twter)
 
 	f := &retwtFile{twter: twter}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for {
+		twt, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.twts = append(f.twts, twt)
+	}
+
+	return f, nil
+}
 
-		twt, err := ParseLine(line, twter)
+// Scanner reads the twts of a feed one line at a time
+type Scanner struct {
+	scanner *bufio.Scanner
+	twter   types.Twter
+
+	nTwts, nErrors int
+}
+
+var _ types.TwtScanner = (*Scanner)(nil)
+
+// NewScanner returns a new Scanner reading a feed from r
+func NewScanner(r io.Reader, twter types.Twter) *Scanner {
+	return &Scanner{scanner: bufio.NewScanner(r), twter: twter}
+}
+
+// Next returns the next twt of the feed or io.EOF once there are no more
+func (s *Scanner) Next() (types.Twt, error) {
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			s.parseComment(line)
+			continue
+		}
+
+		twt, err := ParseLine(line, s.twter)
 		if err != nil {
-			nErrors++
+			s.nErrors++
 			continue
 		}
 
@@ -146,23 +183,55 @@ func ParseFile(r io.Reader, twter types.Twter) (*retwtFile, error) {
 			continue
 		}
 
-		nTwts++
-		f.twts = append(f.twts, twt)
+		// Share the feed's Twter so changes to it apply to all twts read
+		twt.(*reTwt).twter = &s.twter
+
+		s.nTwts++
+		return twt, nil
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if err := s.scanner.Err(); err != nil {
+		return types.NilTwt, err
 	}
 
-	if nTwts == 0 && nErrors > 0 {
-		log.Warnf("erroneous feed dtected (%d twts parsed %d errors)", nTwts, nErrors)
-		return nil, types.ErrInvalidFeed
+	if s.nTwts == 0 && s.nErrors > 0 {
+		log.Warnf("erroneous feed dtected (%d twts parsed %d errors)", s.nTwts, s.nErrors)
+		return types.NilTwt, types.ErrInvalidFeed
 	}
 
-	return f, nil
+	return types.NilTwt, io.EOF
+}
+
+// parseComment applies the metadata of a comment line to the feed's Twter,
+// only the `# hash_version` the feed's twts are hashed with is parsed
+func (s *Scanner) parseComment(line string) {
+	sp := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), "=", 2)
+	if len(sp) != 2 || strings.TrimSpace(sp[0]) != "hash_version" {
+		return
+	}
+
+	// Twts are hashed with the hash version the feed advertises (if known)
+	v, err := strconv.Atoi(strings.TrimSpace(sp[1]))
+	if err != nil {
+		return
+	}
+	if _, ok := types.LookupTwtHashVersion(v); ok {
+		s.twter.HashVersion = v
+	}
 }
 
-func (twt reTwt) Twter() types.Twter { return twt.twter }
-func (twt reTwt) Text() string       { return twt.text }
+// Twter returns the feed's Twter, changes to it apply to all twts read
+func (s *Scanner) Twter() *types.Twter { return &s.twter }
+
+// File returns the feed's metadata, retwt does not parse any.
+func (s *Scanner) File() types.TwtFile { return retwtFile{twter: s.twter} }
+
+func (twt reTwt) Twter() types.Twter {
+	if twt.twter == nil {
+		return types.Twter{}
+	}
+	return *twt.twter
+}
+func (twt reTwt) Text() string { return twt.text }
 func (twt reTwt) MarkdownText() string {
 	// we assume FmtOpts is always null for markdown.
 	return formatMentionsAndTags(nil, twt.text, types.MarkdownFmt)
@@ -206,6 +275,7 @@ func (twt reTwt) MarshalJSON() ([]byte, error) {
 		Hash    string   `json:"hash"`
 		Tags    []string `json:"tags"`
 		Subject string   `json:"subject"`
+		Summary string   `json:"summary,omitempty"`
 	}{
 		Twter:        twt.Twter(),
 		Text:         twt.Text(),
@@ -216,6 +286,7 @@ func (twt reTwt) MarshalJSON() ([]byte, error) {
 		Hash:    twt.Hash(),
 		Tags:    tags.Tags(),
 		Subject: twt.Subject().String(),
+		Summary: twt.ContentWarning(),
 	})
 }
 
@@ -277,19 +348,22 @@ func (twt reTwt) Subject() types.Subject {
 	return reSubject(fmt.Sprintf("(#%s)", twt.Hash()))
 }
 
+// ContentWarning ...
+func (twt reTwt) ContentWarning() string {
+	match := contentWarningRe.FindStringSubmatch(twt.text)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(match[3])
+}
+
 // Hash ...
 func (twt reTwt) Hash() string {
 	if twt.hash != "" {
 		return twt.hash
 	}
 
-	payload := twt.Twter().URL + "\n" + twt.Created().Format(time.RFC3339) + "\n" + twt.Text()
-	sum := blake2b.Sum256([]byte(payload))
-
-	// Base32 is URL-safe, unlike Base64, and shorter than hex.
-	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
-	hash := strings.ToLower(encoding.EncodeToString(sum[:]))
-	twt.hash = hash[len(hash)-types.TwtHashLength:]
+	twt.hash = types.TwtHash(twt.Twter(), twt.Created(), twt.Text())
 
 	return twt.hash
 }
@@ -426,6 +500,9 @@ func (retwtManager) ParseLine(line string, twter types.Twter) (twt types.Twt, er
 func (retwtManager) ParseFile(r io.Reader, twter types.Twter) (types.TwtFile, error) {
 	return ParseFile(r, twter)
 }
+func (retwtManager) ScanFile(r io.Reader, twter types.Twter) types.TwtScanner {
+	return NewScanner(r, twter)
+}
 func (retwtManager) MakeTwt(twter types.Twter, ts time.Time, text string) types.Twt {
 	return NewReTwt(twter, text, ts)
 }
@@ -446,6 +523,17 @@ func (r retwtFile) Comment() string    { return "" }
 func (r retwtFile) Info() types.Info   { return nil }
 func (r retwtFile) Twts() types.Twts   { return r.twts }
 
+func (r retwtFile) Nick() string            { return "" }
+func (r retwtFile) URL() string             { return "" }
+func (r retwtFile) Avatar() string          { return "" }
+func (r retwtFile) Description() string     { return "" }
+func (r retwtFile) Links() []types.FeedLink { return nil }
+func (r retwtFile) Refresh() time.Duration  { return 0 }
+func (r retwtFile) Following() int          { return 0 }
+func (r retwtFile) Prev() (string, string)  { return "", "" }
+func (r retwtFile) Deleted() []string       { return nil }
+func (r retwtFile) Edits() []types.TwtEdit  { return nil }
+
 type reSubject string
 
 func (r reSubject) Tag() types.TwtTag {
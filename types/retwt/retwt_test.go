@@ -2,6 +2,7 @@ package retwt_test
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -134,3 +135,45 @@ func TestHash(t *testing.T) {
 		})
 	}
 }
+
+func TestScannerTwter(t *testing.T) {
+	assert := assert.New(t)
+
+	twter := types.Twter{Nick: "alice", URL: "https://example.com/twtxt.txt"}
+	scanner := retwt.NewScanner(strings.NewReader(
+		"2021-01-01T00:00:00Z\tHello\n2021-01-02T00:00:00Z\tWorld\n",
+	), twter)
+
+	first, err := scanner.Next()
+	assert.NoError(err)
+
+	// The Twter is updated once the first twt is read (e.g: its avatar)
+	scanner.Twter().Avatar = "https://example.com/avatar.png"
+
+	second, err := scanner.Next()
+	assert.NoError(err)
+
+	assert.Equal("https://example.com/avatar.png", first.Twter().Avatar)
+	assert.Equal("https://example.com/avatar.png", second.Twter().Avatar)
+}
+
+func TestScannerHashVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	twter := types.Twter{Nick: "alice", URL: "https://example.com/twtxt.txt"}
+	created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, version := range []int{types.LegacyTwtHashVersion, 2} {
+		feed := fmt.Sprintf("# hash_version = %d\n2021-01-01T00:00:00Z\tHello\n", version)
+		twt, err := retwt.NewScanner(strings.NewReader(feed), twter).Next()
+		assert.NoError(err)
+
+		v, _ := types.LookupTwtHashVersion(version)
+		assert.Equal(v.Hash(twter.URL, created, "Hello"), twt.Hash())
+	}
+
+	// Unknown versions are hashed with the legacy version
+	twt, err := retwt.NewScanner(strings.NewReader("# hash_version = 99\n2021-01-01T00:00:00Z\tHello\n"), twter).Next()
+	assert.NoError(err)
+	assert.Len(twt.Hash(), types.TwtHashLength)
+}
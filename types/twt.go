@@ -9,11 +9,13 @@ import (
 	"io"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
+	// TwtHashLength is the length of a legacy twt hash
 	TwtHashLength = 7
 )
 
@@ -24,6 +26,10 @@ type Twter struct {
 	Avatar  string
 	Tagline string
 	Follow  map[string]Twter
+
+	// HashVersion is the version of the hash the twter's twts are hashed
+	// with (as advertised by their feed), zero for the legacy version.
+	HashVersion int
 }
 
 func (twter Twter) IsZero() bool {
@@ -76,6 +82,8 @@ type Twt interface {
 
 	Hash() string
 	Subject() Subject
+	// ContentWarning is the warning a twt is marked sensitive with, if any
+	ContentWarning() string
 	Mentions() MentionList
 	Links() LinkList
 	Tags() TagList
@@ -299,11 +307,12 @@ func (nilTwt) Twter() Twter       { return Twter{} }
 func (nilTwt) Created() time.Time { return time.Now() }
 func (nilTwt) Text() string       { return "" }
 
-func (nilTwt) Hash() string          { return "" }
-func (nilTwt) Subject() Subject      { return nil }
-func (nilTwt) Mentions() MentionList { return nil }
-func (nilTwt) Tags() TagList         { return nil }
-func (nilTwt) Links() LinkList       { return nil }
+func (nilTwt) Hash() string           { return "" }
+func (nilTwt) Subject() Subject       { return nil }
+func (nilTwt) ContentWarning() string { return "" }
+func (nilTwt) Mentions() MentionList  { return nil }
+func (nilTwt) Tags() TagList          { return nil }
+func (nilTwt) Links() LinkList        { return nil }
 
 func (nilTwt) ExpandLinks(FmtOpts, FeedLookup)          {}
 func (nilTwt) Format(state fmt.State, c rune)           {}
@@ -322,6 +331,7 @@ type TwtManager interface {
 	DecodeJSON([]byte) (Twt, error)
 	ParseLine(string, Twter) (Twt, error)
 	ParseFile(io.Reader, Twter) (TwtFile, error)
+	ScanFile(io.Reader, Twter) TwtScanner
 	MakeTwt(twter Twter, ts time.Time, text string) Twt
 }
 
@@ -336,6 +346,9 @@ func (nilManager) ParseLine(line string, twter Twter) (twt Twt, err error) {
 func (nilManager) ParseFile(r io.Reader, twter Twter) (TwtFile, error) {
 	panic("twt managernot configured")
 }
+func (nilManager) ScanFile(r io.Reader, twter Twter) TwtScanner {
+	panic("twt managernot configured")
+}
 func (nilManager) MakeTwt(twter Twter, ts time.Time, text string) Twt {
 	panic("twt managernot configured")
 }
@@ -354,6 +367,9 @@ func ParseLine(line string, twter Twter) (twt Twt, err error) {
 func ParseFile(r io.Reader, twter Twter) (TwtFile, error) {
 	return twtManager.ParseFile(r, twter)
 }
+func ScanFile(r io.Reader, twter Twter) TwtScanner {
+	return twtManager.ScanFile(r, twter)
+}
 func MakeTwt(twter Twter, ts time.Time, text string) Twt {
 	return twtManager.MakeTwt(twter, ts, text)
 }
@@ -366,6 +382,221 @@ type TwtFile interface {
 	Twter() Twter
 	Info() Info
 	Twts() Twts
+
+	// Well-known feed metadata from `# key = value` comments
+	Nick() string
+	URL() string
+	Avatar() string
+	Description() string
+	Links() []FeedLink
+	Refresh() time.Duration
+	Following() int
+	Prev() (string, string)
+	Deleted() []string
+	Edits() []TwtEdit
+}
+
+// TwtScanner reads the twts of a feed incrementally, one at a time
+type TwtScanner interface {
+	// Next returns the next twt of the feed or io.EOF once there are no more
+	Next() (Twt, error)
+
+	// Twter returns the Twter shared by all twts of the feed, changes to it
+	// (e.g: resolving its avatar) apply to all twts read.
+	Twter() *Twter
+
+	// File returns the feed's metadata read so far without its twts
+	File() TwtFile
+}
+
+// ScanTwts reads all twts from s and returns at most the N most recent twts
+// newer than ttl like SplitTwts, passing all other twts to old as they are
+// read so that memory use is bounded by N. Feeds found to be in reverse
+// chronological order, i.e: starting with twts newer than ttl in descending
+// order, are read until the first twt older than ttl only.
+func ScanTwts(s TwtScanner, ttl time.Duration, N int, old func(Twt)) (Twts, error) {
+	oldTime := time.Now().Add(-ttl)
+
+	var (
+		twts       Twts
+		prev       time.Time
+		descending = true
+		recent     = false
+	)
+
+	trim := func() {
+		sort.Sort(twts)
+		for _, twt := range twts[N:] {
+			old(twt)
+		}
+		twts = twts[:N]
+	}
+
+	for n := 0; ; n++ {
+		twt, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		created := twt.Created()
+		if n > 0 && created.After(prev) {
+			descending = false
+		}
+		prev = created
+
+		if created.Before(oldTime) {
+			old(twt)
+			if descending && recent {
+				break
+			}
+			continue
+		}
+		recent = true
+
+		twts = append(twts, twt)
+		if len(twts) >= 2*N+1 {
+			trim()
+		}
+	}
+
+	if len(twts) > N {
+		trim()
+	} else {
+		sort.Sort(twts)
+	}
+
+	return twts, nil
+}
+
+// FeedLink is a link advertised by a feed with `# link = <text> <url>`
+type FeedLink struct {
+	Text string
+	URL  string
+}
+
+// MetaValue returns the value of the first metadata key in kv or an empty
+// string if it is not present
+func MetaValue(kv KV, key string) string {
+	if kv == nil {
+		return ""
+	}
+	if v, ok := kv.GetN(key, 0); ok {
+		return strings.TrimSpace(v.Value())
+	}
+	return ""
+}
+
+// MetaLinks returns all `link` metadata in kv
+func MetaLinks(kv KV) []FeedLink {
+	if kv == nil {
+		return nil
+	}
+
+	var links []FeedLink
+	for _, v := range kv.GetAll("link") {
+		if v.Key() != "link" {
+			continue
+		}
+		sp := strings.Fields(v.Value())
+		if len(sp) == 0 {
+			continue
+		}
+		links = append(links, FeedLink{
+			Text: strings.Join(sp[:len(sp)-1], " "),
+			URL:  sp[len(sp)-1],
+		})
+	}
+	return links
+}
+
+// MetaRefresh returns the `refresh` metadata in kv (given in seconds) or
+// zero if it is not present or invalid
+func MetaRefresh(kv KV) time.Duration {
+	n, err := strconv.Atoi(MetaValue(kv, "refresh"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// MetaPrev returns the hash and url of the previous (archived) feed from the
+// `# prev = <hash> <url>` metadata in kv, or empty strings if not present
+func MetaPrev(kv KV) (string, string) {
+	sp := strings.Fields(MetaValue(kv, "prev"))
+	if len(sp) < 2 {
+		return "", ""
+	}
+	return sp[0], sp[1]
+}
+
+// TwtEdit records that a twt has been replaced by an edited twt, advertised
+// by a feed with `# edit = <hash> <replacement hash>`
+type TwtEdit struct {
+	Hash        string
+	Replacement string
+}
+
+// MetaDeleted returns the hashes of all twts a feed has deleted from the
+// `# delete = <hash>` metadata in kv
+func MetaDeleted(kv KV) []string {
+	if kv == nil {
+		return nil
+	}
+
+	var hashes []string
+	for _, v := range kv.GetAll("delete") {
+		if v.Key() != "delete" {
+			continue
+		}
+		if hash := strings.TrimSpace(v.Value()); hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// MetaEdits returns all twt edits a feed has made from the
+// `# edit = <hash> <replacement hash>` metadata in kv
+func MetaEdits(kv KV) []TwtEdit {
+	if kv == nil {
+		return nil
+	}
+
+	var edits []TwtEdit
+	for _, v := range kv.GetAll("edit") {
+		if v.Key() != "edit" {
+			continue
+		}
+		sp := strings.Fields(v.Value())
+		if len(sp) != 2 {
+			continue
+		}
+		edits = append(edits, TwtEdit{Hash: sp[0], Replacement: sp[1]})
+	}
+	return edits
+}
+
+// MetaFollowing returns the `following` count metadata in kv or zero if it
+// is not present or invalid
+func MetaFollowing(kv KV) int {
+	n, err := strconv.Atoi(MetaValue(kv, "following"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// MetaHashVersion returns the `hash_version` metadata in kv or zero if it is
+// not present or invalid
+func MetaHashVersion(kv KV) int {
+	n, err := strconv.Atoi(MetaValue(kv, "hash_version"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
 }
 
 type Info interface {
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jointwt/twtxt/types"
 	"github.com/jointwt/twtxt/types/lextwt"
@@ -285,3 +286,38 @@ func TestPreambleFeed(t *testing.T) {
 		is.Equal(tt.drain, string(drain))
 	}
 }
+
+func TestScanTwts(t *testing.T) {
+	twter := types.Twter{Nick: "alice", URL: "https://example.com/twtxt.txt"}
+	now := time.Now().UTC()
+	ts := func(d time.Duration) string { return now.Add(-d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name string
+		feed []string
+		kept int
+		old  int
+	}{
+		{"ascending", []string{ts(72 * time.Hour), ts(48 * time.Hour), ts(2 * time.Hour), ts(time.Hour)}, 2, 2},
+		{"descending", []string{ts(time.Hour), ts(2 * time.Hour), ts(48 * time.Hour), ts(72 * time.Hour)}, 2, 1},
+		{"old first", []string{ts(72 * time.Hour), ts(48 * time.Hour), ts(time.Hour), ts(2 * time.Hour)}, 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			var lines []string
+			for _, created := range tt.feed {
+				lines = append(lines, created+"\tHello")
+			}
+			scanner := lextwt.NewScanner(strings.NewReader(strings.Join(lines, "\n")+"\n"), twter)
+
+			old := 0
+			twts, err := types.ScanTwts(scanner, 24*time.Hour, 10, func(types.Twt) { old++ })
+			is.NoErr(err)
+			is.Equal(len(twts), tt.kept)
+			is.Equal(old, tt.old)
+		})
+	}
+}